@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/agenthands/npython/pkg/compiler/emitter"
 	"github.com/agenthands/npython/pkg/compiler/lexer"
 	"github.com/agenthands/npython/pkg/compiler/parser"
 	"github.com/agenthands/npython/pkg/compiler/python"
+	"github.com/agenthands/npython/pkg/debug"
 	"github.com/agenthands/npython/pkg/stdlib"
 	"github.com/agenthands/npython/pkg/vm"
 )
@@ -22,13 +28,19 @@ func (g *cliGatekeeper) Validate(scope, token string) bool {
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: npython [run|query] ...")
+		fmt.Println("Usage: npython [run|debug|compile|disasm|query] ...")
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "run":
 		runScript()
+	case "debug":
+		debugScript()
+	case "compile":
+		compileScript()
+	case "disasm":
+		disasmScript()
 	case "query":
 		runQuery()
 	default:
@@ -40,21 +52,135 @@ func main() {
 func runScript() {
 	runCmd := flag.NewFlagSet("run", flag.ExitOnError)
 	gasLimit := runCmd.Int("gas", 1000000, "Maximum instruction limit")
+	timeout := runCmd.Duration("timeout", 0, "Maximum wall-clock time (0 for no limit)")
+	limits := vm.DefaultLimits
+	runCmd.IntVar(&limits.StackDepth, "stack", vm.StackDepth, "Operand stack size")
+	runCmd.IntVar(&limits.MaxFrames, "frames", vm.MaxFrames, "Maximum call depth")
+	runCmd.IntVar(&limits.MaxLocals, "locals", vm.MaxLocals, "Maximum local variables per function")
+	profile := runCmd.Bool("profile", false, "Print a cost profile to stderr and write it for go tool pprof")
+	var opts runOptions
+	runCmd.StringVar(&opts.profileOut, "profile-out", "", "pprof output file (default: script name with .pprof extension)")
+	runCmd.StringVar(&opts.record, "record", "", "Record the results of network and file functions to this file")
+	runCmd.StringVar(&opts.replay, "replay", "", "Replay network and file functions from a recording instead of performing them")
 
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: npython run <source.py> [-gas limit]")
+		fmt.Println("Usage: npython run <source.py|script.npyc> [-gas limit] [-timeout duration] [-stack n] [-frames n] [-locals n] [-profile] [-profile-out file] [-record file | -replay file]")
 		os.Exit(1)
 	}
 	scriptPath := os.Args[2]
 	runCmd.Parse(os.Args[3:])
+	if opts.record != "" && opts.replay != "" {
+		fmt.Println("Error: -record and -replay are exclusive")
+		os.Exit(1)
+	}
+
+	bc := load(scriptPath, limits.MaxLocals)
+	if !*profile {
+		opts.profileOut = ""
+	} else if opts.profileOut == "" {
+		opts.profileOut = strings.TrimSuffix(scriptPath, filepath.Ext(scriptPath)) + ".pprof"
+	}
+	execute(bc, limits, *gasLimit, *timeout, opts)
+}
 
-	src, err := os.ReadFile(scriptPath)
+// runOptions are the optional instruments of execute, each a file name.
+type runOptions struct {
+	profileOut string // write a profile of the run
+	record     string // record the effects of host functions
+	replay     string // replay them from a recording
+}
+
+// report prints the profile recorded by p and writes it to path.
+func report(p *vm.Profiler, path string) {
+	prof := p.Profile()
+	prof.WriteTable(os.Stderr)
+	f, err := os.Create(path)
+	if err == nil {
+		err = prof.WritePprof(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
 	if err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error writing profile: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Profile written to %s\n", path)
+}
+
+func debugScript() {
+	debugCmd := flag.NewFlagSet("debug", flag.ExitOnError)
+	gasLimit := debugCmd.Int("gas", 1000000, "Maximum instruction limit")
+
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: npython debug <source.py> [-gas limit]")
+		os.Exit(1)
+	}
+	scriptPath := os.Args[2]
+	debugCmd.Parse(os.Args[3:])
+
+	bc := load(scriptPath, vm.MaxLocals)
+	if bc.Debug == nil {
+		fmt.Println("Load Error: no debug information; debug the .py source")
+		os.Exit(1)
+	}
+	if abs, err := filepath.Abs(bc.Debug.File); err == nil {
+		bc.Debug.File = abs // clients match breakpoints by path
+	}
+	m := vm.NewMachine(vm.DefaultLimits)
+	prepare(m, bc)
+
+	// The protocol owns stdout; the program's output is forwarded to the
+	// client as output events.
+	dapOut := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Stdout = w
+	s := debug.NewServer(m, *gasLimit)
+	go io.Copy(s.Output(), r)
+
+	if err := s.Serve(os.Stdin, dapOut); err != nil {
+		fmt.Fprintf(os.Stderr, "Debug Adapter Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func compileScript() {
+	compileCmd := flag.NewFlagSet("compile", flag.ExitOnError)
+	out := compileCmd.String("o", "", "Output file (default: source name with .npyc extension)")
+	maxLocals := compileCmd.Int("locals", vm.MaxLocals, "Maximum local variables per function")
+
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: npython compile <source.py> [-o script.npyc] [-locals n]")
 		os.Exit(1)
 	}
+	scriptPath := os.Args[2]
+	compileCmd.Parse(os.Args[3:])
+	if *out == "" {
+		*out = strings.TrimSuffix(scriptPath, filepath.Ext(scriptPath)) + ".npyc"
+	}
 
-	execute(string(src), filepath.Ext(scriptPath) == ".py", *gasLimit)
+	bc := load(scriptPath, *maxLocals)
+	data, err := bc.MarshalBinary()
+	if err != nil {
+		fmt.Printf("Compilation Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		fmt.Printf("Error writing file: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func disasmScript() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: npython disasm <source.py|script.npyc>")
+		os.Exit(1)
+	}
+	fmt.Print(vm.Disassemble(load(os.Args[2], vm.MaxLocals)))
 }
 
 func runQuery() {
@@ -73,10 +199,40 @@ with scope("HTTP-ENV", "%s"):
     print(fetch("%s"))
 `, token, url)
 
-	execute(src, true, 1000000)
+	execute(compile(src, true), vm.DefaultLimits, 1000000, 0, runOptions{})
+}
+
+// load reads a script: compiled bytecode for .npyc files, Python source for
+// .py and the legacy syntax for anything else. Python functions may use up to
+// maxLocals locals.
+func load(path string, maxLocals int) *vm.Bytecode {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+	switch filepath.Ext(path) {
+	case ".npyc":
+		bc := new(vm.Bytecode)
+		if err := bc.UnmarshalBinary(data); err != nil {
+			fmt.Printf("Load Error: %v\n", err)
+			os.Exit(1)
+		}
+		return bc
+	case ".py":
+		c := python.NewCompiler()
+		c.MaxLocals = maxLocals
+		bc, err := c.CompileFile(path, string(data))
+		if err != nil {
+			fmt.Printf("Compilation Error: %v\n", err)
+			os.Exit(1)
+		}
+		return bc
+	}
+	return compile(string(data), false)
 }
 
-func execute(src string, isPython bool, gasLimit int) {
+func compile(src string, isPython bool) *vm.Bytecode {
 	var bc *vm.Bytecode
 	var err error
 	if isPython {
@@ -99,13 +255,84 @@ func execute(src string, isPython bool, gasLimit int) {
 		fmt.Printf("Compilation Error: %v\n", err)
 		os.Exit(1)
 	}
+	return bc
+}
 
-	m := vm.GetMachine()
+// execute runs bc with the instruments in opts and exits on error.
+func execute(bc *vm.Bytecode, limits vm.Limits, gasLimit int, timeout time.Duration, opts runOptions) {
+	var m *vm.Machine
+	if limits == vm.DefaultLimits {
+		m = vm.GetMachine()
+	} else {
+		m = vm.NewMachine(limits)
+	}
 	defer vm.PutMachine(m)
+	prepare(m, bc)
+	var p *vm.Profiler
+	if opts.profileOut != "" {
+		p = vm.NewProfiler()
+		m.Tracer = p
+	}
+	var rec *vm.Recorder
+	var replay *vm.Replayer
+	switch {
+	case opts.record != "":
+		rec = &vm.Recorder{}
+		m.Effects = rec
+	case opts.replay != "":
+		data, err := os.ReadFile(opts.replay)
+		if err != nil {
+			fmt.Printf("Error reading recording: %v\n", err)
+			os.Exit(1)
+		}
+		var log vm.EffectLog
+		if err := log.UnmarshalBinary(data); err != nil {
+			fmt.Printf("Replay Error: %v\n", err)
+			os.Exit(1)
+		}
+		replay = vm.NewReplayer(&log)
+		m.Effects = replay
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	m.Code = bc.Instructions
-	m.Constants = bc.Constants
-	m.Arena = bc.Arena
+	err := m.RunContext(ctx, gasLimit)
+	// The process exits on errors; keep what led to them.
+	if p != nil {
+		report(p, opts.profileOut)
+	}
+	if rec != nil {
+		data, werr := rec.Log.MarshalBinary()
+		if werr == nil {
+			werr = os.WriteFile(opts.record, data, 0644)
+		}
+		if werr != nil {
+			fmt.Fprintf(os.Stderr, "Error writing recording: %v\n", werr)
+		}
+	}
+	if err == nil && replay != nil && replay.Remaining() > 0 {
+		fmt.Printf("Replay Error: %d recorded calls were not made\n", replay.Remaining())
+		os.Exit(1)
+	}
+	if err != nil {
+		if bc.Debug != nil && errors.As(err, new(*vm.RuntimeError)) {
+			fmt.Println(err) // already a traceback
+		} else {
+			fmt.Printf("Runtime Error: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// prepare loads bc into m with the CLI's sandboxes and gatekeeper, exiting
+// if the code does not link or verify.
+func prepare(m *vm.Machine, bc *vm.Bytecode) {
+	m.Load(bc)
 	m.Gatekeeper = &cliGatekeeper{}
 
 	wd, _ := os.Getwd()
@@ -113,80 +340,13 @@ func execute(src string, isPython bool, gasLimit int) {
 	httpSandbox := stdlib.NewHTTPSandbox([]string{"localhost", "127.0.0.1", "api.github.com", "google.com"})
 	httpSandbox.AllowLocalhost = true
 
-	// Host Registry
-	m.HostRegistry = make([]vm.HostFunctionEntry, 0, 64)
-	m.RegisterHostFunction("FS-ENV", fsSandbox.WriteFile)       // 0
-	m.RegisterHostFunction("HTTP-ENV", httpSandbox.Fetch)       // 1
-	m.RegisterHostFunction("", stdlib.Print)                    // 2
-	m.RegisterHostFunction("", stdlib.ParseJSON)                // 3
-	m.RegisterHostFunction("", stdlib.GetField)                 // 4
-	m.RegisterHostFunction("HTTP-ENV", httpSandbox.SendRequest) // 5
-	m.RegisterHostFunction("", httpSandbox.CheckStatus)         // 6
-	m.RegisterHostFunction("", stdlib.ParseJSONKey)             // 7
-	m.RegisterHostFunction("", stdlib.ParseJSONKey)             // 8
-	m.RegisterHostFunction("", stdlib.FormatString)             // 9
-	m.RegisterHostFunction("", stdlib.IsEmpty)                  // 10
-	m.RegisterHostFunction("", httpSandbox.WithClient)          // 11
-	m.RegisterHostFunction("", httpSandbox.SetURL)              // 12
-	m.RegisterHostFunction("", httpSandbox.SetMethod)           // 13
-	m.RegisterHostFunction("", stdlib.Len)                      // 14
-	m.RegisterHostFunction("", stdlib.Range)                    // 15
-	m.RegisterHostFunction("", stdlib.List)                     // 16
-	m.RegisterHostFunction("", stdlib.Sum)                      // 17
-	m.RegisterHostFunction("", stdlib.Max)                      // 18
-	m.RegisterHostFunction("", stdlib.Min)                      // 19
-	m.RegisterHostFunction("", stdlib.Map)                      // 20
-	m.RegisterHostFunction("", stdlib.Abs)                      // 21
-	m.RegisterHostFunction("", stdlib.Bool)                     // 22
-	m.RegisterHostFunction("", stdlib.Int)                      // 23
-	m.RegisterHostFunction("", stdlib.Str)                      // 24
-	m.RegisterHostFunction("", stdlib.Filter)                   // 25
-	m.RegisterHostFunction("", stdlib.Pow)                      // 26
-	m.RegisterHostFunction("", stdlib.All)                      // 27
-	m.RegisterHostFunction("", stdlib.Any)                      // 28
-	m.RegisterHostFunction("", stdlib.MakeList)                 // 29
-	m.RegisterHostFunction("", stdlib.GetItem)                  // 30
-	m.RegisterHostFunction("", stdlib.SetItem)                  // 31
-	m.RegisterHostFunction("", stdlib.DivMod)                   // 32
-	m.RegisterHostFunction("", stdlib.Round)                    // 33
-	m.RegisterHostFunction("", stdlib.Float)                    // 34
-	m.RegisterHostFunction("", stdlib.Bin)                      // 35
-	m.RegisterHostFunction("", stdlib.Oct)                      // 36
-	m.RegisterHostFunction("", stdlib.Hex)                      // 37
-	m.RegisterHostFunction("", stdlib.Chr)                      // 38
-	m.RegisterHostFunction("", stdlib.Ord)                      // 39
-	m.RegisterHostFunction("", stdlib.Dict)                     // 40
-	m.RegisterHostFunction("", stdlib.Tuple)                    // 41
-	m.RegisterHostFunction("", stdlib.Set)                      // 42
-	m.RegisterHostFunction("", stdlib.Reversed)                 // 43
-	m.RegisterHostFunction("", stdlib.Sorted)                   // 44
-	m.RegisterHostFunction("", stdlib.Zip)                      // 45
-	m.RegisterHostFunction("", stdlib.Enumerate)                // 46
-	m.RegisterHostFunction("", stdlib.Repr)                     // 47
-	m.RegisterHostFunction("", stdlib.Ascii)                    // 48
-	m.RegisterHostFunction("", stdlib.Hash)                     // 49
-	m.RegisterHostFunction("", stdlib.Id)                       // 50
-	m.RegisterHostFunction("", stdlib.TypeWord)                 // 51
-	m.RegisterHostFunction("", stdlib.Callable)                 // 52
-	m.RegisterHostFunction("", stdlib.Iter)                     // 53
-	m.RegisterHostFunction("", stdlib.Next)                     // 54
-	m.RegisterHostFunction("", stdlib.Locals)                   // 55
-	m.RegisterHostFunction("", stdlib.Globals)                  // 56
-	m.RegisterHostFunction("", stdlib.SliceBuiltin)             // 57
-	m.RegisterHostFunction("", stdlib.Bytes)                    // 58
-	m.RegisterHostFunction("", stdlib.ByteArray)                // 59
-	m.RegisterHostFunction("", stdlib.HasNext)                  // 60
-	m.RegisterHostFunction("", stdlib.MakeTuple)                // 61
-	m.RegisterHostFunction("", stdlib.MethodCall)               // 62
-	m.RegisterHostFunction("", stdlib.IsInstance)               // 63
-
-	for name, ip := range bc.Functions {
-		m.FunctionRegistry[name] = ip
-	}
-
-	err = m.Run(gasLimit)
-	if err != nil {
-		fmt.Printf("Runtime Error: %v\n", err)
+	m.HostRegistry = stdlib.NewRegistry(fsSandbox, httpSandbox)
+	if err := bc.CheckLinks(m.HostRegistry); err != nil {
+		fmt.Printf("Load Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := vm.VerifyLimits(bc, m.HostRegistry, m.Limits()); err != nil {
+		fmt.Printf("Verification Error: %v\n", err)
 		os.Exit(1)
 	}
 }
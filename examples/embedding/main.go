@@ -69,9 +69,7 @@ y
 	}
 
 	// 4. Load the bytecode
-	m.Code = bc.Instructions
-	m.Constants = bc.Constants
-	m.Arena = bc.Arena
+	m.Load(bc)
 
 	// 5. Run the VM
 	err = m.Run(1000) // 1000 gas limit
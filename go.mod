@@ -3,6 +3,7 @@ module github.com/agenthands/npython
 go 1.25.1
 
 require (
+	github.com/go-python/gpython v0.2.0
 	github.com/google/generative-ai-go v0.20.1
 	google.golang.org/api v0.266.0
 )
@@ -18,7 +19,6 @@ require (
 	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/go-logr/logr v1.4.3 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
-	github.com/go-python/gpython v0.2.0 // indirect
 	github.com/google/s2a-go v0.1.9 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.11 // indirect
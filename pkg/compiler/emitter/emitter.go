@@ -11,6 +11,24 @@ import (
 	"github.com/agenthands/npython/pkg/vm"
 )
 
+// hostNames names the host functions behind the words emitted as OP_SYSCALL.
+var hostNames = map[uint32]string{
+	0:  "write_file",
+	1:  "fetch",
+	2:  "print",
+	3:  "parse_json",
+	4:  "get_field",
+	5:  "send_request",
+	6:  "check_status",
+	7:  "parse_json_key",
+	8:  "parse_and_get",
+	9:  "format_string",
+	10: "is_empty",
+	11: "with_client",
+	12: "set_url",
+	13: "set_method",
+}
+
 type Emitter struct {
 	instructions  []uint32
 	constants     []value.Value
@@ -52,6 +70,7 @@ func (e *Emitter) Emit(prog *ast.Program) (*vm.Bytecode, error) {
 		Constants:    e.constants,
 		Arena:        e.arena,
 		Functions:    e.functions,
+		Links:        vm.CollectLinks(e.instructions, hostNames),
 	}, nil
 }
 
@@ -3,7 +3,9 @@ package python
 import (
 	"fmt"
 	"math"
-	"strconv"
+	"math/big"
+	"slices"
+	"sort"
 	"strings"
 
 	"github.com/go-python/gpython/ast"
@@ -16,6 +18,7 @@ import (
 
 var PythonBuiltins = map[string]uint32{
 	"write_file":    0,
+	"read_file":     65,
 	"fetch":         1,
 	"print":         2,
 	"parse_json":    3,
@@ -73,20 +76,64 @@ var PythonBuiltins = map[string]uint32{
 	"isinstance":    63,
 }
 
+// internalSyscalls names the host functions the compiler emits for syntax
+// rather than for a call by name.
+var internalSyscalls = map[uint32]string{
+	4:  "get_field",
+	29: "make_list",
+	30: "get_item",
+	31: "set_item",
+	61: "make_tuple",
+	62: "method_call",
+	64: "sorted_key",
+}
+
 type loopContext struct {
 	startIP    uint32
 	breakJumps []int
 }
 
+// blockKind identifies a construct that return, break and continue have to
+// clean up when they leave it.
+type blockKind int
+
+const (
+	blockLoop      blockKind = iota
+	blockFor                 // a loop with its iterator on the stack
+	blockWith                // an open scope
+	blockTry                 // an exception handler
+	blockFinally             // an exception handler with a finally body
+	blockException           // a caught exception on the stack
+	blockValue               // a return value on the stack while finally runs
+)
+
+type block struct {
+	kind    blockKind
+	finally []ast.Stmt
+}
+
 type Compiler struct {
+	// MaxLocals is the number of locals a function or the module may use,
+	// including compiler temporaries. It must not exceed the MaxLocals limit
+	// of the machine that runs the code.
+	MaxLocals int
+
 	instructions  []uint32
 	constants     []value.Value
 	locals        map[string]int
-	nextLocal     int
+	globals       map[string]int  // slots of module-level names
+	bound         map[string]bool // names bound at module level
+	fixed         map[string]bool // module-level defs never rebound
+	scope         *funcScope      // the function being compiled, nil at module level
+	scopes        map[ast.Ast]*funcScope
 	arena         []byte
 	stringOffsets map[string]uint32
 	functions     map[string]*funcSignature
 	loops         []*loopContext
+	blocks        []block
+	lines         []vm.LineEntry
+	funcs         []vm.FuncRange
+	pos           vm.LineEntry
 }
 
 type funcSignature struct {
@@ -94,8 +141,40 @@ type funcSignature struct {
 	args []string
 }
 
+// funcScope records how the names used in a function body bind.
+type funcScope struct {
+	parent   *funcScope
+	args     []string
+	assigned map[string]bool // bound in the body, hence local
+	global   map[string]bool // declared global
+	nonlocal map[string]bool // declared nonlocal
+	cells    map[string]bool // locals that nested functions close over
+	free     map[string]bool // variables of enclosing functions
+	used     map[string]bool // referenced by the code compiled so far
+	// generator is set if the body yields, making the function return a
+	// generator instead of running.
+	generator bool
+}
+
+// freeNames returns the free variables of s in the order in which they
+// follow the arguments in the locals and the cells of its closures.
+func (s *funcScope) freeNames() []string {
+	names := make([]string, 0, len(s.free))
+	for name := range s.free {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deref reports whether name is accessed through a cell.
+func (s *funcScope) deref(name string) bool {
+	return s.cells[name] || s.free[name]
+}
+
 func NewCompiler() *Compiler {
 	return &Compiler{
+		MaxLocals:     vm.MaxLocals,
 		locals:        make(map[string]int),
 		constants:     make([]value.Value, 0),
 		arena:         make([]byte, 0, 1024),
@@ -106,16 +185,25 @@ func NewCompiler() *Compiler {
 }
 
 func (c *Compiler) Compile(src string) (*vm.Bytecode, error) {
+	return c.CompileFile("<string>", src)
+}
+
+// CompileFile compiles src, naming it filename in error messages and in the
+// debug information used for tracebacks.
+func (c *Compiler) CompileFile(filename, src string) (*vm.Bytecode, error) {
 	c.instructions = c.instructions[:0]
 	c.constants = c.constants[:0]
 	c.locals = make(map[string]int)
-	c.nextLocal = 0
+	c.globals, c.scope = make(map[string]int), nil
+	c.scopes = make(map[ast.Ast]*funcScope)
 	c.loops = c.loops[:0]
+	c.blocks = c.blocks[:0]
 	c.arena = c.arena[:0]
 	c.stringOffsets = make(map[string]uint32)
 	c.functions = make(map[string]*funcSignature)
+	c.lines, c.funcs, c.pos = nil, nil, vm.LineEntry{}
 
-	mod, err := parser.Parse(strings.NewReader(src), "<string>", py.ExecMode)
+	mod, err := parser.Parse(strings.NewReader(src), filename, py.ExecMode)
 	if err != nil {
 		return nil, fmt.Errorf("python parse error: %w", err)
 	}
@@ -124,6 +212,11 @@ func (c *Compiler) Compile(src string) (*vm.Bytecode, error) {
 	if !ok {
 		return nil, fmt.Errorf("expected *ast.Module")
 	}
+	c.bound = moduleBindings(module.Body)
+	c.fixed = fixedFunctions(module.Body)
+	if err := c.analyze(module.Body, nil); err != nil {
+		return nil, err
+	}
 
 	for i, stmt := range module.Body {
 		if i == len(module.Body)-1 {
@@ -139,15 +232,35 @@ func (c *Compiler) Compile(src string) (*vm.Bytecode, error) {
 		}
 	}
 	c.emitOp(vm.OP_HALT, 0)
+	if err := c.checkLocals("<module>"); err != nil {
+		return nil, err
+	}
+	if n := len(c.globals); n > vm.MaxGlobals {
+		return nil, fmt.Errorf("<module> uses %d global variables, limit is %d", n, vm.MaxGlobals)
+	}
 
 	return &vm.Bytecode{
 		Instructions: c.instructions,
 		Constants:    c.constants,
 		Arena:        c.arena,
 		Functions:    c.exportFunctions(),
+		Globals:      len(c.globals),
+		Links:        vm.CollectLinks(c.instructions, syscallNames()),
+		Debug:        &vm.DebugInfo{File: filename, Source: src, Lines: c.lines, Funcs: c.funcs, Globals: slotNames(c.globals)},
 	}, nil
 }
 
+func syscallNames() map[uint32]string {
+	names := make(map[uint32]string, len(PythonBuiltins)+len(internalSyscalls))
+	for name, idx := range PythonBuiltins {
+		names[idx] = name
+	}
+	for idx, name := range internalSyscalls {
+		names[idx] = name
+	}
+	return names
+}
+
 func (c *Compiler) exportFunctions() map[string]int {
 	res := make(map[string]int)
 	for k, v := range c.functions {
@@ -160,9 +273,37 @@ func (c *Compiler) emitOp(op uint8, arg uint32) {
 	c.instructions = append(c.instructions, (uint32(op)<<24)|(arg&0x00FFFFFF))
 }
 
+// at attributes the code emitted from now on to node and returns a function
+// that restores the previous position, for use with defer.
+func (c *Compiler) at(node ast.Ast) func() {
+	prev := c.pos
+	if line := node.GetLineno(); line > 0 {
+		c.setPos(vm.LineEntry{Line: line, Col: node.GetColOffset() + 1})
+	}
+	return func() { c.setPos(prev) }
+}
+
+func (c *Compiler) setPos(p vm.LineEntry) {
+	p.IP = len(c.instructions)
+	c.pos = p
+	if p.Line == 0 {
+		return
+	}
+	if n := len(c.lines); n > 0 {
+		if last := &c.lines[n-1]; last.Line == p.Line && last.Col == p.Col {
+			return
+		} else if last.IP == p.IP {
+			*last = p
+			return
+		}
+	}
+	c.lines = append(c.lines, p)
+}
+
 func (c *Compiler) addConstant(v value.Value) uint32 {
 	for i, existing := range c.constants {
-		if existing.Type == v.Type && existing.Data == v.Data {
+		if existing.Type == v.Type && existing.Data == v.Data && existing.IsBig() == v.IsBig() &&
+			(!v.IsBig() || existing.BigInt().Cmp(v.BigInt()) == 0) {
 			return uint32(i)
 		}
 	}
@@ -181,16 +322,392 @@ func (c *Compiler) packNewString(s string) uint64 {
 }
 
 func (c *Compiler) getLocalIndex(name string) int {
-	if idx, ok := c.locals[name]; ok {
+	return slot(c.locals, name)
+}
+
+// slot returns the index of name in table, allocating the next one if it has
+// none yet.
+func slot(table map[string]int, name string) int {
+	if idx, ok := table[name]; ok {
 		return idx
 	}
-	idx := c.nextLocal
-	c.locals[name] = idx
-	c.nextLocal++
+	idx := len(table)
+	table[name] = idx
 	return idx
 }
 
+// slotNames lists the names in table by slot. Compiler temporaries are left
+// unnamed.
+func slotNames(table map[string]int) []string {
+	if len(table) == 0 {
+		return nil
+	}
+	names := make([]string, len(table))
+	for name, idx := range table {
+		if !strings.HasPrefix(name, "__tmp_") {
+			names[idx] = name
+		}
+	}
+	return names
+}
+
+// checkLocals reports an error if the current function, or the module with
+// its temporaries, uses more locals than the machine provides.
+func (c *Compiler) checkLocals(name string) error {
+	if n := len(c.locals); n > c.MaxLocals {
+		return fmt.Errorf("%s uses %d local variables, limit is %d", name, n, c.MaxLocals)
+	}
+	return nil
+}
+
+// bindings returns the names that body binds, by assignment, as a loop or
+// except target or, with defs set, by a nested def, and the names it declares
+// global and nonlocal. Nested functions and lambdas are not entered.
+func bindings(body []ast.Stmt, defs bool) (assigned, global, nonlocal map[string]bool) {
+	assigned, global, nonlocal = make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	visit := func(node ast.Ast) bool {
+		switch n := node.(type) {
+		case *ast.FunctionDef:
+			if defs {
+				assigned[string(n.Name)] = true
+			}
+			return false
+		case *ast.Lambda:
+			return false
+		case *ast.Name:
+			if n.Ctx == ast.Store {
+				assigned[string(n.Id)] = true
+			}
+		case *ast.ExceptHandler:
+			if n.Name != "" {
+				assigned[string(n.Name)] = true
+			}
+		case *ast.Global:
+			for _, name := range n.Names {
+				global[string(name)] = true
+			}
+		case *ast.Nonlocal:
+			for _, name := range n.Names {
+				nonlocal[string(name)] = true
+			}
+		}
+		return true
+	}
+	for _, stmt := range body {
+		ast.Walk(stmt, visit)
+	}
+	return assigned, global, nonlocal
+}
+
+// references returns the names that body reads, not counting nested
+// functions and lambdas.
+func references(body []ast.Stmt) map[string]bool {
+	refs := make(map[string]bool)
+	for _, stmt := range body {
+		ast.Walk(stmt, func(node ast.Ast) bool {
+			switch n := node.(type) {
+			case *ast.FunctionDef, *ast.Lambda:
+				return false
+			case *ast.Name:
+				if n.Ctx == ast.Load {
+					refs[string(n.Id)] = true
+				}
+			}
+			return true
+		})
+	}
+	return refs
+}
+
+// yields reports whether body contains a yield, not counting nested
+// functions and lambdas.
+func yields(body []ast.Stmt) bool {
+	found := false
+	for _, stmt := range body {
+		ast.Walk(stmt, func(node ast.Ast) bool {
+			switch node.(type) {
+			case *ast.FunctionDef, *ast.Lambda:
+				return false
+			case *ast.Yield, *ast.YieldFrom:
+				found = true
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// moduleBindings returns the global names of a module: those bound at module
+// level, including the functions it defines, and those any function declares
+// global.
+func moduleBindings(body []ast.Stmt) map[string]bool {
+	bound, _, _ := bindings(body, true)
+	for _, stmt := range body {
+		ast.Walk(stmt, func(node ast.Ast) bool {
+			if g, ok := node.(*ast.Global); ok {
+				for _, name := range g.Names {
+					bound[string(name)] = true
+				}
+			}
+			return true
+		})
+	}
+	return bound
+}
+
+// fixedFunctions returns the names a module binds with a single def and in
+// no other way at module level. Functions that declare one of them global
+// and assign it are left to analyze.
+func fixedFunctions(body []ast.Stmt) map[string]bool {
+	defs := make(map[string]int)
+	for _, stmt := range body {
+		ast.Walk(stmt, func(node ast.Ast) bool {
+			switch n := node.(type) {
+			case *ast.FunctionDef:
+				defs[string(n.Name)]++
+				return false
+			case *ast.Lambda:
+				return false
+			}
+			return true
+		})
+	}
+	assigned, _, _ := bindings(body, false)
+	fixed := make(map[string]bool)
+	for name, n := range defs {
+		if n == 1 && !assigned[name] {
+			fixed[name] = true
+		}
+	}
+	return fixed
+}
+
+// analyze builds the scopes of the functions and lambdas defined in body,
+// which belongs to the function parent or, if it is nil, to the module.
+func (c *Compiler) analyze(body []ast.Stmt, parent *funcScope) error {
+	var err error
+	for _, stmt := range body {
+		ast.Walk(stmt, func(node ast.Ast) bool {
+			if err != nil {
+				return false
+			}
+			switch n := node.(type) {
+			case *ast.FunctionDef:
+				err = c.analyzeFunction(n, argNames(n.Args), n.Body, parent)
+				return false
+			case *ast.Lambda:
+				err = c.analyzeFunction(n, argNames(n.Args), []ast.Stmt{&ast.Return{Value: n.Body}}, parent)
+				return false
+			}
+			return true
+		})
+	}
+	return err
+}
+
+// analyzeFunction builds the scope of the function node and resolves the
+// names it reads from enclosing functions, marking them free here and cells
+// where they are bound.
+func (c *Compiler) analyzeFunction(node ast.Ast, args []string, body []ast.Stmt, parent *funcScope) error {
+	assigned, global, nonlocal := bindings(body, true)
+	for _, arg := range args {
+		switch {
+		case global[arg]:
+			return fmt.Errorf("name '%s' is parameter and global", arg)
+		case nonlocal[arg]:
+			return fmt.Errorf("name '%s' is parameter and nonlocal", arg)
+		}
+		assigned[arg] = true
+	}
+	for name := range global {
+		if assigned[name] {
+			delete(c.fixed, name)
+		}
+		delete(assigned, name)
+	}
+	for name := range nonlocal {
+		delete(assigned, name)
+	}
+	s := &funcScope{parent: parent, args: args, assigned: assigned, global: global, nonlocal: nonlocal,
+		cells: make(map[string]bool), free: make(map[string]bool), generator: yields(body)}
+	if _, ok := node.(*ast.Lambda); ok && s.generator {
+		return fmt.Errorf("'yield' inside lambda is not supported")
+	}
+	c.scopes[node] = s
+	if err := c.analyze(body, s); err != nil {
+		return err
+	}
+	for name := range nonlocal {
+		if !s.resolve(name) {
+			return fmt.Errorf("no binding for nonlocal '%s' found", name)
+		}
+	}
+	for name := range references(body) {
+		if !assigned[name] && !global[name] {
+			s.resolve(name)
+		}
+	}
+	return nil
+}
+
+// resolve looks name up in the enclosing functions. If one binds it, name
+// becomes a cell there and free in s and every function in between.
+func (s *funcScope) resolve(name string) bool {
+	for p := s.parent; p != nil; p = p.parent {
+		if p.global[name] {
+			return false
+		}
+		if p.assigned[name] {
+			p.cells[name] = true
+			for q := s; q != p; q = q.parent {
+				q.free[name] = true
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func argNames(args *ast.Arguments) []string {
+	names := make([]string, len(args.Args))
+	for i, a := range args.Args {
+		names[i] = string(a.Arg)
+	}
+	return names
+}
+
+// enterFunction starts compiling the function node: its arguments take the
+// first locals, followed by its free variables, and the locals that nested
+// functions close over are moved into cells. It returns a function that
+// restores the enclosing scope.
+func (c *Compiler) enterFunction(node ast.Ast) func() {
+	s := c.scopes[node]
+	oldL, oldScope, oldLoops, oldBlocks := c.locals, c.scope, c.loops, c.blocks
+	c.locals = make(map[string]int)
+	for _, arg := range s.args {
+		c.getLocalIndex(arg)
+	}
+	for _, name := range s.freeNames() {
+		c.getLocalIndex(name)
+	}
+	s.used = make(map[string]bool)
+	c.scope = s
+	c.loops, c.blocks = nil, nil
+
+	cells := make([]string, 0, len(s.cells))
+	for name := range s.cells {
+		cells = append(cells, name)
+	}
+	sort.Strings(cells)
+	for _, name := range cells {
+		idx := uint32(c.getLocalIndex(name))
+		if !slices.Contains(s.args, name) {
+			// Locals keep values from earlier calls.
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeVoid}))
+			c.emitOp(vm.OP_POP_L, idx)
+		}
+		c.emitOp(vm.OP_MAKE_CELL, idx)
+	}
+	return func() {
+		c.locals, c.scope, c.loops, c.blocks = oldL, oldScope, oldLoops, oldBlocks
+	}
+}
+
+// emitFunction pushes a value for the function node compiled at entry,
+// closing over its free variables, which the enclosing function holds in
+// cells.
+func (c *Compiler) emitFunction(node ast.Ast, name string, entry int) {
+	s := c.scopes[node]
+	c.emitOp(vm.OP_PUSH_C, c.addConstant(value.NewFunction(name, entry, len(s.args))))
+	free := s.freeNames()
+	if len(free) == 0 {
+		return
+	}
+	for _, name := range free {
+		c.emitOp(vm.OP_PUSH_L, uint32(c.getLocalIndex(name)))
+	}
+	c.emitOp(vm.OP_CLOSURE, uint32(len(free)))
+}
+
+// isGlobal reports whether name refers to a module global from the current
+// scope.
+func (c *Compiler) isGlobal(name string) bool {
+	if c.scope == nil {
+		return c.bound[name] || c.isLocal(name)
+	}
+	return c.scope.global[name] || (!c.scope.assigned[name] && !c.scope.free[name] && c.bound[name])
+}
+
+// direct returns the signature of the module-level function name if it is
+// compiled and its global always holds it, so that it can be loaded as a
+// constant and called directly.
+func (c *Compiler) direct(name string) *funcSignature {
+	if !c.fixed[name] {
+		return nil
+	}
+	return c.functions[name]
+}
+
+// isFunctionLocal reports whether name is a variable of the function being
+// compiled, either its own or one it closes over.
+func (c *Compiler) isFunctionLocal(name string) bool {
+	return c.scope != nil && (c.scope.assigned[name] || c.scope.free[name])
+}
+
+// emitLoadName pushes the value of name, resolved by Python's LEGB rule: a
+// name bound in the current function is local, one bound in an enclosing
+// function is read through its cell, one bound at module level or declared
+// global is global, and anything else must be a function, an exception
+// class or a builtin. Functions evaluate to function values, exception
+// classes and builtins to their name.
+func (c *Compiler) emitLoadName(name string) error {
+	if c.scope != nil {
+		c.scope.used[name] = true
+	}
+	switch {
+	case c.scope != nil && c.scope.deref(name):
+		c.emitOp(vm.OP_LOAD_DEREF, uint32(c.getLocalIndex(name)))
+	case c.scope != nil && c.scope.assigned[name]:
+		c.emitOp(vm.OP_PUSH_L, uint32(c.getLocalIndex(name)))
+	case c.direct(name) != nil:
+		sig := c.direct(name)
+		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.NewFunction(name, sig.ip, len(sig.args))))
+	case c.isGlobal(name):
+		c.emitOp(vm.OP_PUSH_G, uint32(slot(c.globals, name)))
+	case isExceptionClass(name), isBuiltin(name):
+		// Exception classes and builtins evaluate to their name, which
+		// isinstance compares against.
+		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeString, Data: c.packNewString(name)}))
+	default:
+		return fmt.Errorf("name '%s' is not defined", name)
+	}
+	return nil
+}
+
+func isBuiltin(name string) bool {
+	_, ok := PythonBuiltins[name]
+	return ok
+}
+
+// emitStoreName pops the top of the stack into name.
+func (c *Compiler) emitStoreName(name string) {
+	if c.scope == nil {
+		c.emitOp(vm.OP_POP_G, uint32(slot(c.globals, name)))
+		return
+	}
+	c.scope.used[name] = true
+	switch {
+	case c.scope.global[name]:
+		c.emitOp(vm.OP_POP_G, uint32(slot(c.globals, name)))
+	case c.scope.deref(name):
+		c.emitOp(vm.OP_STORE_DEREF, uint32(c.getLocalIndex(name)))
+	default:
+		c.emitOp(vm.OP_POP_L, uint32(c.getLocalIndex(name)))
+	}
+}
+
 func (c *Compiler) emitStmt(stmt ast.Stmt) error {
+	defer c.at(stmt)()
 	switch s := stmt.(type) {
 	case *ast.Assign:
 		if len(s.Targets) != 1 {
@@ -201,7 +718,7 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 			if err := c.emitExpr(s.Value); err != nil {
 				return err
 			}
-			c.emitOp(vm.OP_POP_L, uint32(c.getLocalIndex(string(target.Id))))
+			c.emitStoreName(string(target.Id))
 		case *ast.Tuple:
 			// Unpack via temporary local
 			tmpIdx := c.getLocalIndex("__tmp_unpack")
@@ -214,7 +731,7 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 				c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeInt, Data: uint64(i)}))
 				c.emitOp(vm.OP_SYSCALL, 30) // get_item
 				if name, ok := el.(*ast.Name); ok {
-					c.emitOp(vm.OP_POP_L, uint32(c.getLocalIndex(string(name.Id))))
+					c.emitStoreName(string(name.Id))
 				} else if sub, ok := el.(*ast.Subscript); ok {
 					if err := c.emitExpr(sub.Value); err != nil {
 						return err
@@ -240,8 +757,10 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 			c.emitOp(vm.OP_SYSCALL, 31) // set_item
 		}
 	case *ast.AugAssign:
-		idx := uint32(c.getLocalIndex(string(s.Target.(*ast.Name).Id)))
-		c.emitOp(vm.OP_PUSH_L, idx)
+		name := string(s.Target.(*ast.Name).Id)
+		if err := c.emitLoadName(name); err != nil {
+			return err
+		}
 		if err := c.emitExpr(s.Value); err != nil {
 			return err
 		}
@@ -254,8 +773,14 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 			c.emitOp(vm.OP_MUL, 0)
 		case ast.Div:
 			c.emitOp(vm.OP_DIV, 0)
+		case ast.FloorDiv:
+			c.emitOp(vm.OP_FLOOR_DIV, 0)
+		case ast.Modulo:
+			c.emitOp(vm.OP_MOD, 0)
+		case ast.Pow:
+			c.emitOp(vm.OP_POW, 0)
 		}
-		c.emitOp(vm.OP_POP_L, idx)
+		c.emitStoreName(name)
 	case *ast.ExprStmt:
 		if err := c.emitExpr(s.Value); err != nil {
 			return err
@@ -288,6 +813,7 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 	case *ast.While:
 		ctx := &loopContext{startIP: uint32(len(c.instructions))}
 		c.loops = append(c.loops, ctx)
+		c.blocks = append(c.blocks, block{kind: blockLoop})
 		if err := c.emitExpr(s.Test); err != nil {
 			return err
 		}
@@ -304,6 +830,7 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 			c.instructions[idx] = (uint32(vm.OP_JMP) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
 		}
 		c.loops = c.loops[:len(c.loops)-1]
+		c.blocks = c.blocks[:len(c.blocks)-1]
 	case *ast.For:
 		if err := c.emitExpr(s.Iter); err != nil {
 			return err
@@ -311,6 +838,7 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 		c.emitOp(vm.OP_SYSCALL, 53) // iter()
 		ctx := &loopContext{startIP: uint32(len(c.instructions))}
 		c.loops = append(c.loops, ctx)
+		c.blocks = append(c.blocks, block{kind: blockFor})
 		c.emitOp(vm.OP_SYSCALL, 60) // has_next()
 		jumpEndIdx := len(c.instructions)
 		c.emitOp(vm.OP_JMP_FALSE, 0)
@@ -318,7 +846,7 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 		c.emitOp(vm.OP_SYSCALL, 54) // next()
 		switch target := s.Target.(type) {
 		case *ast.Name:
-			c.emitOp(vm.OP_POP_L, uint32(c.getLocalIndex(string(target.Id))))
+			c.emitStoreName(string(target.Id))
 		case *ast.Tuple:
 			tmpIdx := c.getLocalIndex("__tmp_for")
 			c.emitOp(vm.OP_POP_L, uint32(tmpIdx))
@@ -327,7 +855,7 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 				c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeInt, Data: uint64(i)}))
 				c.emitOp(vm.OP_SYSCALL, 30) // get_item
 				if name, ok := el.(*ast.Name); ok {
-					c.emitOp(vm.OP_POP_L, uint32(c.getLocalIndex(string(name.Id))))
+					c.emitStoreName(string(name.Id))
 				} else if sub, ok := el.(*ast.Subscript); ok {
 					if err := c.emitExpr(sub.Value); err != nil {
 						return err
@@ -353,12 +881,21 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 		}
 		c.emitOp(vm.OP_DROP, 0)
 		c.loops = c.loops[:len(c.loops)-1]
-	case *ast.Break:
+		c.blocks = c.blocks[:len(c.blocks)-1]
+	case *ast.Break, *ast.Continue:
+		if len(c.loops) == 0 {
+			return fmt.Errorf("'break' or 'continue' outside loop")
+		}
+		if err := c.unwind(c.loopBlock()+1, false); err != nil {
+			return err
+		}
 		ctx := c.loops[len(c.loops)-1]
-		ctx.breakJumps = append(ctx.breakJumps, len(c.instructions))
-		c.emitOp(vm.OP_JMP, 0)
-	case *ast.Continue:
-		c.emitOp(vm.OP_JMP, c.loops[len(c.loops)-1].startIP)
+		if _, ok := s.(*ast.Break); ok {
+			ctx.breakJumps = append(ctx.breakJumps, len(c.instructions))
+			c.emitOp(vm.OP_JMP, 0)
+		} else {
+			c.emitOp(vm.OP_JMP, ctx.startIP)
+		}
 	case *ast.With:
 		call, ok := s.Items[0].ContextExpr.(*ast.Call)
 		if !ok || len(call.Args) != 2 {
@@ -371,35 +908,51 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 			return err
 		}
 		c.emitOp(vm.OP_ADDRESS, 0)
+		c.blocks = append(c.blocks, block{kind: blockWith})
 		for _, stmt := range s.Body {
 			if err := c.emitStmt(stmt); err != nil {
 				return err
 			}
 		}
+		c.blocks = c.blocks[:len(c.blocks)-1]
 		c.emitOp(vm.OP_EXIT_ADDR, 0)
 	case *ast.FunctionDef:
 		jmpIdx := len(c.instructions)
 		c.emitOp(vm.OP_JMP, 0)
-		args := make([]string, len(s.Args.Args))
-		for i, a := range s.Args.Args {
-			args[i] = string(a.Arg)
+		start := len(c.instructions)
+		nested := c.scope != nil
+		if !nested {
+			// Functions defined at module level that are never rebound are
+			// called directly once compiled, and through their global
+			// before.
+			c.functions[string(s.Name)] = &funcSignature{ip: start, args: argNames(s.Args)}
 		}
-		c.functions[string(s.Name)] = &funcSignature{ip: len(c.instructions), args: args}
-		oldL, oldN := c.locals, c.nextLocal
-		c.locals = make(map[string]int)
-		c.nextLocal = len(s.Args.Args)
-		for i, arg := range s.Args.Args {
-			c.locals[string(arg.Arg)] = i
+		generator := c.scopes[s].generator
+		if generator {
+			// Calling a generator function returns a generator that runs
+			// the body from the next instruction; the operand, the number
+			// of locals it keeps, is set once the body is compiled.
+			c.emitOp(vm.OP_GEN, 0)
 		}
+		leave := c.enterFunction(s)
 		for _, stmt := range s.Body {
 			if err := c.emitStmt(stmt); err != nil {
 				return err
 			}
 		}
+		if err := c.checkLocals(string(s.Name)); err != nil {
+			return err
+		}
+		if generator {
+			c.instructions[start] = (uint32(vm.OP_GEN) << 24) | (uint32(len(c.locals)) & 0x00FFFFFF)
+		}
 		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeVoid}))
 		c.emitOp(vm.OP_RET, 0)
-		c.locals, c.nextLocal = oldL, oldN
+		c.funcs = append(c.funcs, vm.FuncRange{Name: string(s.Name), Start: start, End: len(c.instructions), Locals: slotNames(c.locals)})
+		leave()
 		c.instructions[jmpIdx] = (uint32(vm.OP_JMP) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+		c.emitFunction(s, string(s.Name), start)
+		c.emitStoreName(string(s.Name))
 	case *ast.Return:
 		if s.Value != nil {
 			if err := c.emitExpr(s.Value); err != nil {
@@ -408,29 +961,300 @@ func (c *Compiler) emitStmt(stmt ast.Stmt) error {
 		} else {
 			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeVoid}))
 		}
+		if err := c.unwind(0, true); err != nil {
+			return err
+		}
 		c.emitOp(vm.OP_RET, 0)
 	case *ast.Try:
-		// nPython doesn't support exception catching natively in the VM yet.
-		// To allow LLMs to write standard defensive Python, we simply compile and execute the happy-path Body inline.
-		for _, stmt := range s.Body {
-			if err := c.emitStmt(stmt); err != nil {
+		if len(s.Finalbody) > 0 {
+			return c.emitTryFinally(s)
+		}
+		return c.emitTryExcept(s)
+	case *ast.Global:
+		// Declarations were collected by analyze before the body was
+		// compiled.
+		for _, name := range s.Names {
+			if c.scope != nil && c.scope.used[string(name)] {
+				return fmt.Errorf("name '%s' is used prior to global declaration", name)
+			}
+		}
+	case *ast.Nonlocal:
+		if c.scope == nil {
+			return fmt.Errorf("nonlocal declaration not allowed at module level")
+		}
+		for _, name := range s.Names {
+			if c.scope.used[string(name)] {
+				return fmt.Errorf("name '%s' is used prior to nonlocal declaration", name)
+			}
+		}
+	case *ast.Raise:
+		if s.Exc == nil {
+			// Re-raise the exception being handled.
+			depth, ok := c.caughtDepth()
+			if !ok {
+				return fmt.Errorf("no active exception to re-raise")
+			}
+			c.emitOp(vm.OP_DUP, uint32(depth))
+		} else if name, ok := s.Exc.(*ast.Name); ok && isExceptionClass(string(name.Id)) && !c.isLocal(string(name.Id)) {
+			if err := c.emitNewException(string(name.Id), nil); err != nil {
 				return err
 			}
+		} else if err := c.emitExpr(s.Exc); err != nil {
+			return err
 		}
+		c.emitOp(vm.OP_RAISE, 0)
 	default:
 		return fmt.Errorf("unsupported statement type: %T", stmt)
 	}
 	return nil
 }
 
+// emitTryExcept compiles a try statement without a finally clause. The
+// handler code receives the exception on the stack and tests it against each
+// except clause in turn, re-raising it if none matches.
+func (c *Compiler) emitTryExcept(s *ast.Try) error {
+	setup := len(c.instructions)
+	c.emitOp(vm.OP_SETUP_EXCEPT, 0)
+	c.blocks = append(c.blocks, block{kind: blockTry})
+	for _, stmt := range s.Body {
+		if err := c.emitStmt(stmt); err != nil {
+			return err
+		}
+	}
+	c.blocks = c.blocks[:len(c.blocks)-1]
+	c.emitOp(vm.OP_POP_EXCEPT, 0)
+	for _, stmt := range s.Orelse {
+		if err := c.emitStmt(stmt); err != nil {
+			return err
+		}
+	}
+	endJumps := []int{len(c.instructions)}
+	c.emitOp(vm.OP_JMP, 0)
+
+	c.instructions[setup] = (uint32(vm.OP_SETUP_EXCEPT) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+	c.blocks = append(c.blocks, block{kind: blockException})
+	for _, h := range s.Handlers {
+		classes, err := exceptClasses(h.ExprType)
+		if err != nil {
+			return err
+		}
+		nextIdx := -1
+		for i, class := range classes {
+			c.emitOp(vm.OP_DUP, uint32(min(i, 1)))
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeString, Data: c.packNewString(class)}))
+			c.emitOp(vm.OP_EXC_MATCH, 0)
+			if i > 0 {
+				c.emitOp(vm.OP_OR, 0)
+			}
+		}
+		if len(classes) > 0 {
+			nextIdx = len(c.instructions)
+			c.emitOp(vm.OP_JMP_FALSE, 0)
+		}
+		if h.Name != "" {
+			c.emitOp(vm.OP_DUP, 0)
+			c.emitStoreName(string(h.Name))
+		}
+		for _, stmt := range h.Body {
+			if err := c.emitStmt(stmt); err != nil {
+				return err
+			}
+		}
+		c.emitOp(vm.OP_DROP, 0)
+		endJumps = append(endJumps, len(c.instructions))
+		c.emitOp(vm.OP_JMP, 0)
+		if nextIdx >= 0 {
+			c.instructions[nextIdx] = (uint32(vm.OP_JMP_FALSE) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+		}
+	}
+	c.blocks = c.blocks[:len(c.blocks)-1]
+	c.emitOp(vm.OP_RAISE, 0)
+	for _, idx := range endJumps {
+		c.instructions[idx] = (uint32(vm.OP_JMP) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+	}
+	return nil
+}
+
+// emitTryFinally compiles a try statement with a finally clause. The finally
+// body is emitted on the normal path, in the handler, which re-raises after
+// it, and wherever return, break or continue leave the try block.
+func (c *Compiler) emitTryFinally(s *ast.Try) error {
+	setup := len(c.instructions)
+	c.emitOp(vm.OP_SETUP_EXCEPT, 0)
+	c.blocks = append(c.blocks, block{kind: blockFinally, finally: s.Finalbody})
+	if len(s.Handlers) > 0 {
+		if err := c.emitTryExcept(&ast.Try{Body: s.Body, Handlers: s.Handlers, Orelse: s.Orelse}); err != nil {
+			return err
+		}
+	} else {
+		for _, stmt := range s.Body {
+			if err := c.emitStmt(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	c.blocks = c.blocks[:len(c.blocks)-1]
+	c.emitOp(vm.OP_POP_EXCEPT, 0)
+	for _, stmt := range s.Finalbody {
+		if err := c.emitStmt(stmt); err != nil {
+			return err
+		}
+	}
+	endIdx := len(c.instructions)
+	c.emitOp(vm.OP_JMP, 0)
+
+	c.instructions[setup] = (uint32(vm.OP_SETUP_EXCEPT) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+	c.blocks = append(c.blocks, block{kind: blockException})
+	for _, stmt := range s.Finalbody {
+		if err := c.emitStmt(stmt); err != nil {
+			return err
+		}
+	}
+	c.blocks = c.blocks[:len(c.blocks)-1]
+	c.emitOp(vm.OP_RAISE, 0)
+	c.instructions[endIdx] = (uint32(vm.OP_JMP) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+	return nil
+}
+
+// checkYield reports an error if the code being compiled cannot yield. A
+// generator may not be suspended inside a with block, which would leave
+// its scope open in the code that resumes it.
+func (c *Compiler) checkYield() error {
+	if c.scope == nil || !c.scope.generator {
+		return fmt.Errorf("'yield' outside function")
+	}
+	for _, b := range c.blocks {
+		if b.kind == blockWith {
+			return fmt.Errorf("'yield' inside 'with' is not supported")
+		}
+	}
+	return nil
+}
+
+// unwind emits the cleanup for leaving the blocks above index to: it closes
+// scopes, removes exception handlers and runs finally bodies. Values the
+// blocks keep on the stack are dropped unless the function is returning,
+// in which case OP_RET discards them.
+func (c *Compiler) unwind(to int, returning bool) error {
+	for i := len(c.blocks) - 1; i >= to; i-- {
+		switch b := c.blocks[i]; b.kind {
+		case blockWith:
+			c.emitOp(vm.OP_EXIT_ADDR, 0)
+		case blockTry:
+			c.emitOp(vm.OP_POP_EXCEPT, 0)
+		case blockFinally:
+			c.emitOp(vm.OP_POP_EXCEPT, 0)
+			saved := c.blocks
+			c.blocks = c.blocks[:i:i]
+			if returning {
+				c.blocks = append(c.blocks, block{kind: blockValue})
+			}
+			for _, stmt := range b.finally {
+				if err := c.emitStmt(stmt); err != nil {
+					return err
+				}
+			}
+			c.blocks = saved
+		case blockFor, blockException, blockValue:
+			if !returning {
+				c.emitOp(vm.OP_DROP, 0)
+			}
+		}
+	}
+	return nil
+}
+
+// loopBlock returns the index of the innermost loop in the block stack.
+func (c *Compiler) loopBlock() int {
+	for i := len(c.blocks) - 1; i >= 0; i-- {
+		if k := c.blocks[i].kind; k == blockLoop || k == blockFor {
+			return i
+		}
+	}
+	return -1
+}
+
+// caughtDepth returns how far below the top of the stack the exception being
+// handled is.
+func (c *Compiler) caughtDepth() (int, bool) {
+	depth := 0
+	for i := len(c.blocks) - 1; i >= 0; i-- {
+		switch c.blocks[i].kind {
+		case blockException:
+			return depth, true
+		case blockFor, blockValue:
+			depth++
+		}
+	}
+	return 0, false
+}
+
+// isLocal reports whether name is a variable of the code being compiled: a
+// local of the function or, at module level, a global.
+func (c *Compiler) isLocal(name string) bool {
+	table := c.locals
+	if c.scope == nil {
+		table = c.globals
+	}
+	_, ok := table[name]
+	return ok
+}
+
+// emitNewException pushes an exception of class with msg as its message.
+func (c *Compiler) emitNewException(class string, msg ast.Expr) error {
+	c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeString, Data: c.packNewString(class)}))
+	if msg == nil {
+		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeVoid}))
+	} else if err := c.emitExpr(msg); err != nil {
+		return err
+	}
+	c.emitOp(vm.OP_MAKE_EXC, 0)
+	return nil
+}
+
+// isExceptionClass reports whether name is treated as an exception class:
+// a call to it builds an exception instead of calling a function.
+func isExceptionClass(name string) bool {
+	return strings.HasSuffix(name, "Error") || strings.HasSuffix(name, "Exception") || name == "StopIteration"
+}
+
+// exceptClasses returns the class names an except clause matches, or none
+// for a bare except.
+func exceptClasses(expr ast.Expr) ([]string, error) {
+	switch e := expr.(type) {
+	case nil:
+		return nil, nil
+	case *ast.Name:
+		return []string{string(e.Id)}, nil
+	case *ast.Attribute:
+		return []string{string(e.Attr)}, nil
+	case *ast.Tuple:
+		var classes []string
+		for _, elt := range e.Elts {
+			cs, err := exceptClasses(elt)
+			if err != nil {
+				return nil, err
+			}
+			classes = append(classes, cs...)
+		}
+		return classes, nil
+	}
+	return nil, fmt.Errorf("unsupported exception class: %T", expr)
+}
+
 func (c *Compiler) emitExpr(expr ast.Expr) error {
+	defer c.at(expr)()
 	switch e := expr.(type) {
 	case *ast.Num:
-		s := fmt.Sprintf("%v", e.N)
-		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
-			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeInt, Data: uint64(i)}))
-		} else if f, err := strconv.ParseFloat(s, 64); err == nil {
-			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeFloat, Data: math.Float64bits(f)}))
+		switch n := e.N.(type) {
+		case py.Int:
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeInt, Data: uint64(n)}))
+		case *py.BigInt:
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.NewBigInt((*big.Int)(n))))
+		case py.Float:
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeFloat, Data: math.Float64bits(float64(n))}))
+		default:
+			return fmt.Errorf("unsupported number literal: %v", e.N)
 		}
 	case *ast.Str:
 		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeString, Data: c.packNewString(string(e.S))}))
@@ -443,13 +1267,7 @@ func (c *Compiler) emitExpr(expr ast.Expr) error {
 		}
 		c.emitOp(vm.OP_PUSH_C, c.addConstant(val))
 	case *ast.Name:
-		name := string(e.Id)
-		if sig, ok := c.functions[name]; ok {
-			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeString, Data: c.packNewString(name)}))
-			_ = sig // Unused but keep for symmetry
-		} else {
-			c.emitOp(vm.OP_PUSH_L, uint32(c.getLocalIndex(name)))
-		}
+		return c.emitLoadName(string(e.Id))
 	case *ast.BinOp:
 		if err := c.emitExpr(e.Left); err != nil {
 			return err
@@ -484,49 +1302,78 @@ func (c *Compiler) emitExpr(expr ast.Expr) error {
 			c.emitOp(vm.OP_RSHIFT, 0)
 		}
 	case *ast.BoolOp:
-		for _, v := range e.Values {
+		// The result is the first operand that decides the outcome, or the
+		// last one: each but the last is kept if it does and dropped if not.
+		jump := vm.OP_JMP_FALSE_OR_POP
+		if e.Op == ast.Or {
+			jump = vm.OP_JMP_TRUE_OR_POP
+		}
+		var jumps []int
+		for i, v := range e.Values {
 			if err := c.emitExpr(v); err != nil {
 				return err
 			}
+			if i < len(e.Values)-1 {
+				jumps = append(jumps, len(c.instructions))
+				c.emitOp(jump, 0)
+			}
 		}
-		if e.Op == ast.And {
-			c.emitOp(vm.OP_AND, 0)
-		} else {
-			c.emitOp(vm.OP_OR, 0)
+		for _, idx := range jumps {
+			c.instructions[idx] = (uint32(jump) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+		}
+	case *ast.IfExp:
+		if err := c.emitExpr(e.Test); err != nil {
+			return err
+		}
+		jumpFalseIdx := len(c.instructions)
+		c.emitOp(vm.OP_JMP_FALSE, 0)
+		if err := c.emitExpr(e.Body); err != nil {
+			return err
 		}
+		jumpEndIdx := len(c.instructions)
+		c.emitOp(vm.OP_JMP, 0)
+		c.instructions[jumpFalseIdx] = (uint32(vm.OP_JMP_FALSE) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+		if err := c.emitExpr(e.Orelse); err != nil {
+			return err
+		}
+		c.instructions[jumpEndIdx] = (uint32(vm.OP_JMP) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
 	case *ast.Compare:
+		// a < b < c is a < b and b < c with b evaluated once: each middle
+		// operand is saved in a temporary before its first comparison and
+		// pushed again for the next one if the chain goes on.
 		if err := c.emitExpr(e.Left); err != nil {
 			return err
 		}
-		if err := c.emitExpr(e.Comparators[0]); err != nil {
-			return err
-		}
-		switch e.Ops[0] {
-		case ast.Eq:
-			c.emitOp(vm.OP_EQ, 0)
-		case ast.NotEq:
-			c.emitOp(vm.OP_NE, 0)
-		case ast.Gt:
-			c.emitOp(vm.OP_GT, 0)
-		case ast.Lt:
-			c.emitOp(vm.OP_LT, 0)
-		case ast.GtE:
-			c.emitOp(vm.OP_GTE, 0)
-		case ast.LtE:
-			c.emitOp(vm.OP_LTE, 0)
-		case ast.In:
-			c.emitOp(vm.OP_IN, 0)
-		case ast.NotIn:
-			c.emitOp(vm.OP_NOT_IN, 0)
-		case ast.Is:
-			c.emitOp(vm.OP_EQ, 0) // Treat 'is' identically to '=='
-		case ast.IsNot:
-			c.emitOp(vm.OP_NE, 0) // Treat 'is not' identically to '!='
+		var jumps []int
+		for i, comparator := range e.Comparators {
+			if err := c.emitExpr(comparator); err != nil {
+				return err
+			}
+			if i == len(e.Comparators)-1 {
+				c.emitCompareOp(e.Ops[i])
+				break
+			}
+			tmpIdx := uint32(c.getLocalIndex("__tmp_compare"))
+			c.emitOp(vm.OP_DUP, 0)
+			c.emitOp(vm.OP_POP_L, tmpIdx)
+			c.emitCompareOp(e.Ops[i])
+			jumps = append(jumps, len(c.instructions))
+			c.emitOp(vm.OP_JMP_FALSE_OR_POP, 0)
+			c.emitOp(vm.OP_PUSH_L, tmpIdx)
+		}
+		for _, idx := range jumps {
+			c.instructions[idx] = (uint32(vm.OP_JMP_FALSE_OR_POP) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
 		}
 	case *ast.Call:
 		switch fn := e.Func.(type) {
 		case *ast.Name:
 			name := string(fn.Id)
+			if c.isFunctionLocal(name) {
+				return c.emitCallValue(e)
+			}
+			if name == "sorted" && len(e.Keywords) > 0 {
+				return c.emitSortedKey(e)
+			}
 			if sysIdx, ok := PythonBuiltins[name]; ok {
 				for _, arg := range e.Args {
 					if err := c.emitExpr(arg); err != nil {
@@ -542,7 +1389,7 @@ func (c *Compiler) emitExpr(expr ast.Expr) error {
 				}
 				return nil
 			}
-			if sig, ok := c.functions[name]; ok {
+			if sig := c.direct(name); sig != nil {
 				if len(e.Keywords) == 0 {
 					for _, arg := range e.Args {
 						if err := c.emitExpr(arg); err != nil {
@@ -571,6 +1418,19 @@ func (c *Compiler) emitExpr(expr ast.Expr) error {
 				c.emitOp(vm.OP_CALL, (uint32(sig.ip)<<8)|(uint32(len(sig.args))&0xFF))
 				return nil
 			}
+			if isExceptionClass(name) {
+				if len(e.Args) > 1 {
+					return fmt.Errorf("%s() takes at most 1 argument", name)
+				}
+				var arg ast.Expr
+				if len(e.Args) == 1 {
+					arg = e.Args[0]
+				}
+				return c.emitNewException(name, arg)
+			}
+			if c.isGlobal(name) {
+				return c.emitCallValue(e)
+			}
 			return fmt.Errorf("unknown function '%s'", name)
 		case *ast.Attribute:
 			if err := c.emitExpr(fn.Value); err != nil {
@@ -585,11 +1445,23 @@ func (c *Compiler) emitExpr(expr ast.Expr) error {
 			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeInt, Data: uint64(len(e.Args))}))
 			c.emitOp(vm.OP_SYSCALL, 62)
 			return nil
+		default:
+			return c.emitCallValue(e)
 		}
 	case *ast.UnaryOp:
-		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeInt, Data: 0}))
-		c.emitExpr(e.Operand)
-		c.emitOp(vm.OP_SUB, 0)
+		if err := c.emitExpr(e.Operand); err != nil {
+			return err
+		}
+		switch e.Op {
+		case ast.Not:
+			c.emitOp(vm.OP_NOT, 0)
+		case ast.USub:
+			c.emitOp(vm.OP_NEG, 0)
+		case ast.UAdd:
+			c.emitOp(vm.OP_POS, 0)
+		case ast.Invert:
+			c.emitOp(vm.OP_INVERT, 0)
+		}
 	case *ast.List:
 		for _, el := range e.Elts {
 			if err := c.emitExpr(el); err != nil {
@@ -663,34 +1535,134 @@ func (c *Compiler) emitExpr(expr ast.Expr) error {
 			}
 			c.emitOp(vm.OP_SYSCALL, 57)
 		}
+	case *ast.Yield:
+		if err := c.checkYield(); err != nil {
+			return err
+		}
+		if e.Value != nil {
+			if err := c.emitExpr(e.Value); err != nil {
+				return err
+			}
+		} else {
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeVoid}))
+		}
+		c.emitOp(vm.OP_YIELD, 0)
+	case *ast.YieldFrom:
+		if err := c.checkYield(); err != nil {
+			return err
+		}
+		if err := c.emitExpr(e.Value); err != nil {
+			return err
+		}
+		c.emitOp(vm.OP_SYSCALL, 53) // iter()
+		loop := len(c.instructions)
+		c.emitOp(vm.OP_SYSCALL, 60) // has_next()
+		jumpEndIdx := len(c.instructions)
+		c.emitOp(vm.OP_JMP_FALSE, 0)
+		c.emitOp(vm.OP_DUP, 0)
+		c.emitOp(vm.OP_SYSCALL, 54) // next()
+		c.emitOp(vm.OP_YIELD, 0)
+		c.emitOp(vm.OP_DROP, 0)
+		c.emitOp(vm.OP_JMP, uint32(loop))
+		c.instructions[jumpEndIdx] = (uint32(vm.OP_JMP_FALSE) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
+		c.emitOp(vm.OP_DROP, 0)
+		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeVoid}))
 	case *ast.Lambda:
-		name := fmt.Sprintf("__lambda_%d", len(c.functions))
 		jmp := len(c.instructions)
 		c.emitOp(vm.OP_JMP, 0)
-		args := make([]string, len(e.Args.Args))
-		for i, a := range e.Args.Args {
-			args[i] = string(a.Arg)
-		}
-		c.functions[name] = &funcSignature{ip: len(c.instructions), args: args}
-		oldL, oldN := c.locals, c.nextLocal
-		c.locals = make(map[string]int)
-		c.nextLocal = len(e.Args.Args)
-		for i, a := range e.Args.Args {
-			c.locals[string(a.Arg)] = i
-		}
+		start := len(c.instructions)
+		leave := c.enterFunction(e)
 		if err := c.emitExpr(e.Body); err != nil {
 			return err
 		}
+		if err := c.checkLocals("<lambda>"); err != nil {
+			return err
+		}
 		c.emitOp(vm.OP_RET, 0)
-		c.locals, c.nextLocal = oldL, oldN
+		c.funcs = append(c.funcs, vm.FuncRange{Name: "<lambda>", Start: start, End: len(c.instructions), Locals: slotNames(c.locals)})
+		leave()
 		c.instructions[jmp] = (uint32(vm.OP_JMP) << 24) | (uint32(len(c.instructions)) & 0x00FFFFFF)
-		c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeString, Data: c.packNewString(name)}))
+		c.emitFunction(e, "<lambda>", start)
 	default:
 		return fmt.Errorf("unsupported expression type: %T", expr)
 	}
 	return nil
 }
 
+// emitCallValue calls the function value that e.Func evaluates to.
+// emitCompareOp emits the instruction for a single comparison operator.
+func (c *Compiler) emitCompareOp(op ast.CmpOp) {
+	switch op {
+	case ast.Eq:
+		c.emitOp(vm.OP_EQ, 0)
+	case ast.NotEq:
+		c.emitOp(vm.OP_NE, 0)
+	case ast.Gt:
+		c.emitOp(vm.OP_GT, 0)
+	case ast.Lt:
+		c.emitOp(vm.OP_LT, 0)
+	case ast.GtE:
+		c.emitOp(vm.OP_GTE, 0)
+	case ast.LtE:
+		c.emitOp(vm.OP_LTE, 0)
+	case ast.In:
+		c.emitOp(vm.OP_IN, 0)
+	case ast.NotIn:
+		c.emitOp(vm.OP_NOT_IN, 0)
+	case ast.Is:
+		c.emitOp(vm.OP_IS, 0)
+	case ast.IsNot:
+		c.emitOp(vm.OP_IS_NOT, 0)
+	}
+}
+
+func (c *Compiler) emitCallValue(e *ast.Call) error {
+	if len(e.Keywords) > 0 {
+		return fmt.Errorf("keyword arguments are only supported in calls of functions defined at module level")
+	}
+	if err := c.emitExpr(e.Func); err != nil {
+		return err
+	}
+	for _, arg := range e.Args {
+		if err := c.emitExpr(arg); err != nil {
+			return err
+		}
+	}
+	c.emitOp(vm.OP_CALL_FN, uint32(len(e.Args)))
+	return nil
+}
+
+// emitSortedKey compiles sorted(iterable, key=None, reverse=False).
+func (c *Compiler) emitSortedKey(e *ast.Call) error {
+	if len(e.Args) != 1 {
+		return fmt.Errorf("sorted() takes exactly 1 positional argument")
+	}
+	args := []ast.Expr{e.Args[0], nil, nil}
+	for _, kw := range e.Keywords {
+		switch kw.Arg {
+		case "key":
+			args[1] = kw.Value
+		case "reverse":
+			args[2] = kw.Value
+		default:
+			return fmt.Errorf("sorted() got an unexpected keyword argument '%s'", kw.Arg)
+		}
+	}
+	for i, arg := range args {
+		if arg != nil {
+			if err := c.emitExpr(arg); err != nil {
+				return err
+			}
+		} else if i == 1 {
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeVoid}))
+		} else {
+			c.emitOp(vm.OP_PUSH_C, c.addConstant(value.Value{Type: value.TypeBool}))
+		}
+	}
+	c.emitOp(vm.OP_SYSCALL, 64)
+	return nil
+}
+
 func (c *Compiler) emitComprehension(elt ast.Expr, generators []ast.Comprehension) error {
 	gen := generators[0]
 	if err := c.emitExpr(gen.Iter); err != nil {
@@ -703,7 +1675,7 @@ func (c *Compiler) emitComprehension(elt ast.Expr, generators []ast.Comprehensio
 	c.emitOp(vm.OP_JMP_FALSE, 0)
 	c.emitOp(vm.OP_DUP, 0)
 	c.emitOp(vm.OP_SYSCALL, 54)
-	c.emitOp(vm.OP_POP_L, uint32(c.getLocalIndex(string(gen.Target.(*ast.Name).Id))))
+	c.emitStoreName(string(gen.Target.(*ast.Name).Id))
 	var ifs []int
 	for _, cond := range gen.Ifs {
 		if err := c.emitExpr(cond); err != nil {
@@ -741,7 +1713,7 @@ func (c *Compiler) emitDictComprehension(key, val ast.Expr, generators []ast.Com
 	c.emitOp(vm.OP_JMP_FALSE, 0)
 	c.emitOp(vm.OP_DUP, 0)
 	c.emitOp(vm.OP_SYSCALL, 54)
-	c.emitOp(vm.OP_POP_L, uint32(c.getLocalIndex(string(gen.Target.(*ast.Name).Id))))
+	c.emitStoreName(string(gen.Target.(*ast.Name).Id))
 	var ifs []int
 	for _, cond := range gen.Ifs {
 		if err := c.emitExpr(cond); err != nil {
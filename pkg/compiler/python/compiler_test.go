@@ -1,7 +1,12 @@
 package python
 
 import (
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
 )
 
 func TestCompilerComprehensive(t *testing.T) {
@@ -140,7 +145,10 @@ with scope("HTTP-ENV", "token"):
 			msg string
 		}{
 			{"x = y = 1", "only single assignment"},
-			{"global x", "unsupported statement type"},
+			{"nonlocal x", "not allowed at module level"},
+			{"raise", "no active exception"},
+			{"break", "outside loop"},
+			{"try:\n    x = 1\nexcept 1:\n    x = 2", "unsupported exception class"},
 		}
 		for _, tt := range badSrcs {
 			_, err := c.Compile(tt.src)
@@ -150,3 +158,223 @@ with scope("HTTP-ENV", "token"):
 		}
 	})
 }
+
+func TestCompilerDebugInfo(t *testing.T) {
+	src := "x = 1\ndef f(a):\n    return a + x\ny = f(2)\n"
+	bc, err := NewCompiler().CompileFile("prog.py", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := bc.Debug
+	if d == nil || d.File != "prog.py" || d.Source != src {
+		t.Fatalf("missing debug info: %+v", d)
+	}
+	entry := bc.Functions["f"]
+	if name := d.FuncName(entry); name != "f" {
+		t.Errorf("expected f at %d, got %s", entry, name)
+	}
+	if line, _ := d.Position(entry); line != 3 {
+		t.Errorf("expected the body of f on line 3, got %d", line)
+	}
+	last := len(bc.Instructions) - 1
+	if line, _ := d.Position(last); line != 4 || d.FuncName(last) != "<module>" {
+		t.Errorf("expected the end of the program on line 4 in <module>, got %d in %s", line, d.FuncName(last))
+	}
+	if got := d.SourceLine(3); got != "return a + x" {
+		t.Errorf("unexpected source line %q", got)
+	}
+	if got := d.LocalNames(entry); len(got) != 1 || got[0] != "a" {
+		t.Errorf("expected f's locals to be [a], got %v", got)
+	}
+	if got := d.Globals; !slices.Equal(got, []string{"x", "f", "y"}) || bc.Globals != 3 {
+		t.Errorf("expected the globals [x f y], got %v", got)
+	}
+	if got := d.LocalNames(last); got != nil {
+		t.Errorf("expected no locals at module level, got %v", got)
+	}
+}
+
+func TestCompilerNameResolution(t *testing.T) {
+	src := `
+URL = "http://example.com"
+def f(path):
+    return URL + path
+def g():
+    global hits
+    hits = 1
+def h():
+    URL = "shadowed"
+    return URL
+`
+	bc, err := NewCompiler().Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := map[uint8]int{}
+	for _, instr := range bc.Instructions {
+		ops[uint8(instr>>24)]++
+	}
+	// The module stores URL, f, g and h and f reads URL through the
+	// globals, and g stores hits; path and h's own URL are locals.
+	if ops[vm.OP_PUSH_G] != 1 || ops[vm.OP_POP_G] != 5 || ops[vm.OP_PUSH_L] != 2 {
+		t.Errorf("expected one PUSH_G, five POP_G and two PUSH_L, got %d, %d and %d", ops[vm.OP_PUSH_G], ops[vm.OP_POP_G], ops[vm.OP_PUSH_L])
+	}
+
+	bad := []struct{ src, msg string }{
+		{"x = y", "name 'y' is not defined"},
+		{"def f():\n    return missing\n", "name 'missing' is not defined"},
+		{"def f(a):\n    global a\n", "parameter and global"},
+		{"def f():\n    x = 1\n    global x\n", "prior to global declaration"},
+	}
+	for _, tt := range bad {
+		if _, err := NewCompiler().Compile(tt.src); err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected %q, got %v", tt.src, tt.msg, err)
+		}
+	}
+}
+
+func TestCompilerClosures(t *testing.T) {
+	src := `
+def outer(a):
+    b = 1
+    def inner(x):
+        def innermost():
+            return a + b + x
+        return innermost
+    return inner
+f = lambda y: y
+`
+	bc, err := NewCompiler().Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := map[uint8]int{}
+	for _, instr := range bc.Instructions {
+		ops[uint8(instr>>24)]++
+	}
+	// a and b become cells of outer and x of inner; inner closes over a and
+	// b, innermost over all three; the lambda closes over nothing.
+	if ops[vm.OP_MAKE_CELL] != 3 || ops[vm.OP_CLOSURE] != 2 || ops[vm.OP_LOAD_DEREF] != 3 {
+		t.Errorf("expected 3 MAKE_CELL, 2 CLOSURE and 3 LOAD_DEREF, got %d, %d and %d", ops[vm.OP_MAKE_CELL], ops[vm.OP_CLOSURE], ops[vm.OP_LOAD_DEREF])
+	}
+
+	bad := []struct{ src, msg string }{
+		{"def f():\n    nonlocal x\n", "no binding for nonlocal 'x'"},
+		{"def f(a):\n    def g(a):\n        nonlocal a\n", "parameter and nonlocal"},
+		{"def f():\n    x = 1\n    def g():\n        x = 2\n        nonlocal x\n", "prior to nonlocal declaration"},
+		{"def f(g):\n    return g(key=1)\n", "keyword arguments"},
+	}
+	for _, tt := range bad {
+		if _, err := NewCompiler().Compile(tt.src); err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected %q, got %v", tt.src, tt.msg, err)
+		}
+	}
+}
+
+func TestCompilerGenerators(t *testing.T) {
+	src := `
+def gen(n):
+    i = 0
+    while i < n:
+        yield i
+        i += 1
+    yield from range(n)
+def plain():
+    return lambda: 1
+`
+	bc, err := NewCompiler().Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := bc.Instructions[bc.Functions["gen"]]
+	// gen keeps n and i; plain is not a generator.
+	if uint8(entry>>24) != vm.OP_GEN || entry&0x00FFFFFF != 2 {
+		t.Errorf("expected gen to start with GEN 2, got %08x", entry)
+	}
+	if op := uint8(bc.Instructions[bc.Functions["plain"]] >> 24); op == vm.OP_GEN {
+		t.Errorf("plain compiled as a generator")
+	}
+	ops := map[uint8]int{}
+	for _, instr := range bc.Instructions {
+		ops[uint8(instr>>24)]++
+	}
+	if ops[vm.OP_YIELD] != 2 || ops[vm.OP_GEN] != 1 {
+		t.Errorf("expected 2 YIELD and 1 GEN, got %d and %d", ops[vm.OP_YIELD], ops[vm.OP_GEN])
+	}
+
+	bad := []struct{ src, msg string }{
+		{"yield 1\n", "'yield' outside function"},
+		{"def f():\n    def g():\n        return 1\n    yield g\nx = lambda: (yield)\n", "'yield' inside lambda"},
+		{"def f():\n    with scope(\"FS-ENV\", \"t\"):\n        yield 1\n", "'yield' inside 'with'"},
+	}
+	for _, tt := range bad {
+		if _, err := NewCompiler().Compile(tt.src); err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%q: expected %q, got %v", tt.src, tt.msg, err)
+		}
+	}
+}
+
+func TestCompilerShortCircuit(t *testing.T) {
+	src := `
+x = None
+a = x and x["k"] and x["j"]
+b = x or "default"
+c = "big" if a else "small"
+`
+	bc, err := NewCompiler().Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := map[uint8]int{}
+	for _, instr := range bc.Instructions {
+		ops[uint8(instr>>24)]++
+	}
+	// One jump per operand but the last; no operand is coerced to a bool.
+	if ops[vm.OP_JMP_FALSE_OR_POP] != 2 || ops[vm.OP_JMP_TRUE_OR_POP] != 1 || ops[vm.OP_AND]+ops[vm.OP_OR] != 0 {
+		t.Errorf("expected 2 JMP_FALSE_OR_POP and 1 JMP_TRUE_OR_POP, got %v", ops)
+	}
+}
+
+func TestCompilerChainedCompare(t *testing.T) {
+	src := `
+x = 5
+a = 0 <= x < 10 <= 20
+b = x is None
+c = not -x
+d = 2.0
+`
+	bc, err := NewCompiler().Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := map[uint8]int{}
+	for _, instr := range bc.Instructions {
+		ops[uint8(instr>>24)]++
+	}
+	// One jump per comparison but the last, and no 0 - x for negation.
+	if ops[vm.OP_JMP_FALSE_OR_POP] != 2 || ops[vm.OP_IS] != 1 || ops[vm.OP_EQ] != 0 || ops[vm.OP_NOT] != 1 || ops[vm.OP_NEG] != 1 || ops[vm.OP_SUB] != 0 {
+		t.Errorf("unexpected instructions: %v", ops)
+	}
+	var floats int
+	for _, v := range bc.Constants {
+		if v.Type == value.TypeFloat {
+			floats++
+		}
+	}
+	if floats != 1 {
+		t.Errorf("expected 2.0 to compile to a float constant, got %v", bc.Constants)
+	}
+}
+
+func TestCompilerMaxLocals(t *testing.T) {
+	src := "def f(a):\n    b = a\n    c = b\n    return c\n"
+	c := NewCompiler()
+	c.MaxLocals = 2
+	if _, err := c.Compile(src); err == nil || !strings.Contains(err.Error(), "f uses 3 local variables") {
+		t.Errorf("expected a locals error, got %v", err)
+	}
+	c.MaxLocals = 3
+	if _, err := c.Compile(src); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package value
 import (
 	"fmt"
 	"math"
+	"math/big"
 	"sort"
 	"strings"
 	"unsafe"
@@ -23,15 +24,152 @@ const (
 	TypeTuple
 	TypeSet
 	TypeIterator
+	TypeException
+	TypeFunction
+	TypeCell
+	TypeRange
 )
 
-// Value is a tagged union.
+// Value is a tagged union. An int that does not fit in int64 keeps its value
+// as a *big.Int in Opaque and its low 64 bits in Data.
 type Value struct {
 	Type   Type
 	Data   uint64 // Still uint64 bits, but interpreted based on Type
 	Opaque any    // For complex objects like maps
 }
 
+// IterKind says where an Iterator takes its items from.
+type IterKind uint8
+
+const (
+	IterList      IterKind = iota // the items of List from Index
+	IterRange                     // Index, Index+Step, ... up to Stop
+	IterMap                       // Fn applied to the items of Sources[0]
+	IterFilter                    // the items of Sources[0] for which Fn is true
+	IterZip                       // tuples of the items of Sources
+	IterEnumerate                 // (Index, item) for the items of Sources[0]
+	IterGenerator                 // the values yielded by Gen
+)
+
+var iterKindNames = [...]string{"list_iterator", "range_iterator", "map", "filter", "zip", "enumerate", "generator"}
+
+// String returns the Python type name of iterators of kind k.
+func (k IterKind) String() string {
+	if int(k) < len(iterKindNames) {
+		return iterKindNames[k]
+	}
+	return "iterator"
+}
+
+// Iterator is the state behind a TypeIterator value. A list iterator walks
+// List from Index; the other kinds compute each item when it is asked for,
+// so that they never hold more than the items in Ahead.
+type Iterator struct {
+	Kind  IterKind
+	List  *[]Value
+	Index int
+	// Stop and Step bound a range iterator.
+	Stop, Step int
+	// Fn is the function of a map or filter, or None for filter(None, ...).
+	Fn Value
+	// Sources are the iterators that a map, filter, zip or enumerate draws
+	// from.
+	Sources []*Iterator
+	// Gen is the suspended frame of a generator.
+	Gen *Generator
+	// Ahead holds items already taken from the iterator that are returned
+	// before any new ones, e.g. the item that has_next looked at.
+	Ahead []Value
+}
+
+// Generator is a suspended generator function: its locals, its part of the
+// operand stack, the try blocks open in it and the instruction to resume
+// at. IP is -1 once the function has returned. Entry is the first
+// instruction of the function, which names it in tracebacks and profiles.
+//
+// A generator is suspended at a yield, or wherever it ran out of gas, in
+// which case it may be inside functions it called, whose frames are kept
+// in Calls, and inside the scopes they opened.
+type Generator struct {
+	Entry    int
+	IP       int
+	Locals   []Value
+	Stack    []Value
+	Handlers []Handler
+	Calls    []Call
+	Scopes   []string
+	Running  bool
+}
+
+// Call is the frame of a function that a suspended generator was calling,
+// with its stack base relative to the generator's.
+type Call struct {
+	Entry, ReturnIP, BaseSP, ArgCount int
+	Locals                            []Value
+}
+
+// Handler is a try block open in a suspended generator: the start of its
+// except or finally code, the stack depth to unwind to, relative to the
+// generator's frame, the frame it belongs to, 0 for the generator's own and
+// i for Calls[i-1], and the number of Scopes open when it was entered.
+type Handler struct {
+	IP, SP, Frame, Scopes int
+}
+
+// Range is the value behind a TypeRange: the integers from Start up to, but
+// not including, Stop, Step apart. Step is never zero.
+type Range struct {
+	Start, Stop, Step int
+}
+
+// Len returns the number of integers in r.
+func (r *Range) Len() int {
+	switch {
+	case r.Step > 0 && r.Stop > r.Start:
+		return (r.Stop - r.Start + r.Step - 1) / r.Step
+	case r.Step < 0 && r.Stop < r.Start:
+		return (r.Start - r.Stop - r.Step - 1) / -r.Step
+	}
+	return 0
+}
+
+// At returns the ith integer of r.
+func (r *Range) At(i int) int {
+	return r.Start + i*r.Step
+}
+
+// Exception is the value behind a TypeException: a Python exception of
+// class Kind. Err is the error that raised it, if any, so that re-raising
+// the exception preserves its origin.
+type Exception struct {
+	Kind    string
+	Message string
+	Err     error
+}
+
+// Function is the value behind a TypeFunction: a function defined in the
+// program, entered at Entry with Arity arguments. Cells are the variables it
+// closes over, which the VM places in the locals after the arguments. Data
+// of a TypeFunction holds Entry as well, so that values of the same function
+// compare equal.
+type Function struct {
+	Name  string
+	Entry int
+	Arity int
+	Cells []*Cell
+}
+
+// Cell is the value behind a TypeCell: a variable shared between a function
+// and the closures defined in it.
+type Cell struct {
+	Value Value
+}
+
+// NewFunction returns a value for the function at entry.
+func NewFunction(name string, entry, arity int) Value {
+	return Value{Type: TypeFunction, Data: uint64(entry), Opaque: &Function{Name: name, Entry: entry, Arity: arity}}
+}
+
 // PackString encodes offset and length into the Data register.
 func PackString(offset, length uint32) uint64 {
 	return (uint64(offset) << 32) | uint64(length)
@@ -62,19 +200,49 @@ func UnpackString(data uint64, arena []byte) string {
 	return s
 }
 
-// Int returns the value as int64.
+// Int returns the value as int64. For a big int it is the low 64 bits.
 func (v Value) Int() int64 {
 	return int64(v.Data)
 }
 
-// Float returns the value as float64.
+// Float returns the value as float64. Big ints too large for a float64
+// become infinities.
 func (v Value) Float() float64 {
 	if v.Type == TypeFloat {
 		return math.Float64frombits(v.Data)
 	}
+	if b, ok := v.Opaque.(*big.Int); ok {
+		f, _ := new(big.Float).SetInt(b).Float64()
+		return f
+	}
 	return float64(int64(v.Data))
 }
 
+// IsBig reports whether v is an int that does not fit in int64.
+func (v Value) IsBig() bool {
+	_, ok := v.Opaque.(*big.Int)
+	return v.Type == TypeInt && ok
+}
+
+// BigInt returns the value of an int or bool as a new *big.Int.
+func (v Value) BigInt() *big.Int {
+	if b, ok := v.Opaque.(*big.Int); ok {
+		return new(big.Int).Set(b)
+	}
+	return big.NewInt(int64(v.Data))
+}
+
+// NewBigInt returns an int with the value of b, kept in Data if it fits in
+// int64. The result takes ownership of b.
+func NewBigInt(b *big.Int) Value {
+	if b.IsInt64() {
+		return Value{Type: TypeInt, Data: uint64(b.Int64())}
+	}
+	return Value{Type: TypeInt, Data: uint64(new(big.Int).And(b, maxUint64).Uint64()), Opaque: b}
+}
+
+var maxUint64 = new(big.Int).SetUint64(math.MaxUint64)
+
 // SetInt stores an int64.
 func (v *Value) SetInt(i int64) {
 	v.Type = TypeInt
@@ -94,6 +262,9 @@ func (v Value) formatRecursive(arena []byte, depth int) string {
 	case TypeString:
 		return UnpackString(v.Data, arena)
 	case TypeInt:
+		if b, ok := v.Opaque.(*big.Int); ok {
+			return b.String()
+		}
 		return strings.TrimSuffix(strings.TrimSuffix(fmt.Sprintf("%d", int64(v.Data)), ".0"), ".00")
 	case TypeFloat:
 		f := math.Float64frombits(v.Data)
@@ -146,6 +317,29 @@ func (v Value) formatRecursive(arena []byte, depth int) string {
 		return fmt.Sprintf("%v", v.Opaque)
 	case TypeVoid:
 		return "None"
+	case TypeException:
+		if e, ok := v.Opaque.(*Exception); ok {
+			return e.Message
+		}
+		return ""
+	case TypeFunction:
+		if f, ok := v.Opaque.(*Function); ok {
+			return "<function " + f.Name + ">"
+		}
+		return "<function>"
+	case TypeRange:
+		if r, ok := v.Opaque.(*Range); ok {
+			if r.Step != 1 {
+				return fmt.Sprintf("range(%d, %d, %d)", r.Start, r.Stop, r.Step)
+			}
+			return fmt.Sprintf("range(%d, %d)", r.Start, r.Stop)
+		}
+		return "range"
+	case TypeIterator:
+		if it, ok := v.Opaque.(*Iterator); ok {
+			return "<" + it.Kind.String() + " object>"
+		}
+		return "<iterator>"
 	default:
 		return fmt.Sprintf("%v", v.Data)
 	}
@@ -0,0 +1,520 @@
+package debug
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// The Debug Adapter Protocol exchanges JSON messages, each preceded by a
+// Content-Length header. Only the requests a single-threaded, single-file
+// program needs are supported.
+
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    *bool           `json:"success,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       any             `json:"body,omitempty"`
+}
+
+const threadID = 1
+
+// Server runs a program under the debugger and serves a DAP client.
+type Server struct {
+	m   *vm.Machine
+	gas int
+	dbg *Debugger
+
+	wmu sync.Mutex
+	w   io.Writer
+	seq int
+
+	launched, configured bool
+	cancel               context.CancelFunc
+	done                 chan struct{}
+
+	// refs holds the containers handed out as variablesReference while
+	// the program is stopped; reference n is refs[n-1].
+	refs []ref
+}
+
+type refKind int
+
+const (
+	refLocals refKind = iota
+	refGlobals
+	refStack
+	refVM
+	refValue
+)
+
+type ref struct {
+	kind  refKind
+	frame int // refLocals
+	ip    int
+	v     value.Value // refValue
+}
+
+// NewServer returns a server that will run the program loaded in m, which
+// must have debug information, with the given gas limit.
+func NewServer(m *vm.Machine, gas int) *Server {
+	s := &Server{m: m, gas: gas, dbg: New(m.Debug), done: make(chan struct{})}
+	s.dbg.OnStop = func(reason string) {
+		s.event("stopped", map[string]any{"reason": reason, "threadId": threadID, "allThreadsStopped": true})
+	}
+	m.Tracer = s.dbg
+	return s
+}
+
+// Output returns a writer that forwards the program's output to the client.
+func (s *Server) Output() io.Writer {
+	return outputWriter{s}
+}
+
+type outputWriter struct{ s *Server }
+
+func (o outputWriter) Write(p []byte) (int, error) {
+	o.s.event("output", map[string]any{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+// Serve reads requests from r and writes responses and events to w until
+// the client disconnects or r ends. The program is stopped if it still
+// runs.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.w = w
+	defer s.stop()
+	tp := textproto.NewReader(bufio.NewReader(r))
+	for {
+		req, err := readMessage(tp)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := s.handle(req)
+		s.respond(req, body, err)
+		switch req.Command {
+		case "initialize":
+			s.event("initialized", nil)
+		case "launch", "configurationDone":
+			s.start()
+		case "continue":
+			s.resume(s.dbg.Continue)
+		case "next":
+			s.resume(s.dbg.Next)
+		case "stepIn":
+			s.resume(s.dbg.StepIn)
+		case "stepOut":
+			s.resume(s.dbg.StepOut)
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+}
+
+func readMessage(tp *textproto.Reader) (*message, error) {
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(header) == 0 {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("dap: bad Content-Length %q", header.Get("Content-Length"))
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(tp.R, buf); err != nil {
+		return nil, err
+	}
+	msg := new(message)
+	if err := json.Unmarshal(buf, msg); err != nil {
+		return nil, fmt.Errorf("dap: %w", err)
+	}
+	return msg, nil
+}
+
+func (s *Server) send(msg *message) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	msg.Seq = s.seq
+	data, err := json.Marshal(msg)
+	if err != nil {
+		data, _ = json.Marshal(&message{Seq: msg.Seq, Type: "event", Event: "output", Body: map[string]any{"category": "stderr", "output": err.Error()}})
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (s *Server) respond(req *message, body any, err error) {
+	ok := err == nil
+	msg := &message{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: &ok, Body: body}
+	if err != nil {
+		msg.Message = err.Error()
+	}
+	s.send(msg)
+}
+
+func (s *Server) event(name string, body any) {
+	s.send(&message{Type: "event", Event: name, Body: body})
+}
+
+// handle answers a request. Requests that resume the program are answered
+// before it resumes, so that the response precedes the next stopped event.
+func (s *Server) handle(req *message) (any, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		var args struct {
+			StopOnEntry bool `json:"stopOnEntry"`
+		}
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		if args.StopOnEntry {
+			s.dbg.StopOnEntry()
+		}
+		s.launched = true
+		return nil, nil
+	case "configurationDone":
+		s.configured = true
+		return nil, nil
+	case "setBreakpoints":
+		var args struct {
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		lines := make([]int, len(args.Breakpoints))
+		for i, b := range args.Breakpoints {
+			lines[i] = b.Line
+		}
+		bps := []map[string]any{}
+		for _, line := range s.dbg.SetBreakpoints(lines) {
+			if line == 0 {
+				bps = append(bps, map[string]any{"verified": false, "message": "no code on or after this line"})
+			} else {
+				bps = append(bps, map[string]any{"verified": true, "line": line})
+			}
+		}
+		return map[string]any{"breakpoints": bps}, nil
+	case "setExceptionBreakpoints":
+		return map[string]any{"breakpoints": []any{}}, nil
+	case "threads":
+		return map[string]any{"threads": []any{map[string]any{"id": threadID, "name": "main"}}}, nil
+	case "continue":
+		return map[string]any{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut":
+		return nil, nil
+	case "pause":
+		s.dbg.Pause()
+		return nil, nil
+	case "disconnect", "terminate":
+		return nil, nil
+	case "stackTrace":
+		return s.stackTrace()
+	case "scopes":
+		var args struct {
+			FrameID int `json:"frameId"`
+		}
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.scopes(args.FrameID)
+	case "variables":
+		var args struct {
+			Ref int `json:"variablesReference"`
+		}
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.variables(args.Ref)
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+			FrameID    int    `json:"frameId"`
+		}
+		if err := unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.evaluate(strings.TrimSpace(args.Expression), args.FrameID)
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+func unmarshal(data json.RawMessage, v any) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// start runs the program once it is launched and configured.
+func (s *Server) start() {
+	if !s.launched || !s.configured || s.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		defer close(s.done)
+		exitCode := 0
+		if err := s.m.RunContext(ctx, s.gas); err != nil {
+			exitCode = 1
+			s.event("output", map[string]any{"category": "stderr", "output": err.Error() + "\n"})
+		}
+		s.event("exited", map[string]any{"exitCode": exitCode})
+		s.event("terminated", nil)
+	}()
+}
+
+// stop ends the program, if it runs, and waits for it.
+func (s *Server) stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.dbg.Detach()
+	<-s.done
+}
+
+func (s *Server) resume(proceed func()) {
+	s.refs = s.refs[:0]
+	proceed()
+}
+
+var errRunning = errors.New("the program is not stopped")
+
+func (s *Server) stackTrace() (any, error) {
+	if !s.dbg.Stopped() {
+		return nil, errRunning
+	}
+	d := s.m.Debug
+	source := map[string]any{"name": filepath.Base(d.File), "path": d.File}
+	calls := s.m.CallStack()
+	frames := make([]any, 0, len(calls))
+	for i := len(calls) - 1; i >= 0; i-- {
+		c := calls[i]
+		frames = append(frames, map[string]any{
+			"id": c.Frame + 1, "name": c.Func, "line": c.Line, "column": c.Col, "source": source,
+		})
+	}
+	return map[string]any{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+// frameIP returns the instruction frame id (a frame index plus one) is at.
+func (s *Server) frameIP(id int) (int, error) {
+	for _, c := range s.m.CallStack() {
+		if c.Frame == id-1 {
+			return c.IP, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown frame %d", id)
+}
+
+func (s *Server) scopes(id int) (any, error) {
+	if !s.dbg.Stopped() {
+		return nil, errRunning
+	}
+	ip, err := s.frameIP(id)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []any
+	if id > 1 {
+		scopes = append(scopes, map[string]any{"name": "Locals", "presentationHint": "locals", "variablesReference": s.ref(ref{kind: refLocals, frame: id - 1, ip: ip})})
+	}
+	scopes = append(scopes,
+		map[string]any{"name": "Globals", "variablesReference": s.ref(ref{kind: refGlobals})},
+		map[string]any{"name": "VM", "variablesReference": s.ref(ref{kind: refVM})},
+	)
+	return map[string]any{"scopes": scopes}, nil
+}
+
+func (s *Server) ref(r ref) int {
+	s.refs = append(s.refs, r)
+	return len(s.refs)
+}
+
+func (s *Server) variables(n int) (any, error) {
+	if !s.dbg.Stopped() {
+		return nil, errRunning
+	}
+	if n < 1 || n > len(s.refs) {
+		return nil, fmt.Errorf("unknown variables reference %d", n)
+	}
+	m := s.m
+	var vars []any
+	add := func(name string, v value.Value) {
+		vars = append(vars, s.variable(name, v))
+	}
+	switch r := s.refs[n-1]; r.kind {
+	case refLocals:
+		names := m.Debug.LocalNames(r.ip)
+		for i, name := range names {
+			if name != "" {
+				add(name, m.Frames[r.frame].Locals[i])
+			}
+		}
+	case refGlobals:
+		globals := m.Globals()
+		for i, name := range m.Debug.Globals {
+			if name != "" && i < len(globals) {
+				add(name, globals[i])
+			}
+		}
+	case refStack:
+		for i := m.SP - 1; i >= 0; i-- {
+			add(strconv.Itoa(m.SP-1-i), m.Stack[i])
+		}
+	case refVM:
+		vars = append(vars,
+			map[string]any{"name": "stack", "value": fmt.Sprintf("%d values", m.SP), "variablesReference": s.ref(ref{kind: refStack})},
+			map[string]any{"name": "scopes", "value": formatScopes(m.ScopeStack), "variablesReference": 0},
+			map[string]any{"name": "ip", "value": strconv.Itoa(m.IP), "variablesReference": 0},
+			map[string]any{"name": "gas", "value": strconv.Itoa(m.GasRemaining()), "variablesReference": 0},
+		)
+	case refValue:
+		for _, c := range children(r.v) {
+			add(c.name, c.v)
+		}
+	}
+	if vars == nil {
+		vars = []any{}
+	}
+	return map[string]any{"variables": vars}, nil
+}
+
+func (s *Server) variable(name string, v value.Value) map[string]any {
+	return map[string]any{"name": name, "value": display(v, s.m.Arena), "type": vm.TypeName(v), "variablesReference": s.valueRef(v)}
+}
+
+// valueRef returns a reference to the elements of a container, or 0.
+func (s *Server) valueRef(v value.Value) int {
+	if len(children(v)) == 0 {
+		return 0
+	}
+	return s.ref(ref{kind: refValue, v: v})
+}
+
+// evaluate looks up a name in frame id and then among the globals. $stack
+// and $scopes evaluate to the operand stack, top first, and the active
+// scopes.
+func (s *Server) evaluate(expr string, id int) (any, error) {
+	if !s.dbg.Stopped() {
+		return nil, errRunning
+	}
+	m := s.m
+	switch expr {
+	case "$stack":
+		vals := make([]value.Value, m.SP)
+		for i := range vals {
+			vals[i] = m.Stack[m.SP-1-i]
+		}
+		list := value.Value{Type: value.TypeList, Opaque: &vals}
+		return map[string]any{"result": display(list, m.Arena), "variablesReference": s.ref(ref{kind: refStack})}, nil
+	case "$scopes":
+		return map[string]any{"result": formatScopes(m.ScopeStack), "variablesReference": 0}, nil
+	}
+	if id == 0 {
+		id = m.FP + 1
+	}
+	if ip, err := s.frameIP(id); err == nil && id > 1 {
+		for i, name := range m.Debug.LocalNames(ip) {
+			if name == expr {
+				return s.result(m.Frames[id-1].Locals[i]), nil
+			}
+		}
+	}
+	globals := m.Globals()
+	for i, name := range m.Debug.Globals {
+		if name == expr && i < len(globals) {
+			return s.result(globals[i]), nil
+		}
+	}
+	return nil, fmt.Errorf("name '%s' is not defined", expr)
+}
+
+func (s *Server) result(v value.Value) map[string]any {
+	return map[string]any{"result": display(v, s.m.Arena), "type": vm.TypeName(v), "variablesReference": s.valueRef(v)}
+}
+
+type child struct {
+	name string
+	v    value.Value
+}
+
+// children lists the elements of a list, tuple or dict.
+func children(v value.Value) []child {
+	var cs []child
+	switch o := v.Opaque.(type) {
+	case *[]value.Value:
+		for i, el := range *o {
+			cs = append(cs, child{strconv.Itoa(i), el})
+		}
+	case []value.Value:
+		if v.Type == value.TypeTuple {
+			for i, el := range o {
+				cs = append(cs, child{strconv.Itoa(i), el})
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(o))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch el := o[k].(type) {
+			case value.Value:
+				cs = append(cs, child{strconv.Quote(k), el})
+			case *[]value.Value:
+				cs = append(cs, child{strconv.Quote(k), value.Value{Type: value.TypeList, Opaque: el}})
+			}
+		}
+	}
+	return cs
+}
+
+// display renders v as the debugger shows it: strings are quoted.
+func display(v value.Value, arena []byte) string {
+	if v.Type == value.TypeString {
+		return strconv.Quote(v.Format(arena))
+	}
+	return v.Format(arena)
+}
+
+func formatScopes(scopes []string) string {
+	return "[" + strings.Join(scopes, ", ") + "]"
+}
@@ -0,0 +1,252 @@
+package debug_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/agenthands/npython/pkg/compiler/python"
+	"github.com/agenthands/npython/pkg/debug"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+const script = `def add(a, b):
+    c = a + b
+    return c
+
+x = 1
+
+y = add(x, 2)
+z = y * 10
+`
+
+// client is a scripted DAP client.
+type client struct {
+	t    *testing.T
+	w    io.Writer
+	seq  int
+	msgs chan map[string]any
+}
+
+func newClient(t *testing.T, r io.Reader, w io.Writer) *client {
+	c := &client{t: t, w: w, msgs: make(chan map[string]any, 100)}
+	go func() {
+		tp := textproto.NewReader(bufio.NewReader(r))
+		for {
+			h, err := tp.ReadMIMEHeader()
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			n, _ := strconv.Atoi(h.Get("Content-Length"))
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(tp.R, buf); err != nil {
+				close(c.msgs)
+				return
+			}
+			var msg map[string]any
+			json.Unmarshal(buf, &msg)
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+// request sends a request and returns the body of its response.
+func (c *client) request(command string, args any) map[string]any {
+	c.t.Helper()
+	c.seq++
+	data, _ := json.Marshal(map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	msg := c.next("response")
+	if msg["command"] != command || msg["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, msg)
+	}
+	body, _ := msg["body"].(map[string]any)
+	return body
+}
+
+// next returns the next response or the next event named kind.
+func (c *client) next(kind string) map[string]any {
+	c.t.Helper()
+	for {
+		select {
+		case msg, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %s", kind)
+			}
+			if msg["type"] == kind || msg["event"] == kind {
+				return msg
+			}
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("timed out waiting for %s", kind)
+		}
+	}
+}
+
+// stopped waits for the program to stop and returns the reason and the
+// innermost frame.
+func (c *client) stopped() (string, map[string]any) {
+	c.t.Helper()
+	reason := c.next("stopped")["body"].(map[string]any)["reason"].(string)
+	frames := c.request("stackTrace", map[string]any{"threadId": 1})["stackFrames"].([]any)
+	return reason, frames[0].(map[string]any)
+}
+
+func (c *client) evaluate(expr string, frame any) string {
+	c.t.Helper()
+	return c.request("evaluate", map[string]any{"expression": expr, "frameId": frame})["result"].(string)
+}
+
+// session compiles src as dbg.py and serves a debugger for it to a new
+// client. The channel receives the result of Serve.
+func session(t *testing.T, src string) (*client, *vm.Machine, *vm.Bytecode, chan error) {
+	t.Helper()
+	bc, err := python.NewCompiler().CompileFile("dbg.py", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := vm.NewMachine(vm.DefaultLimits)
+	m.Load(bc)
+
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	s := debug.NewServer(m, 10000)
+	served := make(chan error)
+	go func() { served <- s.Serve(toServer, fromServer) }()
+	return newClient(t, toClient, fromClient), m, bc, served
+}
+
+func TestDAP(t *testing.T) {
+	c, m, bc, served := session(t, script)
+	c.request("initialize", map[string]any{"adapterID": "npython"})
+	c.next("initialized")
+	c.request("launch", map[string]any{"stopOnEntry": true})
+	bps := c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": "dbg.py"},
+		"breakpoints": []any{map[string]any{"line": 2}, map[string]any{"line": 6}, map[string]any{"line": 50}},
+	})["breakpoints"].([]any)
+	if got := fmt.Sprint(bps); got != "[map[line:2 verified:true] map[line:7 verified:true] map[message:no code on or after this line verified:false]]" {
+		t.Errorf("breakpoints %s", got)
+	}
+	c.request("configurationDone", nil)
+
+	if reason, f := c.stopped(); reason != "entry" || f["line"] != 1.0 {
+		t.Fatalf("stopped for %s at %v", reason, f)
+	}
+	c.request("continue", map[string]any{"threadId": 1})
+	if reason, f := c.stopped(); reason != "breakpoint" || f["line"] != 7.0 {
+		t.Fatalf("stopped for %s at %v", reason, f)
+	}
+	c.request("stepIn", map[string]any{"threadId": 1})
+	reason, f := c.stopped()
+	if reason != "step" || f["line"] != 2.0 || f["name"] != "add" {
+		t.Fatalf("stepped in to %s at %v", reason, f)
+	}
+
+	// Locals by name, and globals from inside a function.
+	scopes := c.request("scopes", map[string]any{"frameId": f["id"]})["scopes"].([]any)
+	locals := scopes[0].(map[string]any)
+	vars := c.request("variables", map[string]any{"variablesReference": locals["variablesReference"]})["variables"].([]any)
+	var got []string
+	for _, v := range vars {
+		v := v.(map[string]any)
+		got = append(got, fmt.Sprintf("%s=%s", v["name"], v["value"]))
+	}
+	if fmt.Sprint(got) != "[a=1 b=2 c=None]" {
+		t.Errorf("locals %v", got)
+	}
+	if v := c.evaluate("x", f["id"]); v != "1" {
+		t.Errorf("x = %s", v)
+	}
+
+	c.request("next", map[string]any{"threadId": 1})
+	if reason, f := c.stopped(); reason != "step" || f["line"] != 3.0 {
+		t.Fatalf("stepped over to %s at %v", reason, f)
+	}
+	if v := c.evaluate("c", f["id"]); v != "3" {
+		t.Errorf("c = %s", v)
+	}
+	if v := c.evaluate("$stack", f["id"]); v != "[]" {
+		t.Errorf("$stack = %s", v)
+	}
+	c.request("stepOut", map[string]any{"threadId": 1})
+	if reason, f = c.stopped(); reason != "step" || f["line"] != 7.0 || f["name"] != "<module>" {
+		t.Fatalf("stepped out to %s at %v", reason, f)
+	}
+	c.request("next", map[string]any{"threadId": 1})
+	if reason, f = c.stopped(); reason != "step" || f["line"] != 8.0 {
+		t.Fatalf("stepped over to %s at %v", reason, f)
+	}
+	if v := c.evaluate("y", f["id"]); v != "3" {
+		t.Errorf("y = %s", v)
+	}
+	c.request("next", map[string]any{"threadId": 1})
+	c.next("terminated")
+	c.request("disconnect", nil)
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range bc.Debug.Globals {
+		if v := m.Globals()[i].Format(m.Arena); name == "z" && v != "30" {
+			t.Errorf("z = %s", v)
+		}
+	}
+}
+
+func TestDAPStepOut(t *testing.T) {
+	const src = `def inner(n):
+    return n * 2
+
+def outer(n):
+    r = inner(n) + 1
+    return r
+
+v = outer(4)
+w = v
+`
+	c, _, _, served := session(t, src)
+	c.request("initialize", map[string]any{"adapterID": "npython"})
+	c.next("initialized")
+	c.request("launch", map[string]any{})
+	c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": "dbg.py"},
+		"breakpoints": []any{map[string]any{"line": 2}},
+	})
+	c.request("configurationDone", nil)
+
+	if reason, f := c.stopped(); reason != "breakpoint" || f["line"] != 2.0 || f["name"] != "inner" {
+		t.Fatalf("stopped for %s at %v", reason, f)
+	}
+	// Out of inner, the rest of line 5 is still to run.
+	c.request("stepOut", map[string]any{"threadId": 1})
+	reason, f := c.stopped()
+	if reason != "step" || f["line"] != 5.0 || f["name"] != "outer" {
+		t.Fatalf("stepped out to %s at %v", reason, f)
+	}
+	if v := c.evaluate("r", f["id"]); v != "None" {
+		t.Errorf("r = %s", v)
+	}
+	c.request("stepOut", map[string]any{"threadId": 1})
+	if reason, f = c.stopped(); reason != "step" || f["line"] != 8.0 || f["name"] != "<module>" {
+		t.Fatalf("stepped out to %s at %v", reason, f)
+	}
+	c.request("next", map[string]any{"threadId": 1})
+	if reason, f = c.stopped(); reason != "step" || f["line"] != 9.0 {
+		t.Fatalf("stepped over to %s at %v", reason, f)
+	}
+	if v := c.evaluate("v", f["id"]); v != "9" {
+		t.Errorf("v = %s", v)
+	}
+	c.request("continue", map[string]any{"threadId": 1})
+	c.next("terminated")
+	c.request("disconnect", nil)
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,210 @@
+// Package debug implements an interactive debugger for the VM and serves it
+// over the Debug Adapter Protocol.
+package debug
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// Stop reasons, as reported in DAP stopped events.
+const (
+	ReasonEntry      = "entry"
+	ReasonBreakpoint = "breakpoint"
+	ReasonStep       = "step"
+	ReasonPause      = "pause"
+)
+
+type stepKind int
+
+const (
+	run      stepKind = iota
+	stepIn            // stop at the next line
+	stepOver          // ... that is not in a deeper call
+	stepOut           // ... that is in a caller
+)
+
+// Debugger is a vm.Tracer that stops the program at breakpoints and after
+// steps. It works on source lines, so the machine must have debug
+// information. While the program is stopped the goroutine running it is
+// blocked in the tracer, and the machine may be inspected from another
+// goroutine until the program is resumed.
+type Debugger struct {
+	vm.NopTracer
+
+	// OnStop is called, on the goroutine running the program, when it
+	// stops; the program stays stopped until Continue or a step.
+	OnStop func(reason string)
+
+	debug *vm.DebugInfo
+	code  map[int]bool // lines with code
+
+	mu          sync.Mutex
+	breakpoints map[int]bool
+	step        stepKind
+	depth       int // frame the step started in
+	pausing     bool
+	stopped     bool
+	detached    bool
+	resume      chan struct{}
+
+	// lines holds the line last executed in each frame, so that a line is
+	// entered again only after another line of its frame ran.
+	lines []int
+}
+
+// New returns a debugger for code compiled with debug information d.
+func New(d *vm.DebugInfo) *Debugger {
+	dbg := &Debugger{
+		debug:       d,
+		code:        make(map[int]bool),
+		breakpoints: make(map[int]bool),
+		depth:       -1,
+		resume:      make(chan struct{}),
+	}
+	for _, l := range d.Lines {
+		dbg.code[l.Line] = true
+	}
+	return dbg
+}
+
+// StopOnEntry makes the program stop before its first line. It must be
+// called before the program starts.
+func (d *Debugger) StopOnEntry() {
+	d.mu.Lock()
+	d.step = stepIn
+	d.mu.Unlock()
+}
+
+// SetBreakpoints replaces the breakpoints with the given lines. A line
+// without code moves to the next line that has some; the result holds the
+// line each breakpoint was placed on, or 0 if there is none.
+func (d *Debugger) SetBreakpoints(lines []int) []int {
+	var code []int
+	for l := range d.code {
+		code = append(code, l)
+	}
+	sort.Ints(code)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.breakpoints)
+	placed := make([]int, len(lines))
+	for i, l := range lines {
+		if j := sort.SearchInts(code, l); j < len(code) {
+			placed[i] = code[j]
+			d.breakpoints[code[j]] = true
+		}
+	}
+	return placed
+}
+
+// Continue resumes the program until the next breakpoint.
+func (d *Debugger) Continue() { d.proceed(run) }
+
+// StepIn resumes the program until the next line, entering calls.
+func (d *Debugger) StepIn() { d.proceed(stepIn) }
+
+// Next resumes the program until the next line of the current function or
+// of a caller.
+func (d *Debugger) Next() { d.proceed(stepOver) }
+
+// StepOut resumes the program until it is back in a caller.
+func (d *Debugger) StepOut() { d.proceed(stepOut) }
+
+// Pause stops the running program at the next line.
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	d.pausing = true
+	d.mu.Unlock()
+}
+
+// Detach removes all breakpoints and lets the program run to the end
+// without stopping again.
+func (d *Debugger) Detach() {
+	d.mu.Lock()
+	d.detached = true
+	d.mu.Unlock()
+	d.proceed(run)
+}
+
+// Stopped reports whether the program is stopped.
+func (d *Debugger) Stopped() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stopped
+}
+
+func (d *Debugger) proceed(k stepKind) {
+	d.mu.Lock()
+	if !d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.step = k
+	d.stopped = false
+	d.mu.Unlock()
+	d.resume <- struct{}{}
+}
+
+// Instruction stops the program when it enters a line it should stop at.
+func (d *Debugger) Instruction(m *vm.Machine, ip int, op uint8, arg int) {
+	line, _ := d.debug.Position(ip)
+	if line == 0 {
+		return
+	}
+	for len(d.lines) <= m.FP {
+		d.lines = append(d.lines, 0)
+	}
+	entered := d.lines[m.FP] != line
+	d.lines[m.FP] = line
+
+	d.mu.Lock()
+	var reason string
+	if d.detached {
+		// run on
+	} else if d.pausing {
+		reason = ReasonPause
+	} else if entered || d.step == stepOut && m.FP < d.depth {
+		// Stepping out stops as soon as the caller resumes, on the rest
+		// of the line that made the call.
+		reason = d.reason(line, m.FP)
+	}
+	if reason == "" {
+		d.mu.Unlock()
+		return
+	}
+	d.stopped, d.pausing, d.depth = true, false, m.FP
+	d.mu.Unlock()
+	if d.OnStop != nil {
+		d.OnStop(reason)
+	}
+	<-d.resume
+}
+
+// reason returns why the program should stop on entering line in frame fp,
+// or "" if it should not.
+func (d *Debugger) reason(line, fp int) string {
+	switch {
+	case d.step == stepIn,
+		d.step == stepOver && fp <= d.depth,
+		d.step == stepOut && fp < d.depth:
+		if d.depth < 0 {
+			return ReasonEntry
+		}
+		return ReasonStep
+	case d.breakpoints[line]:
+		return ReasonBreakpoint
+	}
+	return ""
+}
+
+// Call starts the new frame without a current line.
+func (d *Debugger) Call(m *vm.Machine, entry, depth int) {
+	for len(d.lines) <= depth {
+		d.lines = append(d.lines, 0)
+	}
+	d.lines[depth] = 0
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -12,6 +14,11 @@ import (
 	"github.com/agenthands/npython/pkg/vm"
 )
 
+// gasForBytes is the gas charged for moving n bytes into or out of the VM.
+func gasForBytes(n int) int {
+	return (n + 1023) / 1024
+}
+
 func pushString(m *vm.Machine, s string) error {
 	offset, err := m.WriteArena([]byte(s))
 	if err != nil {
@@ -26,24 +33,27 @@ func DivMod(m *vm.Machine) error {
 	bVal := m.Pop()
 	aVal := m.Pop()
 	if bVal.Type != value.TypeInt || aVal.Type != value.TypeInt {
-		return errors.New("TypeError: unsupported operand type(s) for divmod()")
+		return vm.NewError("TypeError", "unsupported operand type(s) for divmod()")
+	}
+	if !vm.IsTruthy(bVal) {
+		return vm.NewError("ZeroDivisionError", "integer division or modulo by zero")
+	}
+	q, err := vm.Arith(vm.OP_FLOOR_DIV, aVal, bVal)
+	if err != nil {
+		return err
 	}
-	b := bVal.Int()
-	a := aVal.Int()
-	if b == 0 {
-		return errors.New("ZeroDivisionError: integer division or modulo by zero")
+	r, err := vm.Arith(vm.OP_MOD, aVal, bVal)
+	if err != nil {
+		return err
 	}
-	m.Push(value.Value{Type: value.TypeTuple, Opaque: []value.Value{
-		{Type: value.TypeInt, Data: uint64(a / b)},
-		{Type: value.TypeInt, Data: uint64(a % b)},
-	}})
+	m.Push(value.Value{Type: value.TypeTuple, Opaque: []value.Value{q, r}})
 	return nil
 }
 
 func Round(m *vm.Machine) error {
 	nVal := m.Pop()
 	if nVal.Type != value.TypeInt {
-		return errors.New("TypeError: expected int for arg count")
+		return vm.NewError("TypeError", "expected int for arg count")
 	}
 	n := nVal.Int()
 
@@ -51,25 +61,28 @@ func Round(m *vm.Machine) error {
 	if n == 2 {
 		ndVal := m.Pop()
 		if ndVal.Type != value.TypeInt {
-			return errors.New("TypeError: ndigits must be an integer")
+			return vm.NewError("TypeError", "ndigits must be an integer")
 		}
 		ndigits = ndVal.Int()
 	} else if n != 1 {
-		return fmt.Errorf("TypeError: round() takes at most 2 arguments (%d given)", n)
+		return vm.NewError("TypeError", "round() takes at most 2 arguments (%d given)", n)
 	}
 
 	v := m.Pop()
 	var f float64
-	if v.Type == value.TypeInt {
-		f = float64(v.Int())
+	if v.Type == value.TypeInt && n == 1 {
+		m.Push(v)
+		return nil
+	} else if v.Type == value.TypeInt {
+		f = v.Float()
 	} else if v.Type == value.TypeFloat {
 		f = math.Float64frombits(v.Data)
 	} else {
-		return fmt.Errorf("TypeError: type %d doesn't define __round__ method", v.Type)
+		return vm.NewError("TypeError", "type %d doesn't define __round__ method", v.Type)
 	}
 
 	if n == 1 {
-		m.Push(value.Value{Type: value.TypeInt, Data: uint64(int64(math.Round(f)))})
+		return pushFloatInt(m, math.Round(f))
 	} else {
 		p := math.Pow(10, float64(ndigits))
 		res := math.Round(f*p) / p
@@ -83,58 +96,74 @@ func Float(m *vm.Machine) error {
 	var f float64
 	switch v.Type {
 	case value.TypeInt:
-		f = float64(v.Int())
+		f = v.Float()
+		if math.IsInf(f, 0) {
+			return vm.NewError("OverflowError", "int too large to convert to float")
+		}
+	case value.TypeBool:
+		f = float64(v.Data)
 	case value.TypeFloat:
 		f = math.Float64frombits(v.Data)
 	case value.TypeString:
+		s := value.UnpackString(v.Data, m.Arena)
 		var err error
-		f, err = strconv.ParseFloat(value.UnpackString(v.Data, m.Arena), 64)
-		if err != nil {
-			return err
+		// Out of range literals parse to an infinity, as in Python.
+		f, err = strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return vm.NewError("ValueError", "could not convert string to float: '%s'", s)
 		}
 	default:
-		return fmt.Errorf("TypeError: float() argument must be a string or a number, not '%v'", v.Type)
+		return vm.NewError("TypeError", "float() argument must be a string or a real number, not '%s'", vm.TypeName(v))
 	}
 	m.Push(value.Value{Type: value.TypeFloat, Data: math.Float64bits(f)})
 	return nil
 }
 
-func Bin(m *vm.Machine) error {
+func Bin(m *vm.Machine) error { return pushIntText(m, 2, "0b") }
+func Oct(m *vm.Machine) error { return pushIntText(m, 8, "0o") }
+func Hex(m *vm.Machine) error { return pushIntText(m, 16, "0x") }
+
+// pushIntText pushes an int in the given base, with the sign before the
+// prefix as Python writes it: hex(-255) is "-0xff".
+func pushIntText(m *vm.Machine, base int, prefix string) error {
 	v := m.Pop()
 	if v.Type != value.TypeInt {
-		return errors.New("TypeError: expected integer")
+		return vm.NewError("TypeError", "expected integer")
 	}
-	return pushString(m, "0b"+strconv.FormatInt(v.Int(), 2))
-}
-func Oct(m *vm.Machine) error {
-	v := m.Pop()
-	if v.Type != value.TypeInt {
-		return errors.New("TypeError: expected integer")
+	s := v.BigInt().Text(base)
+	if s[0] == '-' {
+		return pushString(m, "-"+prefix+s[1:])
 	}
-	return pushString(m, "0o"+strconv.FormatInt(v.Int(), 8))
+	return pushString(m, prefix+s)
 }
-func Hex(m *vm.Machine) error {
-	v := m.Pop()
-	if v.Type != value.TypeInt {
-		return errors.New("TypeError: expected integer")
-	}
-	return pushString(m, "0x"+strconv.FormatInt(v.Int(), 16))
+
+// pushFloatInt pushes the integral float f as an int.
+func pushFloatInt(m *vm.Machine, f float64) error {
+	switch {
+	case math.IsNaN(f):
+		return vm.NewError("ValueError", "cannot convert float NaN to integer")
+	case math.IsInf(f, 0):
+		return vm.NewError("OverflowError", "cannot convert float infinity to integer")
+	}
+	b, _ := big.NewFloat(f).Int(nil)
+	m.Push(value.NewBigInt(b))
+	return nil
 }
 func Chr(m *vm.Machine) error {
 	v := m.Pop()
 	if v.Type != value.TypeInt {
-		return errors.New("TypeError: expected integer")
+		return vm.NewError("TypeError", "expected integer")
 	}
 	return pushString(m, string(rune(v.Int())))
 }
 func Ord(m *vm.Machine) error {
 	v := m.Pop()
 	if v.Type != value.TypeString {
-		return errors.New("TypeError: expected string")
+		return vm.NewError("TypeError", "expected string")
 	}
 	s := value.UnpackString(v.Data, m.Arena)
 	if len(s) == 0 {
-		return errors.New("empty ord")
+		return vm.NewError("TypeError", "ord() expected a character, but string of length 0 found")
 	}
 	m.Push(value.Value{Type: value.TypeInt, Data: uint64(s[0])})
 	return nil
@@ -148,7 +177,7 @@ func Dict(m *vm.Machine) error {
 func MakeTuple(m *vm.Machine) error {
 	nVal := m.Pop()
 	if nVal.Type != value.TypeInt {
-		return errors.New("TypeError: tuple size must be integer")
+		return vm.NewError("TypeError", "tuple size must be integer")
 	}
 	n := int(nVal.Int())
 	l := make([]value.Value, n)
@@ -160,31 +189,27 @@ func MakeTuple(m *vm.Machine) error {
 }
 
 func Tuple(m *vm.Machine) error {
-	v := m.Pop()
-	var list []value.Value
-	if v.Type == value.TypeList {
-		list = *(v.Opaque.(*[]value.Value))
-	} else if v.Type == value.TypeTuple {
-		list = v.Opaque.([]value.Value)
-	} else {
-		return errors.New("TypeError: not iterable")
+	list, err := items(m, m.Pop())
+	if err != nil {
+		return err
 	}
 	m.Push(value.Value{Type: value.TypeTuple, Opaque: list})
 	return nil
 }
 
 func Set(m *vm.Machine) error {
-	v := m.Pop()
-	var list []value.Value
-	if v.Type == value.TypeList {
-		list = *(v.Opaque.(*[]value.Value))
-	} else if v.Type == value.TypeTuple {
-		list = v.Opaque.([]value.Value)
-	} else {
-		return errors.New("TypeError: not iterable")
+	list, err := items(m, m.Pop())
+	if err != nil {
+		return err
 	}
 	s := make(map[any]struct{})
 	for _, x := range list {
+		// Strings are keyed by content: their offsets change when the
+		// arena is compacted.
+		if x.Type == value.TypeString {
+			s[strings.Clone(value.UnpackString(x.Data, m.Arena))] = struct{}{}
+			continue
+		}
 		s[x.Data] = struct{}{}
 	}
 	m.Push(value.Value{Type: value.TypeSet, Opaque: s})
@@ -192,11 +217,13 @@ func Set(m *vm.Machine) error {
 }
 
 func Reversed(m *vm.Machine) error {
-	v := m.Pop()
-	if v.Type != value.TypeList {
-		return errors.New("TypeError: not iterable")
+	l, err := items(m, m.Pop())
+	if err != nil {
+		return err
+	}
+	if err := m.ConsumeGas(len(l)); err != nil {
+		return err
 	}
-	l := *(v.Opaque.(*[]value.Value))
 	res := make([]value.Value, len(l))
 	for i, j := 0, len(l)-1; i < len(l); i, j = i+1, j-1 {
 		res[i] = l[j]
@@ -208,39 +235,122 @@ func Reversed(m *vm.Machine) error {
 }
 
 func Sorted(m *vm.Machine) error {
-	v := m.Pop()
-	if v.Type != value.TypeList {
-		return errors.New("TypeError: not iterable")
+	l, err := items(m, m.Pop())
+	if err != nil {
+		return err
+	}
+	if err := m.ConsumeGas(len(l)); err != nil {
+		return err
 	}
-	l := *(v.Opaque.(*[]value.Value))
 	res := make([]value.Value, len(l))
 	copy(res, l)
-	sort.Slice(res, func(i, j int) bool { return res[i].Data < res[j].Data })
+	var cmpErr error
+	sort.SliceStable(res, func(i, j int) bool {
+		lt, err := less(res[i], res[j], m.Arena)
+		if cmpErr == nil {
+			cmpErr = err
+		}
+		return lt
+	})
+	if cmpErr != nil {
+		return cmpErr
+	}
 	ptr := new([]value.Value)
 	*ptr = res
 	m.Push(value.Value{Type: value.TypeList, Opaque: ptr})
 	return nil
 }
 
+// SortedKey implements sorted(iterable, key=..., reverse=...). It pops the
+// list, the key function or None, and the reverse flag. The sort is stable,
+// as in Python, also when reversed.
+func SortedKey(m *vm.Machine) error {
+	reverse := vm.IsTruthy(m.Pop())
+	key := m.Pop()
+	l, err := items(m, m.Pop())
+	if err != nil {
+		return err
+	}
+	if err := m.ConsumeGas(len(l)); err != nil {
+		return err
+	}
+	keys := l
+	if key.Type != value.TypeVoid {
+		keys = make([]value.Value, len(l))
+		for i, x := range l {
+			k, err := m.CallValue(key, x)
+			if err != nil {
+				return err
+			}
+			keys[i] = k
+		}
+	}
+	order := make([]int, len(l))
+	for i := range order {
+		order[i] = i
+	}
+	var cmpErr error
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := keys[order[i]], keys[order[j]]
+		if reverse {
+			a, b = b, a
+		}
+		lt, err := less(a, b, m.Arena)
+		if cmpErr == nil {
+			cmpErr = err
+		}
+		return lt
+	})
+	if cmpErr != nil {
+		return cmpErr
+	}
+	res := make([]value.Value, len(l))
+	for i, idx := range order {
+		res[i] = l[idx]
+	}
+	m.Push(value.Value{Type: value.TypeList, Opaque: &res})
+	return nil
+}
+
+// less orders numbers by value, strings lexicographically and tuples
+// element by element, from the first elements that differ. It returns the
+// TypeError of Compare for values that cannot be ordered.
+func less(a, b value.Value, arena []byte) (bool, error) {
+	if a.Type != value.TypeTuple || b.Type != value.TypeTuple {
+		return vm.Compare(vm.OP_LT, a, b, arena)
+	}
+	at, bt := a.Opaque.([]value.Value), b.Opaque.([]value.Value)
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		x, y := at[i], bt[i]
+		if x.Type != value.TypeTuple || y.Type != value.TypeTuple {
+			if vm.Equal(x, y, arena) {
+				continue
+			}
+			return less(x, y, arena)
+		}
+		if lt, err := less(x, y, arena); lt || err != nil {
+			return lt, err
+		}
+		if gt, err := less(y, x, arena); gt || err != nil {
+			return false, err
+		}
+	}
+	return len(at) < len(bt), nil
+}
+
+// Zip: ( a b -- zip ) pairs the items of a and b as they are asked for.
 func Zip(m *vm.Machine) error {
 	v2 := m.Pop()
 	v1 := m.Pop()
-	if v1.Type != value.TypeList || v2.Type != value.TypeList {
-		return errors.New("TypeError: not iterable")
-	}
-	l2 := *(v2.Opaque.(*[]value.Value))
-	l1 := *(v1.Opaque.(*[]value.Value))
-	min := len(l1)
-	if len(l2) < min {
-		min = len(l2)
+	it1, err := iterator(m, v1)
+	if err != nil {
+		return err
 	}
-	res := make([]value.Value, min)
-	for i := 0; i < min; i++ {
-		res[i] = value.Value{Type: value.TypeTuple, Opaque: []value.Value{l1[i], l2[i]}}
+	it2, err := iterator(m, v2)
+	if err != nil {
+		return err
 	}
-	ptr := new([]value.Value)
-	*ptr = res
-	m.Push(value.Value{Type: value.TypeList, Opaque: ptr})
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{Kind: value.IterZip, Sources: []*value.Iterator{it1, it2}}})
 	return nil
 }
 
@@ -254,32 +364,50 @@ func Id(m *vm.Machine) error { return Hash(m) }
 
 func TypeWord(m *vm.Machine) error {
 	v := m.Pop()
-	names := map[value.Type]string{value.TypeInt: "int", value.TypeFloat: "float", value.TypeBool: "bool", value.TypeString: "str", value.TypeList: "list", value.TypeDict: "dict"}
+	if v.Type == value.TypeException {
+		return pushString(m, v.Opaque.(*value.Exception).Kind)
+	}
+	names := map[value.Type]string{value.TypeInt: "int", value.TypeFloat: "float", value.TypeBool: "bool", value.TypeString: "str", value.TypeList: "list", value.TypeDict: "dict", value.TypeFunction: "function", value.TypeRange: "range"}
 	return pushString(m, names[v.Type])
 }
 
 func Callable(m *vm.Machine) error {
-	name := value.UnpackString(m.Pop().Data, m.Arena)
 	res := uint64(0)
-	if _, ok := m.FunctionRegistry[name]; ok {
+	if m.Pop().Type == value.TypeFunction {
 		res = 1
 	}
 	m.Push(value.Value{Type: value.TypeBool, Data: res})
 	return nil
 }
 
-func Locals(m *vm.Machine) error {
+func Locals(m *vm.Machine) error { return pushFrameDict(m, &m.Frames[m.FP]) }
+
+// Globals returns the module globals by the names in the debug
+// information.
+func Globals(m *vm.Machine) error {
 	res := make(map[string]any)
-	for i, name := range m.Frames[m.FP].LocalNames {
-		if name != "" {
-			res[name] = m.Frames[m.FP].Locals[i]
+	if m.Debug != nil {
+		globals := m.Globals()
+		for i, name := range m.Debug.Globals {
+			if name != "" && i < len(globals) {
+				res[name] = globals[i]
+			}
 		}
 	}
 	m.Push(value.Value{Type: value.TypeDict, Opaque: res})
 	return nil
 }
 
-func Globals(m *vm.Machine) error { return Locals(m) }
+func pushFrameDict(m *vm.Machine, f *vm.Frame) error {
+	res := make(map[string]any)
+	for i, name := range f.LocalNames {
+		if name != "" {
+			res[name] = f.Locals[i]
+		}
+	}
+	m.Push(value.Value{Type: value.TypeDict, Opaque: res})
+	return nil
+}
 
 func SliceBuiltin(m *vm.Machine) error {
 	step := m.Pop()
@@ -313,19 +441,14 @@ func Bytes(m *vm.Machine) error {
 }
 func ByteArray(m *vm.Machine) error { return Bytes(m) }
 
+// Enumerate: ( v -- enumerate ) numbers the items of v as they are asked
+// for.
 func Enumerate(m *vm.Machine) error {
-	v := m.Pop()
-	if v.Type != value.TypeList {
-		return errors.New("TypeError: not iterable")
-	}
-	l := *(v.Opaque.(*[]value.Value))
-	res := make([]value.Value, len(l))
-	for i, v := range l {
-		res[i] = value.Value{Type: value.TypeTuple, Opaque: []value.Value{{Type: value.TypeInt, Data: uint64(i)}, v}}
+	src, err := iterator(m, m.Pop())
+	if err != nil {
+		return err
 	}
-	ptr := new([]value.Value)
-	*ptr = res
-	m.Push(value.Value{Type: value.TypeList, Opaque: ptr})
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{Kind: value.IterEnumerate, Sources: []*value.Iterator{src}}})
 	return nil
 }
 
@@ -341,93 +464,146 @@ func Len(m *vm.Machine) error {
 		ln = len(*(v.Opaque.(*[]value.Value)))
 	case value.TypeTuple:
 		ln = len(v.Opaque.([]value.Value))
+	case value.TypeRange:
+		ln = v.Opaque.(*value.Range).Len()
 	case value.TypeIterator:
-		ln = len(*(v.Opaque.(*iteratorState).listPtr))
+		// A lazy iterator has to be run to be counted; it keeps the items
+		// and becomes a list iterator over them.
+		it := v.Opaque.(*value.Iterator)
+		if it.Kind != value.IterList || len(it.Ahead) > 0 {
+			l, err := m.IterDrain(it)
+			if err != nil {
+				return err
+			}
+			*it = value.Iterator{List: &l}
+		}
+		ln = len(*it.List)
 	default:
-		return fmt.Errorf("TypeError: object of type %d has no len()", v.Type)
+		return vm.NewError("TypeError", "object of type %d has no len()", v.Type)
 	}
 	m.Push(value.Value{Type: value.TypeInt, Data: uint64(ln)})
 	return nil
 }
 
-type iteratorState struct {
-	listPtr *[]value.Value
-	index   int
-}
-
 func Iter(m *vm.Machine) error {
-	v := m.Pop()
-	var lp *[]value.Value
-	switch v.Type {
-	case value.TypeList:
-		lp = v.Opaque.(*[]value.Value)
-	case value.TypeTuple:
-		l := v.Opaque.([]value.Value)
-		lp = &l
-	case value.TypeDict:
-		d := v.Opaque.(map[string]any)
-		l := make([]value.Value, 0, len(d))
-		for k := range d {
-			pushString(m, k)
-			l = append(l, m.Pop())
-		}
-		lp = &l
-	default:
-		return fmt.Errorf("TypeError: '%v' object is not iterable", v.Type)
+	it, err := iterator(m, m.Pop())
+	if err != nil {
+		return err
 	}
-	m.Push(value.Value{Type: value.TypeIterator, Opaque: &iteratorState{listPtr: lp, index: 0}})
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: it})
 	return nil
 }
 
 func Next(m *vm.Machine) error {
 	v := m.Pop()
 	if v.Type != value.TypeIterator {
-		return fmt.Errorf("TypeError: '%v' object is not an iterator", v.Type)
+		return vm.NewError("TypeError", "'%s' object is not an iterator", vm.TypeName(v))
 	}
-	s := v.Opaque.(*iteratorState)
-	if s.index >= len(*s.listPtr) {
-		return errors.New("stop iteration")
+	x, ok, err := m.IterNext(v.Opaque.(*value.Iterator))
+	if err != nil {
+		return err
 	}
-	m.Push((*s.listPtr)[s.index])
-	s.index++
+	if !ok {
+		return vm.NewError("StopIteration", "")
+	}
+	m.Push(x)
 	return nil
 }
 
+// HasNext: ( it -- it bool ) leaves the iterator in place for next.
 func HasNext(m *vm.Machine) error {
-	s := m.Peek().Opaque.(*iteratorState)
+	ok, err := m.IterHasNext(m.Peek().Opaque.(*value.Iterator))
+	if err != nil {
+		return err
+	}
 	res := uint64(0)
-	if s.index < len(*s.listPtr) {
+	if ok {
 		res = 1
 	}
 	m.Push(value.Value{Type: value.TypeBool, Data: res})
 	return nil
 }
 
+// iterator returns an iterator over the items of v, or v itself if it is
+// an iterator already.
+func iterator(m *vm.Machine, v value.Value) (*value.Iterator, error) {
+	switch v.Type {
+	case value.TypeIterator:
+		return v.Opaque.(*value.Iterator), nil
+	case value.TypeList:
+		return &value.Iterator{List: v.Opaque.(*[]value.Value)}, nil
+	case value.TypeTuple:
+		l := v.Opaque.([]value.Value)
+		return &value.Iterator{List: &l}, nil
+	case value.TypeRange:
+		r := v.Opaque.(*value.Range)
+		return &value.Iterator{Kind: value.IterRange, Index: r.Start, Stop: r.Stop, Step: r.Step}, nil
+	case value.TypeDict:
+		d := v.Opaque.(map[string]any)
+		l := make([]value.Value, 0, len(d))
+		for k := range d {
+			if err := pushString(m, k); err != nil {
+				return nil, err
+			}
+			l = append(l, m.Pop())
+		}
+		return &value.Iterator{List: &l}, nil
+	}
+	return nil, vm.NewError("TypeError", "'%s' object is not iterable", vm.TypeName(v))
+}
+
+// items returns the items of v. A list or tuple returns its own slice,
+// which the caller must not modify; a range or a lazy iterator is run to
+// the end, for a unit of gas per item.
+func items(m *vm.Machine, v value.Value) ([]value.Value, error) {
+	switch v.Type {
+	case value.TypeList:
+		return *(v.Opaque.(*[]value.Value)), nil
+	case value.TypeTuple:
+		return v.Opaque.([]value.Value), nil
+	case value.TypeRange:
+		r := v.Opaque.(*value.Range)
+		if err := m.ConsumeGas(r.Len()); err != nil {
+			return nil, err
+		}
+		res := make([]value.Value, r.Len())
+		for i := range res {
+			res[i] = value.Value{Type: value.TypeInt, Data: uint64(r.At(i))}
+		}
+		return res, nil
+	}
+	it, err := iterator(m, v)
+	if err != nil {
+		return nil, err
+	}
+	return m.IterDrain(it)
+}
+
+// Range: ( [start] stop [step] n -- range ) returns the range itself; its
+// integers are computed only as they are iterated over.
 func Range(m *vm.Machine) error {
 	n := int(m.Pop().Int())
-	st, sp := 0, 0
-	if n == 1 {
-		spVal := m.Pop()
-		if spVal.Type != value.TypeInt {
-			return errors.New("TypeError")
-		}
-		sp = int(spVal.Int())
-	} else {
-		spVal := m.Pop()
-		stVal := m.Pop()
-		if spVal.Type != value.TypeInt || stVal.Type != value.TypeInt {
-			return errors.New("TypeError")
+	if n < 1 || n > 3 {
+		return vm.NewError("TypeError", "range expected 1 to 3 arguments, got %d", n)
+	}
+	var args [3]int
+	for i := n - 1; i >= 0; i-- {
+		a := m.Pop()
+		if a.Type != value.TypeInt || a.IsBig() {
+			return vm.NewError("TypeError", "range() integer arguments expected")
 		}
-		sp = int(spVal.Int())
-		st = int(stVal.Int())
+		args[i] = int(a.Int())
 	}
-	res := make([]value.Value, 0)
-	for i := st; i < sp; i++ {
-		res = append(res, value.Value{Type: value.TypeInt, Data: uint64(i)})
+	r := &value.Range{Stop: args[0], Step: 1}
+	if n > 1 {
+		r.Start, r.Stop = args[0], args[1]
 	}
-	ptr := new([]value.Value)
-	*ptr = res
-	m.Push(value.Value{Type: value.TypeList, Opaque: ptr})
+	if n == 3 {
+		if r.Step = args[2]; r.Step == 0 {
+			return vm.NewError("ValueError", "range() arg 3 must not be zero")
+		}
+	}
+	m.Push(value.Value{Type: value.TypeRange, Opaque: r})
 	return nil
 }
 
@@ -437,68 +613,55 @@ func List(m *vm.Machine) error {
 		m.Push(v)
 		return nil
 	}
-	if v.Type == value.TypeIterator {
-		s := v.Opaque.(*iteratorState)
-		res := make([]value.Value, 0)
-		for s.index < len(*s.listPtr) {
-			res = append(res, (*s.listPtr)[s.index])
-			s.index++
-		}
-		ptr := new([]value.Value)
-		*ptr = res
-		m.Push(value.Value{Type: value.TypeList, Opaque: ptr})
-		m.Push(value.Value{Type: value.TypeList, Opaque: ptr})
-		return nil
+	l, err := items(m, v)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("TypeError: '%v' object is not iterable", v.Type)
+	if v.Type == value.TypeTuple {
+		l = slices.Clone(l)
+	}
+	m.Push(value.Value{Type: value.TypeList, Opaque: &l})
+	return nil
 }
 
 func Sum(m *vm.Machine) error {
 	n := int(m.Pop().Int())
 	if n == 0 {
-		return errors.New("TypeError: sum() expected at least 1 argument, got 0")
+		return vm.NewError("TypeError", "sum() expected at least 1 argument, got 0")
 	}
 
-	var start int64 = 0
+	total := value.Value{Type: value.TypeInt}
 	if n == 2 {
-		start = m.Pop().Int()
+		total = m.Pop()
 	}
 
-	v := m.Pop()
-	var l []value.Value
-	if v.Type == value.TypeList {
-		l = *(v.Opaque.(*[]value.Value))
-	} else if v.Type == value.TypeIterator {
-		l = (*v.Opaque.(*iteratorState).listPtr)[v.Opaque.(*iteratorState).index:]
-	} else {
-		return fmt.Errorf("TypeError: '%v' object is not iterable", v.Type)
+	l, err := items(m, m.Pop())
+	if err != nil {
+		return err
 	}
 
-	var total int64 = start
 	for _, x := range l {
-		if x.Type == value.TypeInt {
-			total += int64(x.Data)
-		} else if x.Type == value.TypeFloat {
-			total += int64(math.Float64frombits(x.Data))
+		var err error
+		if total, err = vm.Arith(vm.OP_ADD, total, x); err != nil {
+			return err
 		}
 	}
-	m.Push(value.Value{Type: value.TypeInt, Data: uint64(total)})
+	m.Push(total)
 	return nil
 }
 
 func Max(m *vm.Machine) error {
 	n := int(m.Pop().Int())
 	if n == 0 {
-		return errors.New("TypeError: max() expected at least 1 argument, got 0")
+		return vm.NewError("TypeError", "max() expected at least 1 argument, got 0")
 	}
 
 	var l []value.Value
 	if n == 1 {
-		v := m.Pop()
-		if v.Type != value.TypeList {
-			return fmt.Errorf("TypeError: '%v' object is not iterable", v.Type)
+		var err error
+		if l, err = items(m, m.Pop()); err != nil {
+			return err
 		}
-		l = *(v.Opaque.(*[]value.Value))
 	} else {
 		l = make([]value.Value, n)
 		for i := n - 1; i >= 0; i-- {
@@ -507,11 +670,15 @@ func Max(m *vm.Machine) error {
 	}
 
 	if len(l) == 0 {
-		return errors.New("ValueError: max() arg is an empty sequence")
+		return vm.NewError("ValueError", "max() arg is an empty sequence")
 	}
 	mx := l[0]
-	for _, x := range l {
-		if x.Int() > mx.Int() {
+	for _, x := range l[1:] {
+		gt, err := vm.Compare(vm.OP_GT, x, mx, m.Arena)
+		if err != nil {
+			return err
+		}
+		if gt {
 			mx = x
 		}
 	}
@@ -522,16 +689,15 @@ func Max(m *vm.Machine) error {
 func Min(m *vm.Machine) error {
 	n := int(m.Pop().Int())
 	if n == 0 {
-		return errors.New("TypeError: min() expected at least 1 argument, got 0")
+		return vm.NewError("TypeError", "min() expected at least 1 argument, got 0")
 	}
 
 	var l []value.Value
 	if n == 1 {
-		v := m.Pop()
-		if v.Type != value.TypeList {
-			return fmt.Errorf("TypeError: '%v' object is not iterable", v.Type)
+		var err error
+		if l, err = items(m, m.Pop()); err != nil {
+			return err
 		}
-		l = *(v.Opaque.(*[]value.Value))
 	} else {
 		l = make([]value.Value, n)
 		for i := n - 1; i >= 0; i-- {
@@ -540,11 +706,15 @@ func Min(m *vm.Machine) error {
 	}
 
 	if len(l) == 0 {
-		return errors.New("ValueError: min() arg is an empty sequence")
+		return vm.NewError("ValueError", "min() arg is an empty sequence")
 	}
 	mn := l[0]
-	for _, x := range l {
-		if x.Int() < mn.Int() {
+	for _, x := range l[1:] {
+		lt, err := vm.Compare(vm.OP_LT, x, mn, m.Arena)
+		if err != nil {
+			return err
+		}
+		if lt {
 			mn = x
 		}
 	}
@@ -552,49 +722,45 @@ func Min(m *vm.Machine) error {
 	return nil
 }
 
+// Map: ( fn v -- map ) calls fn on each item of v when it is asked for.
 func Map(m *vm.Machine) error {
 	v := m.Pop()
-	if v.Type != value.TypeList {
-		return fmt.Errorf("TypeError: '%v' object is not iterable", v.Type)
-	}
-	l := *(v.Opaque.(*[]value.Value))
-	name := value.UnpackString(m.Pop().Data, m.Arena)
-	ip, exists := m.FunctionRegistry[name]
-	if !exists {
-		return fmt.Errorf("NameError: name '%s' is not defined", name)
+	fn := m.Pop()
+	if fn.Type != value.TypeFunction {
+		return vm.NewError("TypeError", "'%s' object is not callable", vm.TypeName(fn))
 	}
-	res := make([]value.Value, len(l))
-	for i, x := range l {
-		res[i], _ = m.Call(ip, x)
+	src, err := iterator(m, v)
+	if err != nil {
+		return err
 	}
-	m.Push(value.Value{Type: value.TypeIterator, Opaque: &iteratorState{listPtr: &res, index: 0}})
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{Kind: value.IterMap, Fn: fn, Sources: []*value.Iterator{src}}})
 	return nil
 }
 
+// Filter: ( fn v -- filter ) yields the items of v for which fn is true,
+// or, as filter(None, v), the truthy ones.
 func Filter(m *vm.Machine) error {
 	v := m.Pop()
-	if v.Type != value.TypeList {
-		return fmt.Errorf("TypeError: '%v' object is not iterable", v.Type)
+	fn := m.Pop()
+	if fn.Type != value.TypeFunction && fn.Type != value.TypeVoid {
+		return vm.NewError("TypeError", "'%s' object is not callable", vm.TypeName(fn))
 	}
-	l := *(v.Opaque.(*[]value.Value))
-	name := value.UnpackString(m.Pop().Data, m.Arena)
-	ip, exists := m.FunctionRegistry[name]
-	if !exists {
-		return fmt.Errorf("NameError: name '%s' is not defined", name)
-	}
-	res := make([]value.Value, 0)
-	for _, x := range l {
-		if r, _ := m.Call(ip, x); r.Data != 0 {
-			res = append(res, x)
-		}
+	src, err := iterator(m, v)
+	if err != nil {
+		return err
 	}
-	m.Push(value.Value{Type: value.TypeIterator, Opaque: &iteratorState{listPtr: &res, index: 0}})
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{Kind: value.IterFilter, Fn: fn, Sources: []*value.Iterator{src}}})
 	return nil
 }
 
 func Abs(m *vm.Machine) error {
 	v := m.Pop()
 	if v.Type == value.TypeInt {
+		if v.IsBig() || v.Int() == math.MinInt64 {
+			b := v.BigInt()
+			m.Push(value.NewBigInt(b.Abs(b)))
+			return nil
+		}
 		i := int64(v.Data)
 		if i < 0 {
 			i = -i
@@ -606,7 +772,7 @@ func Abs(m *vm.Machine) error {
 		m.Push(value.Value{Type: value.TypeFloat, Data: math.Float64bits(math.Abs(f))})
 		return nil
 	}
-	return errors.New("TypeError: bad operand type for abs()")
+	return vm.NewError("TypeError", "bad operand type for abs()")
 }
 func Bool(m *vm.Machine) error {
 	res := uint64(0)
@@ -618,17 +784,31 @@ func Bool(m *vm.Machine) error {
 }
 func Int(m *vm.Machine) error {
 	v := m.Pop()
-	if v.Type == value.TypeInt {
+	switch v.Type {
+	case value.TypeInt:
 		m.Push(v)
 		return nil
-	}
-	if v.Type == value.TypeFloat {
-		m.Push(value.Value{Type: value.TypeInt, Data: uint64(int64(math.Float64frombits(v.Data)))})
+	case value.TypeBool:
+		m.Push(value.Value{Type: value.TypeInt, Data: v.Data})
 		return nil
+	case value.TypeFloat:
+		return pushFloatInt(m, math.Trunc(math.Float64frombits(v.Data)))
+	case value.TypeString:
+		// parsed below
+	default:
+		return vm.NewError("TypeError", "int() argument must be a string, a bytes-like object or a real number, not '%s'", vm.TypeName(v))
+	}
+	s := value.UnpackString(v.Data, m.Arena)
+	digits := strings.TrimSpace(s)
+	i, err := strconv.ParseInt(digits, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		if b, ok := new(big.Int).SetString(digits, 10); ok {
+			m.Push(value.NewBigInt(b))
+			return nil
+		}
 	}
-	i, err := strconv.ParseInt(value.UnpackString(v.Data, m.Arena), 10, 64)
 	if err != nil {
-		return err
+		return vm.NewError("ValueError", "invalid literal for int() with base 10: '%s'", s)
 	}
 	m.Push(value.Value{Type: value.TypeInt, Data: uint64(i)})
 	return nil
@@ -638,54 +818,51 @@ func Pow(m *vm.Machine) error {
 	eVal := m.Pop()
 	bVal := m.Pop()
 	if bVal.Type != value.TypeInt && bVal.Type != value.TypeFloat {
-		return errors.New("TypeError: unsupported operand type for pow()")
+		return vm.NewError("TypeError", "unsupported operand type for pow()")
 	}
 	if eVal.Type != value.TypeInt && eVal.Type != value.TypeFloat {
-		return errors.New("TypeError: unsupported operand type for pow()")
+		return vm.NewError("TypeError", "unsupported operand type for pow()")
 	}
 
-	e := float64(eVal.Int())
-	if eVal.Type == value.TypeFloat {
-		e = math.Float64frombits(eVal.Data)
-	}
-	b := float64(bVal.Int())
-	if bVal.Type == value.TypeFloat {
-		b = math.Float64frombits(bVal.Data)
+	res, err := vm.Arith(vm.OP_POW, bVal, eVal)
+	if err != nil {
+		return err
 	}
-
-	m.Push(value.Value{Type: value.TypeInt, Data: uint64(int64(math.Pow(b, e)))})
+	m.Push(res)
 	return nil
 }
 
-func All(m *vm.Machine) error {
-	v := m.Pop()
-	if v.Type != value.TypeList {
-		return errors.New("TypeError: not iterable")
+func All(m *vm.Machine) error { return findTruth(m, false) }
+
+func Any(m *vm.Machine) error { return findTruth(m, true) }
+
+// findTruth implements any, when want is true, and all, when it is false:
+// it looks for an item whose truth is want and stops at the first, so that
+// a lazy iterator is run no further. If a lazy item runs out of gas, the
+// items taken before it all had the other truth, so running the call again
+// on Resume gives the same answer.
+func findTruth(m *vm.Machine, want bool) error {
+	it, err := iterator(m, m.Pop())
+	if err != nil {
+		return err
 	}
-	l := *(v.Opaque.(*[]value.Value))
-	res := uint64(1)
-	for _, x := range l {
-		if x.Data == 0 {
-			res = 0
+	found := false
+	for !found {
+		if err := m.ConsumeGas(1); err != nil {
+			return err
+		}
+		x, ok, err := m.IterNext(it)
+		if err != nil {
+			return err
+		}
+		if !ok {
 			break
 		}
+		found = vm.IsTruthy(x) == want
 	}
-	m.Push(value.Value{Type: value.TypeBool, Data: res})
-	return nil
-}
-
-func Any(m *vm.Machine) error {
-	v := m.Pop()
-	if v.Type != value.TypeList {
-		return errors.New("TypeError: not iterable")
-	}
-	l := *(v.Opaque.(*[]value.Value))
 	res := uint64(0)
-	for _, x := range l {
-		if x.Data != 0 {
-			res = 1
-			break
-		}
+	if found == want {
+		res = 1
 	}
 	m.Push(value.Value{Type: value.TypeBool, Data: res})
 	return nil
@@ -697,7 +874,7 @@ func SetItem(m *vm.Machine) error {
 	obj := m.Pop()
 	if obj.Type == value.TypeList {
 		if idxVal.Type != value.TypeInt {
-			return errors.New("TypeError: list indices must be integers")
+			return vm.NewError("TypeError", "list indices must be integers")
 		}
 		l := *(obj.Opaque.(*[]value.Value))
 		idx := int(idxVal.Int())
@@ -705,17 +882,17 @@ func SetItem(m *vm.Machine) error {
 			idx += len(l)
 		}
 		if idx < 0 || idx >= len(l) {
-			return errors.New("IndexError: list assignment index out of range")
+			return vm.NewError("IndexError", "list assignment index out of range")
 		}
 		l[idx] = v
 	} else if obj.Type == value.TypeDict {
 		if idxVal.Type != value.TypeString {
-			return errors.New("TypeError: dictionary keys must be strings in this implementation")
+			return vm.NewError("TypeError", "dictionary keys must be strings in this implementation")
 		}
 		key := value.UnpackString(idxVal.Data, m.Arena)
 		obj.Opaque.(map[string]any)[key] = v
 	} else {
-		return fmt.Errorf("TypeError: '%v' object does not support item assignment", obj.Type)
+		return vm.NewError("TypeError", "'%v' object does not support item assignment", obj.Type)
 	}
 	return nil
 }
@@ -723,12 +900,12 @@ func SetItem(m *vm.Machine) error {
 func MethodCall(m *vm.Machine) error {
 	nVal := m.Pop()
 	if nVal.Type != value.TypeInt {
-		return errors.New("TypeError: method call arg count must be integer")
+		return vm.NewError("TypeError", "method call arg count must be integer")
 	}
 	n := int(nVal.Int())
 	nameVal := m.Pop()
 	if nameVal.Type != value.TypeString {
-		return errors.New("TypeError: method name must be string")
+		return vm.NewError("TypeError", "method name must be string")
 	}
 	name := value.UnpackString(nameVal.Data, m.Arena)
 	args := make([]value.Value, n)
@@ -749,7 +926,7 @@ func MethodCall(m *vm.Machine) error {
 				vv := m.Pop()
 				res = append(res, value.Value{Type: value.TypeTuple, Opaque: []value.Value{kv, vv}})
 			}
-			m.Push(value.Value{Type: value.TypeIterator, Opaque: &iteratorState{listPtr: &res, index: 0}})
+			m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{List: &res}})
 			return nil
 		case "keys":
 			res := make([]value.Value, 0, len(d))
@@ -757,7 +934,7 @@ func MethodCall(m *vm.Machine) error {
 				pushString(m, k)
 				res = append(res, m.Pop())
 			}
-			m.Push(value.Value{Type: value.TypeIterator, Opaque: &iteratorState{listPtr: &res, index: 0}})
+			m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{List: &res}})
 			return nil
 		case "get":
 			k := value.UnpackString(args[0].Data, m.Arena)
@@ -801,7 +978,10 @@ func MethodCall(m *vm.Machine) error {
 			m.Push(value.Value{Type: value.TypeList, Opaque: ptr})
 			return nil
 		case "join":
-			l := *(args[0].Opaque.(*[]value.Value))
+			l, err := items(m, args[0])
+			if err != nil {
+				return err
+			}
 			ss := make([]string, len(l))
 			for i, x := range l {
 				ss[i] = x.Format(m.Arena)
@@ -841,7 +1021,7 @@ func Print(m *vm.Machine) error {
 func MakeList(m *vm.Machine) error {
 	nVal := m.Pop()
 	if nVal.Type != value.TypeInt {
-		return errors.New("TypeError: list size must be integer")
+		return vm.NewError("TypeError", "list size must be integer")
 	}
 	n := int(nVal.Int())
 	l := make([]value.Value, n)
@@ -859,7 +1039,7 @@ func GetItem(m *vm.Machine) error {
 	obj := m.Pop()
 	if obj.Type == value.TypeList {
 		if idxVal.Type != value.TypeInt {
-			return errors.New("TypeError: list indices must be integers")
+			return vm.NewError("TypeError", "list indices must be integers")
 		}
 		l := *(obj.Opaque.(*[]value.Value))
 		idx := int(idxVal.Int())
@@ -867,37 +1047,51 @@ func GetItem(m *vm.Machine) error {
 			idx += len(l)
 		}
 		if idx < 0 || idx >= len(l) {
-			return errors.New("IndexError: list index out of range")
+			return vm.NewError("IndexError", "list index out of range")
 		}
 		m.Push(l[idx])
 		return nil
 	} else if obj.Type == value.TypeTuple {
 		l := obj.Opaque.([]value.Value)
 		if idxVal.Type != value.TypeInt {
-			return errors.New("TypeError: tuple indices must be integers")
+			return vm.NewError("TypeError", "tuple indices must be integers")
 		}
 		idx := int(idxVal.Int())
 		if idx < 0 {
 			idx += len(l)
 		}
 		if idx < 0 || idx >= len(l) {
-			return errors.New("IndexError: tuple index out of range")
+			return vm.NewError("IndexError", "tuple index out of range")
 		}
 		m.Push(l[idx])
 		return nil
 	} else if obj.Type == value.TypeDict {
 		if idxVal.Type != value.TypeString {
-			return errors.New("TypeError: dictionary keys must be strings")
+			return vm.NewError("TypeError", "dictionary keys must be strings")
 		}
 		d := obj.Opaque.(map[string]any)
 		key := value.UnpackString(idxVal.Data, m.Arena)
 		val, ok := d[key]
 		if !ok {
-			return fmt.Errorf("KeyError: %s", key)
+			return vm.NewError("KeyError", "%s", key)
 		}
 		return pushConverted(m, val)
+	} else if obj.Type == value.TypeRange {
+		if idxVal.Type != value.TypeInt {
+			return vm.NewError("TypeError", "range indices must be integers")
+		}
+		r := obj.Opaque.(*value.Range)
+		idx := int(idxVal.Int())
+		if idx < 0 {
+			idx += r.Len()
+		}
+		if idx < 0 || idx >= r.Len() {
+			return vm.NewError("IndexError", "range object index out of range")
+		}
+		m.Push(value.Value{Type: value.TypeInt, Data: uint64(r.At(idx))})
+		return nil
 	}
-	return fmt.Errorf("TypeError: cannot index into object of type %v", obj.Type)
+	return vm.NewError("TypeError", "cannot index into object of type %v", obj.Type)
 }
 
 func IsInstance(m *vm.Machine) error {
@@ -945,10 +1139,18 @@ func IsInstance(m *vm.Machine) error {
 		if typeStr == "set" {
 			res = 1
 		}
+	case value.TypeRange:
+		if typeStr == "range" {
+			res = 1
+		}
 	case value.TypeBytes:
 		if typeStr == "bytes" || typeStr == "bytearray" {
 			res = 1
 		}
+	case value.TypeException:
+		if vm.ExceptionMatches(obj.Opaque.(*value.Exception).Kind, typeStr) {
+			res = 1
+		}
 	}
 
 	m.Push(value.Value{Type: value.TypeBool, Data: res})
@@ -1,7 +1,9 @@
 package stdlib
 
 import (
+	"errors"
 	"math"
+	"math/big"
 	"strings"
 	"testing"
 
@@ -75,6 +77,46 @@ func TestBuiltins(t *testing.T) {
 		if value.UnpackString(m.Pop().Data, m.Arena) != "0o12" {
 			t.Errorf("oct(10) failed")
 		}
+
+		m.Push(value.NewBigInt(new(big.Int).Lsh(big.NewInt(-1), 64)))
+		Hex(m)
+		if h := value.UnpackString(m.Pop().Data, m.Arena); h != "-0x10000000000000000" {
+			t.Errorf("hex(-2**64) = %s", h)
+		}
+	})
+
+	t.Run("BigInts", func(t *testing.T) {
+		m.Reset()
+		s := "123456789012345678901234567890"
+		if err := pushString(m, s); err != nil {
+			t.Fatal(err)
+		}
+		if err := Int(m); err != nil {
+			t.Fatal(err)
+		}
+		if v := m.Pop(); !v.IsBig() || v.Format(m.Arena) != s {
+			t.Errorf("int(%q) = %v", s, v.Format(m.Arena))
+		}
+
+		m.Push(value.Value{Type: value.TypeFloat, Data: math.Float64bits(1e20)})
+		Int(m)
+		if v := m.Pop().Format(m.Arena); v != "100000000000000000000" {
+			t.Errorf("int(1e20) = %s", v)
+		}
+
+		if err := pushString(m, `{"id": `+s+`, "n": 7, "p": 2.5, "xs": [1e3]}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := ParseJSON(m); err != nil {
+			t.Fatal(err)
+		}
+		d := m.Pop().Opaque.(map[string]any)
+		if d["id"].(value.Value).Format(m.Arena) != s || d["n"].(value.Value).Int() != 7 {
+			t.Errorf("JSON ints lost: %v", d)
+		}
+		if d["p"].(value.Value).Float() != 2.5 || d["xs"].([]any)[0].(value.Value).Float() != 1000 {
+			t.Errorf("JSON floats lost: %v", d)
+		}
 	})
 
 	t.Run("Collections", func(t *testing.T) {
@@ -124,6 +166,39 @@ func TestBuiltins(t *testing.T) {
 		}
 	})
 
+	t.Run("SortedKey", func(t *testing.T) {
+		m.Reset()
+		m.Arena = append(m.Arena, "bca"...)
+		list := []value.Value{
+			{Type: value.TypeString, Data: value.PackString(0, 1)},
+			{Type: value.TypeString, Data: value.PackString(1, 1)},
+			{Type: value.TypeString, Data: value.PackString(2, 1)},
+		}
+		m.Push(value.Value{Type: value.TypeList, Opaque: &list})
+		m.Push(value.Value{Type: value.TypeVoid})
+		m.Push(value.Value{Type: value.TypeBool, Data: 1})
+		if err := SortedKey(m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Pop().Format(m.Arena); got != "[c, b, a]" {
+			t.Errorf("sorted(reverse=True) = %s", got)
+		}
+
+		// Values that cannot be ordered raise the TypeError of <.
+		mixed := []value.Value{list[0], {Type: value.TypeInt, Data: 1}}
+		var re *vm.RuntimeError
+		m.Push(value.Value{Type: value.TypeList, Opaque: &mixed})
+		if err := Sorted(m); !errors.As(err, &re) || re.Kind != "TypeError" {
+			t.Errorf("sorted([b, 1]): expected a TypeError, got %v", err)
+		}
+		m.Push(value.Value{Type: value.TypeList, Opaque: &mixed})
+		m.Push(value.Value{Type: value.TypeVoid})
+		m.Push(value.Value{Type: value.TypeBool, Data: 0})
+		if err := SortedKey(m); !errors.As(err, &re) || re.Kind != "TypeError" {
+			t.Errorf("sorted([b, 1], key=None): expected a TypeError, got %v", err)
+		}
+	})
+
 	t.Run("ZipEnumerate", func(t *testing.T) {
 		m.Reset()
 		l1 := []value.Value{{Type: value.TypeInt, Data: 1}}
@@ -131,6 +206,10 @@ func TestBuiltins(t *testing.T) {
 		m.Push(value.Value{Type: value.TypeList, Opaque: &l1})
 		m.Push(value.Value{Type: value.TypeList, Opaque: &l2})
 		Zip(m)
+		if m.Peek().Type != value.TypeIterator {
+			t.Errorf("zip is not lazy")
+		}
+		List(m)
 		res := *(m.Pop().Opaque.(*[]value.Value))
 		if len(res) != 1 || res[0].Type != value.TypeTuple {
 			t.Errorf("zip failed")
@@ -138,6 +217,7 @@ func TestBuiltins(t *testing.T) {
 
 		m.Push(value.Value{Type: value.TypeList, Opaque: &l1})
 		Enumerate(m)
+		List(m)
 		enum := *(m.Pop().Opaque.(*[]value.Value))
 		if len(enum) != 1 || enum[0].Type != value.TypeTuple {
 			t.Errorf("enumerate failed")
@@ -307,13 +387,19 @@ func TestBuiltins(t *testing.T) {
 
 	t.Run("Callable", func(t *testing.T) {
 		m.Reset()
-		m.FunctionRegistry["f"] = 0
 		m.Push(value.Value{Type: value.TypeString, Data: uint64(len(m.Arena))})
 		m.Arena = append(m.Arena, "f"...)
 		m.Push(value.Value{Type: value.TypeString, Data: value.PackString(uint32(len(m.Arena)-1), 1)})
 		if err := Callable(m); err != nil {
 			t.Fatal(err)
 		}
+		if m.Pop().Data != 0 {
+			t.Errorf("a string is not callable")
+		}
+		m.Push(value.NewFunction("f", 0, 0))
+		if err := Callable(m); err != nil {
+			t.Fatal(err)
+		}
 		if m.Pop().Data != 1 {
 			t.Errorf("callable failed")
 		}
@@ -360,8 +446,9 @@ func TestBuiltins(t *testing.T) {
 		}
 
 		emptyIterList := make([]value.Value, 0)
-		m.Push(value.Value{Type: value.TypeIterator, Opaque: &iteratorState{listPtr: &emptyIterList, index: 0}})
-		if err := Next(m); err == nil || err.Error() != "stop iteration" {
+		m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{List: &emptyIterList}})
+		var re *vm.RuntimeError
+		if err := Next(m); !errors.As(err, &re) || re.Kind != "StopIteration" {
 			t.Errorf("expected stop iteration")
 		}
 	})
@@ -617,8 +704,8 @@ func TestBuiltins(t *testing.T) {
 
 	t.Run("Functional", func(t *testing.T) {
 		m.Reset()
+		m.AddGas(1000) // Call draws on the machine's budget
 		// Mock a function: def double(x): return x * 2
-		m.FunctionRegistry["double"] = 0
 		m.Code = []uint32{
 			(uint32(vm.OP_PUSH_L) << 24), // Push local 0
 			(uint32(vm.OP_PUSH_C) << 24), // Push 2
@@ -629,10 +716,7 @@ func TestBuiltins(t *testing.T) {
 
 		// Map
 		l1 := []value.Value{{Type: value.TypeInt, Data: 1}, {Type: value.TypeInt, Data: 2}}
-		funcName := "double"
-		offset := uint32(len(m.Arena))
-		m.Arena = append(m.Arena, []byte(funcName)...)
-		m.Push(value.Value{Type: value.TypeString, Data: value.PackString(offset, uint32(len(funcName)))})
+		m.Push(value.NewFunction("double", 0, 1))
 		m.Push(value.Value{Type: value.TypeList, Opaque: &l1})
 
 		if err := Map(m); err != nil {
@@ -642,14 +726,18 @@ func TestBuiltins(t *testing.T) {
 		if resVal.Type != value.TypeIterator {
 			t.Errorf("expected iterator")
 		}
-		res := *(resVal.Opaque.(*iteratorState).listPtr)
+		m.Push(resVal)
+		if err := List(m); err != nil {
+			t.Fatal(err)
+		}
+		res := *(m.Pop().Opaque.(*[]value.Value))
 		if len(res) != 2 || res[0].Int() != 2 || res[1].Int() != 4 {
 			t.Errorf("map double failed, got %v", res)
 		}
 
 		// Filter
 		m.Reset()
-		m.FunctionRegistry["is_one"] = 0
+		m.AddGas(1000)
 		m.Code = []uint32{
 			(uint32(vm.OP_PUSH_L) << 24), // Push Arg 0
 			(uint32(vm.OP_PUSH_C) << 24), // Push 1
@@ -658,10 +746,7 @@ func TestBuiltins(t *testing.T) {
 		}
 		m.Constants = []value.Value{{Type: value.TypeInt, Data: 1}}
 
-		funcName = "is_one"
-		offset = uint32(len(m.Arena))
-		m.Arena = append(m.Arena, []byte(funcName)...)
-		m.Push(value.Value{Type: value.TypeString, Data: value.PackString(offset, uint32(len(funcName)))})
+		m.Push(value.NewFunction("is_one", 0, 1))
 		m.Push(value.Value{Type: value.TypeList, Opaque: &l1})
 
 		if err := Filter(m); err != nil {
@@ -671,7 +756,11 @@ func TestBuiltins(t *testing.T) {
 		if resVal.Type != value.TypeIterator {
 			t.Errorf("expected iterator")
 		}
-		res = *(resVal.Opaque.(*iteratorState).listPtr)
+		m.Push(resVal)
+		if err := List(m); err != nil {
+			t.Fatal(err)
+		}
+		res = *(m.Pop().Opaque.(*[]value.Value))
 		if len(res) != 1 || res[0].Int() != 1 {
 			t.Errorf("filter is_one failed, got %v", res)
 		}
@@ -830,3 +919,36 @@ func TestBuiltins(t *testing.T) {
 		}
 	})
 }
+
+func TestBuiltinGas(t *testing.T) {
+	m := vm.GetMachine()
+	defer vm.PutMachine(m)
+
+	m.HostRegistry = []vm.HostFunctionEntry{{Fn: Range}, {Fn: List}}
+	m.Constants = []value.Value{
+		{Type: value.TypeInt, Data: 10000},
+		{Type: value.TypeInt, Data: 1},
+	}
+	m.Code = []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_PUSH_C) << 24) | 1,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_SYSCALL) << 24) | 1,
+		(uint32(vm.OP_HALT) << 24),
+	}
+
+	// range(10000) itself is free; list(range(10000)) pays for the items.
+	if err := m.Run(1000); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatalf("list(range(10000)) should exhaust 1000 gas, got %v", err)
+	}
+	if m.IP != 3 {
+		t.Errorf("ran out of gas at %d, want the list() call at 3", m.IP)
+	}
+	m.Reset()
+	if err := m.Run(20000); err != nil {
+		t.Fatal(err)
+	}
+	if m.GasUsed() < 10000 {
+		t.Errorf("list(range(10000)) charged only %d gas", m.GasUsed())
+	}
+}
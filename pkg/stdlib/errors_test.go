@@ -1,6 +1,7 @@
 package stdlib
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/agenthands/npython/pkg/core/value"
@@ -25,11 +26,12 @@ func TestBuiltinErrors(t *testing.T) {
 		{"MinEmpty", Min, []value.Value{{Type: value.TypeList, Opaque: &[]value.Value{}}}},
 		{"MapErr1", Map, []value.Value{{Type: value.TypeInt}, {Type: value.TypeInt}}},
 		{"MapErr2", Map, []value.Value{{Type: value.TypeString}, {Type: value.TypeInt}}},
-		{"MapErr3", Map, []value.Value{{Type: value.TypeString, Data: 0}, {Type: value.TypeList, Opaque: &[]value.Value{}}}}, // Unknown func
+		{"MapErr3", Map, []value.Value{{Type: value.TypeString, Data: 0}, {Type: value.TypeList, Opaque: &[]value.Value{}}}}, // Not a function
 		{"AbsErr", Abs, []value.Value{{Type: value.TypeString}}},
 		{"IntErr", Int, []value.Value{{Type: value.TypeVoid}}},
 		{"FloatErr", Float, []value.Value{{Type: value.TypeVoid}}},
 		{"FloatParseErr", Float, []value.Value{{Type: value.TypeString, Data: uint64(len(m.Arena))}}}, // Needs "abc" in arena
+		{"IntParseErr", Int, []value.Value{{Type: value.TypeString, Data: uint64(len(m.Arena))}}},     // Needs "abc" in arena
 		{"FilterErr1", Filter, []value.Value{{Type: value.TypeInt}, {Type: value.TypeInt}}},
 		{"FilterErr2", Filter, []value.Value{{Type: value.TypeString}, {Type: value.TypeInt}}},
 		{"PowErr", Pow, []value.Value{{Type: value.TypeString}, {Type: value.TypeInt}}},
@@ -50,7 +52,7 @@ func TestBuiltinErrors(t *testing.T) {
 		{"EnumerateErr", Enumerate, []value.Value{{Type: value.TypeInt}}},
 		{"IterErr", Iter, []value.Value{{Type: value.TypeInt}}},
 		{"NextErr", Next, []value.Value{{Type: value.TypeInt}}},
-		{"NextEmpty", Next, []value.Value{{Type: value.TypeIterator, Opaque: &iteratorState{listPtr: &[]value.Value{}, index: 0}}}},
+		{"NextEmpty", Next, []value.Value{{Type: value.TypeIterator, Opaque: &value.Iterator{List: &[]value.Value{}}}}},
 		{"ParseJSONErr", ParseJSON, []value.Value{{Type: value.TypeString, Data: 0}}}, // Needs invalid JSON in arena
 		{"GetFieldErr", GetField, []value.Value{{Type: value.TypeInt}, {Type: value.TypeString}}},
 		{"CheckStatusErr", func(m *vm.Machine) error { sandbox := NewHTTPSandbox(nil); return sandbox.CheckStatus(m) }, []value.Value{{Type: value.TypeInt}}},
@@ -103,11 +105,20 @@ func TestBuiltinErrors(t *testing.T) {
 		}, nil},
 	}
 
+	// The kinds a script can catch, for the cases that must raise a
+	// particular one.
+	kinds := map[string]string{
+		"IntErr":        "TypeError",
+		"IntParseErr":   "ValueError",
+		"FloatErr":      "TypeError",
+		"FloatParseErr": "ValueError",
+	}
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			m.Reset()
 			for _, arg := range tt.args {
-				if tt.name == "FloatParseErr" && arg.Type == value.TypeString {
+				if (tt.name == "FloatParseErr" || tt.name == "IntParseErr") && arg.Type == value.TypeString {
 					m.Arena = append(m.Arena, "abc"...)
 					arg.Data = value.PackString(0, 3)
 				}
@@ -117,9 +128,14 @@ func TestBuiltinErrors(t *testing.T) {
 				}
 				m.Push(arg)
 			}
-			if err := tt.fn(m); err == nil {
+			err := tt.fn(m)
+			if err == nil {
 				t.Errorf("%s: expected error, got nil", tt.name)
 			}
+			var re *vm.RuntimeError
+			if kind, ok := kinds[tt.name]; ok && (!errors.As(err, &re) || re.Kind != kind) {
+				t.Errorf("%s: expected a %s, got %v", tt.name, kind, err)
+			}
 		})
 	}
 }
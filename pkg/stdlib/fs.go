@@ -40,21 +40,27 @@ func (s *FSSandbox) WriteFile(m *vm.Machine) error {
 	// CONSTRAINT A: Root Jailing
 	cleanPath := filepath.Join(s.Root, filepath.Clean(path))
 	if !strings.HasPrefix(cleanPath, s.Root) {
-		return ErrPathEscape
+		return vm.WrapError("SecurityViolation", ErrPathEscape)
 	}
 
 	// CONSTRAINT D: Size Limit
 	if len(content) > s.MaxFileSize {
-		return ErrFileTooLarge
+		return vm.WrapError("OSError", ErrFileTooLarge)
+	}
+	if err := m.ConsumeGas(gasForBytes(len(content))); err != nil {
+		return err
 	}
 
 	// Create directory if not exists
 	dir := filepath.Dir(cleanPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+		return vm.WrapError("OSError", err)
 	}
 
-	return os.WriteFile(cleanPath, []byte(content), 0644)
+	if err := os.WriteFile(cleanPath, []byte(content), 0644); err != nil {
+		return vm.WrapError("OSError", err)
+	}
+	return nil
 }
 
 // ReadFile: ( path -- content )
@@ -65,11 +71,14 @@ func (s *FSSandbox) ReadFile(m *vm.Machine) error {
 	// CONSTRAINT A: Root Jailing
 	cleanPath := filepath.Join(s.Root, filepath.Clean(path))
 	if !strings.HasPrefix(cleanPath, s.Root) {
-		return ErrPathEscape
+		return vm.WrapError("SecurityViolation", ErrPathEscape)
 	}
 
 	data, err := os.ReadFile(cleanPath)
 	if err != nil {
+		return vm.WrapError("OSError", err)
+	}
+	if err := m.ConsumeGas(gasForBytes(len(data))); err != nil {
 		return err
 	}
 
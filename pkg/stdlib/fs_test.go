@@ -1,6 +1,7 @@
 package stdlib_test
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -89,7 +90,7 @@ func TestFSSandboxJailing(t *testing.T) {
 	m.Push(value.Value{Type: value.TypeString, Data: pathData})
 
 	err := sandbox.WriteFile(m)
-	if err != stdlib.ErrPathEscape {
+	if !errors.Is(err, stdlib.ErrPathEscape) {
 		t.Errorf("expected ErrPathEscape, got %v", err)
 	}
 }
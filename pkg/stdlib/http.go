@@ -16,10 +16,12 @@ var (
 	ErrLocalhostBlocked = errors.New("stdlib/http: localhost/internal access blocked")
 )
 
+// HTTPSandbox holds no per-execution state, so one sandbox can serve many
+// machines at once; the request built by WithClient, SetURL and SetMethod is
+// kept on the machine.
 type HTTPSandbox struct {
 	AllowedDomains []string
 	AllowLocalhost bool
-	pendingReqs    map[*vm.Machine]*httpRequest
 }
 
 type httpRequest struct {
@@ -31,13 +33,18 @@ type httpRequest struct {
 func NewHTTPSandbox(allowedDomains []string) *HTTPSandbox {
 	return &HTTPSandbox{
 		AllowedDomains: allowedDomains,
-		pendingReqs:    make(map[*vm.Machine]*httpRequest),
 	}
 }
 
+// pending returns the request m is building with s.
+func (s *HTTPSandbox) pending(m *vm.Machine) (*httpRequest, bool) {
+	req, ok := m.HostState(s).(*httpRequest)
+	return req, ok
+}
+
 // WithClient: ( -- )
 func (s *HTTPSandbox) WithClient(m *vm.Machine) error {
-	s.pendingReqs[m] = &httpRequest{method: "GET"}
+	m.SetHostState(s, &httpRequest{method: "GET"})
 	return nil
 }
 
@@ -46,9 +53,9 @@ func (s *HTTPSandbox) SetURL(m *vm.Machine) error {
 	urlPacked := m.Pop().Data
 	urlStr := value.UnpackString(urlPacked, m.Arena)
 
-	req, ok := s.pendingReqs[m]
+	req, ok := s.pending(m)
 	if !ok {
-		return errors.New("stdlib/http: no pending request, call WITH-CLIENT first")
+		return vm.NewError("RuntimeError", "stdlib/http: no pending request, call WITH-CLIENT first")
 	}
 	req.url = urlStr
 	return nil
@@ -59,9 +66,9 @@ func (s *HTTPSandbox) SetMethod(m *vm.Machine) error {
 	methodPacked := m.Pop().Data
 	method := value.UnpackString(methodPacked, m.Arena)
 
-	req, ok := s.pendingReqs[m]
+	req, ok := s.pending(m)
 	if !ok {
-		return errors.New("stdlib/http: no pending request, call WITH-CLIENT first")
+		return vm.NewError("RuntimeError", "stdlib/http: no pending request, call WITH-CLIENT first")
 	}
 	req.method = strings.ToUpper(method)
 	return nil
@@ -69,39 +76,42 @@ func (s *HTTPSandbox) SetMethod(m *vm.Machine) error {
 
 // SendRequest: ( -- resp )
 func (s *HTTPSandbox) SendRequest(m *vm.Machine) error {
-	reqState, ok := s.pendingReqs[m]
+	reqState, ok := s.pending(m)
 	if !ok {
-		return errors.New("stdlib/http: no pending request")
+		return vm.NewError("RuntimeError", "stdlib/http: no pending request")
 	}
-	delete(s.pendingReqs, m)
+	m.SetHostState(s, nil)
 
 	u, err := url.Parse(reqState.url)
 	if err != nil {
-		return err
+		return vm.WrapError("ValueError", err)
 	}
 
 	if !s.isAllowed(u.Hostname()) {
-		return ErrDomainNotAllowed
+		return vm.WrapError("SecurityViolation", ErrDomainNotAllowed)
 	}
 
 	if !s.AllowLocalhost && isLocalhost(u.Hostname()) {
-		return ErrLocalhostBlocked
+		return vm.WrapError("SecurityViolation", ErrLocalhostBlocked)
 	}
 
 	httpClient := &http.Client{}
-	req, err := http.NewRequest(reqState.method, reqState.url, reqState.body)
+	req, err := http.NewRequestWithContext(m.Context(), reqState.method, reqState.url, reqState.body)
 	if err != nil {
-		return err
+		return vm.WrapError("ValueError", err)
 	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return vm.WrapError("ConnectionError", err)
 	}
 	defer resp.Body.Close()
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
+		return vm.WrapError("ConnectionError", err)
+	}
+	if err := m.ConsumeGas(gasForBytes(len(data))); err != nil {
 		return err
 	}
 
@@ -131,7 +141,7 @@ func (s *HTTPSandbox) SendRequest(m *vm.Machine) error {
 func (s *HTTPSandbox) CheckStatus(m *vm.Machine) error {
 	respVal := m.Pop()
 	if respVal.Type != value.TypeDict {
-		return errors.New("stdlib/http: CHECK-STATUS expects response map")
+		return vm.NewError("TypeError", "stdlib/http: CHECK-STATUS expects response map")
 	}
 	respMap := respVal.Opaque.(map[string]any)
 	status := respMap["status"].(int64)
@@ -147,27 +157,35 @@ func (s *HTTPSandbox) Fetch(m *vm.Machine) error {
 
 	u, err := url.Parse(urlStr)
 	if err != nil {
-		return err
+		return vm.WrapError("ValueError", err)
 	}
 
 	// CONSTRAINT 1: Strict Allowlist
 	if !s.isAllowed(u.Hostname()) {
-		return ErrDomainNotAllowed
+		return vm.WrapError("SecurityViolation", ErrDomainNotAllowed)
 	}
 
 	// CONSTRAINT 2: No Localhost
 	if !s.AllowLocalhost && isLocalhost(u.Hostname()) {
-		return ErrLocalhostBlocked
+		return vm.WrapError("SecurityViolation", ErrLocalhostBlocked)
 	}
 
-	resp, err := http.Get(urlStr)
+	req, err := http.NewRequestWithContext(m.Context(), http.MethodGet, urlStr, nil)
 	if err != nil {
-		return err
+		return vm.WrapError("ValueError", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return vm.WrapError("ConnectionError", err)
 	}
 	defer resp.Body.Close()
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
+		return vm.WrapError("ConnectionError", err)
+	}
+	if err := m.ConsumeGas(gasForBytes(len(data))); err != nil {
 		return err
 	}
 
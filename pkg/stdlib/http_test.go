@@ -1,11 +1,17 @@
 package stdlib_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/agenthands/npython/pkg/compiler/python"
 	"github.com/agenthands/npython/pkg/core/value"
 	"github.com/agenthands/npython/pkg/stdlib"
 	"github.com/agenthands/npython/pkg/vm"
@@ -23,7 +29,7 @@ func TestHTTPSandboxDomainBlocking(t *testing.T) {
 	m.Push(value.Value{Type: value.TypeString, Data: urlData})
 
 	err := sandbox.Fetch(m)
-	if err != stdlib.ErrDomainNotAllowed {
+	if !errors.Is(err, stdlib.ErrDomainNotAllowed) {
 		t.Errorf("expected ErrDomainNotAllowed, got %v", err)
 	}
 }
@@ -40,7 +46,7 @@ func TestHTTPSandboxLocalhostBlocking(t *testing.T) {
 	m.Push(value.Value{Type: value.TypeString, Data: urlData})
 
 	err := sandbox.Fetch(m)
-	if err != stdlib.ErrLocalhostBlocked {
+	if !errors.Is(err, stdlib.ErrLocalhostBlocked) {
 		t.Errorf("expected ErrLocalhostBlocked, got %v", err)
 	}
 }
@@ -122,3 +128,105 @@ func TestHTTPSandboxFetch(t *testing.T) {
 		t.Errorf("got %s", res)
 	}
 }
+
+func TestHTTPSandboxFetchCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	u, _ := url.Parse(server.URL)
+	sandbox := stdlib.NewHTTPSandbox([]string{u.Hostname()})
+	sandbox.AllowLocalhost = true
+	m := vm.GetMachine()
+	defer vm.PutMachine(m)
+	m.Reset()
+
+	m.HostRegistry = []vm.HostFunctionEntry{{Fn: sandbox.Fetch}}
+	m.Arena = append(m.Arena, server.URL...)
+	m.Constants = []value.Value{{Type: value.TypeString, Data: value.PackString(0, uint32(len(server.URL)))}}
+	m.Code = []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_HALT) << 24),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := m.RunContext(ctx, 100); !errors.Is(err, vm.ErrDeadline) {
+		t.Fatalf("expected ErrDeadline, got %v", err)
+	}
+}
+
+// tokenGatekeeper accepts any non-empty token.
+type tokenGatekeeper struct{}
+
+func (tokenGatekeeper) Validate(scope, token string) bool { return token != "" }
+
+func TestHTTPSandboxEngine(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Path))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	// Concurrent executions build their requests through one sandbox.
+	src := `
+def inputs():
+    global base
+    global n
+    base = ""
+    n = 0
+with scope("HTTP-ENV", "token"):
+    with_client()
+    set_method("post")
+    set_url(base + "/echo/" + str(n))
+    resp = send_request()
+body = resp["body"]
+`
+	bc, err := python.NewCompiler().CompileFile("echo.py", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots := map[string]int{}
+	for i, name := range bc.Debug.Globals {
+		slots[name] = i
+	}
+	sandbox := stdlib.NewHTTPSandbox([]string{u.Hostname()})
+	sandbox.AllowLocalhost = true
+	reg := stdlib.NewRegistry(stdlib.NewFSSandbox(t.TempDir(), 1024), sandbox)
+	e, err := vm.NewEngine(bc, reg, vm.EngineOptions{Workers: 8, Gatekeeper: tokenGatekeeper{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xs := make([]vm.Execution, 50)
+	got := make([]string, len(xs))
+	for i := range xs {
+		xs[i] = vm.Execution{
+			Gas: 10000,
+			Setup: func(m *vm.Machine) {
+				off, _ := m.WriteArena([]byte(server.URL))
+				m.Globals()[slots["base"]] = value.Value{Type: value.TypeString, Data: value.PackString(off, uint32(len(server.URL)))}
+				m.Globals()[slots["n"]] = value.Value{Type: value.TypeInt, Data: uint64(i)}
+			},
+			Done: func(m *vm.Machine, err error) {
+				got[i] = strings.Clone(m.Globals()[slots["body"]].Format(m.Arena))
+			},
+		}
+	}
+	for i, err := range e.RunAll(context.Background(), xs) {
+		if err != nil {
+			t.Fatalf("execution %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("POST /echo/%d", i); got[i] != want {
+			t.Errorf("execution %d: got %q, want %q", i, got[i], want)
+		}
+	}
+}
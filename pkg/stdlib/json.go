@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"strings"
 
 	"github.com/agenthands/npython/pkg/core/value"
@@ -14,13 +17,13 @@ import (
 func ParseJSON(m *vm.Machine) error {
 	strVal := m.Pop()
 	if strVal.Type != value.TypeString {
-		return errors.New("TypeError: parse_json() argument 1 must be string")
+		return vm.NewError("TypeError", "parse_json() argument 1 must be string")
 	}
 	str := value.UnpackString(strVal.Data, m.Arena)
 
-	var data map[string]any
-	if err := json.Unmarshal([]byte(str), &data); err != nil {
-		return fmt.Errorf("json unmarshal failed: %v", err)
+	data, err := decodeJSON(str)
+	if err != nil {
+		return vm.NewError("ValueError", "json unmarshal failed: %v", err)
 	}
 
 	m.Push(value.Value{
@@ -35,7 +38,7 @@ func ParseJSONKey(m *vm.Machine) error {
 	keyVal := m.Pop() // key is on top
 	strVal := m.Pop() // str is below
 	if keyVal.Type != value.TypeString || strVal.Type != value.TypeString {
-		return errors.New("TypeError: parse_json_key() arguments must be strings")
+		return vm.NewError("TypeError", "parse_json_key() arguments must be strings")
 	}
 
 	key := value.UnpackString(keyVal.Data, m.Arena)
@@ -47,9 +50,9 @@ func ParseJSONKey(m *vm.Machine) error {
 	str = strings.Trim(str, "\"")
 	str = strings.ReplaceAll(str, "\\\"", "\"")
 
-	var data map[string]any
-	if err := json.Unmarshal([]byte(str), &data); err != nil {
-		return fmt.Errorf("json unmarshal failed: %v | Raw: %s", err, str)
+	data, err := decodeJSON(str)
+	if err != nil {
+		return vm.NewError("ValueError", "json unmarshal failed: %v | Raw: %s", err, str)
 	}
 
 	val, ok := data[key]
@@ -61,6 +64,45 @@ func ParseJSONKey(m *vm.Machine) error {
 	return pushConverted(m, val)
 }
 
+// decodeJSON parses a JSON object. Numbers become int and float values, so
+// that integers too large for a float64 keep every digit.
+func decodeJSON(str string) (map[string]any, error) {
+	d := json.NewDecoder(strings.NewReader(str))
+	d.UseNumber()
+	var data map[string]any
+	if err := d.Decode(&data); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	jsonNumbers(data)
+	return data, nil
+}
+
+func jsonNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return value.Value{Type: value.TypeInt, Data: uint64(i)}
+		}
+		if b, ok := new(big.Int).SetString(string(v), 10); ok {
+			return value.NewBigInt(b)
+		}
+		f, _ := v.Float64()
+		return value.Value{Type: value.TypeFloat, Data: math.Float64bits(f)}
+	case map[string]any:
+		for k, x := range v {
+			v[k] = jsonNumbers(x)
+		}
+	case []any:
+		for i, x := range v {
+			v[i] = jsonNumbers(x)
+		}
+	}
+	return v
+}
+
 func pushConverted(m *vm.Machine, val any) error {
 	if v, ok := val.(value.Value); ok {
 		m.Push(v)
@@ -115,7 +157,7 @@ func GetField(m *vm.Machine) error {
 	key := value.UnpackString(keyVal.Data, m.Arena)
 	key = strings.Trim(key, "\"") // Handle LLM quotes
 	if mapVal.Type != value.TypeDict {
-		return fmt.Errorf("expected Dict, got %v", mapVal.Type)
+		return vm.NewError("TypeError", "expected Dict, got %v", mapVal.Type)
 	}
 
 	data := mapVal.Opaque.(map[string]any)
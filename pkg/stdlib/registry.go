@@ -0,0 +1,88 @@
+package stdlib
+
+import "github.com/agenthands/npython/pkg/vm"
+
+// NewRegistry returns the standard host registry, laid out at the indices the
+// compilers emit, with the stack effects vm.Verify needs. fs and http back
+// the scoped file and network functions, which are marked Nondeterministic
+// so that a vm.Recorder logs them; the HTTP request builders are marked too,
+// since a replayed send_request does not need their state.
+func NewRegistry(fs *FSSandbox, http *HTTPSandbox) []vm.HostFunctionEntry {
+	return []vm.HostFunctionEntry{
+		0:  {Name: "write_file", RequiredScope: "FS-ENV", Fn: fs.WriteFile, Effect: effect(2, 0), Nondeterministic: true},
+		1:  {Name: "fetch", RequiredScope: "HTTP-ENV", Fn: http.Fetch, Effect: effect(1, 1), Nondeterministic: true},
+		2:  {Name: "print", Fn: Print, Effect: variadic(1, 1)},
+		3:  {Name: "parse_json", Fn: ParseJSON, Effect: effect(1, 1)},
+		4:  {Name: "get_field", Fn: GetField, Effect: effect(2, 1)},
+		5:  {Name: "send_request", RequiredScope: "HTTP-ENV", Fn: http.SendRequest, Effect: effect(0, 1), Nondeterministic: true},
+		6:  {Name: "check_status", Fn: http.CheckStatus, Effect: effect(1, 1)},
+		7:  {Name: "parse_json_key", Fn: ParseJSONKey, Effect: effect(2, 1)},
+		8:  {Name: "parse_and_get", Fn: ParseJSONKey, Effect: effect(2, 1)},
+		9:  {Name: "format_string", Fn: FormatString, Effect: effect(2, 1)},
+		10: {Name: "is_empty", Fn: IsEmpty, Effect: effect(1, 1)},
+		11: {Name: "with_client", Fn: http.WithClient, Effect: effect(0, 0), Nondeterministic: true},
+		12: {Name: "set_url", Fn: http.SetURL, Effect: effect(1, 0), Nondeterministic: true},
+		13: {Name: "set_method", Fn: http.SetMethod, Effect: effect(1, 0), Nondeterministic: true},
+		14: {Name: "len", Fn: Len, Effect: effect(1, 1)},
+		15: {Name: "range", Fn: Range, Effect: variadic(1, 1)},
+		16: {Name: "list", Fn: List, Effect: effect(1, 1)},
+		17: {Name: "sum", Fn: Sum, Effect: variadic(1, 1)},
+		18: {Name: "max", Fn: Max, Effect: variadic(1, 1)},
+		19: {Name: "min", Fn: Min, Effect: variadic(1, 1)},
+		20: {Name: "map", Fn: Map, Effect: effect(2, 1)},
+		21: {Name: "abs", Fn: Abs, Effect: effect(1, 1)},
+		22: {Name: "bool", Fn: Bool, Effect: effect(1, 1)},
+		23: {Name: "int", Fn: Int, Effect: effect(1, 1)},
+		24: {Name: "str", Fn: Str, Effect: effect(1, 1)},
+		25: {Name: "filter", Fn: Filter, Effect: effect(2, 1)},
+		26: {Name: "pow", Fn: Pow, Effect: effect(2, 1)},
+		27: {Name: "all", Fn: All, Effect: effect(1, 1)},
+		28: {Name: "any", Fn: Any, Effect: effect(1, 1)},
+		29: {Name: "make_list", Fn: MakeList, Effect: variadic(1, 1)},
+		30: {Name: "get_item", Fn: GetItem, Effect: effect(2, 1)},
+		31: {Name: "set_item", Fn: SetItem, Effect: effect(3, 0)},
+		32: {Name: "divmod", Fn: DivMod, Effect: effect(2, 1)},
+		33: {Name: "round", Fn: Round, Effect: variadic(1, 1)},
+		34: {Name: "float", Fn: Float, Effect: effect(1, 1)},
+		35: {Name: "bin", Fn: Bin, Effect: effect(1, 1)},
+		36: {Name: "oct", Fn: Oct, Effect: effect(1, 1)},
+		37: {Name: "hex", Fn: Hex, Effect: effect(1, 1)},
+		38: {Name: "chr", Fn: Chr, Effect: effect(1, 1)},
+		39: {Name: "ord", Fn: Ord, Effect: effect(1, 1)},
+		40: {Name: "dict", Fn: Dict, Effect: effect(0, 1)},
+		41: {Name: "tuple", Fn: Tuple, Effect: effect(1, 1)},
+		42: {Name: "set", Fn: Set, Effect: effect(1, 1)},
+		43: {Name: "reversed", Fn: Reversed, Effect: effect(1, 1)},
+		44: {Name: "sorted", Fn: Sorted, Effect: effect(1, 1)},
+		45: {Name: "zip", Fn: Zip, Effect: effect(2, 1)},
+		46: {Name: "enumerate", Fn: Enumerate, Effect: effect(1, 1)},
+		47: {Name: "repr", Fn: Repr, Effect: effect(1, 1)},
+		48: {Name: "ascii", Fn: Ascii, Effect: effect(1, 1)},
+		49: {Name: "hash", Fn: Hash, Effect: effect(1, 1)},
+		50: {Name: "id", Fn: Id, Effect: effect(1, 1)},
+		51: {Name: "type", Fn: TypeWord, Effect: effect(1, 1)},
+		52: {Name: "callable", Fn: Callable, Effect: effect(1, 1)},
+		53: {Name: "iter", Fn: Iter, Effect: effect(1, 1)},
+		54: {Name: "next", Fn: Next, Effect: effect(1, 1)},
+		55: {Name: "locals", Fn: Locals, Effect: effect(0, 1)},
+		56: {Name: "globals", Fn: Globals, Effect: effect(0, 1)},
+		57: {Name: "slice", Fn: SliceBuiltin, Effect: effect(4, 1)},
+		58: {Name: "bytes", Fn: Bytes, Effect: effect(1, 1)},
+		59: {Name: "bytearray", Fn: ByteArray, Effect: effect(1, 1)},
+		60: {Name: "has_next", Fn: HasNext, Effect: effect(0, 1)},
+		61: {Name: "make_tuple", Fn: MakeTuple, Effect: variadic(1, 1)},
+		62: {Name: "method_call", Fn: MethodCall, Effect: variadic(3, 1)},
+		63: {Name: "isinstance", Fn: IsInstance, Effect: effect(2, 1)},
+		64: {Name: "sorted_key", Fn: SortedKey, Effect: effect(3, 1)},
+		65: {Name: "read_file", RequiredScope: "FS-ENV", Fn: fs.ReadFile, Effect: effect(1, 1), Nondeterministic: true},
+	}
+}
+
+func effect(pops, pushes int) *vm.StackEffect {
+	return &vm.StackEffect{Pops: pops, Pushes: pushes}
+}
+
+// variadic declares a function whose argument count is pushed last.
+func variadic(pops, pushes int) *vm.StackEffect {
+	return &vm.StackEffect{Pops: pops, Pushes: pushes, Variadic: true}
+}
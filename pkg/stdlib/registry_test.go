@@ -0,0 +1,35 @@
+package stdlib_test
+
+import (
+	"testing"
+
+	"github.com/agenthands/npython/pkg/compiler/python"
+	"github.com/agenthands/npython/pkg/stdlib"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestRegistryMatchesCompiler(t *testing.T) {
+	reg := stdlib.NewRegistry(stdlib.NewFSSandbox(t.TempDir(), 1024), stdlib.NewHTTPSandbox(nil))
+	for name, idx := range python.PythonBuiltins {
+		if int(idx) >= len(reg) {
+			t.Errorf("builtin %q: index %d is not in the registry", name, idx)
+		} else if reg[idx].Name != name {
+			t.Errorf("builtin %q: compiler uses index %d, registry has %q there", name, idx, reg[idx].Name)
+		}
+	}
+
+	bc, err := python.NewCompiler().Compile(`
+d = {"a": [1, 2]}
+d["b"] = (3, 4)
+print(d["a"][0], "x".upper(), sorted([3, 1]))
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.CheckLinks(reg); err != nil {
+		t.Error(err)
+	}
+	if err := vm.Verify(bc, reg); err != nil {
+		t.Error(err)
+	}
+}
@@ -14,7 +14,7 @@ func FormatString(m *vm.Machine) error {
 	formatVal := m.Pop()
 
 	if formatVal.Type != value.TypeString {
-		return fmt.Errorf("TypeError: format must be string")
+		return vm.NewError("TypeError", "format must be string")
 	}
 	format := value.UnpackString(formatVal.Data, m.Arena)
 
@@ -1,6 +1,11 @@
 package vm
 
-import "github.com/agenthands/npython/pkg/core/value"
+import (
+	"sort"
+	"strings"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
 
 // Bytecode represents the compiled output of a program.
 type Bytecode struct {
@@ -8,4 +13,119 @@ type Bytecode struct {
 	Constants    []value.Value
 	Arena        []byte
 	Functions    map[string]int
+	// Globals is the number of module globals the code uses.
+	Globals int
+	// Links lists the host functions the code calls through OP_SYSCALL.
+	Links []HostLink
+	// Debug, if set, maps instructions to source positions for tracebacks.
+	Debug *DebugInfo
+}
+
+// HostLink records the host function a program expects at a registry index.
+type HostLink struct {
+	Index uint32
+	Name  string
+}
+
+// CollectLinks returns the linkage table for code: one entry per distinct
+// OP_SYSCALL index, in index order, named from names.
+func CollectLinks(code []uint32, names map[uint32]string) []HostLink {
+	seen := make(map[uint32]bool)
+	var links []HostLink
+	for _, instr := range code {
+		if uint8(instr>>24) != OP_SYSCALL {
+			continue
+		}
+		idx := instr & 0x00FFFFFF
+		if !seen[idx] {
+			seen[idx] = true
+			links = append(links, HostLink{Index: idx, Name: names[idx]})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Index < links[j].Index })
+	return links
+}
+
+// DebugInfo maps instructions back to the source they were compiled from.
+type DebugInfo struct {
+	File   string
+	Source string
+	// Lines is sorted by IP; each entry covers the instructions up to the
+	// next one.
+	Lines []LineEntry
+	Funcs []FuncRange
+	// Globals names the module globals by slot.
+	Globals []string
+}
+
+// LineEntry gives the source position, 1-based, of the code starting at IP.
+type LineEntry struct {
+	IP, Line, Col int
+}
+
+// FuncRange names the function whose body spans [Start, End) and its
+// locals by slot.
+type FuncRange struct {
+	Name       string
+	Start, End int
+	Locals     []string
+}
+
+// Position returns the source line and column of the instruction at ip, or
+// zeros if it is not known.
+func (d *DebugInfo) Position(ip int) (line, col int) {
+	i := sort.Search(len(d.Lines), func(i int) bool { return d.Lines[i].IP > ip })
+	if i == 0 {
+		return 0, 0
+	}
+	return d.Lines[i-1].Line, d.Lines[i-1].Col
+}
+
+// FuncName returns the name of the innermost function containing ip, or
+// "<module>" for top-level code.
+func (d *DebugInfo) FuncName(ip int) string {
+	if f := d.function(ip); f != nil {
+		return f.Name
+	}
+	return "<module>"
+}
+
+// LocalNames returns the names of the locals, by slot, of the innermost
+// function containing ip. Top-level code keeps only compiler temporaries in
+// its locals, so it has none.
+func (d *DebugInfo) LocalNames(ip int) []string {
+	if f := d.function(ip); f != nil {
+		return f.Locals
+	}
+	return nil
+}
+
+func (d *DebugInfo) function(ip int) *FuncRange {
+	var fn *FuncRange
+	for i := range d.Funcs {
+		f := &d.Funcs[i]
+		if ip >= f.Start && ip < f.End && (fn == nil || f.Start > fn.Start) {
+			fn = f
+		}
+	}
+	return fn
+}
+
+// SourceLine returns line n of the source without surrounding whitespace.
+func (d *DebugInfo) SourceLine(n int) string {
+	src := d.Source
+	for ; n > 1 && src != ""; n-- {
+		i := strings.IndexByte(src, '\n')
+		if i < 0 {
+			return ""
+		}
+		src = src[i+1:]
+	}
+	if n != 1 {
+		return ""
+	}
+	if i := strings.IndexByte(src, '\n'); i >= 0 {
+		src = src[:i]
+	}
+	return strings.TrimSpace(src)
 }
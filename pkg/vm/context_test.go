@@ -0,0 +1,73 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// infiniteLoop is `while True: pass`.
+var infiniteLoop = []uint32{
+	(uint32(vm.OP_JMP) << 24) | 0,
+}
+
+func TestRunContextCancelled(t *testing.T) {
+	m := &vm.Machine{Code: []uint32{(uint32(vm.OP_HALT) << 24)}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := m.RunContext(ctx, 100); !errors.Is(err, vm.ErrCancelled) {
+		t.Fatalf("expected ErrCancelled, got %v", err)
+	}
+}
+
+func TestRunContextCancelDuringLoop(t *testing.T) {
+	m := &vm.Machine{Code: infiniteLoop}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	if err := m.RunContext(ctx, 1<<62); !errors.Is(err, vm.ErrCancelled) {
+		t.Fatalf("expected ErrCancelled, got %v", err)
+	}
+}
+
+func TestRunContextDeadline(t *testing.T) {
+	m := &vm.Machine{Code: infiniteLoop}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := m.RunContext(ctx, 1<<62); !errors.Is(err, vm.ErrDeadline) {
+		t.Fatalf("expected ErrDeadline, got %v", err)
+	}
+}
+
+func TestRunContextHostFunction(t *testing.T) {
+	m := &vm.Machine{}
+	m.RegisterHostFunction("", func(m *vm.Machine) error {
+		<-m.Context().Done()
+		return m.Context().Err()
+	})
+	m.Code = []uint32{
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_HALT) << 24),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := m.RunContext(ctx, 100); !errors.Is(err, vm.ErrDeadline) {
+		t.Fatalf("expected ErrDeadline, got %v", err)
+	}
+	if m.Context() != context.Background() {
+		t.Errorf("context should be cleared after RunContext returns")
+	}
+}
@@ -0,0 +1,159 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+var opNames = [256]string{
+	OP_HALT:      "HALT",
+	OP_NOOP:      "NOOP",
+	OP_PUSH_C:    "PUSH_C",
+	OP_PUSH_L:    "PUSH_L",
+	OP_POP_L:     "POP_L",
+	OP_DUP:       "DUP",
+	OP_PUSH_G:    "PUSH_G",
+	OP_POP_G:     "POP_G",
+	OP_ADD:       "ADD",
+	OP_SUB:       "SUB",
+	OP_MUL:       "MUL",
+	OP_DIV:       "DIV",
+	OP_EQ:        "EQ",
+	OP_NE:        "NE",
+	OP_GT:        "GT",
+	OP_LT:        "LT",
+	OP_DROP:      "DROP",
+	OP_PRINT:     "PRINT",
+	OP_CONTAINS:  "CONTAINS",
+	OP_FIND:      "FIND",
+	OP_SLICE:     "SLICE",
+	OP_LEN:       "LEN",
+	OP_TRIM:      "TRIM",
+	OP_MOD:       "MOD",
+	OP_LTE:       "LTE",
+	OP_GTE:       "GTE",
+	OP_POW:       "POW",
+	OP_AND:       "AND",
+	OP_OR:        "OR",
+	OP_IN:        "IN",
+	OP_NOT_IN:    "NOT_IN",
+	OP_ERROR:     "ERROR",
+	OP_JMP:       "JMP",
+	OP_JMP_FALSE: "JMP_FALSE",
+	OP_CALL:      "CALL",
+	OP_RET:       "RET",
+	OP_FLOOR_DIV: "FLOOR_DIV",
+	OP_BIT_AND:   "BIT_AND",
+	OP_BIT_OR:    "BIT_OR",
+	OP_BIT_XOR:   "BIT_XOR",
+	OP_LSHIFT:    "LSHIFT",
+	OP_RSHIFT:    "RSHIFT",
+	OP_ADDRESS:   "ADDRESS",
+	OP_EXIT_ADDR: "EXIT_ADDR",
+	OP_SYSCALL:   "SYSCALL",
+
+	OP_SETUP_EXCEPT: "SETUP_EXCEPT",
+	OP_POP_EXCEPT:   "POP_EXCEPT",
+	OP_RAISE:        "RAISE",
+	OP_EXC_MATCH:    "EXC_MATCH",
+	OP_MAKE_EXC:     "MAKE_EXC",
+	OP_CALL_FN:      "CALL_FN",
+	OP_CLOSURE:      "CLOSURE",
+	OP_MAKE_CELL:    "MAKE_CELL",
+	OP_LOAD_DEREF:   "LOAD_DEREF",
+	OP_STORE_DEREF:  "STORE_DEREF",
+
+	OP_JMP_FALSE_OR_POP: "JMP_FALSE_OR_POP",
+	OP_JMP_TRUE_OR_POP:  "JMP_TRUE_OR_POP",
+	OP_NOT:              "NOT",
+	OP_NEG:              "NEG",
+	OP_POS:              "POS",
+	OP_INVERT:           "INVERT",
+	OP_IS:               "IS",
+	OP_IS_NOT:           "IS_NOT",
+	OP_GEN:              "GEN",
+	OP_YIELD:            "YIELD",
+}
+
+// opName returns the mnemonic of op, or OP_xx for unknown opcodes.
+func opName(op uint8) string {
+	if name := opNames[op]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("OP_%02X", op)
+}
+
+// Disassemble renders bc as one instruction per line: the address, the
+// mnemonic and the decoded operand, followed by a comment naming the
+// constant, call target or host function it refers to. Entries of
+// bc.Functions are printed as labels; host function names come from bc.Links.
+func Disassemble(bc *Bytecode) string {
+	labels := make(map[int][]string)
+	for name, ip := range bc.Functions {
+		labels[ip] = append(labels[ip], name)
+	}
+	// Nested functions and lambdas are only known by their constants.
+	for _, c := range bc.Constants {
+		if f, ok := c.Opaque.(*value.Function); ok && c.Type == value.TypeFunction && len(labels[f.Entry]) == 0 {
+			labels[f.Entry] = []string{f.Name}
+		}
+	}
+	for _, names := range labels {
+		sort.Strings(names)
+	}
+	hosts := make(map[int]string)
+	for _, l := range bc.Links {
+		hosts[int(l.Index)] = l.Name
+	}
+
+	var b strings.Builder
+	for ip, instr := range bc.Instructions {
+		for _, name := range labels[ip] {
+			fmt.Fprintf(&b, "%s:\n", name)
+		}
+		op, arg := uint8(instr>>24), int(instr&0x00FFFFFF)
+		operand, comment := "", ""
+		switch op {
+		case OP_PUSH_C:
+			operand = strconv.Itoa(arg)
+			if arg < len(bc.Constants) {
+				comment = formatConstant(bc.Constants[arg], bc.Arena)
+			} else {
+				comment = "out of range"
+			}
+		case OP_CALL:
+			target := arg >> 8
+			operand = fmt.Sprintf("%d argc=%d", target, arg&0xFF)
+			comment = strings.Join(labels[target], ", ")
+		case OP_CALL_FN:
+			operand = fmt.Sprintf("argc=%d", arg)
+		case OP_SYSCALL:
+			operand = strconv.Itoa(arg)
+			comment = hosts[arg]
+		default:
+			if arg != 0 || op == OP_PUSH_L || op == OP_POP_L || op == OP_GEN || op == OP_PUSH_G || op == OP_POP_G || op == OP_MAKE_CELL || op == OP_LOAD_DEREF || op == OP_STORE_DEREF || op == OP_JMP || op == OP_JMP_FALSE || op == OP_JMP_FALSE_OR_POP || op == OP_JMP_TRUE_OR_POP || op == OP_SETUP_EXCEPT {
+				operand = strconv.Itoa(arg)
+			}
+		}
+		line := fmt.Sprintf("%6d  %-12s %s", ip, opName(op), operand)
+		if comment != "" {
+			line = fmt.Sprintf("%-34s ; %s", line, comment)
+		}
+		b.WriteString(strings.TrimRight(line, " "))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// formatConstant renders a constant, quoting strings so that they can be told
+// apart from numbers.
+func formatConstant(v value.Value, arena []byte) string {
+	if v.Type == value.TypeString {
+		return strconv.Quote(v.Format(arena))
+	}
+	return v.Format(arena)
+}
@@ -0,0 +1,44 @@
+package vm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestDisassemble(t *testing.T) {
+	bc := &vm.Bytecode{
+		Instructions: []uint32{
+			(uint32(vm.OP_JMP) << 24) | 3,
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_RET) << 24),
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_CALL) << 24) | (1 << 8) | 1,
+			(uint32(vm.OP_SYSCALL) << 24) | 2,
+			(uint32(0xEE) << 24),
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{{Type: value.TypeString, Data: value.PackString(0, 2)}},
+		Arena:     []byte("hi"),
+		Functions: map[string]int{"f": 1},
+		Links:     []vm.HostLink{{Index: 2, Name: "print"}},
+	}
+	want := `     0  JMP          3
+f:
+     1  PUSH_L       0
+     2  RET
+     3  PUSH_C       0             ; "hi"
+     4  CALL         1 argc=1      ; f
+     5  SYSCALL      2             ; print
+     6  OP_EE
+     7  HALT
+`
+	if got := vm.Disassemble(bc); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if !strings.HasSuffix(vm.Disassemble(&vm.Bytecode{Instructions: []uint32{(uint32(vm.OP_PUSH_C) << 24) | 5}}), "; out of range\n") {
+		t.Errorf("missing constant not flagged")
+	}
+}
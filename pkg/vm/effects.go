@@ -0,0 +1,465 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+var (
+	ErrReplayDivergence = errors.New("vm: replay diverged from the recording")
+	ErrBadEffectLog     = errors.New("vm: malformed effect log")
+)
+
+const (
+	effectLogMagic   = "NPYE"
+	effectLogVersion = 2
+)
+
+// EffectHandler intercepts the calls to host functions marked
+// Nondeterministic while it is set as Machine.Effects. Recorder and Replayer
+// implement it.
+type EffectHandler interface {
+	// HostCall performs, or stands in for, the call of entry, registered at
+	// index. Like entry.Fn, it pops the arguments and pushes the results.
+	HostCall(m *Machine, index int, entry *HostFunctionEntry) error
+}
+
+// EffectRecord is one call of a nondeterministic host function. Args holds
+// the values the function popped, as far as its Effect declares them, and
+// Results the values it pushed. Strings in Args and Results carry their text
+// in Opaque rather than pointing into an arena, so that records outlive the
+// machine that made them.
+type EffectRecord struct {
+	Index   int
+	Name    string
+	Args    []value.Value
+	Results []value.Value
+	// Gas is what the function charged through ConsumeGas.
+	Gas int
+	// ErrKind and ErrMessage describe the error the function returned, if
+	// any, as a RuntimeError would.
+	ErrKind, ErrMessage string
+}
+
+// String renders the record as a call, e.g. fetch("http://x") -> "body".
+func (r *EffectRecord) String() string {
+	s := formatCall(r.Name, r.Args) + " -> "
+	if r.ErrKind != "" {
+		return s + r.ErrKind + ": " + r.ErrMessage
+	}
+	return s + formatValues(r.Results)
+}
+
+// EffectLog is the sequence of nondeterministic host function calls of an
+// execution.
+type EffectLog struct {
+	Records []EffectRecord
+}
+
+// MarshalBinary encodes the log.
+func (l *EffectLog) MarshalBinary() ([]byte, error) {
+	w := &encoder{refs: make(map[objectRef]uint64)}
+	w.buf = append(w.buf, effectLogMagic...)
+	w.buf = append(w.buf, effectLogVersion)
+	w.uint(uint64(len(l.Records)))
+	for _, r := range l.Records {
+		w.int(r.Index)
+		w.string(r.Name)
+		w.values(r.Args)
+		w.values(r.Results)
+		w.int(r.Gas)
+		w.string(r.ErrKind)
+		w.string(r.ErrMessage)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary decodes a log written by MarshalBinary.
+func (l *EffectLog) UnmarshalBinary(data []byte) error {
+	r := &decoder{buf: data}
+	if string(r.next(len(effectLogMagic))) != effectLogMagic || r.byte() != effectLogVersion {
+		return ErrBadEffectLog
+	}
+	var records []EffectRecord
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		records = append(records, EffectRecord{
+			Index:      r.int(),
+			Name:       r.string(),
+			Args:       r.values(),
+			Results:    r.values(),
+			Gas:        r.int(),
+			ErrKind:    r.string(),
+			ErrMessage: r.string(),
+		})
+	}
+	if r.err != nil || len(r.buf) != 0 {
+		return ErrBadEffectLog
+	}
+	l.Records = records
+	return nil
+}
+
+// Recorder is an EffectHandler that performs the calls and logs them. A
+// call that suspends the execution is logged when it is completed, with the
+// value passed to Complete as its result, so that a replay does not suspend.
+type Recorder struct {
+	Log EffectLog
+
+	suspended *EffectRecord
+	handle    Handle
+}
+
+func (rec *Recorder) HostCall(m *Machine, index int, entry *HostFunctionEntry) error {
+	base := hostArgs(m, entry)
+	r := EffectRecord{Index: index, Name: entry.Name, Args: detachValues(m.Stack[base:m.SP], m.Arena)}
+	used := m.GasUsed()
+	err := entry.Fn(m)
+	// A call that runs out of gas or is cancelled is rolled back and made
+	// again on Resume.
+	if errors.Is(err, ErrGasExhausted) || m.Context().Err() != nil {
+		return err
+	}
+	r.Gas = m.GasUsed() - used
+	if errors.Is(err, ErrSuspended) && m.pending != 0 {
+		rec.suspended, rec.handle = &r, m.pending
+		return err
+	}
+	if err != nil {
+		r.ErrKind, r.ErrMessage = errorKind(err)
+	} else if m.SP >= base {
+		r.Results = detachValues(m.Stack[base:m.SP], m.Arena)
+	}
+	rec.Log.Records = append(rec.Log.Records, r)
+	return err
+}
+
+// complete logs the suspended call h with its result v.
+func (rec *Recorder) complete(m *Machine, h Handle, v value.Value) {
+	if rec.suspended == nil || rec.handle != h {
+		return // suspended before the recorder was set
+	}
+	rec.suspended.Results = detachValues([]value.Value{v}, m.Arena)
+	rec.Log.Records = append(rec.Log.Records, *rec.suspended)
+	rec.suspended = nil
+}
+
+// Replayer is an EffectHandler that answers the calls from a log without
+// running the host functions. A call that does not match the next record,
+// by name and arguments, fails with a DivergenceError.
+type Replayer struct {
+	log  *EffectLog
+	next int
+}
+
+// NewReplayer returns a replayer for log.
+func NewReplayer(log *EffectLog) *Replayer {
+	return &Replayer{log: log}
+}
+
+// Remaining returns the number of records not replayed yet.
+func (rp *Replayer) Remaining() int {
+	return len(rp.log.Records) - rp.next
+}
+
+func (rp *Replayer) HostCall(m *Machine, index int, entry *HostFunctionEntry) error {
+	base := hostArgs(m, entry)
+	args := detachValues(m.Stack[base:m.SP], m.Arena)
+	d := &DivergenceError{Seq: rp.next, Name: entry.Name, Args: args}
+	if rp.next >= len(rp.log.Records) {
+		return d
+	}
+	r := &rp.log.Records[rp.next]
+	if d.Want = r; !sameCall(r, index, entry.Name, args) {
+		return d
+	}
+	if err := m.ConsumeGas(r.Gas); err != nil {
+		return err
+	}
+	rp.next++
+	m.SP = base
+	if r.ErrKind != "" {
+		return &RuntimeError{Kind: r.ErrKind, Message: r.ErrMessage}
+	}
+	memo := make(map[unsafe.Pointer]any)
+	for _, v := range r.Results {
+		v, err := attach(v, m, memo)
+		if err != nil {
+			return err
+		}
+		m.Push(v)
+	}
+	return nil
+}
+
+// DivergenceError reports the first call of a replayed execution that does
+// not match the recording: the call Seq, counted from 0, of Name with Args.
+// Want is the record it was expected to match, or nil if the log has ended.
+type DivergenceError struct {
+	Seq  int
+	Name string
+	Args []value.Value
+	Want *EffectRecord
+}
+
+func (e *DivergenceError) Error() string {
+	got := formatCall(e.Name, e.Args)
+	if e.Want == nil {
+		return fmt.Sprintf("replay diverged at call %d: %s is not in the recording", e.Seq, got)
+	}
+	return fmt.Sprintf("replay diverged at call %d: %s was recorded as %s", e.Seq, got, formatCall(e.Want.Name, e.Want.Args))
+}
+
+func (e *DivergenceError) Unwrap() error { return ErrReplayDivergence }
+
+// hostArgs returns the stack index of the first argument of entry, as its
+// Effect declares them; without one no arguments are known.
+func hostArgs(m *Machine, entry *HostFunctionEntry) int {
+	n := 0
+	if e := entry.Effect; e != nil {
+		n = e.Pops
+		if e.Variadic && m.SP > 0 {
+			n += int(m.Stack[m.SP-1].Data)
+		}
+	}
+	return max(m.SP-min(n, m.SP), 0)
+}
+
+// sameCall reports whether a call of name at index with args matches r.
+// Names are compared when both are known, so that a log survives changes
+// to the registry order.
+func sameCall(r *EffectRecord, index int, name string, args []value.Value) bool {
+	if r.Name != "" && name != "" {
+		if r.Name != name {
+			return false
+		}
+	} else if r.Index != index {
+		return false
+	}
+	if len(r.Args) != len(args) {
+		return false
+	}
+	c := make(comparison)
+	for i := range args {
+		if !c.same(r.Args[i], args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// comparison compares detached values structurally. It holds the pairs of
+// lists and dicts being compared, which are taken to be equal when met
+// again inside themselves.
+type comparison map[[2]unsafe.Pointer]bool
+
+func (c comparison) visit(a, b unsafe.Pointer) bool {
+	k := [2]unsafe.Pointer{a, b}
+	if c[k] {
+		return false
+	}
+	c[k] = true
+	return true
+}
+
+func (c comparison) same(a, b any) bool {
+	switch a := a.(type) {
+	case value.Value:
+		b, ok := b.(value.Value)
+		return ok && a.Type == b.Type && a.Data == b.Data && c.same(a.Opaque, b.Opaque)
+	case *[]value.Value:
+		b, ok := b.(*[]value.Value)
+		return ok && (!c.visit(unsafe.Pointer(a), unsafe.Pointer(b)) || c.same(*a, *b))
+	case []value.Value:
+		b, ok := b.([]value.Value)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !c.same(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		if !c.visit(reflect.ValueOf(a).UnsafePointer(), reflect.ValueOf(b).UnsafePointer()) {
+			return true
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !c.same(v, w) {
+				return false
+			}
+		}
+		return true
+	case *value.Iterator:
+		b, ok := b.(*value.Iterator)
+		return ok && a.Kind == b.Kind && a.Index == b.Index && c.same(a.List, b.List)
+	case *big.Int:
+		b, ok := b.(*big.Int)
+		return ok && a.Cmp(b) == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func detachValues(vs []value.Value, arena []byte) []value.Value {
+	if len(vs) == 0 {
+		return nil
+	}
+	memo := make(map[unsafe.Pointer]any)
+	out := make([]value.Value, len(vs))
+	for i, v := range vs {
+		out[i] = detach(v, arena, memo).(value.Value)
+	}
+	return out
+}
+
+// detach copies o with the strings it refers to taken out of the arena.
+// Shared lists, dicts and iterators stay shared.
+func detach(o any, arena []byte, memo map[unsafe.Pointer]any) any {
+	switch o := o.(type) {
+	case value.Value:
+		if o.Type == value.TypeString {
+			return value.Value{Type: value.TypeString, Opaque: strings.Clone(value.UnpackString(o.Data, arena))}
+		}
+		o.Opaque = detach(o.Opaque, arena, memo)
+		return o
+	case *[]value.Value:
+		if d, ok := memo[unsafe.Pointer(o)]; ok {
+			return d
+		}
+		l := make([]value.Value, len(*o))
+		memo[unsafe.Pointer(o)] = &l
+		for i, v := range *o {
+			l[i] = detach(v, arena, memo).(value.Value)
+		}
+		return &l
+	case []value.Value:
+		l := make([]value.Value, len(o))
+		for i, v := range o {
+			l[i] = detach(v, arena, memo).(value.Value)
+		}
+		return l
+	case map[string]any:
+		p := reflect.ValueOf(o).UnsafePointer()
+		if d, ok := memo[p]; ok {
+			return d
+		}
+		d := make(map[string]any, len(o))
+		memo[p] = d
+		for k, v := range o {
+			d[k] = detach(v, arena, memo)
+		}
+		return d
+	case *value.Iterator:
+		if d, ok := memo[unsafe.Pointer(o)]; ok {
+			return d
+		}
+		c := *o
+		it := &c
+		memo[unsafe.Pointer(o)] = it
+		if o.List != nil {
+			it.List = detach(o.List, arena, memo).(*[]value.Value)
+		}
+		if o.Ahead != nil {
+			it.Ahead = detach(o.Ahead, arena, memo).([]value.Value)
+		}
+		return it
+	}
+	return o
+}
+
+// attach copies a detached o with its strings written to the arena of m.
+func attach(o any, m *Machine, memo map[unsafe.Pointer]any) (_ value.Value, err error) {
+	var walk func(o any) any
+	walk = func(o any) any {
+		switch o := o.(type) {
+		case value.Value:
+			if s, ok := o.Opaque.(string); ok && o.Type == value.TypeString {
+				off, werr := m.WriteArena([]byte(s))
+				if werr != nil && err == nil {
+					err = werr
+				}
+				return value.Value{Type: value.TypeString, Data: value.PackString(off, uint32(len(s)))}
+			}
+			o.Opaque = walk(o.Opaque)
+			return o
+		case *[]value.Value:
+			if a, ok := memo[unsafe.Pointer(o)]; ok {
+				return a
+			}
+			l := make([]value.Value, len(*o))
+			memo[unsafe.Pointer(o)] = &l
+			for i, v := range *o {
+				l[i] = walk(v).(value.Value)
+			}
+			return &l
+		case []value.Value:
+			l := make([]value.Value, len(o))
+			for i, v := range o {
+				l[i] = walk(v).(value.Value)
+			}
+			return l
+		case map[string]any:
+			p := reflect.ValueOf(o).UnsafePointer()
+			if a, ok := memo[p]; ok {
+				return a
+			}
+			d := make(map[string]any, len(o))
+			memo[p] = d
+			for k, v := range o {
+				d[k] = walk(v)
+			}
+			return d
+		case *value.Iterator:
+			if a, ok := memo[unsafe.Pointer(o)]; ok {
+				return a
+			}
+			c := *o
+			it := &c
+			memo[unsafe.Pointer(o)] = it
+			if o.List != nil {
+				it.List = walk(o.List).(*[]value.Value)
+			}
+			if o.Ahead != nil {
+				it.Ahead = walk(o.Ahead).([]value.Value)
+			}
+			return it
+		}
+		return o
+	}
+	return walk(o).(value.Value), err
+}
+
+func formatValues(vs []value.Value) string {
+	m := &Machine{}
+	memo := make(map[unsafe.Pointer]any)
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		v, _ := attach(v, m, memo)
+		parts[i] = v.Format(m.Arena)
+		if v.Type == value.TypeString {
+			parts[i] = strconv.Quote(parts[i])
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatCall(name string, args []value.Value) string {
+	if name == "" {
+		name = "<host function>"
+	}
+	return name + "(" + formatValues(args) + ")"
+}
@@ -0,0 +1,124 @@
+package vm_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// effectMachine returns a machine that calls a nondeterministic host
+// function with "a" and then with arg, leaving both results on the stack.
+// The function answers [arg, n] for its nth real call and charges 7 gas.
+func effectMachine(arg string, calls *int) *vm.Machine {
+	m := vm.NewMachine(vm.DefaultLimits)
+	m.Code = []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_PUSH_C) << 24) | 1,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_HALT) << 24),
+	}
+	m.Arena = []byte("a" + arg)
+	m.Constants = []value.Value{
+		{Type: value.TypeString, Data: value.PackString(0, 1)},
+		{Type: value.TypeString, Data: value.PackString(1, uint32(len(arg)))},
+	}
+	m.HostRegistry = append(m.HostRegistry, vm.HostFunctionEntry{
+		Name:             "lookup",
+		Effect:           &vm.StackEffect{Pops: 1, Pushes: 1},
+		Nondeterministic: true,
+		Fn: func(m *vm.Machine) error {
+			*calls++
+			if err := m.ConsumeGas(7); err != nil {
+				return err
+			}
+			list := []value.Value{m.Pop(), {Type: value.TypeInt, Data: uint64(*calls)}}
+			m.Push(value.Value{Type: value.TypeList, Opaque: &list})
+			return nil
+		},
+	})
+	return m
+}
+
+func TestRecordReplay(t *testing.T) {
+	var calls int
+	m := effectMachine("b", &calls)
+	rec := &vm.Recorder{}
+	m.Effects = rec
+	if err := m.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{m.Stack[0].Format(m.Arena), m.Stack[1].Format(m.Arena)}
+	if want[0] != "[a, 1]" || want[1] != "[b, 2]" || len(rec.Log.Records) != 2 {
+		t.Fatalf("unexpected recording %v, %d records", want, len(rec.Log.Records))
+	}
+	if got := rec.Log.Records[1].String(); got != `lookup("b") -> [b, 2]` {
+		t.Errorf("unexpected record %s", got)
+	}
+
+	data, err := rec.Log.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log vm.EffectLog
+	if err := log.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replay answers from the log, without calling the function.
+	calls = 100
+	r := effectMachine("b", &calls)
+	rp := vm.NewReplayer(&log)
+	r.Effects = rp
+	if err := r.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{r.Stack[0].Format(r.Arena), r.Stack[1].Format(r.Arena)}
+	if calls != 100 || got[0] != want[0] || got[1] != want[1] || rp.Remaining() != 0 {
+		t.Errorf("replay made %d calls and returned %v", calls-100, got)
+	}
+	if r.GasUsed() != m.GasUsed() {
+		t.Errorf("replay used %d gas, the recording %d", r.GasUsed(), m.GasUsed())
+	}
+
+	// The second call has other arguments.
+	r = effectMachine("c", &calls)
+	r.Effects = vm.NewReplayer(&log)
+	err = r.Run(100)
+	var d *vm.DivergenceError
+	if !errors.Is(err, vm.ErrReplayDivergence) || !errors.As(err, &d) || d.Seq != 1 || d.Want == nil {
+		t.Fatalf("expected a divergence at call 1, got %v", err)
+	}
+	if d.Error() != `replay diverged at call 1: lookup("c") was recorded as lookup("b")` {
+		t.Errorf("unexpected message %q", d.Error())
+	}
+
+	// The log ends early.
+	short := vm.EffectLog{Records: log.Records[:1]}
+	r = effectMachine("b", &calls)
+	r.Effects = vm.NewReplayer(&short)
+	if err := r.Run(100); !errors.As(err, &d) || d.Seq != 1 || d.Want != nil {
+		t.Errorf("expected the call past the log to diverge, got %v", err)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	log := vm.EffectLog{Records: []vm.EffectRecord{{
+		Name:    "lookup",
+		Args:    []value.Value{{Type: value.TypeString, Opaque: "a"}},
+		ErrKind: "KeyError", ErrMessage: "'a'",
+	}}}
+	var calls int
+	m := effectMachine("b", &calls)
+	m.Effects = vm.NewReplayer(&log)
+	var re *vm.RuntimeError
+	if err := m.Run(100); !errors.As(err, &re) || re.Kind != "KeyError" || calls != 0 {
+		t.Errorf("expected the recorded KeyError, got %v", err)
+	}
+
+	if err := new(vm.EffectLog).UnmarshalBinary([]byte("NPYE")); !errors.Is(err, vm.ErrBadEffectLog) {
+		t.Errorf("expected ErrBadEffectLog, got %v", err)
+	}
+}
@@ -0,0 +1,589 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/big"
+	"reflect"
+	"unsafe"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+// errMalformed is reported by the decoder; callers replace it with an error
+// specific to the format being read.
+var errMalformed = errors.New("vm: malformed data")
+
+// Kinds of Go values found in Value.Opaque and in dict entries.
+const (
+	kindNil byte = iota
+	kindValue
+	kindList  // *[]value.Value, shared
+	kindTuple // []value.Value
+	kindDict  // map[string]any, shared
+	kindSet   // map[any]struct{}, shared
+	kindIter  // *value.Iterator, shared
+	kindBytes
+	kindString
+	kindFloat
+	kindInt64
+	kindBool
+	kindSlice // []any, from parsed JSON
+	kindUint64
+	kindInt
+	kindException // *value.Exception, without the error that raised it
+	kindFunction  // *value.Function, shared
+	kindCell      // *value.Cell, shared
+	kindBigInt    // *big.Int of an int that does not fit in int64
+	kindRange     // *value.Range
+)
+
+func codeChecksum(code []uint32) uint32 {
+	h := crc32.NewIEEE()
+	var b [4]byte
+	for _, instr := range code {
+		binary.LittleEndian.PutUint32(b[:], instr)
+		h.Write(b[:])
+	}
+	return h.Sum32()
+}
+
+// objectRef identifies a shared object by kind and address.
+type objectRef struct {
+	kind byte
+	ptr  unsafe.Pointer
+}
+
+type encoder struct {
+	buf  []byte
+	refs map[objectRef]uint64
+	err  error
+}
+
+func (w *encoder) uint(n uint64) { w.buf = binary.AppendUvarint(w.buf, n) }
+func (w *encoder) int(n int)     { w.buf = binary.AppendVarint(w.buf, int64(n)) }
+
+func (w *encoder) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *encoder) bytes(b []byte) {
+	w.uint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *encoder) string(s string) {
+	w.uint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *encoder) strings(ss []string) {
+	w.uint(uint64(len(ss)))
+	for _, s := range ss {
+		w.string(s)
+	}
+}
+
+func (w *encoder) value(v value.Value) {
+	w.buf = append(w.buf, byte(v.Type))
+	w.uint(v.Data)
+	w.object(v.Opaque)
+}
+
+// ref writes the id of a shared object and reports whether this is its first
+// occurrence, in which case the caller writes its contents next.
+func (w *encoder) ref(kind byte, ptr unsafe.Pointer) bool {
+	key := objectRef{kind, ptr}
+	if id, ok := w.refs[key]; ok {
+		w.uint(id)
+		return false
+	}
+	id := uint64(len(w.refs))
+	w.refs[key] = id
+	w.uint(id)
+	return true
+}
+
+func (w *encoder) object(o any) {
+	switch o := o.(type) {
+	case nil:
+		w.buf = append(w.buf, kindNil)
+	case value.Value:
+		w.buf = append(w.buf, kindValue)
+		w.value(o)
+	case *[]value.Value:
+		w.buf = append(w.buf, kindList)
+		if w.ref(kindList, unsafe.Pointer(o)) {
+			w.values(*o)
+		}
+	case []value.Value:
+		w.buf = append(w.buf, kindTuple)
+		w.values(o)
+	case map[string]any:
+		w.buf = append(w.buf, kindDict)
+		if w.ref(kindDict, reflect.ValueOf(o).UnsafePointer()) {
+			w.uint(uint64(len(o)))
+			for k, v := range o {
+				w.string(k)
+				w.object(v)
+			}
+		}
+	case map[any]struct{}:
+		w.buf = append(w.buf, kindSet)
+		if w.ref(kindSet, reflect.ValueOf(o).UnsafePointer()) {
+			w.uint(uint64(len(o)))
+			for k := range o {
+				w.object(k)
+			}
+		}
+	case *value.Iterator:
+		w.buf = append(w.buf, kindIter)
+		if w.ref(kindIter, unsafe.Pointer(o)) {
+			w.iterator(o)
+		}
+	case *value.Range:
+		w.buf = append(w.buf, kindRange)
+		w.int(o.Start)
+		w.int(o.Stop)
+		w.int(o.Step)
+	case []byte:
+		w.buf = append(w.buf, kindBytes)
+		w.bytes(o)
+	case string:
+		w.buf = append(w.buf, kindString)
+		w.string(o)
+	case float64:
+		w.buf = append(w.buf, kindFloat)
+		w.uint(math.Float64bits(o))
+	case int64:
+		w.buf = append(w.buf, kindInt64)
+		w.int(int(o))
+	case bool:
+		w.buf = append(w.buf, kindBool)
+		w.bool(o)
+	case []any:
+		w.buf = append(w.buf, kindSlice)
+		w.uint(uint64(len(o)))
+		for _, v := range o {
+			w.object(v)
+		}
+	case uint64:
+		w.buf = append(w.buf, kindUint64)
+		w.uint(o)
+	case int:
+		w.buf = append(w.buf, kindInt)
+		w.int(o)
+	case *value.Exception:
+		w.buf = append(w.buf, kindException)
+		w.string(o.Kind)
+		w.string(o.Message)
+	case *value.Function:
+		w.buf = append(w.buf, kindFunction)
+		if w.ref(kindFunction, unsafe.Pointer(o)) {
+			w.string(o.Name)
+			w.int(o.Entry)
+			w.int(o.Arity)
+			w.uint(uint64(len(o.Cells)))
+			for _, c := range o.Cells {
+				w.object(c)
+			}
+		}
+	case *value.Cell:
+		w.buf = append(w.buf, kindCell)
+		if w.ref(kindCell, unsafe.Pointer(o)) {
+			w.value(o.Value)
+		}
+	case *big.Int:
+		w.buf = append(w.buf, kindBigInt)
+		w.bool(o.Sign() < 0)
+		w.bytes(o.Bytes())
+	default:
+		if w.err == nil {
+			w.err = fmt.Errorf("vm: cannot snapshot value of type %T", o)
+		}
+	}
+}
+
+func (w *encoder) iterator(it *value.Iterator) {
+	w.uint(uint64(it.Kind))
+	if it.List != nil {
+		w.object(it.List)
+	} else {
+		w.object(nil)
+	}
+	w.int(it.Index)
+	w.int(it.Stop)
+	w.int(it.Step)
+	w.value(it.Fn)
+	w.uint(uint64(len(it.Sources)))
+	for _, src := range it.Sources {
+		w.object(src)
+	}
+	w.values(it.Ahead)
+	g := it.Gen
+	w.bool(g != nil)
+	if g == nil {
+		return
+	}
+	w.int(g.Entry)
+	w.int(g.IP)
+	w.values(g.Locals)
+	w.values(g.Stack)
+	w.uint(uint64(len(g.Calls)))
+	for _, c := range g.Calls {
+		w.int(c.Entry)
+		w.int(c.ReturnIP)
+		w.int(c.BaseSP)
+		w.int(c.ArgCount)
+		w.values(c.Locals)
+	}
+	w.strings(g.Scopes)
+	w.uint(uint64(len(g.Handlers)))
+	for _, h := range g.Handlers {
+		w.int(h.IP)
+		w.int(h.SP)
+		w.int(h.Frame)
+		w.int(h.Scopes)
+	}
+}
+
+func (w *encoder) values(vs []value.Value) {
+	w.uint(uint64(len(vs)))
+	for _, v := range vs {
+		w.value(v)
+	}
+}
+
+// maxDecodeDepth bounds the nesting of decoded objects.
+const maxDecodeDepth = 10000
+
+type decoder struct {
+	buf   []byte
+	objs  []any
+	depth int
+	err   error
+	// open holds the iterators being decoded, which must not be their
+	// own sources.
+	open map[*value.Iterator]bool
+}
+
+func (r *decoder) fail() {
+	if r.err == nil {
+		r.err = errMalformed
+	}
+	r.buf = nil
+}
+
+func (r *decoder) next(n int) []byte {
+	if n < 0 || n > len(r.buf) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *decoder) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *decoder) uint() uint64 {
+	n, size := binary.Uvarint(r.buf)
+	if size <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[size:]
+	return n
+}
+
+func (r *decoder) int() int {
+	n, size := binary.Varint(r.buf)
+	if size <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[size:]
+	return int(n)
+}
+
+func (r *decoder) bool() bool { return r.byte() != 0 }
+
+// count reads a length and checks it against the remaining input, where each
+// element takes at least one byte.
+func (r *decoder) count() int {
+	n := r.uint()
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (r *decoder) bytes() []byte  { return r.next(r.count()) }
+func (r *decoder) string() string { return string(r.bytes()) }
+
+func (r *decoder) strings() []string {
+	var ss []string
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		ss = append(ss, r.string())
+	}
+	return ss
+}
+
+func (r *decoder) value() value.Value {
+	t := value.Type(r.byte())
+	data := r.uint()
+	return value.Value{Type: t, Data: data, Opaque: r.object()}
+}
+
+// ref reads an object id. It returns the object if it was seen before, or
+// registers a new id and returns nil so the caller decodes the contents.
+func (r *decoder) ref() (any, bool) {
+	id := r.uint()
+	switch {
+	case id < uint64(len(r.objs)):
+		return r.objs[id], true
+	case id == uint64(len(r.objs)):
+		return nil, false
+	}
+	r.fail()
+	return nil, true
+}
+
+func (r *decoder) object() any {
+	if r.err != nil {
+		return nil
+	}
+	if r.depth++; r.depth > maxDecodeDepth {
+		r.fail()
+		return nil
+	}
+	defer func() { r.depth-- }()
+	switch r.byte() {
+	case kindNil:
+		return nil
+	case kindValue:
+		return r.value()
+	case kindList:
+		if o, ok := r.ref(); ok {
+			if l, ok := o.(*[]value.Value); ok {
+				return l
+			}
+			r.fail()
+			return nil
+		}
+		l := new([]value.Value)
+		r.objs = append(r.objs, l)
+		*l = r.values()
+		return l
+	case kindTuple:
+		return r.values()
+	case kindDict:
+		if o, ok := r.ref(); ok {
+			if d, ok := o.(map[string]any); ok {
+				return d
+			}
+			r.fail()
+			return nil
+		}
+		n := r.count()
+		d := make(map[string]any, n)
+		r.objs = append(r.objs, d)
+		for i := 0; i < n && r.err == nil; i++ {
+			k := r.string()
+			d[k] = r.object()
+		}
+		return d
+	case kindSet:
+		if o, ok := r.ref(); ok {
+			if s, ok := o.(map[any]struct{}); ok {
+				return s
+			}
+			r.fail()
+			return nil
+		}
+		n := r.count()
+		s := make(map[any]struct{}, n)
+		r.objs = append(r.objs, s)
+		for i := 0; i < n && r.err == nil; i++ {
+			k := r.object()
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				r.fail()
+				return nil
+			}
+			s[k] = struct{}{}
+		}
+		return s
+	case kindIter:
+		if o, ok := r.ref(); ok {
+			if it, ok := o.(*value.Iterator); ok {
+				return it
+			}
+			r.fail()
+			return nil
+		}
+		it := &value.Iterator{}
+		r.objs = append(r.objs, it)
+		r.iterator(it)
+		return it
+	case kindRange:
+		rg := &value.Range{Start: r.int(), Stop: r.int(), Step: r.int()}
+		if rg.Step == 0 {
+			r.fail()
+		}
+		return rg
+	case kindBytes:
+		return append([]byte(nil), r.bytes()...)
+	case kindString:
+		return r.string()
+	case kindFloat:
+		return math.Float64frombits(r.uint())
+	case kindInt64:
+		return int64(r.int())
+	case kindBool:
+		return r.bool()
+	case kindSlice:
+		n := r.count()
+		s := make([]any, n)
+		for i := range s {
+			s[i] = r.object()
+		}
+		return s
+	case kindUint64:
+		return r.uint()
+	case kindInt:
+		return r.int()
+	case kindException:
+		return &value.Exception{Kind: r.string(), Message: r.string()}
+	case kindBigInt:
+		neg := r.bool()
+		b := new(big.Int).SetBytes(r.bytes())
+		if neg {
+			b.Neg(b)
+		}
+		return b
+	case kindFunction:
+		if o, ok := r.ref(); ok {
+			if f, ok := o.(*value.Function); ok {
+				return f
+			}
+			r.fail()
+			return nil
+		}
+		f := &value.Function{}
+		r.objs = append(r.objs, f)
+		f.Name, f.Entry, f.Arity = r.string(), r.int(), r.int()
+		f.Cells = make([]*value.Cell, r.count())
+		for i := range f.Cells {
+			if f.Cells[i], _ = r.object().(*value.Cell); f.Cells[i] == nil {
+				r.fail()
+				return nil
+			}
+		}
+		return f
+	case kindCell:
+		if o, ok := r.ref(); ok {
+			if c, ok := o.(*value.Cell); ok {
+				return c
+			}
+			r.fail()
+			return nil
+		}
+		c := &value.Cell{}
+		r.objs = append(r.objs, c)
+		c.Value = r.value()
+		return c
+	}
+	r.fail()
+	return nil
+}
+
+func (r *decoder) iterator(it *value.Iterator) {
+	if r.open == nil {
+		r.open = make(map[*value.Iterator]bool)
+	}
+	r.open[it] = true
+	defer delete(r.open, it)
+	it.Kind = value.IterKind(r.uint())
+	it.List, _ = r.object().(*[]value.Value)
+	it.Index, it.Stop, it.Step = r.int(), r.int(), r.int()
+	it.Fn = r.value()
+	if n := r.count(); n > 0 {
+		it.Sources = make([]*value.Iterator, n)
+		for i := range it.Sources {
+			src, _ := r.object().(*value.Iterator)
+			if src == nil || r.open[src] {
+				r.fail()
+				return
+			}
+			it.Sources[i] = src
+		}
+	}
+	if it.Ahead = r.values(); len(it.Ahead) == 0 {
+		it.Ahead = nil
+	}
+	if r.bool() {
+		g := &value.Generator{Entry: r.int(), IP: r.int(), Locals: r.values(), Stack: r.values()}
+		if n := r.count(); n > 0 {
+			g.Calls = make([]value.Call, n)
+			for i := range g.Calls {
+				c := value.Call{Entry: r.int(), ReturnIP: r.int(), BaseSP: r.int(), ArgCount: r.int(), Locals: r.values()}
+				if c.BaseSP < 0 || c.BaseSP > len(g.Stack) {
+					r.fail()
+					return
+				}
+				g.Calls[i] = c
+			}
+		}
+		g.Scopes = r.strings()
+		if n := r.count(); n > 0 {
+			g.Handlers = make([]value.Handler, n)
+			for i := range g.Handlers {
+				h := value.Handler{IP: r.int(), SP: r.int(), Frame: r.int(), Scopes: r.int()}
+				if h.IP < 0 || h.SP < 0 || h.SP > len(g.Stack) || h.Frame < 0 || h.Frame > len(g.Calls) || h.Scopes < 0 || h.Scopes > len(g.Scopes) {
+					r.fail()
+					return
+				}
+				g.Handlers[i] = h
+			}
+		}
+		it.Gen = g
+	}
+	var ok bool
+	switch it.Kind {
+	case value.IterList:
+		ok = it.List != nil
+	case value.IterRange:
+		ok = it.Step != 0
+	case value.IterMap, value.IterFilter, value.IterEnumerate:
+		ok = len(it.Sources) == 1
+	case value.IterZip:
+		ok = len(it.Sources) > 0
+	case value.IterGenerator:
+		ok = it.Gen != nil
+	}
+	if !ok {
+		r.fail()
+	}
+}
+
+func (r *decoder) values() []value.Value {
+	n := r.count()
+	vs := make([]value.Value, n)
+	for i := range vs {
+		vs[i] = r.value()
+	}
+	return vs
+}
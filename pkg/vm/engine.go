@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// EngineOptions configures an Engine. The zero value runs with
+// DefaultLimits, one worker per CPU, no gatekeeper and the default cost of
+// one gas unit per instruction.
+type EngineOptions struct {
+	// Workers bounds the number of executions running at once; zero
+	// means runtime.GOMAXPROCS(0).
+	Workers     int
+	Limits      Limits
+	Gatekeeper  Gatekeeper
+	GasSchedule *GasSchedule
+}
+
+// Engine runs one program many times, concurrently. The bytecode and the
+// host registry are shared by every execution and must not be modified
+// once the engine is created; everything an execution changes lives in a
+// machine of its own, taken from a pool private to the engine.
+//
+// Host functions run on many goroutines at once, so they must keep
+// per-execution state on the machine, with SetHostState, rather than in
+// their receiver.
+type Engine struct {
+	bc       *Bytecode
+	registry []HostFunctionEntry
+	opts     EngineOptions
+	slots    chan struct{}
+	pool     sync.Pool
+}
+
+// Execution is one run of an Engine's program.
+type Execution struct {
+	Gas int
+	// Setup, if set, is called with the machine before it runs, e.g. to
+	// set a Tracer, Effects or scope tokens.
+	Setup func(m *Machine)
+	// Done, if set, is called with the machine and the result of the run,
+	// to read globals or the stack before the machine is reused. Strings
+	// from the arena, including those returned by Format, must be copied
+	// to outlive it.
+	Done func(m *Machine, err error)
+}
+
+// NewEngine checks that bc links against registry and verifies within the
+// limits of opts, and returns an engine that runs it.
+func NewEngine(bc *Bytecode, registry []HostFunctionEntry, opts EngineOptions) (*Engine, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.Limits == (Limits{}) {
+		opts.Limits = DefaultLimits
+	}
+	if err := bc.CheckLinks(registry); err != nil {
+		return nil, err
+	}
+	if err := VerifyLimits(bc, registry, opts.Limits); err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		bc: bc,
+		// A Setup that registers more functions must not append to the
+		// shared array.
+		registry: slices.Clip(registry),
+		opts:     opts,
+		slots:    make(chan struct{}, opts.Workers),
+	}
+	e.pool.New = func() any { return NewMachine(opts.Limits) }
+	return e, nil
+}
+
+// Run executes the program once, waiting while the engine is running as
+// many executions as it has workers. It returns the error of the run, or
+// the context's error if ctx is done before a worker is free.
+func (e *Engine) Run(ctx context.Context, x Execution) error {
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctxError(ctx.Err())
+	}
+	defer func() { <-e.slots }()
+
+	m := e.pool.Get().(*Machine)
+	defer func() {
+		m.Reset()
+		e.pool.Put(m)
+	}()
+	e.load(m)
+	if x.Setup != nil {
+		x.Setup(m)
+	}
+	err := m.RunContext(ctx, x.Gas)
+	if x.Done != nil {
+		x.Done(m, err)
+	}
+	return err
+}
+
+// RunAll runs every execution of xs, as many at once as the engine has
+// workers, and returns their errors in the same order.
+func (e *Engine) RunAll(ctx context.Context, xs []Execution) []error {
+	errs := make([]error, len(xs))
+	var wg sync.WaitGroup
+	wg.Add(len(xs))
+	for i := range xs {
+		go func() {
+			defer wg.Done()
+			errs[i] = e.Run(ctx, xs[i])
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// load prepares a reset machine to run the engine's program.
+func (e *Engine) load(m *Machine) {
+	arena := m.Arena
+	clear(m.FunctionRegistry)
+	m.Load(e.bc)
+	// The machine appends to its arena, so it gets its own copy.
+	m.Arena = append(arena[:0], e.bc.Arena...)
+	m.HostRegistry = e.registry
+	m.Gatekeeper = e.opts.Gatekeeper
+	m.GasSchedule = e.opts.GasSchedule
+	m.GCThreshold = 0
+}
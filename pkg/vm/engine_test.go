@@ -0,0 +1,92 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestEngine(t *testing.T) {
+	// global 1 = global 0 + "!", after a host call that tracks how many
+	// executions run at once.
+	bc := &vm.Bytecode{
+		Instructions: []uint32{
+			(uint32(vm.OP_SYSCALL) << 24) | 0,
+			(uint32(vm.OP_PUSH_G) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_ADD) << 24),
+			(uint32(vm.OP_POP_G) << 24) | 1,
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{{Type: value.TypeString, Data: value.PackString(0, 1)}},
+		Arena:     make([]byte, 1, 64), // room to append in place
+		Globals:   2,
+	}
+	bc.Arena[0] = '!'
+	var running, peak atomic.Int32
+	var mu sync.Mutex
+	registry := []vm.HostFunctionEntry{{
+		Name:   "enter",
+		Effect: &vm.StackEffect{},
+		Fn: func(m *vm.Machine) error {
+			n := running.Add(1)
+			mu.Lock()
+			peak.Store(max(peak.Load(), n))
+			mu.Unlock()
+			running.Add(-1)
+			return nil
+		},
+	}}
+	bc.Links = vm.CollectLinks(bc.Instructions, map[uint32]string{0: "enter"})
+
+	e, err := vm.NewEngine(bc, registry, vm.EngineOptions{Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xs := make([]vm.Execution, 200)
+	got := make([]string, len(xs))
+	for i := range xs {
+		xs[i] = vm.Execution{
+			Gas: 100,
+			Setup: func(m *vm.Machine) {
+				s := fmt.Sprint(i)
+				off, _ := m.WriteArena([]byte(s))
+				m.Globals()[0] = value.Value{Type: value.TypeString, Data: value.PackString(off, uint32(len(s)))}
+			},
+			Done: func(m *vm.Machine, err error) {
+				// Strings point into the arena, which the next execution reuses.
+				got[i] = strings.Clone(m.Globals()[1].Format(m.Arena))
+			},
+		}
+	}
+	for i, err := range e.RunAll(context.Background(), xs) {
+		if err != nil {
+			t.Fatalf("execution %d: %v", i, err)
+		}
+		if want := fmt.Sprint(i) + "!"; got[i] != want {
+			t.Errorf("execution %d: got %q, want %q", i, got[i], want)
+		}
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("%d executions ran at once with 3 workers", p)
+	}
+	if len(bc.Arena) != 1 || cap(bc.Arena) != 64 || bc.Arena[:2][1] != 0 {
+		t.Errorf("the executions wrote to the shared arena")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := e.Run(ctx, vm.Execution{Gas: 100}); !errors.Is(err, vm.ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+	if _, err := vm.NewEngine(bc, nil, vm.EngineOptions{}); err == nil {
+		t.Error("expected a link error without a registry")
+	}
+}
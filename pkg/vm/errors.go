@@ -0,0 +1,162 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RuntimeError is an error raised while the program runs. Kind is the name of
+// the Python exception class (TypeError, KeyError, IndexError, ...) or, for
+// conditions imposed by the VM, one of SecurityViolation, GasExhausted,
+// Cancelled, DeadlineExceeded, Suspended, StackOverflow, StackUnderflow and
+// RecursionError. Err is the underlying error, if any, so errors.Is matches
+// the sentinels of this package and of the host functions.
+type RuntimeError struct {
+	Kind    string
+	Message string
+	Err     error
+	// IP is the failing instruction.
+	IP int
+	// Stack lists the active calls, outermost first; the last entry is the
+	// failing instruction.
+	Stack []StackFrame
+
+	debug *DebugInfo
+}
+
+// StackFrame is one entry of a RuntimeError's call stack. Line and Col are
+// zero, and Func is empty, without debug information. Frame is the index of
+// the call's frame in Machine.Frames.
+type StackFrame struct {
+	Func      string
+	IP        int
+	Line, Col int
+	Frame     int
+}
+
+// NewError returns a RuntimeError of the given kind for a host function to
+// return; the VM fills in the location.
+func NewError(kind, format string, args ...any) error {
+	return &RuntimeError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// WrapError is like NewError but takes the message from err and keeps it as
+// the cause.
+func WrapError(kind string, err error) error {
+	return &RuntimeError{Kind: kind, Message: err.Error(), Err: err}
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// Error renders "Kind: Message", preceded by a Python-style traceback when
+// the machine had debug information.
+func (e *RuntimeError) Error() string {
+	msg := e.Kind
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.debug == nil {
+		return msg
+	}
+	var b strings.Builder
+	b.WriteString("Traceback (most recent call last):\n")
+	for _, f := range e.Stack {
+		fmt.Fprintf(&b, "  File %q, line %d, in %s\n", e.debug.File, f.Line, f.Func)
+		if src := e.debug.SourceLine(f.Line); src != "" {
+			fmt.Fprintf(&b, "    %s\n", src)
+		}
+	}
+	b.WriteString(msg)
+	return b.String()
+}
+
+var errorKinds = map[error]string{
+	ErrStackOverflow:     "StackOverflow",
+	ErrStackUnderflow:    "StackUnderflow",
+	ErrFrameOverflow:     "RecursionError",
+	ErrLocalsOverflow:    "SystemError",
+	ErrGasExhausted:      "GasExhausted",
+	ErrSecurityViolation: "SecurityViolation",
+	ErrCancelled:         "Cancelled",
+	ErrDeadline:          "DeadlineExceeded",
+	ErrReplayDivergence:  "ReplayDivergence",
+	ErrSuspended:         "Suspended",
+}
+
+// fault turns err, raised at the current IP, into a RuntimeError and records
+// the location. Errors from host functions that are not RuntimeErrors become
+// kind RuntimeError. A RuntimeError that already has a location, from a
+// nested Call, is returned unchanged.
+func (m *Machine) fault(err error) error {
+	if err == errStop {
+		return err
+	}
+	var re *RuntimeError
+	if !errors.As(err, &re) {
+		kind, msg := errorKind(err)
+		re = &RuntimeError{Kind: kind, Message: msg, Err: err}
+		err = re
+	}
+	if re.Stack == nil {
+		re.IP, re.Stack, re.debug = m.IP, m.stack(), m.Debug
+	}
+	return err
+}
+
+// errorKind returns the kind and message of the RuntimeError that err
+// becomes.
+func errorKind(err error) (kind, msg string) {
+	var re *RuntimeError
+	if errors.As(err, &re) {
+		return re.Kind, re.Message
+	}
+	kind = "RuntimeError"
+	for sentinel, k := range errorKinds {
+		if errors.Is(err, sentinel) {
+			kind = k
+			break
+		}
+	}
+	return kind, strings.TrimPrefix(err.Error(), "vm: ")
+}
+
+// CallStack returns the active calls, outermost first, as a RuntimeError
+// would report them if the current instruction failed.
+func (m *Machine) CallStack() []StackFrame {
+	return m.stack()
+}
+
+// stack walks the active frames from the outermost call of the current
+// execution to the innermost.
+func (m *Machine) stack() []StackFrame {
+	var frames []StackFrame
+	ip := m.IP
+	for i := m.FP; i >= 0; i-- {
+		f := m.stackFrame(ip)
+		f.Frame = i
+		frames = append(frames, f)
+		fr := &m.Frames[i]
+		if i == 0 {
+			break
+		}
+		if fr.ReturnIP >= 0 {
+			ip = fr.ReturnIP - 1
+		} else if ip = fr.callerIP; ip < 0 {
+			break // called from outside the VM
+		}
+	}
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+func (m *Machine) stackFrame(ip int) StackFrame {
+	f := StackFrame{IP: ip}
+	if m.Debug != nil {
+		f.Func = m.Debug.FuncName(ip)
+		f.Line, f.Col = m.Debug.Position(ip)
+	}
+	return f
+}
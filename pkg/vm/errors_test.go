@@ -0,0 +1,78 @@
+package vm_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestRuntimeErrorTraceback(t *testing.T) {
+	// f(x) = x // 0, called from line 1
+	bc := &vm.Bytecode{
+		Instructions: []uint32{
+			(uint32(vm.OP_JMP) << 24) | 4,
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(vm.OP_FLOOR_DIV) << 24),
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_CALL) << 24) | (1 << 8) | 1,
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{{Type: value.TypeInt, Data: 7}, {Type: value.TypeInt, Data: 0}},
+		Debug: &vm.DebugInfo{
+			File:   "div.py",
+			Source: "print(f(7))\ndef f(x):\n    return x // 0\n",
+			Lines:  []vm.LineEntry{{IP: 0, Line: 2, Col: 1}, {IP: 1, Line: 3, Col: 5}, {IP: 4, Line: 1, Col: 1}},
+			Funcs:  []vm.FuncRange{{Name: "f", Start: 1, End: 4}},
+		},
+	}
+	m := &vm.Machine{Code: bc.Instructions, Constants: bc.Constants}
+	err := m.Run(100)
+	var re *vm.RuntimeError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected a RuntimeError, got %v", err)
+	}
+	if re.IP != 3 || len(re.Stack) != 2 || re.Stack[0].IP != 5 || re.Stack[1].IP != 3 {
+		t.Fatalf("unexpected location: IP %d, stack %+v", re.IP, re.Stack)
+	}
+	if strings.Contains(err.Error(), "Traceback") {
+		t.Errorf("traceback without debug info: %s", err)
+	}
+
+	m = &vm.Machine{Code: bc.Instructions, Constants: bc.Constants, Debug: bc.Debug}
+	err = m.Run(100)
+	want := `Traceback (most recent call last):
+  File "div.py", line 1, in <module>
+    print(f(7))
+  File "div.py", line 3, in f
+    return x // 0
+`
+	if !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got:\n%s\nwant prefix:\n%s", err, want)
+	}
+}
+
+func TestRuntimeErrorSentinels(t *testing.T) {
+	m := &vm.Machine{Code: []uint32{(uint32(vm.OP_DROP) << 24)}}
+	if err := m.Run(10); !errors.Is(err, vm.ErrStackUnderflow) {
+		t.Errorf("expected ErrStackUnderflow, got %v", err)
+	}
+	var re *vm.RuntimeError
+	m = countTo(100)
+	if err := m.Run(10); !errors.As(err, &re) || re.Kind != "GasExhausted" || !errors.Is(err, vm.ErrGasExhausted) {
+		t.Errorf("expected GasExhausted, got %v", err)
+	}
+
+	// Errors raised by host functions keep their kind and get a location.
+	m = &vm.Machine{Code: []uint32{(uint32(vm.OP_PUSH_C) << 24), (uint32(vm.OP_SYSCALL) << 24), (uint32(vm.OP_HALT) << 24)}}
+	m.Constants = []value.Value{{Type: value.TypeInt, Data: 3}}
+	m.HostRegistry = []vm.HostFunctionEntry{{Fn: func(m *vm.Machine) error {
+		return vm.NewError("KeyError", "%d", m.Pop().Int())
+	}}}
+	if err := m.Run(10); !errors.As(err, &re) || re.Kind != "KeyError" || re.IP != 1 || err.Error() != "KeyError: 3" {
+		t.Errorf("expected KeyError at IP 1, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"errors"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+// handler is an active try block, pushed by OP_SETUP_EXCEPT.
+type handler struct {
+	ip     int // start of the except/finally code
+	fp, sp int
+	scopes int // length of the scope stack, to close scopes left open
+	depth  int // the run that owns it; nested Calls do not see it
+}
+
+// uncatchable lists the kinds that stop the program without running
+// except or finally blocks.
+var uncatchable = map[string]bool{
+	"SecurityViolation": true,
+	"GasExhausted":      true,
+	"Cancelled":         true,
+	"DeadlineExceeded":  true,
+	"ReplayDivergence":  true,
+	"Suspended":         true,
+}
+
+// exceptionBases maps exception classes to their base class. Kinds not
+// listed derive from Exception.
+var exceptionBases = map[string]string{
+	"Exception":           "BaseException",
+	"KeyError":            "LookupError",
+	"IndexError":          "LookupError",
+	"ZeroDivisionError":   "ArithmeticError",
+	"OverflowError":       "ArithmeticError",
+	"ConnectionError":     "OSError",
+	"FileNotFoundError":   "OSError",
+	"PermissionError":     "OSError",
+	"TimeoutError":        "OSError",
+	"JSONDecodeError":     "ValueError",
+	"UnicodeError":        "ValueError",
+	"RecursionError":      "RuntimeError",
+	"NotImplementedError": "RuntimeError",
+	"BaseException":       "",
+}
+
+// ExceptionMatches reports whether an exception of class kind is caught by
+// `except class`.
+func ExceptionMatches(kind, class string) bool {
+	for kind != "" {
+		if kind == class {
+			return true
+		}
+		base, ok := exceptionBases[kind]
+		if !ok {
+			base = "Exception"
+		}
+		kind = base
+	}
+	return false
+}
+
+// handle passes err to the innermost exception handler of the current run.
+// It reports false if there is none or err cannot be caught.
+func (m *Machine) handle(err error) bool {
+	var re *RuntimeError
+	if !errors.As(err, &re) || uncatchable[re.Kind] {
+		return false
+	}
+	for n := len(m.handlers); n > 0; n-- {
+		h := m.handlers[n-1]
+		if h.depth != m.depth {
+			return false
+		}
+		m.handlers = m.handlers[:n-1]
+		if h.fp > m.FP {
+			continue // left behind by a function that already returned
+		}
+		m.FP, m.SP, m.IP = h.fp, h.sp, h.ip
+		if len(m.ScopeStack) > h.scopes {
+			m.ScopeStack = m.ScopeStack[:h.scopes]
+		}
+		m.Push(value.Value{Type: value.TypeException, Opaque: &value.Exception{Kind: re.Kind, Message: re.Message, Err: err}})
+		return true
+	}
+	return false
+}
+
+// raise returns the error for OP_RAISE of v.
+func raise(v value.Value, arena []byte) error {
+	switch v.Type {
+	case value.TypeException:
+		e := v.Opaque.(*value.Exception)
+		if e.Err != nil {
+			return e.Err
+		}
+		return &RuntimeError{Kind: e.Kind, Message: e.Message}
+	case value.TypeString:
+		return &RuntimeError{Kind: "Exception", Message: v.Format(arena)}
+	}
+	return NewError("TypeError", "exceptions must derive from BaseException")
+}
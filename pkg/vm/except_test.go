@@ -0,0 +1,101 @@
+package vm_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestExceptCatch(t *testing.T) {
+	// try: 1 // 0 except: matched = exception is an ArithmeticError; e = exception
+	class := "ArithmeticError"
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_SETUP_EXCEPT) << 24) | 6,
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(vm.OP_FLOOR_DIV) << 24),
+			(uint32(vm.OP_POP_EXCEPT) << 24),
+			(uint32(vm.OP_HALT) << 24),
+			(uint32(vm.OP_DUP) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 2,
+			(uint32(vm.OP_EXC_MATCH) << 24),
+			(uint32(vm.OP_POP_L) << 24) | 0,
+			(uint32(vm.OP_POP_L) << 24) | 1,
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{
+			{Type: value.TypeInt, Data: 1},
+			{Type: value.TypeInt, Data: 0},
+			{Type: value.TypeString, Data: value.PackString(0, uint32(len(class)))},
+		},
+		Arena: []byte(class),
+	}
+	if err := m.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if m.SP != 0 || m.Frames[0].Locals[0].Data != 1 {
+		t.Errorf("expected the handler to match with an empty stack, got SP %d, match %v", m.SP, m.Frames[0].Locals[0])
+	}
+	if e := m.Frames[0].Locals[1]; e.Type != value.TypeException || e.Format(m.Arena) != "division by zero" {
+		t.Errorf("unexpected exception value: %v", e)
+	}
+}
+
+func TestExceptReraise(t *testing.T) {
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_SETUP_EXCEPT) << 24) | 3,
+			(uint32(vm.OP_SYSCALL) << 24) | 0,
+			(uint32(vm.OP_HALT) << 24),
+			(uint32(vm.OP_RAISE) << 24),
+		},
+		HostRegistry: []vm.HostFunctionEntry{{Fn: func(m *vm.Machine) error {
+			return vm.WrapError("OSError", os.ErrNotExist)
+		}}},
+	}
+	err := m.Run(100)
+	var re *vm.RuntimeError
+	if !errors.Is(err, os.ErrNotExist) || !errors.As(err, &re) || re.Kind != "OSError" {
+		t.Errorf("re-raised error lost its cause: %v", err)
+	}
+}
+
+func TestExceptUncatchable(t *testing.T) {
+	// try: while True: pass except: pass
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_SETUP_EXCEPT) << 24) | 2,
+			(uint32(vm.OP_JMP) << 24) | 1,
+			(uint32(vm.OP_DROP) << 24),
+			(uint32(vm.OP_HALT) << 24),
+		},
+	}
+	if err := m.Run(50); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Errorf("expected ErrGasExhausted, got %v", err)
+	}
+}
+
+func TestExceptionMatches(t *testing.T) {
+	tests := []struct {
+		kind, class string
+		want        bool
+	}{
+		{"KeyError", "KeyError", true},
+		{"KeyError", "LookupError", true},
+		{"KeyError", "Exception", true},
+		{"KeyError", "IndexError", false},
+		{"ZeroDivisionError", "ArithmeticError", true},
+		{"MyError", "Exception", true},
+		{"MyError", "ValueError", false},
+		{"ConnectionError", "OSError", true},
+	}
+	for _, tt := range tests {
+		if got := vm.ExceptionMatches(tt.kind, tt.class); got != tt.want {
+			t.Errorf("ExceptionMatches(%q, %q) = %v, want %v", tt.kind, tt.class, got, tt.want)
+		}
+	}
+}
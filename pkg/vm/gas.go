@@ -0,0 +1,100 @@
+package vm
+
+// GasSchedule assigns a base gas cost to every opcode. A nil schedule on the
+// Machine charges one unit per instruction.
+type GasSchedule [256]int
+
+// unitGas is the schedule of machines without one.
+var unitGas = func() (s GasSchedule) {
+	for i := range s {
+		s[i] = 1
+	}
+	return s
+}()
+
+// DefaultGasSchedule returns a schedule that weights instructions by the work
+// they do. Host functions add their own Cost and any gas they charge through
+// ConsumeGas on top of the OP_SYSCALL base cost.
+func DefaultGasSchedule() *GasSchedule {
+	var s GasSchedule
+	for i := range s {
+		s[i] = 1
+	}
+	s[OP_DIV] = 2
+	s[OP_FLOOR_DIV] = 2
+	s[OP_MOD] = 2
+	s[OP_POW] = 4
+	s[OP_IN] = 3
+	s[OP_NOT_IN] = 3
+	s[OP_CONTAINS] = 3
+	s[OP_PRINT] = 5
+	s[OP_CALL] = 3
+	s[OP_CALL_FN] = 3
+	s[OP_RET] = 2
+	s[OP_GEN] = 3
+	s[OP_YIELD] = 2
+	s[OP_ADDRESS] = 10
+	s[OP_SYSCALL] = 5
+	return &s
+}
+
+// ConsumeGas charges n units of gas to the running execution. Host functions
+// use it to bill work proportional to their input, e.g. bytes read or elements
+// sorted. It returns ErrGasExhausted, without charging, when the budget is too
+// small; host functions should charge before pushing results so that the VM
+// can roll the call back. Outside of Run it is a no-op.
+func (m *Machine) ConsumeGas(n int) error {
+	if m.depth == 0 || n <= 0 {
+		return nil
+	}
+	if m.gas < n && !m.refill(n) {
+		return ErrGasExhausted
+	}
+	m.gas -= n
+	return nil
+}
+
+// GasRemaining returns the unused part of the current gas budget.
+func (m *Machine) GasRemaining() int {
+	return m.gas + m.reserve
+}
+
+// AddGas adds n units to the current gas budget, e.g. before Resume, RunSlice
+// or a Call from the host.
+func (m *Machine) AddGas(n int) {
+	m.gas += n
+	m.granted += n
+}
+
+// setGas replaces the remaining budget with n.
+func (m *Machine) setGas(n int) {
+	m.granted += n - m.gas - m.reserve
+	m.gas, m.reserve = n, 0
+}
+
+// GasUsed returns the gas consumed since the last Reset: the gas granted
+// since then less what remains.
+func (m *Machine) GasUsed() int {
+	return m.granted - m.gas - m.reserve
+}
+
+// markGas records the budget as it was before an instruction costing cost.
+func (m *Machine) markGas(cost int) int {
+	return m.gas + m.reserve + cost
+}
+
+// rollbackGas restores the budget to mark, undoing everything charged since.
+// Any gas held back by RunSlice is returned to the budget, since a syscall
+// only runs out after drawing on it.
+func (m *Machine) rollbackGas(mark int) {
+	m.gas, m.reserve = mark, 0
+}
+
+// refill moves the gas held back by RunSlice into the budget and reports
+// whether it now covers n. Host functions and nested calls draw on it since
+// they cannot be preempted midway.
+func (m *Machine) refill(n int) bool {
+	m.gas += m.reserve
+	m.reserve = 0
+	return m.gas >= n
+}
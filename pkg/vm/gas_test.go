@@ -0,0 +1,117 @@
+package vm_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestGasSchedule(t *testing.T) {
+	code := []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_POW) << 24),
+		(uint32(vm.OP_HALT) << 24),
+	}
+	consts := []value.Value{{Type: value.TypeInt, Data: 2}}
+
+	m := &vm.Machine{Code: code, Constants: consts}
+	if err := m.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if m.GasUsed() != 4 {
+		t.Errorf("uniform schedule: expected 4 gas, got %d", m.GasUsed())
+	}
+	// A new budget replaces what is left of the old one, and GasUsed
+	// counts on until Reset.
+	m.IP = 0
+	if err := m.Run(10); err != nil {
+		t.Fatal(err)
+	}
+	if m.GasUsed() != 8 || m.GasRemaining() != 6 {
+		t.Errorf("second run: expected 8 gas used and 6 left, got %d and %d", m.GasUsed(), m.GasRemaining())
+	}
+	m.Reset()
+	if m.GasUsed() != 0 {
+		t.Errorf("expected no gas used after Reset, got %d", m.GasUsed())
+	}
+
+	s := vm.DefaultGasSchedule()
+	m = &vm.Machine{Code: code, Constants: consts, GasSchedule: s}
+	if err := m.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if want := 2*s[vm.OP_PUSH_C] + s[vm.OP_POW] + s[vm.OP_HALT]; m.GasUsed() != want {
+		t.Errorf("default schedule: expected %d gas, got %d", want, m.GasUsed())
+	}
+
+	m = &vm.Machine{Code: code, Constants: consts, GasSchedule: s}
+	if err := m.Run(3); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Errorf("expected ErrGasExhausted, got %v", err)
+	}
+}
+
+func TestHostFunctionCost(t *testing.T) {
+	calls := 0
+	m := &vm.Machine{}
+	m.HostRegistry = []vm.HostFunctionEntry{{
+		Fn:     func(*vm.Machine) error { calls++; return nil },
+		Cost:   10,
+		CostFn: func(m *vm.Machine) int { return int(m.Peek().Int()) },
+	}}
+	m.Constants = []value.Value{{Type: value.TypeInt, Data: 5}}
+	m.Code = []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_HALT) << 24),
+	}
+
+	if err := m.Run(16); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatalf("expected ErrGasExhausted, got %v", err)
+	}
+	if calls != 0 || m.IP != 1 || m.GasUsed() != 1 {
+		t.Errorf("syscall should not run: calls=%d IP=%d used=%d", calls, m.IP, m.GasUsed())
+	}
+
+	m.Reset()
+	if err := m.Run(18); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || m.GasUsed() != 18 {
+		t.Errorf("expected 1 call and 18 gas, got %d calls and %d gas", calls, m.GasUsed())
+	}
+}
+
+func TestConsumeGasRollback(t *testing.T) {
+	m := &vm.Machine{}
+	m.RegisterHostFunction("", func(m *vm.Machine) error {
+		n := m.Pop().Int()
+		if err := m.ConsumeGas(int(n)); err != nil {
+			return err
+		}
+		m.Push(value.Value{Type: value.TypeInt, Data: uint64(n * 2)})
+		return nil
+	})
+	m.Constants = []value.Value{{Type: value.TypeInt, Data: 50}}
+	m.Code = []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_HALT) << 24),
+	}
+
+	if err := m.Run(20); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatalf("expected ErrGasExhausted, got %v", err)
+	}
+	if m.SP != 1 || m.Peek().Int() != 50 {
+		t.Errorf("argument should be restored, SP=%d", m.SP)
+	}
+	if m.GasUsed() != 1 {
+		t.Errorf("partial syscall gas should be refunded, used=%d", m.GasUsed())
+	}
+
+	if m.ConsumeGas(1000) != nil {
+		t.Errorf("ConsumeGas outside Run should not fail")
+	}
+}
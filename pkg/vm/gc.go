@@ -0,0 +1,266 @@
+package vm
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"unsafe"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+// DefaultGCThreshold is the arena size at which a machine compacts its arena
+// unless Machine.GCThreshold says otherwise.
+const DefaultGCThreshold = 1 << 20
+
+// CompactArena moves the strings still referenced from the stack, the locals
+// of the active frames and the collections they hold to the front of the
+// arena, rewriting the offsets packed into their Data, and drops the rest. It
+// returns the number of bytes reclaimed. The strings that constants refer to
+// never move, so bytecode shared between machines is not modified.
+//
+// The VM compacts on its own when the arena outgrows GCThreshold; hosts that
+// run with RunSlice can also call CompactArena between slices. It does nothing
+// while the machine is executing, and string values the host keeps outside the
+// machine are not updated.
+func (m *Machine) CompactArena() int {
+	if m.depth > 0 {
+		return 0
+	}
+	m.init()
+	return m.compact()
+}
+
+// gcThreshold returns the arena size that triggers the next compaction.
+func (m *Machine) gcThreshold() int {
+	switch {
+	case m.GCThreshold < 0:
+		return math.MaxInt
+	case m.GCThreshold == 0:
+		return DefaultGCThreshold
+	}
+	return m.GCThreshold
+}
+
+// collect compacts the arena once it has outgrown the threshold. The
+// instructions that grow the arena call it when they are done, so that it
+// runs at an instruction boundary. Host functions may hold values the
+// collector cannot see, so the arena is only compacted when none is running.
+func (m *Machine) collect() {
+	if len(m.Arena) > m.gcAt && m.depth == 1 {
+		m.compact()
+	}
+}
+
+// compact runs the collector. It may only be called when every live value is
+// reachable from the machine: at an instruction boundary of the outermost run,
+// or between runs.
+func (m *Machine) compact() int {
+	before := len(m.Arena)
+	g := &arenaGC{arena: m.Arena, seen: make(map[objectRef]bool)}
+	for _, c := range m.Constants {
+		if c.Type == value.TypeString {
+			g.pinned = max(g.pinned, g.end(c.Data))
+		}
+	}
+	// Frames above FP and stack slots above SP hold leftovers of finished
+	// calls that would point into the old arena.
+	for i := m.FP + 1; i < len(m.Frames); i++ {
+		clear(m.Frames[i].Locals)
+	}
+	clear(m.Stack[m.SP:])
+
+	g.roots(m)
+	g.plan()
+	g.rewrite = true
+	g.seen = make(map[objectRef]bool)
+	g.roots(m)
+	m.Arena = g.next
+
+	threshold := m.gcThreshold()
+	if live := 2 * len(m.Arena); live > threshold {
+		threshold = live
+	}
+	m.gcAt = threshold
+	return before - len(m.Arena)
+}
+
+// arenaGC is a sliding collector: a mark pass records the byte ranges that
+// strings refer to, which are merged into segments and copied in order to a
+// new arena, and a second pass over the same roots rewrites the offsets.
+type arenaGC struct {
+	arena   []byte
+	next    []byte
+	pinned  int // the prefix that does not move
+	spans   []segment
+	segs    []segment
+	seen    map[objectRef]bool
+	rewrite bool
+}
+
+// segment is a range [from, to) of the old arena that starts at dst in the
+// new one.
+type segment struct {
+	from, to, dst int
+}
+
+// end returns the end of the string packed in data, or 0 if it is empty or
+// does not lie inside the arena.
+func (g *arenaGC) end(data uint64) int {
+	off, n := int(data>>32), int(uint32(data))
+	if n == 0 || off+n > len(g.arena) {
+		return 0
+	}
+	return off + n
+}
+
+func (g *arenaGC) roots(m *Machine) {
+	for i := 0; i < m.SP; i++ {
+		g.value(&m.Stack[i])
+	}
+	for i := 0; i <= m.FP && i < len(m.Frames); i++ {
+		locals := m.Frames[i].Locals
+		for j := range locals {
+			g.value(&locals[j])
+		}
+	}
+	for i := range m.globals {
+		g.value(&m.globals[i])
+	}
+}
+
+// plan merges the marked ranges into segments and copies them to the new
+// arena after the pinned prefix.
+func (g *arenaGC) plan() {
+	sort.Slice(g.spans, func(i, j int) bool { return g.spans[i].from < g.spans[j].from })
+	for _, s := range g.spans {
+		if s.from < g.pinned {
+			g.pinned = max(g.pinned, s.to)
+			continue
+		}
+		if n := len(g.segs); n > 0 && s.from <= g.segs[n-1].to {
+			g.segs[n-1].to = max(g.segs[n-1].to, s.to)
+			continue
+		}
+		g.segs = append(g.segs, s)
+	}
+	g.next = append(make([]byte, 0, cap(g.arena)), g.arena[:g.pinned]...)
+	for i := range g.segs {
+		s := &g.segs[i]
+		s.dst = len(g.next)
+		g.next = append(g.next, g.arena[s.from:s.to]...)
+	}
+}
+
+// str marks or relocates the string packed in data.
+func (g *arenaGC) str(data *uint64) {
+	end := g.end(*data)
+	if end == 0 {
+		if g.rewrite && uint32(*data) == 0 {
+			*data = 0
+		}
+		return
+	}
+	off := int(*data >> 32)
+	if !g.rewrite {
+		if end > g.pinned {
+			g.spans = append(g.spans, segment{from: off, to: end})
+		}
+		return
+	}
+	if off < g.pinned {
+		return
+	}
+	i := sort.Search(len(g.segs), func(i int) bool { return g.segs[i].from > off }) - 1
+	s := g.segs[i]
+	*data = value.PackString(uint32(s.dst+off-s.from), uint32(*data))
+}
+
+// visit reports whether the shared object of the given kind at p is seen
+// for the first time in this pass.
+func (g *arenaGC) visit(kind byte, p unsafe.Pointer) bool {
+	key := objectRef{kind, p}
+	if p == nil || g.seen[key] {
+		return false
+	}
+	g.seen[key] = true
+	return true
+}
+
+func (g *arenaGC) value(v *value.Value) {
+	if v.Type == value.TypeString {
+		g.str(&v.Data)
+	}
+	if v.Opaque != nil {
+		v.Opaque = g.object(v.Opaque)
+	}
+}
+
+// object traces o and returns it, updated if it holds values by copy.
+func (g *arenaGC) object(o any) any {
+	switch o := o.(type) {
+	case value.Value:
+		g.value(&o)
+		return o
+	case *[]value.Value:
+		if g.visit(kindList, unsafe.Pointer(o)) {
+			for i := range *o {
+				g.value(&(*o)[i])
+			}
+		}
+	case []value.Value:
+		// Copies of a tuple share its elements.
+		if g.visit(kindTuple, unsafe.Pointer(unsafe.SliceData(o))) {
+			for i := range o {
+				g.value(&o[i])
+			}
+		}
+	case map[string]any:
+		if g.visit(kindDict, reflect.ValueOf(o).UnsafePointer()) {
+			for k, v := range o {
+				o[k] = g.object(v)
+			}
+		}
+	case []any:
+		if g.visit(kindSlice, unsafe.Pointer(unsafe.SliceData(o))) {
+			for i := range o {
+				o[i] = g.object(o[i])
+			}
+		}
+	case *value.Iterator:
+		if g.visit(kindIter, unsafe.Pointer(o)) {
+			g.object(o.List)
+			g.value(&o.Fn)
+			for _, src := range o.Sources {
+				g.object(src)
+			}
+			for i := range o.Ahead {
+				g.value(&o.Ahead[i])
+			}
+			if gen := o.Gen; gen != nil {
+				for i := range gen.Locals {
+					g.value(&gen.Locals[i])
+				}
+				for i := range gen.Stack {
+					g.value(&gen.Stack[i])
+				}
+				for _, c := range gen.Calls {
+					for i := range c.Locals {
+						g.value(&c.Locals[i])
+					}
+				}
+			}
+		}
+	case *value.Function:
+		if g.visit(kindFunction, unsafe.Pointer(o)) {
+			for _, c := range o.Cells {
+				g.object(c)
+			}
+		}
+	case *value.Cell:
+		if g.visit(kindCell, unsafe.Pointer(o)) {
+			g.value(&o.Value)
+		}
+	}
+	return o
+}
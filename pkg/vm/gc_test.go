@@ -0,0 +1,129 @@
+package vm_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// appendLoop builds a string of n "x"s one concatenation at a time, leaving
+// every intermediate string behind in the arena.
+func appendLoop(n int) *vm.Machine {
+	return &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_POP_L) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 3,
+			(uint32(vm.OP_POP_L) << 24) | 1,
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(vm.OP_LT) << 24),
+			(uint32(vm.OP_JMP_FALSE) << 24) | 17,
+			(uint32(vm.OP_PUSH_L) << 24) | 1,
+			(uint32(vm.OP_PUSH_C) << 24) | 4,
+			(uint32(vm.OP_ADD) << 24),
+			(uint32(vm.OP_POP_L) << 24) | 1,
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 2,
+			(uint32(vm.OP_ADD) << 24),
+			(uint32(vm.OP_POP_L) << 24) | 0,
+			(uint32(vm.OP_JMP) << 24) | 4,
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{
+			{Type: value.TypeInt, Data: 0},
+			{Type: value.TypeInt, Data: uint64(n)},
+			{Type: value.TypeInt, Data: 1},
+			{Type: value.TypeString, Data: value.PackString(0, 0)},
+			{Type: value.TypeString, Data: value.PackString(0, 1)},
+		},
+		Arena: []byte("x"),
+	}
+}
+
+func TestGCStringLoop(t *testing.T) {
+	const n = 5000 // about 12MB of garbage, more than MaxArenaSize
+
+	m := appendLoop(n)
+	m.GCThreshold = 64 << 10
+	if err := m.Run(1000000); err != nil {
+		t.Fatal(err)
+	}
+	s := m.Frames[0].Locals[1]
+	if got := len(value.UnpackString(s.Data, m.Arena)); got != n {
+		t.Errorf("got string of length %d, want %d", got, n)
+	}
+	if len(m.Arena) > 2*n+64<<10 {
+		t.Errorf("arena not compacted: %d bytes", len(m.Arena))
+	}
+
+	m = appendLoop(n)
+	m.GCThreshold = -1
+	var re *vm.RuntimeError
+	if err := m.Run(1000000); !errors.As(err, &re) || re.Kind != "MemoryError" {
+		t.Errorf("expected MemoryError with the collector disabled, got %v", err)
+	}
+}
+
+func TestCompactArena(t *testing.T) {
+	m := &vm.Machine{}
+	m.Load(&vm.Bytecode{
+		Instructions: []uint32{(uint32(vm.OP_HALT) << 24)},
+		Arena:        []byte("constgarbage1listgarbage2dictgarbage3tuplecellsetglobal"),
+		Globals:      1,
+	})
+	str := func(off, n uint32) value.Value {
+		return value.Value{Type: value.TypeString, Data: value.PackString(off, n)}
+	}
+	m.Constants = []value.Value{str(0, 5)}
+
+	list := &[]value.Value{str(13, 4)}
+	*list = append(*list, value.Value{Type: value.TypeList, Opaque: list}) // cycle
+	dict := map[string]any{"k": str(25, 4), "xs": list, "raw": []any{str(13, 4)}}
+	tuple := []value.Value{str(37, 5), str(0, 5)}
+	cell := &value.Cell{Value: str(42, 4)}
+	fn := value.NewFunction("f", 0, 0)
+	fn.Opaque.(*value.Function).Cells = []*value.Cell{cell}
+
+	m.Push(value.Value{Type: value.TypeDict, Opaque: dict})
+	m.Push(value.Value{Type: value.TypeTuple, Opaque: tuple})
+	m.Push(value.Value{Type: value.TypeTuple, Opaque: tuple}) // shared
+	m.Push(fn)
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{List: list}})
+	m.Frames[0].Locals[0] = str(46, 0)
+	m.Frames[0].Locals[1] = str(46, 3)
+	m.Globals()[0] = str(49, 6)
+
+	if got, want := m.CompactArena(), len("garbage1garbage2garbage3"); got != want {
+		t.Errorf("reclaimed %d bytes, want %d", got, want)
+	}
+	if string(m.Arena) != "constlistdicttuplecellsetglobal" {
+		t.Errorf("arena = %q", m.Arena)
+	}
+	if m.Constants[0] != str(0, 5) {
+		t.Errorf("constant moved: %v", m.Constants[0])
+	}
+	for _, c := range []struct {
+		v    value.Value
+		want string
+	}{
+		{(*list)[0], "list"},
+		{dict["k"].(value.Value), "dict"},
+		{dict["raw"].([]any)[0].(value.Value), "list"},
+		{tuple[0], "tuple"},
+		{tuple[1], "const"},
+		{cell.Value, "cell"},
+		{m.Frames[0].Locals[0], ""},
+		{m.Frames[0].Locals[1], "set"},
+		{m.Globals()[0], "global"},
+	} {
+		if got := c.v.Format(m.Arena); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+	if m.CompactArena() != 0 {
+		t.Errorf("second compaction reclaimed bytes")
+	}
+}
@@ -0,0 +1,152 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+// genFrame is a generator running in frame fp.
+type genFrame struct {
+	gen *value.Generator
+	fp  int
+}
+
+// genMark is where a resumed generator starts: the frame below its own, the
+// stack pointer and the start of its stack, and the number of handlers and
+// scopes open below it.
+type genMark struct {
+	fp, sp, base, handlers, scopes int
+}
+
+// resume runs g from where it was suspended until it yields, returns or
+// fails, in frames above the current one, and returns the yielded value.
+// It reports false once g has returned. A generator that fails is finished,
+// except when it runs out of gas: then it is suspended where it stopped, so
+// that a host function rolled back for Resume, which runs it again, finds
+// it there rather than running the same part twice.
+func (m *Machine) resume(g *value.Generator) (value.Value, bool, error) {
+	if g.IP < 0 {
+		return value.Value{}, false, nil
+	}
+	if g.Running {
+		return value.Value{}, false, NewError("ValueError", "generator already executing")
+	}
+	// Start above the arguments of the calling host function, as Call does.
+	k := genMark{fp: m.FP, sp: m.SP, base: max(m.SP, m.hostSP), handlers: len(m.handlers), scopes: len(m.ScopeStack)}
+	if k.fp+1+len(g.Calls) >= len(m.Frames) {
+		return value.Value{}, false, ErrFrameOverflow
+	}
+	for i := 0; i <= len(g.Calls); i++ {
+		locals := g.Locals
+		if i > 0 {
+			locals = g.Calls[i-1].Locals
+		}
+		if n := len(m.Frames[k.fp+1+i].Locals); len(locals) > n {
+			return value.Value{}, false, fmt.Errorf("%w: generator keeps %d locals, limit is %d", ErrLocalsOverflow, len(locals), n)
+		}
+	}
+	if k.base+len(g.Stack) >= len(m.Stack) {
+		return value.Value{}, false, ErrStackOverflow
+	}
+	oldIP := m.IP
+	m.FP++
+	f := &m.Frames[m.FP]
+	f.ReturnIP, f.BaseSP, f.ArgCount, f.callerIP, f.entry = -1, k.base, 0, -1, g.Entry
+	if m.depth > 0 {
+		f.callerIP = oldIP
+	}
+	copy(f.Locals, g.Locals)
+	for _, c := range g.Calls {
+		m.FP++
+		cf := &m.Frames[m.FP]
+		cf.ReturnIP, cf.BaseSP, cf.ArgCount, cf.callerIP, cf.entry = c.ReturnIP, k.base+c.BaseSP, c.ArgCount, -1, c.Entry
+		copy(cf.Locals, c.Locals)
+	}
+	m.maxFP = max(m.maxFP, m.FP)
+	m.SP = k.base + copy(m.Stack[k.base:], g.Stack)
+	m.ScopeStack = append(m.ScopeStack, g.Scopes...)
+	for _, h := range g.Handlers {
+		m.handlers = append(m.handlers, handler{ip: h.IP, fp: k.fp + 1 + h.Frame, sp: k.base + h.SP, scopes: k.scopes + h.Scopes, depth: m.depth + 1})
+	}
+	m.gens = append(m.gens, genFrame{gen: g, fp: k.fp + 1})
+	g.Running = true
+	m.IP = g.IP
+	if m.Tracer != nil {
+		m.Tracer.Call(m, g.Entry, k.fp+1)
+		for i, c := range g.Calls {
+			m.Tracer.Call(m, c.Entry, k.fp+2+i)
+		}
+		for _, s := range g.Scopes {
+			m.Tracer.ScopeEnter(m, s)
+		}
+	}
+	err := m.run()
+	m.gens = m.gens[:len(m.gens)-1]
+	ip := m.IP
+	m.IP = oldIP
+	returned := g.Running
+	g.Running = false
+	if err != nil && err != errStop {
+		if m.Tracer != nil {
+			m.traceUnwind(m.FP, k.fp, m.ScopeStack[min(k.scopes, len(m.ScopeStack)):])
+		}
+		if errors.Is(err, ErrGasExhausted) {
+			m.suspend(g, ip, m.FP, k)
+		} else {
+			finish(g)
+		}
+		m.leave(k)
+		return value.Value{}, false, err
+	}
+	v := m.Pop()
+	if returned {
+		m.SP = k.sp
+		finish(g)
+		return value.Value{}, false, nil
+	}
+	if len(m.ScopeStack) != k.scopes {
+		m.leave(k)
+		finish(g)
+		return value.Value{}, false, NewError("RuntimeError", "generator yielded inside a scope")
+	}
+	// Suspended by OP_YIELD, with None as the value of the yield
+	// expression when it resumes.
+	m.Push(value.Value{Type: value.TypeVoid})
+	m.suspend(g, g.IP, k.fp+1, k)
+	m.leave(k)
+	return v, true, nil
+}
+
+// suspend keeps in g what frames k.fp+1 to top hold, with the stack, the
+// handlers and the scopes above those of k, to resume at ip.
+func (m *Machine) suspend(g *value.Generator, ip, top int, k genMark) {
+	g.IP = ip
+	copy(g.Locals, m.Frames[k.fp+1].Locals)
+	g.Stack = append(g.Stack[:0], m.Stack[k.base:m.SP]...)
+	g.Calls = g.Calls[:0]
+	for i := k.fp + 2; i <= top; i++ {
+		f := &m.Frames[i]
+		g.Calls = append(g.Calls, value.Call{Entry: f.entry, ReturnIP: f.ReturnIP, BaseSP: f.BaseSP - k.base, ArgCount: f.ArgCount, Locals: slices.Clone(f.Locals)})
+	}
+	g.Scopes = append(g.Scopes[:0], m.ScopeStack[min(k.scopes, len(m.ScopeStack)):]...)
+	g.Handlers = g.Handlers[:0]
+	for _, h := range m.handlers[k.handlers:] {
+		g.Handlers = append(g.Handlers, value.Handler{IP: h.ip, SP: h.sp - k.base, Frame: h.fp - k.fp - 1, Scopes: h.scopes - k.scopes})
+	}
+}
+
+// leave returns the machine to k, dropping the frames, stack, handlers and
+// scopes of the generator above it.
+func (m *Machine) leave(k genMark) {
+	m.FP, m.SP, m.handlers = k.fp, k.sp, m.handlers[:k.handlers]
+	m.ScopeStack = m.ScopeStack[:min(k.scopes, len(m.ScopeStack))]
+}
+
+// finish marks g as returned and drops its state.
+func finish(g *value.Generator) {
+	g.IP = -1
+	g.Locals, g.Stack, g.Handlers, g.Calls, g.Scopes = nil, nil, nil, nil, nil
+}
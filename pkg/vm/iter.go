@@ -0,0 +1,147 @@
+package vm
+
+import (
+	"errors"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+// IterNext takes the next item from it and reports false once it is
+// exhausted. Lazy iterators compute the item now: a map or filter calls its
+// function, a generator runs until its next yield.
+//
+// If the machine runs out of gas midway, the items already taken from the
+// iterators that it draws from are given back to them, so that a host
+// function rolled back for Resume finds the iterator as it was.
+func (m *Machine) IterNext(it *value.Iterator) (value.Value, bool, error) {
+	if len(it.Ahead) > 0 {
+		v := it.Ahead[0]
+		if it.Ahead = it.Ahead[1:]; len(it.Ahead) == 0 {
+			it.Ahead = nil
+		}
+		return v, true, nil
+	}
+	switch it.Kind {
+	case value.IterList:
+		if it.Index >= len(*it.List) {
+			return value.Value{}, false, nil
+		}
+		v := (*it.List)[it.Index]
+		it.Index++
+		return v, true, nil
+	case value.IterRange:
+		if (it.Step > 0 && it.Index >= it.Stop) || (it.Step < 0 && it.Index <= it.Stop) {
+			return value.Value{}, false, nil
+		}
+		v := value.Value{Type: value.TypeInt, Data: uint64(it.Index)}
+		it.Index += it.Step
+		return v, true, nil
+	case value.IterMap:
+		x, ok, err := m.IterNext(it.Sources[0])
+		if err != nil || !ok {
+			return value.Value{}, false, err
+		}
+		r, err := m.CallValue(it.Fn, x)
+		if err != nil {
+			giveBack(it.Sources[0], err, x)
+			return value.Value{}, false, err
+		}
+		return r, true, nil
+	case value.IterFilter:
+		for {
+			x, ok, err := m.IterNext(it.Sources[0])
+			if err != nil || !ok {
+				return value.Value{}, false, err
+			}
+			r := x
+			if it.Fn.Type != value.TypeVoid {
+				if r, err = m.CallValue(it.Fn, x); err != nil {
+					giveBack(it.Sources[0], err, x)
+					return value.Value{}, false, err
+				}
+			}
+			if IsTruthy(r) {
+				return x, true, nil
+			}
+		}
+	case value.IterZip:
+		items := make([]value.Value, len(it.Sources))
+		for i, src := range it.Sources {
+			x, ok, err := m.IterNext(src)
+			if err != nil || !ok {
+				for j := range i {
+					giveBack(it.Sources[j], err, items[j])
+				}
+				return value.Value{}, false, err
+			}
+			items[i] = x
+		}
+		return value.Value{Type: value.TypeTuple, Opaque: items}, true, nil
+	case value.IterEnumerate:
+		x, ok, err := m.IterNext(it.Sources[0])
+		if err != nil || !ok {
+			return value.Value{}, false, err
+		}
+		v := value.Value{Type: value.TypeTuple, Opaque: []value.Value{{Type: value.TypeInt, Data: uint64(it.Index)}, x}}
+		it.Index++
+		return v, true, nil
+	case value.IterGenerator:
+		return m.resume(it.Gen)
+	}
+	return value.Value{}, false, NewError("SystemError", "unknown iterator kind %d", it.Kind)
+}
+
+// IterHasNext reports whether it has another item, computing it ahead if
+// it is lazy.
+func (m *Machine) IterHasNext(it *value.Iterator) (bool, error) {
+	switch {
+	case len(it.Ahead) > 0:
+		return true, nil
+	case it.Kind == value.IterList:
+		return it.Index < len(*it.List), nil
+	case it.Kind == value.IterRange:
+		return (it.Step > 0 && it.Index < it.Stop) || (it.Step < 0 && it.Index > it.Stop), nil
+	}
+	v, ok, err := m.IterNext(it)
+	if ok {
+		it.Ahead = append(it.Ahead, v)
+	}
+	return ok, err
+}
+
+// IterDrain takes the remaining items from it. Lazy iterators are charged
+// one unit of gas per item, so that draining one that never ends stops when
+// the budget does; if it runs out, the items are given back to it.
+func (m *Machine) IterDrain(it *value.Iterator) ([]value.Value, error) {
+	if it.Kind == value.IterList && len(it.Ahead) == 0 {
+		items := append([]value.Value(nil), (*it.List)[min(it.Index, len(*it.List)):]...)
+		it.Index = len(*it.List)
+		return items, nil
+	}
+	var items []value.Value
+	for {
+		err := m.ConsumeGas(1)
+		var x value.Value
+		ok := err == nil
+		if ok {
+			x, ok, err = m.IterNext(it)
+		}
+		if err != nil {
+			if errors.Is(err, ErrGasExhausted) {
+				it.Ahead = append(items, it.Ahead...)
+			}
+			return nil, err
+		}
+		if !ok {
+			return items, nil
+		}
+		items = append(items, x)
+	}
+}
+
+// giveBack returns x to it if err leaves the execution to be resumed.
+func giveBack(it *value.Iterator, err error, x value.Value) {
+	if errors.Is(err, ErrGasExhausted) {
+		it.Ahead = append([]value.Value{x}, it.Ahead...)
+	}
+}
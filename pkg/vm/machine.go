@@ -1,45 +1,95 @@
 package vm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/agenthands/npython/pkg/core/value"
 )
 
+// Default limits, used by GetMachine and by machines not created with
+// NewMachine.
 const (
 	StackDepth   = 128
 	MaxFrames    = 32
 	MaxLocals    = 16
 	MaxArenaSize = 10 * 1024 * 1024 // 10MB limit
+	// MaxGlobals bounds the module globals of a program. Unlike locals,
+	// globals are not allocated per frame, so the bound is generous.
+	MaxGlobals = 1 << 16
 )
 
+// Limits sizes the operand stack, the call stack and the locals of each frame
+// of a machine. Zero fields take the defaults.
+type Limits struct {
+	StackDepth int
+	MaxFrames  int
+	MaxLocals  int
+}
+
+// DefaultLimits are the limits of machines from GetMachine.
+var DefaultLimits = Limits{StackDepth: StackDepth, MaxFrames: MaxFrames, MaxLocals: MaxLocals}
+
+func (l Limits) withDefaults() Limits {
+	if l.StackDepth <= 0 {
+		l.StackDepth = StackDepth
+	}
+	if l.MaxFrames <= 0 {
+		l.MaxFrames = MaxFrames
+	}
+	if l.MaxLocals <= 0 {
+		l.MaxLocals = MaxLocals
+	}
+	return l
+}
+
 var (
 	ErrStackOverflow     = errors.New("vm: stack overflow")
 	ErrStackUnderflow    = errors.New("vm: stack underflow")
 	ErrFrameOverflow     = errors.New("vm: call stack overflow")
 	ErrGasExhausted      = errors.New("vm: gas exhausted")
 	ErrSecurityViolation = errors.New("vm: security violation")
+	ErrCancelled         = errors.New("vm: execution cancelled")
+	ErrDeadline          = errors.New("vm: deadline exceeded")
+	ErrNotResumable      = errors.New("vm: execution is not resumable")
+	ErrLocalsOverflow    = errors.New("vm: too many locals")
+
+	// errStop is returned by OP_RET when it pops the frame pushed by Call,
+	// and by OP_YIELD when it suspends a generator.
+	errStop = errors.New("vm: stop marker")
 )
 
+// ctxCheckInterval is how many instructions run between cancellation checks.
+// It must be a power of two.
+const ctxCheckInterval = 1024
+
 type Frame struct {
 	ReturnIP   int
 	BaseSP     int
 	ArgCount   int
-	Locals     [MaxLocals]value.Value
-	LocalNames [MaxLocals]string
+	Locals     []value.Value
+	LocalNames []string
+
+	// callerIP is the OP_SYSCALL that entered this frame through Call, or
+	// -1 if the host called it directly.
+	callerIP int
+	// entry is the first instruction of the function running in the
+	// frame.
+	entry int
 }
 
 type Machine struct {
-	Stack            [StackDepth]value.Value
+	Stack            []value.Value
 	SP               int
 	IP               int
 	FP               int
-	Frames           [MaxFrames]Frame
+	Frames           []Frame
 	Code             []uint32
 	Constants        []value.Value
 	Arena            []byte
@@ -48,6 +98,42 @@ type Machine struct {
 	ScopeStack       []string
 	FunctionRegistry map[string]int
 	HostRegistry     []HostFunctionEntry
+	GasSchedule      *GasSchedule
+	// Debug, if set, is used to render runtime errors as tracebacks.
+	Debug *DebugInfo
+	// GCThreshold is the arena size in bytes at which the arena is
+	// compacted; after a compaction the next one waits until the arena has
+	// doubled. Zero means DefaultGCThreshold, a negative value disables
+	// compaction.
+	GCThreshold int
+	// Tracer, if set, is notified of every instruction, host function
+	// call, scope and function call. Execution is slower while it is set.
+	Tracer Tracer
+	// Effects, if set, handles the calls to Nondeterministic host
+	// functions instead of calling them directly; see Recorder and
+	// Replayer.
+	Effects EffectHandler
+
+	ctx       context.Context
+	gas       int
+	granted   int // gas added since Reset, see GasUsed
+	reserve   int
+	depth     int
+	hostSP    int
+	resumable bool
+	handlers  []handler
+	gcAt      int
+	hostState map[any]any
+	gens      []genFrame
+	globals   []value.Value
+	handles   uint64
+	// locals and localNames back the locals of all frames in order. maxFP
+	// is the highest frame entered since Reset, which only clears the
+	// frames up to it.
+	locals     []value.Value
+	localNames []string
+	maxFP      int
+	pending    Handle
 }
 
 type Gatekeeper interface {
@@ -55,25 +141,140 @@ type Gatekeeper interface {
 }
 
 type HostFunctionEntry struct {
+	// Name identifies the function for linkage checks against Bytecode.Links.
+	Name          string
 	RequiredScope string
 	Fn            func(*Machine) error
+	// Cost is charged on every call in addition to the OP_SYSCALL cost.
+	Cost int
+	// CostFn, if set, computes an extra charge from the arguments on the
+	// stack before the call, e.g. the length of a list to be sorted.
+	CostFn func(*Machine) int
+	// Effect declares the stack effect for Verify. Without it the verifier
+	// cannot track the stack depth past calls to this function.
+	Effect *StackEffect
+	// Nondeterministic marks a function that reads or changes the world
+	// outside the machine, e.g. the network or files. Calls to it go
+	// through Machine.Effects, if set, to be recorded or replayed.
+	Nondeterministic bool
+}
+
+func (e *HostFunctionEntry) cost(m *Machine) int {
+	c := e.Cost
+	if e.CostFn != nil {
+		c += e.CostFn(m)
+	}
+	return c
 }
 
 var machinePool = sync.Pool{
-	New: func() any {
-		return &Machine{
-			TokenMap:         make(map[string]string),
-			ScopeStack:       make([]string, 0, 8),
-			FunctionRegistry: make(map[string]int),
-		}
-	},
+	New: func() any { return NewMachine(DefaultLimits) },
+}
+
+// NewMachine returns a machine with the given limits. The stack, frames and
+// locals are allocated up front and reused across Reset.
+func NewMachine(l Limits) *Machine {
+	m := &Machine{
+		TokenMap:         make(map[string]string),
+		ScopeStack:       make([]string, 0, 8),
+		FunctionRegistry: make(map[string]int),
+	}
+	m.allocate(l)
+	return m
+}
+
+// allocate sizes the stack and frames for l. The locals of all frames share
+// one backing array.
+func (m *Machine) allocate(l Limits) {
+	l = l.withDefaults()
+	m.Stack = make([]value.Value, l.StackDepth)
+	m.Frames = make([]Frame, l.MaxFrames)
+	m.locals = make([]value.Value, l.MaxFrames*l.MaxLocals)
+	m.localNames = make([]string, l.MaxFrames*l.MaxLocals)
+	for i := range m.Frames {
+		lo, hi := i*l.MaxLocals, (i+1)*l.MaxLocals
+		m.Frames[i].Locals = m.locals[lo:hi:hi]
+		m.Frames[i].LocalNames = m.localNames[lo:hi:hi]
+	}
+}
+
+// init gives a machine declared as a struct literal the default limits.
+func (m *Machine) init() {
+	if m.Stack == nil {
+		m.allocate(DefaultLimits)
+	}
+	if m.TokenMap == nil {
+		m.TokenMap = make(map[string]string)
+	}
+	if m.FunctionRegistry == nil {
+		m.FunctionRegistry = make(map[string]int)
+	}
+	if m.gcAt == 0 {
+		m.gcAt = m.gcThreshold()
+	}
+}
+
+// Globals returns the module globals, which OP_PUSH_G and OP_POP_G address
+// from any frame. Load sizes the table for its bytecode; storing to a slot
+// past the end grows it.
+func (m *Machine) Globals() []value.Value {
+	return m.globals
+}
+
+// Load prepares m to run bc from the start: it sets the code, constants,
+// arena and debug information, registers the functions and gives the module
+// globals their slots. The arena is shared with bc, not copied.
+func (m *Machine) Load(bc *Bytecode) {
+	m.init()
+	m.Code = bc.Instructions
+	m.Constants = bc.Constants
+	m.Arena = bc.Arena
+	m.Debug = bc.Debug
+	for name, ip := range bc.Functions {
+		m.FunctionRegistry[name] = ip
+	}
+	clear(m.globals)
+	m.globals = slices.Grow(m.globals[:0], bc.Globals)[:bc.Globals]
+}
+
+// HostState returns the value a host function stored under key with
+// SetHostState, or nil.
+func (m *Machine) HostState(key any) any {
+	return m.hostState[key]
+}
+
+// SetHostState stores v under key for the host functions of the current
+// execution, e.g. a request being built over several calls; a nil v deletes
+// the key. Keeping such state on the machine rather than in the host object
+// isolates executions that share the host object, and Reset clears it so
+// that nothing leaks to the next user of a pooled machine.
+func (m *Machine) SetHostState(key, v any) {
+	if v == nil {
+		delete(m.hostState, key)
+		return
+	}
+	if m.hostState == nil {
+		m.hostState = make(map[any]any)
+	}
+	m.hostState[key] = v
+}
+
+// Limits returns the limits the machine was created with.
+func (m *Machine) Limits() Limits {
+	m.init()
+	return Limits{StackDepth: len(m.Stack), MaxFrames: len(m.Frames), MaxLocals: len(m.Frames[0].Locals)}
 }
 
 func GetMachine() *Machine {
 	return machinePool.Get().(*Machine)
 }
 
+// PutMachine resets m and returns it to the pool. Machines with limits other
+// than DefaultLimits are left to the garbage collector.
 func PutMachine(m *Machine) {
+	if m.Limits() != DefaultLimits {
+		return
+	}
 	m.Reset()
 	machinePool.Put(m)
 }
@@ -83,24 +284,75 @@ func (m *Machine) Reset() {
 	m.IP = 0
 	m.FP = 0
 	m.Arena = m.Arena[:0]
-	for i := range m.Frames {
-		m.Frames[i] = Frame{}
+	if len(m.Frames) > 0 {
+		n := (m.maxFP + 1) * len(m.Frames[0].Locals)
+		clear(m.locals[:n])
+		clear(m.localNames[:n])
+		for i := range m.Frames[:m.maxFP+1] {
+			f := &m.Frames[i]
+			f.ReturnIP, f.BaseSP, f.ArgCount, f.callerIP, f.entry = 0, 0, 0, 0, 0
+		}
 	}
+	m.maxFP = 0
 	m.ScopeStack = m.ScopeStack[:0]
 	for k := range m.TokenMap {
 		delete(m.TokenMap, k)
 	}
-	for i := range m.Stack {
-		m.Stack[i] = value.Value{}
+	clear(m.Stack)
+	m.ctx = nil
+	m.gas = 0
+	m.granted = 0
+	m.reserve = 0
+	m.hostSP = 0
+	m.resumable = false
+	m.handlers = m.handlers[:0]
+	m.Debug = nil
+	m.Tracer = nil
+	m.Effects = nil
+	m.gcAt = 0
+	clear(m.hostState)
+	m.gens = m.gens[:0]
+	clear(m.globals)
+	m.globals = m.globals[:0]
+	m.pending = 0
+}
+
+// Context returns the context of the current execution. Host functions that
+// block (network, disk) should honour it. Outside of RunContext/CallContext it
+// returns context.Background().
+func (m *Machine) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
 	}
+	return m.ctx
+}
+
+// ctxError maps a context error to the corresponding VM sentinel.
+func ctxError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrDeadline
+	}
+	return ErrCancelled
 }
 
 func (m *Machine) Push(v value.Value) {
-	if m.SP >= len(m.Stack) {
+	if m.SP < len(m.Stack) {
+		m.Stack[m.SP] = v
+		m.SP++
+		return
+	}
+	m.pushFull(v)
+}
+
+// pushFull is Push onto a full stack, kept apart so that Push is inlined:
+// it panics with ErrStackOverflow, unless m has no stack yet because it was
+// declared as a struct literal.
+func (m *Machine) pushFull(v value.Value) {
+	if m.Stack != nil {
 		panic(ErrStackOverflow)
 	}
-	m.Stack[m.SP] = v
-	m.SP++
+	m.init()
+	m.Push(v)
 }
 
 func (m *Machine) Pop() value.Value {
@@ -113,7 +365,7 @@ func (m *Machine) Pop() value.Value {
 
 func (m *Machine) WriteArena(data []byte) (uint32, error) {
 	if len(m.Arena)+len(data) > MaxArenaSize {
-		return 0, errors.New("vm: arena overflow")
+		return 0, NewError("MemoryError", "arena overflow")
 	}
 	offset := uint32(len(m.Arena))
 	m.Arena = append(m.Arena, data...)
@@ -143,25 +395,142 @@ func (m *Machine) HasScope(scope string) bool {
 	return false
 }
 
+// Call runs the function at ip with args and returns its result. When invoked
+// from a host function it inherits the context and the gas budget of the
+// running execution; otherwise it draws on whatever budget is left on the
+// machine, which can be topped up with AddGas.
 func (m *Machine) Call(ip int, args ...value.Value) (value.Value, error) {
+	return m.CallContext(m.Context(), ip, args...)
+}
+
+// CallContext is like Call but aborts with ErrCancelled or ErrDeadline once ctx
+// is done. On error the frame, stack and IP are restored to their state before
+// the call.
+func (m *Machine) CallContext(ctx context.Context, ip int, args ...value.Value) (value.Value, error) {
+	return m.call(ctx, ip, nil, args)
+}
+
+// CallValue calls the function value fn, as passed to a host function such
+// as map() or sorted(), with args.
+func (m *Machine) CallValue(fn value.Value, args ...value.Value) (value.Value, error) {
+	f, err := function(fn, len(args))
+	if err != nil {
+		return value.Value{}, err
+	}
+	return m.call(m.Context(), f.Entry, f.Cells, args)
+}
+
+// function returns the function behind fn after checking that it can be
+// called with argc arguments.
+func function(fn value.Value, argc int) (*value.Function, error) {
+	f, ok := fn.Opaque.(*value.Function)
+	if fn.Type != value.TypeFunction || !ok {
+		return nil, NewError("TypeError", "'%s' object is not callable", TypeName(fn))
+	}
+	if argc != f.Arity {
+		return nil, NewError("TypeError", "%s() takes %d positional arguments but %d were given", f.Name, f.Arity, argc)
+	}
+	return f, nil
+}
+
+func (m *Machine) call(ctx context.Context, ip int, cells []*value.Cell, args []value.Value) (value.Value, error) {
+	prev := m.ctx
+	m.ctx = ctx
+	defer func() { m.ctx = prev }()
+
+	m.init()
+	if n := len(args) + len(cells); n > len(m.Frames[0].Locals) {
+		return value.Value{}, fmt.Errorf("%w: %d arguments, limit is %d", ErrLocalsOverflow, n, len(m.Frames[0].Locals))
+	}
+	fp, sp, oldIP, handlers := m.FP, m.SP, m.IP, len(m.handlers)
 	m.FP++
 	if m.FP >= len(m.Frames) {
 		m.FP--
 		return value.Value{}, ErrFrameOverflow
 	}
+	m.maxFP = max(m.maxFP, m.FP)
+	// Start above the arguments of the calling host function so that they
+	// survive a rollback of the syscall.
+	if m.SP < m.hostSP {
+		m.SP = m.hostSP
+	}
 	f := &m.Frames[m.FP]
 	f.ReturnIP = -1
+	f.callerIP, f.entry = -1, ip
+	if m.depth > 0 {
+		f.callerIP = oldIP
+	}
 	f.BaseSP = m.SP
 	f.ArgCount = len(args)
-	copy(f.Locals[:], args)
-	oldIP := m.IP
+	copy(f.Locals, args)
+	bindCells(f, cells)
 	m.IP = ip
-	err := m.Run(1000000)
+	if m.Tracer != nil {
+		m.Tracer.Call(m, ip, m.FP)
+	}
+	err := m.run()
 	m.IP = oldIP
-	if err != nil && err.Error() != "vm: stop marker" {
+	if err != nil && err != errStop {
+		if m.Tracer != nil {
+			m.traceUnwind(m.FP, fp, nil)
+		}
+		m.FP, m.SP, m.handlers = fp, sp, m.handlers[:handlers]
 		return value.Value{}, err
 	}
-	return m.Pop(), nil
+	ret := m.Pop()
+	m.SP = sp
+	return ret, nil
+}
+
+// bindCells places the cells of a closure in the locals of f after its
+// arguments.
+func bindCells(f *Frame, cells []*value.Cell) {
+	for i, c := range cells {
+		f.Locals[f.ArgCount+i] = value.Value{Type: value.TypeCell, Opaque: c}
+	}
+}
+
+// TypeName returns the Python name of the type of v.
+func TypeName(v value.Value) string {
+	switch v.Type {
+	case value.TypeVoid:
+		return "NoneType"
+	case value.TypeInt:
+		return "int"
+	case value.TypeBool:
+		return "bool"
+	case value.TypeFloat:
+		return "float"
+	case value.TypeString:
+		return "str"
+	case value.TypeBytes:
+		return "bytes"
+	case value.TypeDict:
+		return "dict"
+	case value.TypeList:
+		return "list"
+	case value.TypeTuple:
+		return "tuple"
+	case value.TypeSet:
+		return "set"
+	case value.TypeIterator:
+		if it, ok := v.Opaque.(*value.Iterator); ok {
+			return it.Kind.String()
+		}
+		return "iterator"
+	case value.TypeRange:
+		return "range"
+	case value.TypeException:
+		if e, ok := v.Opaque.(*value.Exception); ok {
+			return e.Kind
+		}
+		return "Exception"
+	case value.TypeFunction:
+		return "function"
+	case value.TypeCell:
+		return "cell"
+	}
+	return "object"
 }
 
 func IsTruthy(v value.Value) bool {
@@ -169,7 +538,7 @@ func IsTruthy(v value.Value) bool {
 	case value.TypeBool:
 		return v.Data != 0
 	case value.TypeInt:
-		return v.Data != 0
+		return v.Data != 0 || v.Opaque != nil
 	case value.TypeFloat:
 		return math.Float64frombits(v.Data) != 0
 	case value.TypeString:
@@ -196,7 +565,12 @@ func IsTruthy(v value.Value) bool {
 			return len(s) > 0
 		}
 		return false
-	case value.TypeIterator:
+	case value.TypeRange:
+		if r, ok := v.Opaque.(*value.Range); ok {
+			return r.Len() > 0
+		}
+		return false
+	case value.TypeIterator, value.TypeException, value.TypeFunction:
 		return true
 	}
 	return false
@@ -209,7 +583,7 @@ func contains(m *Machine, container, item value.Value) bool {
 	case value.TypeList:
 		l := *(container.Opaque.(*[]value.Value))
 		for _, v := range l {
-			if v.Type == item.Type && v.Data == item.Data {
+			if Equal(v, item, m.Arena) {
 				return true
 			}
 		}
@@ -217,38 +591,140 @@ func contains(m *Machine, container, item value.Value) bool {
 		d := container.Opaque.(map[string]any)
 		_, ok := d[value.UnpackString(item.Data, m.Arena)]
 		return ok
+	case value.TypeRange:
+		r := container.Opaque.(*value.Range)
+		if item.Type != value.TypeInt || item.IsBig() {
+			return false
+		}
+		i := int(item.Int()) - r.Start
+		return i%r.Step == 0 && i/r.Step >= 0 && i/r.Step < r.Len()
 	}
 	return false
 }
 
-func (m *Machine) Run(gasLimit int) (err error) {
+// Run executes the loaded code until it halts, fails or exhausts gasLimit.
+// Each instruction costs one unit of gas unless a GasSchedule is set.
+func (m *Machine) Run(gasLimit int) error {
+	return m.RunContext(context.Background(), gasLimit)
+}
+
+// RunContext is like Run but also stops when ctx is done, returning
+// ErrCancelled or ErrDeadline. The context is checked periodically in the
+// dispatch loop and is made available to host functions via Context.
+func (m *Machine) RunContext(ctx context.Context, gasLimit int) error {
+	m.setGas(gasLimit)
+	return m.exec(ctx)
+}
+
+// exec runs from the current IP with the current budget under ctx.
+func (m *Machine) exec(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return ctxError(err)
+	}
+	if m.pending != 0 {
+		return ErrSuspended
+	}
+	m.init()
+	prev := m.ctx
+	m.ctx = ctx
+	defer func() { m.ctx = prev }()
+	err := m.run()
+	suspended := errors.Is(err, ErrSuspended) && m.pending != 0
+	if suspended {
+		// Resume continues after the call, with the result pushed by
+		// Complete.
+		m.IP++
+	} else {
+		m.pending = 0
+	}
+	m.resumable = suspended || errors.Is(err, ErrGasExhausted)
+	return err
+}
+
+// run executes from the current IP, passing errors raised by the program to
+// the exception handlers set up in this run.
+func (m *Machine) run() error {
+	m.depth++
+	defer func() { m.depth-- }()
+	for {
+		var err error
+		if m.Tracer != nil {
+			err = m.dispatchTraced()
+		} else {
+			err = m.dispatch(0, -1)
+		}
+		if err == nil {
+			return nil
+		}
+		fp, scopes := m.FP, m.ScopeStack
+		if !m.handle(err) {
+			return err
+		}
+		if m.Tracer != nil {
+			m.traceUnwind(fp, m.FP, scopes[len(m.ScopeStack):])
+		}
+	}
+}
+
+// dispatch executes instructions from the current IP, counting them from n,
+// until the program halts, fails, or steps instructions have run. A negative
+// steps runs without limit.
+func (m *Machine) dispatch(n, steps int) (err error) {
 	var op uint8
+	defer func() {
+		if err != nil {
+			err = m.fault(err)
+		}
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			if e, ok := r.(error); ok && (e == ErrStackUnderflow || e == ErrStackOverflow || e == ErrFrameOverflow) {
-				err = fmt.Errorf("vm: %v at OP_%02X (IP: %d)", e, op, m.IP)
+				err = fmt.Errorf("%w at OP_%02X (IP: %d)", e, op, m.IP)
 				return
 			}
 			if s, ok := r.(string); ok && s == "value: memory access violation" {
-				err = fmt.Errorf("vm: memory access violation at OP_%02X (IP: %d)", op, m.IP)
+				err = NewError("SystemError", "memory access violation at OP_%02X (IP: %d)", op, m.IP)
 				return
 			}
 			if re, ok := r.(runtime.Error); ok {
-				err = fmt.Errorf("vm: runtime error: %v at OP_%02X (IP: %d)", re, op, m.IP)
+				err = NewError("SystemError", "runtime error: %v at OP_%02X (IP: %d)", re, op, m.IP)
 				return
 			}
 			panic(r)
 		}
 	}()
 
-	for i := 0; i < gasLimit; i++ {
+	done := m.Context().Done()
+	sched := m.GasSchedule
+	if sched == nil {
+		sched = &unitGas
+	}
+	// locals are those of frame FP; instructions that change FP reload
+	// them.
+	locals := m.Frames[m.FP].Locals
+	for end := n + steps; n != end; n++ {
+		if done != nil && n&(ctxCheckInterval-1) == 0 {
+			select {
+			case <-done:
+				return ctxError(m.ctx.Err())
+			default:
+			}
+		}
 		if m.IP >= len(m.Code) {
-			return errors.New("vm: instruction pointer out of bounds")
+			return NewError("SystemError", "instruction pointer out of bounds")
 		}
 		instr := m.Code[m.IP]
 		op = uint8(instr >> 24)
 		arg := int(instr & 0x00FFFFFF)
 
+		cost := sched[op]
+		// Only nested runs draw on the gas held back by RunSlice, except for
+		// the first instruction of a slice so that every slice makes progress.
+		if m.gas < cost && ((m.depth == 1 && n > 0) || !m.refill(cost)) {
+			return ErrGasExhausted
+		}
+		m.gas -= cost
+
 		switch op {
 		case OP_HALT:
 			return nil
@@ -258,6 +734,14 @@ func (m *Machine) Run(gasLimit int) (err error) {
 		case OP_ADD:
 			b := m.Pop()
 			a := m.Pop()
+			// Small ints that do not overflow skip Arith.
+			if smallInts(a, b) {
+				if r := a.Int() + b.Int(); (a.Int()^r)&(b.Int()^r) >= 0 {
+					m.Push(value.Value{Type: value.TypeInt, Data: uint64(r)})
+					m.IP++
+					break
+				}
+			}
 			if a.Type == value.TypeString {
 				res := value.UnpackString(a.Data, m.Arena) + b.Format(m.Arena)
 				off, err := m.WriteArena([]byte(res))
@@ -265,60 +749,24 @@ func (m *Machine) Run(gasLimit int) (err error) {
 					return err
 				}
 				m.Push(value.Value{Type: value.TypeString, Data: value.PackString(off, uint32(len(res)))})
+				m.collect()
 			} else {
-				m.Push(value.Value{Type: value.TypeInt, Data: uint64(int64(a.Data) + int64(b.Data))})
-			}
-			m.IP++
-		case OP_SUB:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a - b)})
-			m.IP++
-		case OP_MUL:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a * b)})
-			m.IP++
-		case OP_DIV:
-			b := m.Pop().Float()
-			a := m.Pop().Float()
-			if b == 0 {
-				return errors.New("vm: div0")
+				r, err := Arith(op, a, b)
+				if err != nil {
+					return err
+				}
+				m.Push(r)
 			}
-			m.Push(value.Value{Type: value.TypeFloat, Data: math.Float64bits(a / b)})
 			m.IP++
-		case OP_FLOOR_DIV:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			if b == 0 {
-				return errors.New("vm: div0")
+		case OP_SUB, OP_MUL, OP_DIV, OP_FLOOR_DIV, OP_POW,
+			OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR, OP_LSHIFT, OP_RSHIFT:
+			b := m.Pop()
+			a := m.Pop()
+			r, err := Arith(op, a, b)
+			if err != nil {
+				return err
 			}
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a / b)})
-			m.IP++
-		case OP_BIT_AND:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a & b)})
-			m.IP++
-		case OP_BIT_OR:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a | b)})
-			m.IP++
-		case OP_BIT_XOR:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a ^ b)})
-			m.IP++
-		case OP_LSHIFT:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a << b)})
-			m.IP++
-		case OP_RSHIFT:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			m.Push(value.Value{Type: value.TypeInt, Data: uint64(a >> b)})
+			m.Push(r)
 			m.IP++
 		case OP_MOD:
 			b := m.Pop()
@@ -330,97 +778,62 @@ func (m *Machine) Run(gasLimit int) (err error) {
 					return err
 				}
 				m.Push(value.Value{Type: value.TypeString, Data: value.PackString(off, uint32(len(res)))})
+				m.collect()
 			} else {
-				if b.Data == 0 {
-					return errors.New("vm: div0")
+				r, err := Arith(op, a, b)
+				if err != nil {
+					return err
 				}
-				m.Push(value.Value{Type: value.TypeInt, Data: uint64(int64(a.Data) % int64(b.Data))})
+				m.Push(r)
 			}
 			m.IP++
-		case OP_EQ:
+		case OP_EQ, OP_NE:
 			b := m.Pop()
 			a := m.Pop()
 			r := uint64(0)
-			if a.Type == b.Type {
-				if a.Type == value.TypeString {
-					strA := value.UnpackString(a.Data, m.Arena)
-					strB := value.UnpackString(b.Data, m.Arena)
-					if strA == strB {
-						r = 1
-					}
-				} else if a.Data == b.Data {
-					r = 1
-				}
+			if Equal(a, b, m.Arena) == (op == OP_EQ) {
+				r = 1
 			}
 			m.Push(value.Value{Type: value.TypeBool, Data: r})
 			m.IP++
-		case OP_NE:
+		case OP_IS, OP_IS_NOT:
 			b := m.Pop()
 			a := m.Pop()
-			r := uint64(1)
-			if a.Type == b.Type {
-				if a.Type == value.TypeString {
-					if value.UnpackString(a.Data, m.Arena) == value.UnpackString(b.Data, m.Arena) {
-						r = 0
-					}
-				} else if a.Data == b.Data {
-					r = 0
-				}
-			}
-			m.Push(value.Value{Type: value.TypeBool, Data: r})
-			m.IP++
-		case OP_GT:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
 			r := uint64(0)
-			if a > b {
+			if Identical(a, b) == (op == OP_IS) {
 				r = 1
 			}
 			m.Push(value.Value{Type: value.TypeBool, Data: r})
 			m.IP++
-		case OP_LT:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
+		case OP_NOT:
 			r := uint64(0)
-			if a < b {
+			if !IsTruthy(m.Pop()) {
 				r = 1
 			}
 			m.Push(value.Value{Type: value.TypeBool, Data: r})
 			m.IP++
-		case OP_LTE:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
-			r := uint64(0)
-			if a <= b {
-				r = 1
+		case OP_NEG, OP_POS, OP_INVERT:
+			r, err := Unary(op, m.Pop())
+			if err != nil {
+				return err
 			}
-			m.Push(value.Value{Type: value.TypeBool, Data: r})
+			m.Push(r)
 			m.IP++
-		case OP_GTE:
-			b := m.Pop().Int()
-			a := m.Pop().Int()
+		case OP_GT, OP_LT, OP_LTE, OP_GTE:
+			b := m.Pop()
+			a := m.Pop()
+			var ok bool
+			if smallInts(a, b) {
+				ok = compareInts(op, a.Int(), b.Int())
+			} else if ok, err = Compare(op, a, b, m.Arena); err != nil {
+				return err
+			}
 			r := uint64(0)
-			if a >= b {
+			if ok {
 				r = 1
 			}
 			m.Push(value.Value{Type: value.TypeBool, Data: r})
 			m.IP++
-		case OP_POW:
-			bVal := m.Pop()
-			aVal := m.Pop()
-			var f1, f2 float64
-			if aVal.Type == value.TypeInt {
-				f1 = float64(aVal.Int())
-			} else {
-				f1 = math.Float64frombits(aVal.Data)
-			}
-			if bVal.Type == value.TypeInt {
-				f2 = float64(bVal.Int())
-			} else {
-				f2 = math.Float64frombits(bVal.Data)
-			}
-			m.Push(value.Value{Type: value.TypeFloat, Data: math.Float64bits(math.Pow(f1, f2))})
-			m.IP++
 		case OP_AND:
 			b := m.Pop()
 			a := m.Pop()
@@ -448,9 +861,41 @@ func (m *Machine) Run(gasLimit int) (err error) {
 			}
 			m.Push(value.Value{Type: value.TypeBool, Data: r})
 			m.IP++
+		case OP_SETUP_EXCEPT:
+			if len(m.handlers) >= len(m.Stack) {
+				return ErrStackOverflow
+			}
+			m.handlers = append(m.handlers, handler{ip: arg, fp: m.FP, sp: m.SP, scopes: len(m.ScopeStack), depth: m.depth})
+			m.IP++
+		case OP_POP_EXCEPT:
+			if len(m.handlers) == 0 {
+				return NewError("SystemError", "no exception handler to pop")
+			}
+			m.handlers = m.handlers[:len(m.handlers)-1]
+			m.IP++
+		case OP_RAISE:
+			return raise(m.Pop(), m.Arena)
+		case OP_EXC_MATCH:
+			class := value.UnpackString(m.Pop().Data, m.Arena)
+			exc := m.Pop()
+			r := uint64(0)
+			if e, ok := exc.Opaque.(*value.Exception); ok && ExceptionMatches(e.Kind, class) {
+				r = 1
+			}
+			m.Push(value.Value{Type: value.TypeBool, Data: r})
+			m.IP++
+		case OP_MAKE_EXC:
+			msg := m.Pop()
+			class := m.Pop()
+			e := &value.Exception{Kind: class.Format(m.Arena)}
+			if msg.Type != value.TypeVoid {
+				e.Message = msg.Format(m.Arena)
+			}
+			m.Push(value.Value{Type: value.TypeException, Opaque: e})
+			m.IP++
 		case OP_ERROR:
 			msg := value.UnpackString(m.Pop().Data, m.Arena)
-			return errors.New("npython error: " + msg)
+			return NewError("Exception", "npython error: %s", msg)
 		case OP_PRINT:
 			val := m.Pop()
 			fmt.Println(val.Format(m.Arena))
@@ -478,32 +923,155 @@ func (m *Machine) Run(gasLimit int) (err error) {
 			} else {
 				m.IP++
 			}
+		case OP_JMP_FALSE_OR_POP, OP_JMP_TRUE_OR_POP:
+			if IsTruthy(m.Peek()) == (op == OP_JMP_TRUE_OR_POP) {
+				m.IP = arg
+			} else {
+				m.Pop()
+				m.IP++
+			}
 		case OP_PUSH_L:
-			m.Push(m.Frames[m.FP].Locals[arg])
+			if arg >= len(locals) {
+				return fmt.Errorf("%w: local %d, limit is %d", ErrLocalsOverflow, arg, len(locals))
+			}
+			m.Push(locals[arg])
 			m.IP++
 		case OP_POP_L:
-			m.Frames[m.FP].Locals[arg] = m.Pop()
+			if arg >= len(locals) {
+				return fmt.Errorf("%w: local %d, limit is %d", ErrLocalsOverflow, arg, len(locals))
+			}
+			locals[arg] = m.Pop()
+			m.IP++
+		case OP_PUSH_G:
+			if arg >= MaxGlobals {
+				return fmt.Errorf("%w: global %d, limit is %d", ErrLocalsOverflow, arg, MaxGlobals)
+			}
+			if arg < len(m.globals) {
+				m.Push(m.globals[arg])
+			} else {
+				m.Push(value.Value{Type: value.TypeVoid})
+			}
+			m.IP++
+		case OP_POP_G:
+			if arg >= MaxGlobals {
+				return fmt.Errorf("%w: global %d, limit is %d", ErrLocalsOverflow, arg, MaxGlobals)
+			}
+			if arg >= len(m.globals) {
+				m.globals = append(m.globals, make([]value.Value, arg+1-len(m.globals))...)
+			}
+			m.globals[arg] = m.Pop()
 			m.IP++
 		case OP_CALL:
 			target, argc := arg>>8, arg&0xFF
+			if m.FP+1 >= len(m.Frames) {
+				return ErrFrameOverflow
+			}
+			if argc > len(m.Frames[m.FP+1].Locals) {
+				return fmt.Errorf("%w: %d arguments, limit is %d", ErrLocalsOverflow, argc, len(m.Frames[m.FP+1].Locals))
+			}
 			m.Frames[m.FP+1].ReturnIP, m.Frames[m.FP+1].ArgCount, m.Frames[m.FP+1].BaseSP = m.IP+1, argc, m.SP-argc
+			m.Frames[m.FP+1].entry = int(target)
 			for j := 0; j < argc; j++ {
 				m.Frames[m.FP+1].Locals[j] = m.Stack[m.SP-argc+j]
 			}
 			m.SP -= argc
 			m.FP++
+			m.maxFP = max(m.maxFP, m.FP)
+			locals = m.Frames[m.FP].Locals
 			m.IP = target
+		case OP_CALL_FN:
+			if arg >= m.SP {
+				panic(ErrStackUnderflow)
+			}
+			base := m.SP - arg - 1
+			f, err := function(m.Stack[base], arg)
+			if err != nil {
+				return err
+			}
+			if m.FP+1 >= len(m.Frames) {
+				return ErrFrameOverflow
+			}
+			next := &m.Frames[m.FP+1]
+			if n := arg + len(f.Cells); n > len(next.Locals) {
+				return fmt.Errorf("%w: %d arguments, limit is %d", ErrLocalsOverflow, n, len(next.Locals))
+			}
+			next.ReturnIP, next.ArgCount, next.BaseSP, next.entry = m.IP+1, arg, base, f.Entry
+			copy(next.Locals, m.Stack[base+1:m.SP])
+			bindCells(next, f.Cells)
+			m.SP = base
+			m.FP++
+			m.maxFP = max(m.maxFP, m.FP)
+			locals = next.Locals
+			m.IP = f.Entry
+		case OP_CLOSURE:
+			if arg >= m.SP {
+				panic(ErrStackUnderflow)
+			}
+			base := m.SP - arg - 1
+			proto, ok := m.Stack[base].Opaque.(*value.Function)
+			if !ok {
+				return NewError("SystemError", "closure over a %s", TypeName(m.Stack[base]))
+			}
+			f := &value.Function{Name: proto.Name, Entry: proto.Entry, Arity: proto.Arity, Cells: make([]*value.Cell, arg)}
+			for i := range f.Cells {
+				c, ok := m.Stack[base+1+i].Opaque.(*value.Cell)
+				if !ok {
+					return NewError("SystemError", "closure over a %s", TypeName(m.Stack[base+1+i]))
+				}
+				f.Cells[i] = c
+			}
+			m.SP = base
+			m.Push(value.Value{Type: value.TypeFunction, Data: uint64(f.Entry), Opaque: f})
+			m.IP++
+		case OP_MAKE_CELL:
+			if arg >= len(locals) {
+				return fmt.Errorf("%w: local %d, limit is %d", ErrLocalsOverflow, arg, len(locals))
+			}
+			locals[arg] = value.Value{Type: value.TypeCell, Opaque: &value.Cell{Value: locals[arg]}}
+			m.IP++
+		case OP_LOAD_DEREF, OP_STORE_DEREF:
+			if arg >= len(locals) {
+				return fmt.Errorf("%w: local %d, limit is %d", ErrLocalsOverflow, arg, len(locals))
+			}
+			c, ok := locals[arg].Opaque.(*value.Cell)
+			if !ok {
+				return NewError("SystemError", "local %d is not a cell", arg)
+			}
+			if op == OP_LOAD_DEREF {
+				m.Push(c.Value)
+			} else {
+				c.Value = m.Pop()
+			}
+			m.IP++
+		case OP_GEN:
+			if arg > len(locals) {
+				return fmt.Errorf("%w: local %d, limit is %d", ErrLocalsOverflow, arg, len(locals))
+			}
+			g := &value.Generator{Entry: m.IP, IP: m.IP + 1, Locals: slices.Clone(locals[:arg])}
+			m.Push(value.Value{Type: value.TypeIterator, Opaque: &value.Iterator{Kind: value.IterGenerator, Gen: g}})
+			fallthrough
 		case OP_RET:
 			if m.Frames[m.FP].ReturnIP == -1 {
 				m.IP = -1
 				m.FP--
-				return errors.New("vm: stop marker")
+				return errStop
 			}
 			retVal := m.Pop()
 			m.IP = m.Frames[m.FP].ReturnIP
 			m.SP = m.Frames[m.FP].BaseSP
 			m.Push(retVal)
 			m.FP--
+			locals = m.Frames[m.FP].Locals
+		case OP_YIELD:
+			n := len(m.gens)
+			if n == 0 || m.gens[n-1].fp != m.FP {
+				return NewError("SystemError", "yield outside a generator")
+			}
+			g := m.gens[n-1].gen
+			g.IP, g.Running = m.IP+1, false
+			m.IP = -1
+			m.FP--
+			return errStop
 		case OP_ADDRESS:
 			tVal := m.Pop()
 			sVal := m.Pop()
@@ -525,13 +1093,37 @@ func (m *Machine) Run(gasLimit int) (err error) {
 			if entry.RequiredScope != "" && !m.HasScope(entry.RequiredScope) {
 				return ErrSecurityViolation
 			}
-			if err := entry.Fn(m); err != nil {
+			mark, sp := m.markGas(cost), m.SP
+			if err := m.ConsumeGas(entry.cost(m)); err != nil {
+				m.rollbackGas(mark)
+				return err
+			}
+			hostSP := m.hostSP
+			m.hostSP = sp
+			var err error
+			if m.Effects != nil && entry.Nondeterministic {
+				err = m.Effects.HostCall(m, arg, &entry)
+			} else {
+				err = entry.Fn(m)
+			}
+			m.hostSP = hostSP
+			if err != nil {
+				if ctxErr := m.Context().Err(); ctxErr != nil {
+					return ctxError(ctxErr)
+				}
+				if errors.Is(err, ErrGasExhausted) {
+					// Values popped by the host function are still in place,
+					// so restoring SP undoes the partial call.
+					m.SP = sp
+					m.rollbackGas(mark)
+				}
 				return err
 			}
+			m.collect()
 			m.IP++
 		default:
-			return fmt.Errorf("vm: unknown op %02X", op)
+			return NewError("SystemError", "unknown op %02X", op)
 		}
 	}
-	return ErrGasExhausted
+	return nil
 }
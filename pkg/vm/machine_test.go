@@ -1,13 +1,14 @@
 package vm_test
 
 import (
+	"errors"
 	"testing"
 	"github.com/agenthands/npython/pkg/vm"
 	"github.com/agenthands/npython/pkg/core/value"
 )
 
 func TestMachineReset(t *testing.T) {
-	m := &vm.Machine{}
+	m := vm.NewMachine(vm.DefaultLimits)
 	
 	// Dirty the machine
 	m.SP = 10
@@ -100,3 +101,58 @@ func TestMachineRun(t *testing.T) {
 		t.Errorf("expected 3, got %v (Type: %v)", res.Data, res.Type)
 	}
 }
+
+func TestMachineLimits(t *testing.T) {
+	l := vm.Limits{StackDepth: 4, MaxFrames: 2, MaxLocals: 2}
+	m := vm.NewMachine(l)
+	if got := m.Limits(); got != l || len(m.Stack) != 4 || len(m.Frames[1].Locals) != 2 {
+		t.Fatalf("unexpected limits %+v", got)
+	}
+
+	m.Code = []uint32{(uint32(vm.OP_PUSH_L) << 24) | 2, (uint32(vm.OP_HALT) << 24)}
+	if err := m.Run(10); !errors.Is(err, vm.ErrLocalsOverflow) {
+		t.Errorf("expected ErrLocalsOverflow, got %v", err)
+	}
+
+	// f() calls itself until the frames run out.
+	m.Reset()
+	m.Code = []uint32{(uint32(vm.OP_CALL) << 24) | (0 << 8)}
+	err := m.Run(100)
+	var re *vm.RuntimeError
+	if !errors.Is(err, vm.ErrFrameOverflow) || !errors.As(err, &re) || re.Kind != "RecursionError" {
+		t.Errorf("expected a RecursionError, got %v", err)
+	}
+	vm.PutMachine(m)
+	if got := vm.GetMachine().Limits(); got != vm.DefaultLimits {
+		t.Errorf("pool returned a machine with limits %+v", got)
+	}
+}
+
+func TestMachineGlobals(t *testing.T) {
+	m := vm.NewMachine(vm.DefaultLimits)
+	m.Constants = []value.Value{{Type: value.TypeInt, Data: 7}}
+
+	// f() stores 7 into global 1 and reads it back into its own local 1.
+	m.Code = []uint32{
+		(uint32(vm.OP_CALL) << 24) | (2 << 8), // CALL f
+		(uint32(vm.OP_HALT) << 24),            // HALT
+		(uint32(vm.OP_PUSH_C) << 24) | 0,      // f: PUSH_C 7
+		(uint32(vm.OP_POP_G) << 24) | 1,       // POP_G 1
+		(uint32(vm.OP_PUSH_G) << 24) | 1,      // PUSH_G 1
+		(uint32(vm.OP_POP_L) << 24) | 1,       // POP_L 1
+		(uint32(vm.OP_PUSH_C) << 24) | 0,      // PUSH_C 7
+		(uint32(vm.OP_RET) << 24),             // RET
+	}
+	if err := m.Run(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if g := m.Globals(); g[1].Data != 7 || m.Frames[1].Locals[1].Data != 7 {
+		t.Errorf("expected global 1 and the local of f to hold 7, got %v and %v", g[1], m.Frames[1].Locals[1])
+	}
+
+	// Reset clears the frames the run entered.
+	m.Reset()
+	if len(m.Globals()) != 0 || m.Frames[1].Locals[1].Type != value.TypeVoid {
+		t.Errorf("expected no globals and cleared locals after Reset, got %v and %v", m.Globals(), m.Frames[1].Locals[1])
+	}
+}
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+var (
+	ErrBadBytecode     = errors.New("vm: malformed bytecode file")
+	ErrBytecodeVersion = errors.New("vm: unsupported bytecode version")
+	ErrLinkage         = errors.New("vm: host function linkage mismatch")
+)
+
+// Layout of a compiled bytecode (.npyc) file:
+//
+//	magic "NPYC" | format version u16 | OpcodeVersion u16 | payload | CRC32 u32
+//
+// Integers in the header and trailer are little endian; the CRC32 (IEEE)
+// covers everything before it.
+const (
+	bytecodeMagic   = "NPYC"
+	bytecodeVersion = 4
+	bytecodeHeader  = len(bytecodeMagic) + 4
+)
+
+// MarshalBinary encodes the bytecode in the .npyc format.
+func (bc *Bytecode) MarshalBinary() ([]byte, error) {
+	w := &encoder{refs: make(map[objectRef]uint64)}
+	w.buf = append(w.buf, bytecodeMagic...)
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, bytecodeVersion)
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, OpcodeVersion)
+
+	w.uint(uint64(len(bc.Instructions)))
+	for _, instr := range bc.Instructions {
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, instr)
+	}
+	w.values(bc.Constants)
+	w.bytes(bc.Arena)
+	names := make([]string, 0, len(bc.Functions))
+	for name := range bc.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names) // reproducible output
+	w.uint(uint64(len(names)))
+	for _, name := range names {
+		w.string(name)
+		w.int(bc.Functions[name])
+	}
+	w.int(bc.Globals)
+	w.uint(uint64(len(bc.Links)))
+	for _, l := range bc.Links {
+		w.uint(uint64(l.Index))
+		w.string(l.Name)
+	}
+	w.bool(bc.Debug != nil)
+	if d := bc.Debug; d != nil {
+		w.string(d.File)
+		w.string(d.Source)
+		w.uint(uint64(len(d.Lines)))
+		for _, l := range d.Lines {
+			w.int(l.IP)
+			w.int(l.Line)
+			w.int(l.Col)
+		}
+		w.uint(uint64(len(d.Funcs)))
+		for _, f := range d.Funcs {
+			w.string(f.Name)
+			w.int(f.Start)
+			w.int(f.End)
+			w.strings(f.Locals)
+		}
+		w.strings(d.Globals)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return binary.LittleEndian.AppendUint32(w.buf, crc32.ChecksumIEEE(w.buf)), nil
+}
+
+// UnmarshalBinary decodes a .npyc file. It fails with ErrBytecodeVersion if
+// the file was written for a different format or instruction set and with
+// ErrBadBytecode if it is corrupt.
+func (bc *Bytecode) UnmarshalBinary(data []byte) error {
+	if len(data) < bytecodeHeader+4 || string(data[:len(bytecodeMagic)]) != bytecodeMagic {
+		return ErrBadBytecode
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadBytecode)
+	}
+	format := binary.LittleEndian.Uint16(body[len(bytecodeMagic):])
+	opcodes := binary.LittleEndian.Uint16(body[len(bytecodeMagic)+2:])
+	if format != bytecodeVersion || opcodes != OpcodeVersion {
+		return fmt.Errorf("%w: format %d, opcodes %d (want %d, %d)", ErrBytecodeVersion, format, opcodes, bytecodeVersion, OpcodeVersion)
+	}
+
+	r := &decoder{buf: body[bytecodeHeader:]}
+	n := r.count()
+	code := make([]uint32, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		if b := r.next(4); b != nil {
+			code = append(code, binary.LittleEndian.Uint32(b))
+		}
+	}
+	consts := r.values()
+	arena := append([]byte(nil), r.bytes()...)
+	funcs := make(map[string]int)
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		name := r.string()
+		funcs[name] = r.int()
+	}
+	globals := r.int()
+	if globals < 0 || globals > MaxGlobals {
+		return ErrBadBytecode
+	}
+	var links []HostLink
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		idx := r.uint()
+		links = append(links, HostLink{Index: uint32(idx), Name: r.string()})
+	}
+	var debug *DebugInfo
+	if r.bool() {
+		debug = &DebugInfo{File: r.string(), Source: r.string()}
+		for n := r.count(); n > 0 && r.err == nil; n-- {
+			debug.Lines = append(debug.Lines, LineEntry{IP: r.int(), Line: r.int(), Col: r.int()})
+		}
+		for n := r.count(); n > 0 && r.err == nil; n-- {
+			debug.Funcs = append(debug.Funcs, FuncRange{Name: r.string(), Start: r.int(), End: r.int(), Locals: r.strings()})
+		}
+		debug.Globals = r.strings()
+	}
+	if r.err != nil || len(r.buf) != 0 {
+		return ErrBadBytecode
+	}
+	*bc = Bytecode{Instructions: code, Constants: consts, Arena: arena, Functions: funcs, Globals: globals, Links: links, Debug: debug}
+	return nil
+}
+
+// CheckLinks verifies that registry provides every host function the code
+// expects. Entries without a Name only need to be present.
+func (bc *Bytecode) CheckLinks(registry []HostFunctionEntry) error {
+	for _, l := range bc.Links {
+		if int(l.Index) >= len(registry) || registry[l.Index].Fn == nil {
+			return fmt.Errorf("%w: %q (index %d) is not registered", ErrLinkage, l.Name, l.Index)
+		}
+		if name := registry[l.Index].Name; name != "" && l.Name != "" && name != l.Name {
+			return fmt.Errorf("%w: index %d is %q, bytecode expects %q", ErrLinkage, l.Index, name, l.Name)
+		}
+	}
+	return nil
+}
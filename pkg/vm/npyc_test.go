@@ -0,0 +1,103 @@
+package vm_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func sampleBytecode() *vm.Bytecode {
+	code := []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_SYSCALL) << 24) | 2,
+		(uint32(vm.OP_PUSH_C) << 24) | 1,
+		(uint32(vm.OP_SYSCALL) << 24) | 2,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_HALT) << 24),
+	}
+	return &vm.Bytecode{
+		Instructions: code,
+		Constants: []value.Value{
+			{Type: value.TypeString, Data: value.PackString(0, 2)},
+			{Type: value.TypeFloat, Data: math.Float64bits(1.5)},
+		},
+		Arena:     []byte("hi"),
+		Functions: map[string]int{"f": 3, "g": 4},
+		Links:     vm.CollectLinks(code, map[uint32]string{2: "print"}),
+		Debug: &vm.DebugInfo{
+			File:   "sample.py",
+			Source: "print('hi')\nprint(1.5)\n",
+			Lines:  []vm.LineEntry{{IP: 0, Line: 1, Col: 1}, {IP: 2, Line: 2, Col: 1}},
+			Funcs:  []vm.FuncRange{{Name: "f", Start: 3, End: 4}},
+		},
+	}
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	bc := sampleBytecode()
+	if want := []vm.HostLink{{Index: 0}, {Index: 2, Name: "print"}}; !reflect.DeepEqual(bc.Links, want) {
+		t.Fatalf("CollectLinks: got %v, want %v", bc.Links, want)
+	}
+
+	data, err := bc.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := bc.MarshalBinary(); string(again) != string(data) {
+		t.Errorf("encoding is not deterministic")
+	}
+
+	var got vm.Bytecode
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, bc) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", got, *bc)
+	}
+}
+
+func TestBytecodeRejects(t *testing.T) {
+	data, err := sampleBytecode().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bc vm.Bytecode
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[10] ^= 1
+	if err := bc.UnmarshalBinary(corrupt); !errors.Is(err, vm.ErrBadBytecode) {
+		t.Errorf("expected ErrBadBytecode for a corrupt file, got %v", err)
+	}
+	if err := bc.UnmarshalBinary(data[:len(data)-1]); !errors.Is(err, vm.ErrBadBytecode) {
+		t.Errorf("expected ErrBadBytecode for a truncated file, got %v", err)
+	}
+
+	// Same file claiming a newer instruction set, with a valid checksum.
+	newer := append([]byte(nil), data[:len(data)-4]...)
+	binary.LittleEndian.PutUint16(newer[6:], vm.OpcodeVersion+1)
+	newer = binary.LittleEndian.AppendUint32(newer, crc32.ChecksumIEEE(newer))
+	if err := bc.UnmarshalBinary(newer); !errors.Is(err, vm.ErrBytecodeVersion) {
+		t.Errorf("expected ErrBytecodeVersion, got %v", err)
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	bc := sampleBytecode()
+	fn := func(*vm.Machine) error { return nil }
+
+	if err := bc.CheckLinks([]vm.HostFunctionEntry{{Fn: fn}}); !errors.Is(err, vm.ErrLinkage) {
+		t.Errorf("expected ErrLinkage for a missing entry, got %v", err)
+	}
+	if err := bc.CheckLinks([]vm.HostFunctionEntry{{Fn: fn}, {}, {Name: "len", Fn: fn}}); !errors.Is(err, vm.ErrLinkage) {
+		t.Errorf("expected ErrLinkage for a renamed entry, got %v", err)
+	}
+	if err := bc.CheckLinks([]vm.HostFunctionEntry{{Fn: fn}, {}, {Name: "print", Fn: fn}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
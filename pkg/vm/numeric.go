@@ -0,0 +1,433 @@
+package vm
+
+import (
+	"cmp"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+// Numbers follow Python's rules: bools take part as the integers 0 and 1, an
+// operation on two integers gives an integer (except true division), and one
+// with a float operand is carried out in float64. Integers stay in int64
+// until a result overflows it, and are big ints from then on.
+
+// maxIntBits bounds the size of an int, so that a single multiplication or
+// power cannot exhaust memory.
+const maxIntBits = 1 << 20
+
+var opSymbols = map[uint8]string{
+	OP_ADD: "+", OP_SUB: "-", OP_MUL: "*", OP_DIV: "/", OP_FLOOR_DIV: "//",
+	OP_MOD: "%", OP_POW: "** or pow()",
+	OP_BIT_AND: "&", OP_BIT_OR: "|", OP_BIT_XOR: "^", OP_LSHIFT: "<<", OP_RSHIFT: ">>",
+	OP_LT: "<", OP_LTE: "<=", OP_GT: ">", OP_GTE: ">=",
+	OP_NEG: "-", OP_POS: "+", OP_INVERT: "~",
+}
+
+func isNumber(v value.Value) bool {
+	return v.Type == value.TypeInt || v.Type == value.TypeFloat || v.Type == value.TypeBool
+}
+
+// smallInts reports whether a and b are both ints that fit in Data, the
+// common case that Arith and Compare check first.
+func smallInts(a, b value.Value) bool {
+	return a.Type == value.TypeInt && b.Type == value.TypeInt && a.Opaque == nil && b.Opaque == nil
+}
+
+// Arith applies the arithmetic operator op (OP_ADD, OP_SUB, OP_MUL, OP_DIV,
+// OP_FLOOR_DIV, OP_MOD, OP_POW or one of the bitwise operators) to two
+// numbers.
+func Arith(op uint8, a, b value.Value) (value.Value, error) {
+	if smallInts(a, b) {
+		return intArith(op, a.Int(), b.Int())
+	}
+	bitwise := op >= OP_BIT_AND && op <= OP_RSHIFT
+	if !isNumber(a) || !isNumber(b) || bitwise && (a.Type == value.TypeFloat || b.Type == value.TypeFloat) {
+		return value.Value{}, NewError("TypeError", "unsupported operand type(s) for %s: '%s' and '%s'", opSymbols[op], TypeName(a), TypeName(b))
+	}
+	if a.Type == value.TypeFloat || b.Type == value.TypeFloat {
+		fa, err := toFloat(a)
+		if err != nil {
+			return value.Value{}, err
+		}
+		fb, err := toFloat(b)
+		if err != nil {
+			return value.Value{}, err
+		}
+		return floatArith(op, fa, fb)
+	}
+	if a.IsBig() || b.IsBig() {
+		return bigArith(op, a.BigInt(), b.BigInt())
+	}
+	return intArith(op, a.Int(), b.Int())
+}
+
+// Unary applies the unary operator op (OP_NEG, OP_POS or OP_INVERT) to a
+// number. Bools become ints, as in Python.
+func Unary(op uint8, v value.Value) (value.Value, error) {
+	if !isNumber(v) || op == OP_INVERT && v.Type == value.TypeFloat {
+		return value.Value{}, NewError("TypeError", "bad operand type for unary %s: '%s'", opSymbols[op], TypeName(v))
+	}
+	switch {
+	case v.Type == value.TypeFloat && op == OP_NEG:
+		return value.Value{Type: value.TypeFloat, Data: v.Data ^ (1 << 63)}, nil
+	case v.Type == value.TypeFloat:
+		return v, nil
+	case op == OP_NEG:
+		return Arith(OP_SUB, value.Value{Type: value.TypeInt}, v)
+	case op == OP_INVERT:
+		return Arith(OP_SUB, value.Value{Type: value.TypeInt, Data: math.MaxUint64}, v)
+	}
+	if v.Type == value.TypeBool {
+		v.Type = value.TypeInt
+	}
+	return v, nil
+}
+
+func toFloat(v value.Value) (float64, error) {
+	f := v.Float()
+	if math.IsInf(f, 0) && v.Type == value.TypeInt {
+		return 0, NewError("OverflowError", "int too large to convert to float")
+	}
+	return f, nil
+}
+
+// intArith is the fast path for two ints that fit in int64. It hands over
+// to bigArith when the result does not.
+func intArith(op uint8, a, b int64) (value.Value, error) {
+	var r int64
+	switch op {
+	case OP_ADD:
+		r = a + b
+		if (a^r)&(b^r) < 0 {
+			return bigArith(op, big.NewInt(a), big.NewInt(b))
+		}
+	case OP_SUB:
+		r = a - b
+		if (a^b)&(a^r) < 0 {
+			return bigArith(op, big.NewInt(a), big.NewInt(b))
+		}
+	case OP_MUL:
+		var ok bool
+		if r, ok = mul64(a, b); !ok {
+			return bigArith(op, big.NewInt(a), big.NewInt(b))
+		}
+	case OP_DIV:
+		if b == 0 {
+			return value.Value{}, NewError("ZeroDivisionError", "division by zero")
+		}
+		if a > 1<<53 || a < -1<<53 || b > 1<<53 || b < -1<<53 {
+			// Not exact in float64: divide exactly and round once.
+			return bigArith(op, big.NewInt(a), big.NewInt(b))
+		}
+		return floatArith(op, float64(a), float64(b))
+	case OP_FLOOR_DIV, OP_MOD:
+		if b == 0 {
+			return value.Value{}, NewError("ZeroDivisionError", "division by zero")
+		}
+		if a == math.MinInt64 && b == -1 {
+			return bigArith(op, big.NewInt(a), big.NewInt(b))
+		}
+		// Go truncates towards zero; Python floors.
+		q, m := a/b, a%b
+		if m != 0 && (m < 0) != (b < 0) {
+			q, m = q-1, m+b
+		}
+		r = m
+		if op == OP_FLOOR_DIV {
+			r = q
+		}
+	case OP_POW:
+		if b < 0 {
+			return floatArith(op, float64(a), float64(b))
+		}
+		r = 1
+		for x, n := a, b; n > 0; n >>= 1 {
+			var ok bool
+			if n&1 == 1 {
+				if r, ok = mul64(r, x); !ok {
+					return bigArith(op, big.NewInt(a), big.NewInt(b))
+				}
+			}
+			if n > 1 {
+				if x, ok = mul64(x, x); !ok {
+					return bigArith(op, big.NewInt(a), big.NewInt(b))
+				}
+			}
+		}
+	case OP_BIT_AND:
+		r = a & b
+	case OP_BIT_OR:
+		r = a | b
+	case OP_BIT_XOR:
+		r = a ^ b
+	case OP_LSHIFT:
+		if b < 0 {
+			return value.Value{}, NewError("ValueError", "negative shift count")
+		}
+		if b >= 63 || (a<<b)>>b != a {
+			return bigArith(op, big.NewInt(a), big.NewInt(b))
+		}
+		r = a << b
+	case OP_RSHIFT:
+		if b < 0 {
+			return value.Value{}, NewError("ValueError", "negative shift count")
+		}
+		r = a >> min(b, 63)
+	}
+	return value.Value{Type: value.TypeInt, Data: uint64(r)}, nil
+}
+
+// mul64 returns a*b and whether it did not overflow.
+func mul64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	r := a * b
+	if r/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return r, true
+}
+
+func bigArith(op uint8, a, b *big.Int) (value.Value, error) {
+	r := new(big.Int)
+	switch op {
+	case OP_ADD:
+		r.Add(a, b)
+	case OP_SUB:
+		r.Sub(a, b)
+	case OP_MUL:
+		if a.BitLen()+b.BitLen() > maxIntBits+1 {
+			return value.Value{}, intTooLarge()
+		}
+		r.Mul(a, b)
+	case OP_DIV:
+		if b.Sign() == 0 {
+			return value.Value{}, NewError("ZeroDivisionError", "division by zero")
+		}
+		f, _ := new(big.Rat).SetFrac(a, b).Float64()
+		if math.IsInf(f, 0) {
+			return value.Value{}, NewError("OverflowError", "integer division result too large for a float")
+		}
+		return value.Value{Type: value.TypeFloat, Data: math.Float64bits(f)}, nil
+	case OP_FLOOR_DIV, OP_MOD:
+		if b.Sign() == 0 {
+			return value.Value{}, NewError("ZeroDivisionError", "division by zero")
+		}
+		q, m := new(big.Int).QuoRem(a, b, new(big.Int))
+		if m.Sign() != 0 && m.Sign() != b.Sign() {
+			q.Sub(q, big.NewInt(1))
+			m.Add(m, b)
+		}
+		r = m
+		if op == OP_FLOOR_DIV {
+			r = q
+		}
+	case OP_POW:
+		if b.Sign() < 0 {
+			fa, err := toFloat(value.NewBigInt(a))
+			if err != nil {
+				return value.Value{}, err
+			}
+			fb, _ := b.Float64()
+			return floatArith(op, fa, fb)
+		}
+		if a.CmpAbs(big.NewInt(1)) > 0 && (!b.IsInt64() || int64(a.BitLen()-1)*b.Int64() > maxIntBits) {
+			return value.Value{}, intTooLarge()
+		}
+		r.Exp(a, b, nil)
+	case OP_BIT_AND:
+		r.And(a, b)
+	case OP_BIT_OR:
+		r.Or(a, b)
+	case OP_BIT_XOR:
+		r.Xor(a, b)
+	case OP_LSHIFT, OP_RSHIFT:
+		if b.Sign() < 0 {
+			return value.Value{}, NewError("ValueError", "negative shift count")
+		}
+		n := b.Int64()
+		switch {
+		case op == OP_RSHIFT && (!b.IsInt64() || n > int64(a.BitLen())):
+			r.SetInt64(int64(a.Sign() >> 1)) // 0 or -1
+		case op == OP_RSHIFT:
+			r.Rsh(a, uint(n))
+		case a.Sign() == 0:
+		case !b.IsInt64() || int64(a.BitLen())+n > maxIntBits:
+			return value.Value{}, intTooLarge()
+		default:
+			r.Lsh(a, uint(n))
+		}
+	}
+	if r.BitLen() > maxIntBits {
+		return value.Value{}, intTooLarge()
+	}
+	return value.NewBigInt(r), nil
+}
+
+func intTooLarge() error {
+	return NewError("OverflowError", "int too large")
+}
+
+func floatArith(op uint8, a, b float64) (value.Value, error) {
+	var r float64
+	switch op {
+	case OP_ADD:
+		r = a + b
+	case OP_SUB:
+		r = a - b
+	case OP_MUL:
+		r = a * b
+	case OP_DIV:
+		if b == 0 {
+			return value.Value{}, NewError("ZeroDivisionError", "float division by zero")
+		}
+		r = a / b
+	case OP_FLOOR_DIV:
+		if b == 0 {
+			return value.Value{}, NewError("ZeroDivisionError", "float floor division by zero")
+		}
+		r = math.Floor(a / b)
+	case OP_MOD:
+		if b == 0 {
+			return value.Value{}, NewError("ZeroDivisionError", "float modulo")
+		}
+		r = math.Mod(a, b)
+		if r != 0 && (r < 0) != (b < 0) {
+			r += b
+		}
+	case OP_POW:
+		switch {
+		case a == 0 && b < 0:
+			return value.Value{}, NewError("ZeroDivisionError", "0.0 cannot be raised to a negative power")
+		case a < 0 && b != math.Trunc(b):
+			return value.Value{}, NewError("ValueError", "negative number cannot be raised to a fractional power")
+		}
+		r = math.Pow(a, b)
+	}
+	return value.Value{Type: value.TypeFloat, Data: math.Float64bits(r)}, nil
+}
+
+// Compare evaluates the ordering comparison op (OP_LT, OP_LTE, OP_GT or
+// OP_GTE) between two numbers or two strings.
+func Compare(op uint8, a, b value.Value, arena []byte) (bool, error) {
+	var c int
+	switch {
+	case smallInts(a, b):
+		return compareInts(op, a.Int(), b.Int()), nil
+	case isNumber(a) && isNumber(b):
+		if isNaN(a) || isNaN(b) {
+			return false, nil
+		}
+		c = compareNumbers(a, b)
+	case a.Type == value.TypeString && b.Type == value.TypeString:
+		c = strings.Compare(value.UnpackString(a.Data, arena), value.UnpackString(b.Data, arena))
+	default:
+		return false, NewError("TypeError", "'%s' not supported between instances of '%s' and '%s'", opSymbols[op], TypeName(a), TypeName(b))
+	}
+	switch op {
+	case OP_LT:
+		return c < 0, nil
+	case OP_LTE:
+		return c <= 0, nil
+	case OP_GT:
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+// compareInts is Compare for two ints that fit in Data.
+func compareInts(op uint8, a, b int64) bool {
+	switch op {
+	case OP_LT:
+		return a < b
+	case OP_LTE:
+		return a <= b
+	case OP_GT:
+		return a > b
+	}
+	return a >= b
+}
+
+// Equal reports whether a == b. Numbers are equal when their values are,
+// whatever their types, and strings when their contents are.
+func Equal(a, b value.Value, arena []byte) bool {
+	switch {
+	case isNumber(a) && isNumber(b):
+		return !isNaN(a) && !isNaN(b) && compareNumbers(a, b) == 0
+	case a.Type != b.Type:
+		return false
+	case a.Type == value.TypeString:
+		return value.UnpackString(a.Data, arena) == value.UnpackString(b.Data, arena)
+	}
+	return a.Data == b.Data
+}
+
+// Identical reports whether a and b are the same object, as Python's is
+// operator does: None, True and False are singletons, and lists, dicts and
+// other containers are identical only to themselves.
+func Identical(a, b value.Value) bool {
+	if a.Type != b.Type || a.Data != b.Data {
+		return false
+	}
+	if a.Opaque == nil || b.Opaque == nil {
+		return a.Opaque == nil && b.Opaque == nil
+	}
+	ra, rb := reflect.ValueOf(a.Opaque), reflect.ValueOf(b.Opaque)
+	switch ra.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Func:
+		return ra.Kind() == rb.Kind() && ra.UnsafePointer() == rb.UnsafePointer()
+	case reflect.Slice:
+		return rb.Kind() == reflect.Slice && ra.UnsafePointer() == rb.UnsafePointer() && ra.Len() == rb.Len()
+	}
+	return false
+}
+
+func isNaN(v value.Value) bool {
+	return v.Type == value.TypeFloat && math.IsNaN(v.Float())
+}
+
+// compareNumbers compares two numbers other than NaN exactly, without
+// rounding large integers to float64.
+func compareNumbers(a, b value.Value) int {
+	switch {
+	case a.IsBig() || b.IsBig():
+		return bigFloat(a).Cmp(bigFloat(b))
+	case a.Type != value.TypeFloat && b.Type != value.TypeFloat:
+		return cmp.Compare(a.Int(), b.Int())
+	case a.Type == value.TypeFloat && b.Type == value.TypeFloat:
+		return cmp.Compare(a.Float(), b.Float())
+	case a.Type == value.TypeFloat:
+		return -compareIntFloat(b.Int(), a.Float())
+	}
+	return compareIntFloat(a.Int(), b.Float())
+}
+
+// bigFloat returns a number other than NaN as an exact big.Float.
+func bigFloat(v value.Value) *big.Float {
+	if v.Type == value.TypeFloat {
+		return big.NewFloat(v.Float())
+	}
+	return new(big.Float).SetInt(v.BigInt())
+}
+
+func compareIntFloat(i int64, f float64) int {
+	switch {
+	case f >= 1<<63:
+		return -1
+	case f < -(1 << 63):
+		return 1
+	}
+	fl := math.Floor(f)
+	if c := cmp.Compare(i, int64(fl)); c != 0 {
+		return c
+	}
+	if fl == f {
+		return 0
+	}
+	return -1
+}
@@ -0,0 +1,345 @@
+package vm_test
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func num(x any) value.Value {
+	switch x := x.(type) {
+	case int:
+		return value.Value{Type: value.TypeInt, Data: uint64(int64(x))}
+	case float64:
+		return value.Value{Type: value.TypeFloat, Data: math.Float64bits(x)}
+	case bool:
+		if x {
+			return value.Value{Type: value.TypeBool, Data: 1}
+		}
+		return value.Value{Type: value.TypeBool}
+	}
+	panic("not a number")
+}
+
+// binop runs a single binary instruction and returns the result formatted as
+// Python would print it, or the error.
+func binop(op uint8, a, b value.Value) (string, error) {
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(op) << 24),
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{a, b},
+	}
+	if err := m.Run(10); err != nil {
+		return "", err
+	}
+	return m.Pop().Format(m.Arena), nil
+}
+
+// TestNumericTower checks mixed int, float and bool operands against the
+// results CPython gives.
+func TestNumericTower(t *testing.T) {
+	ops := map[string]uint8{
+		"+": vm.OP_ADD, "-": vm.OP_SUB, "*": vm.OP_MUL, "/": vm.OP_DIV,
+		"//": vm.OP_FLOOR_DIV, "%": vm.OP_MOD, "**": vm.OP_POW,
+		"==": vm.OP_EQ, "!=": vm.OP_NE, "<": vm.OP_LT, "<=": vm.OP_LTE,
+		">": vm.OP_GT, ">=": vm.OP_GTE,
+	}
+	tests := []struct {
+		a    any
+		op   string
+		b    any
+		want string
+	}{
+		{1.5, "+", 2, "3.5"},
+		{2, "+", 1.5, "3.5"},
+		{0.1, "+", 0.2, "0.30000000000000004"},
+		{true, "+", true, "2"},
+		{true, "+", 0.5, "1.5"},
+		{1, "+", 2, "3"},
+		{5, "-", 7.5, "-2.5"},
+		{2.5, "-", true, "1.5"},
+		{3, "*", 0.5, "1.5"},
+		{false, "*", 2.5, "0.0"},
+		{6, "*", 7, "42"},
+		{7, "/", 2, "3.5"},
+		{6, "/", 3, "2.0"},
+		{7.5, "/", true, "7.5"},
+		{7, "//", 2, "3"},
+		{-7, "//", 2, "-4"},
+		{7, "//", -2, "-4"},
+		{7.5, "//", 2, "3.0"},
+		{-7.5, "//", 2, "-4.0"},
+		{7, "//", 2.0, "3.0"},
+		{7, "%", 3, "1"},
+		{-7, "%", 3, "2"},
+		{7, "%", -3, "-2"},
+		{7.5, "%", 2, "1.5"},
+		{-7.5, "%", 2, "0.5"},
+		{7.5, "%", -2, "-0.5"},
+		{true, "%", 2, "1"},
+		{2, "**", 10, "1024"},
+		{2, "**", -1, "0.5"},
+		{2.0, "**", 3, "8.0"},
+		{4, "**", 0.5, "2.0"},
+		{true, "**", 5, "1"},
+		{1, "==", 1.0, "True"},
+		{1.0, "==", true, "True"},
+		{0, "==", false, "True"},
+		{1, "==", 1.5, "False"},
+		{1, "!=", 1.0, "False"},
+		{2, "!=", 2.5, "True"},
+		{0.3, ">", 0.2, "True"},
+		{0.2, ">", 0.3, "False"},
+		{1.5, "<", 2, "True"},
+		{2, "<", 1.5, "False"},
+		{-1, "<", -0.5, "True"},
+		{-1, ">", -1.5, "True"},
+		{2, "<=", 2.0, "True"},
+		{2, ">=", 2.5, "False"},
+		{true, ">", 0.5, "True"},
+		{9007199254740993, ">", 9007199254740992.0, "True"},
+		{9007199254740993, "==", 9007199254740992.0, "False"},
+		{math.MaxInt64, "<", 9223372036854775808.0, "True"},
+		{math.Inf(1), ">", math.MaxInt64, "True"},
+		{math.NaN(), "==", math.NaN(), "False"},
+		{math.NaN(), "!=", 1, "True"},
+		{math.NaN(), "<", 1, "False"},
+		{1, ">=", math.NaN(), "False"},
+	}
+	for _, tt := range tests {
+		got, err := binop(ops[tt.op], num(tt.a), num(tt.b))
+		if err != nil {
+			t.Errorf("%v %s %v: %v", tt.a, tt.op, tt.b, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v %s %v = %s, want %s", tt.a, tt.op, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNumericErrors(t *testing.T) {
+	str := value.Value{Type: value.TypeString, Data: value.PackString(0, 0)}
+	tests := []struct {
+		op   uint8
+		a, b value.Value
+		kind string
+	}{
+		{vm.OP_DIV, num(1), num(0), "ZeroDivisionError"},
+		{vm.OP_DIV, num(1.5), num(0.0), "ZeroDivisionError"},
+		{vm.OP_FLOOR_DIV, num(1), num(false), "ZeroDivisionError"},
+		{vm.OP_FLOOR_DIV, num(1.5), num(0), "ZeroDivisionError"},
+		{vm.OP_MOD, num(1), num(0), "ZeroDivisionError"},
+		{vm.OP_MOD, num(1), num(0.0), "ZeroDivisionError"},
+		{vm.OP_POW, num(0), num(-1), "ZeroDivisionError"},
+		{vm.OP_SUB, num(1), str, "TypeError"},
+		{vm.OP_MUL, value.Value{Type: value.TypeVoid}, num(2), "TypeError"},
+		{vm.OP_LT, num(1), str, "TypeError"},
+		{vm.OP_GTE, str, num(1.5), "TypeError"},
+	}
+	for _, tt := range tests {
+		_, err := binop(tt.op, tt.a, tt.b)
+		var re *vm.RuntimeError
+		if !errors.As(err, &re) || re.Kind != tt.kind {
+			t.Errorf("op %#x on %v, %v: expected %s, got %v", tt.op, tt.a, tt.b, tt.kind, err)
+		}
+	}
+	// Mixed types are never equal, but comparing them is not an error.
+	if got, err := binop(vm.OP_EQ, num(1), str); err != nil || got != "False" {
+		t.Errorf("1 == \"\" = %s, %v", got, err)
+	}
+}
+
+func bigNum(s string) value.Value {
+	b, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic(s)
+	}
+	return value.NewBigInt(b)
+}
+
+// TestBigInts checks that ints overflowing int64 become big ints and that
+// big ints take part in every operator, against the results CPython gives.
+func TestBigInts(t *testing.T) {
+	const (
+		max  = "9223372036854775807"
+		min  = "-9223372036854775808"
+		p64  = "18446744073709551616"
+		big1 = "123456789012345678901234567890"
+	)
+	tests := []struct {
+		a    value.Value
+		op   uint8
+		b    value.Value
+		want string
+	}{
+		{num(math.MaxInt64), vm.OP_ADD, num(1), "9223372036854775808"},
+		{num(math.MinInt64), vm.OP_SUB, num(1), "-9223372036854775809"},
+		{num(math.MinInt64), vm.OP_MUL, num(-1), "9223372036854775808"},
+		{num(-1), vm.OP_MUL, num(math.MinInt64), "9223372036854775808"},
+		{num(math.MinInt64), vm.OP_FLOOR_DIV, num(-1), "9223372036854775808"},
+		{num(1 << 32), vm.OP_MUL, num(1 << 32), p64},
+		{num(2), vm.OP_POW, num(64), p64},
+		{num(3), vm.OP_POW, num(40), "12157665459056928801"},
+		{num(-2), vm.OP_POW, num(63), min},
+		{num(1), vm.OP_LSHIFT, num(64), p64},
+		{num(-1), vm.OP_LSHIFT, num(63), min},
+		{bigNum(p64), vm.OP_RSHIFT, num(1), "9223372036854775808"},
+		{bigNum(p64), vm.OP_RSHIFT, num(100), "0"},
+		{bigNum("-" + p64), vm.OP_RSHIFT, num(100), "-1"},
+		{bigNum(p64), vm.OP_SUB, num(1), "18446744073709551615"},
+		{bigNum("9223372036854775808"), vm.OP_SUB, num(1), max},
+		{bigNum(big1), vm.OP_ADD, bigNum(big1), "246913578024691357802469135780"},
+		{bigNum(big1), vm.OP_FLOOR_DIV, num(-11), "-11223344455667788991021324354"},
+		{bigNum(big1), vm.OP_MOD, num(-11), "-4"},
+		{bigNum("-" + big1), vm.OP_MOD, num(11), "4"},
+		{bigNum(big1), vm.OP_DIV, num(10), "1.2345678901234568e+28"},
+		{bigNum(p64), vm.OP_DIV, bigNum(p64), "1.0"},
+		{bigNum(p64), vm.OP_ADD, num(0.5), "1.8446744073709552e+19"},
+		{num(2), vm.OP_POW, num(-64), "5.421010862427522e-20"},
+		{bigNum(p64), vm.OP_BIT_AND, num(-1), p64},
+		{bigNum(p64), vm.OP_BIT_OR, num(1), "18446744073709551617"},
+		{bigNum(p64), vm.OP_BIT_XOR, bigNum(p64), "0"},
+		{bigNum(p64), vm.OP_EQ, bigNum(p64), "True"},
+		{bigNum(p64), vm.OP_EQ, num(0), "False"},
+		{bigNum(p64), vm.OP_EQ, num(18446744073709551616.0), "True"},
+		{bigNum(p64), vm.OP_NE, bigNum("-" + p64), "True"},
+		{bigNum(p64), vm.OP_GT, num(math.MaxInt64), "True"},
+		{bigNum("-" + p64), vm.OP_LT, num(math.MinInt64), "True"},
+		{bigNum(p64), vm.OP_LT, num(1e20), "True"},
+		{bigNum(p64), vm.OP_LT, num(math.Inf(1)), "True"},
+		{bigNum(p64), vm.OP_GTE, num(math.NaN()), "False"},
+	}
+	for _, tt := range tests {
+		got, err := binop(tt.op, tt.a, tt.b)
+		if err != nil {
+			t.Errorf("%s %#x %s: %v", tt.a.Format(nil), tt.op, tt.b.Format(nil), err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %#x %s = %s, want %s", tt.a.Format(nil), tt.op, tt.b.Format(nil), got, tt.want)
+		}
+	}
+
+	// Results that fit in int64 again lose their big.Int.
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(vm.OP_SUB) << 24),
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{bigNum(p64), bigNum(p64)},
+	}
+	if err := m.Run(10); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.Pop(); r.IsBig() || r.Int() != 0 || vm.IsTruthy(r) {
+		t.Errorf("expected a plain 0, got %+v", r)
+	}
+	if !vm.IsTruthy(bigNum(p64)) {
+		t.Errorf("2**64 is falsy")
+	}
+
+	for _, tt := range []struct {
+		a, b value.Value
+		op   uint8
+		kind string
+	}{
+		{num(2), num(1 << 40), vm.OP_POW, "OverflowError"},
+		{num(1), num(1 << 40), vm.OP_LSHIFT, "OverflowError"},
+		{num(1), num(-1), vm.OP_LSHIFT, "ValueError"},
+		{bigNum(p64), num(-1), vm.OP_RSHIFT, "ValueError"},
+		{bigNum(p64), num(0), vm.OP_MOD, "ZeroDivisionError"},
+		{num(1.5), num(1), vm.OP_BIT_AND, "TypeError"},
+	} {
+		_, err := binop(tt.op, tt.a, tt.b)
+		var re *vm.RuntimeError
+		if !errors.As(err, &re) || re.Kind != tt.kind {
+			t.Errorf("op %#x on %v, %v: expected %s, got %v", tt.op, tt.a.Format(nil), tt.b.Format(nil), tt.kind, err)
+		}
+	}
+	// 1, 0 and -1 can be raised to any power.
+	if got, err := binop(vm.OP_POW, num(-1), num(1<<40+1)); err != nil || got != "-1" {
+		t.Errorf("(-1) ** (2**40+1) = %s, %v", got, err)
+	}
+}
+
+// TestUnary checks -x, +x, ~x and not x against CPython.
+func TestUnary(t *testing.T) {
+	tests := []struct {
+		op   uint8
+		v    value.Value
+		want string
+	}{
+		{vm.OP_NEG, num(5), "-5"},
+		{vm.OP_NEG, num(-2.5), "2.5"},
+		{vm.OP_NEG, num(0.0), "-0.0"},
+		{vm.OP_NEG, num(true), "-1"},
+		{vm.OP_NEG, num(math.MinInt64), "9223372036854775808"},
+		{vm.OP_NEG, bigNum("9223372036854775808"), "-9223372036854775808"},
+		{vm.OP_POS, num(true), "1"},
+		{vm.OP_POS, num(-1.5), "-1.5"},
+		{vm.OP_INVERT, num(5), "-6"},
+		{vm.OP_INVERT, num(false), "-1"},
+		{vm.OP_INVERT, bigNum("-100000000000000000000"), "99999999999999999999"},
+		{vm.OP_NOT, num(0.0), "True"},
+		{vm.OP_NOT, num(3), "False"},
+		{vm.OP_NOT, value.Value{Type: value.TypeVoid}, "True"},
+	}
+	for _, tt := range tests {
+		m := &vm.Machine{
+			Code: []uint32{
+				(uint32(vm.OP_PUSH_C) << 24) | 0,
+				(uint32(tt.op) << 24),
+				(uint32(vm.OP_HALT) << 24),
+			},
+			Constants: []value.Value{tt.v},
+		}
+		if err := m.Run(10); err != nil {
+			t.Errorf("op %#x on %s: %v", tt.op, tt.v.Format(nil), err)
+			continue
+		}
+		if got := m.Pop().Format(m.Arena); got != tt.want {
+			t.Errorf("op %#x on %s = %s, want %s", tt.op, tt.v.Format(nil), got, tt.want)
+		}
+	}
+
+	for _, v := range []value.Value{num(1.5), {Type: value.TypeVoid}} {
+		var re *vm.RuntimeError
+		if _, err := vm.Unary(vm.OP_INVERT, v); !errors.As(err, &re) || re.Kind != "TypeError" {
+			t.Errorf("~%s: expected TypeError, got %v", v.Format(nil), err)
+		}
+	}
+}
+
+func TestIdentical(t *testing.T) {
+	list := &[]value.Value{num(1)}
+	other := &[]value.Value{num(1)}
+	none := value.Value{Type: value.TypeVoid}
+	tests := []struct {
+		a, b value.Value
+		want bool
+	}{
+		{none, none, true},
+		{num(true), num(true), true},
+		{num(true), num(1), false},
+		{num(0), none, false},
+		{value.Value{Type: value.TypeList, Opaque: list}, value.Value{Type: value.TypeList, Opaque: list}, true},
+		{value.Value{Type: value.TypeList, Opaque: list}, value.Value{Type: value.TypeList, Opaque: other}, false},
+		{value.Value{Type: value.TypeDict, Opaque: map[string]any{}}, value.Value{Type: value.TypeDict, Opaque: map[string]any{}}, false},
+	}
+	for i, tt := range tests {
+		if got := vm.Identical(tt.a, tt.b); got != tt.want {
+			t.Errorf("case %d: Identical = %v, want %v", i, got, tt.want)
+		}
+	}
+}
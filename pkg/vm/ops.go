@@ -1,5 +1,10 @@
 package vm
 
+// OpcodeVersion identifies the instruction set. It is stored in compiled
+// bytecode files and must be bumped whenever an opcode is added or changes
+// meaning.
+const OpcodeVersion = 7
+
 const (
 	OP_HALT      uint8 = 0x00
 	OP_NOOP      uint8 = 0x01
@@ -7,6 +12,8 @@ const (
 	OP_PUSH_L    uint8 = 0x03
 	OP_POP_L     uint8 = 0x04
 	OP_DUP       uint8 = 0x05
+	OP_PUSH_G    uint8 = 0x06 // push module global arg
+	OP_POP_G     uint8 = 0x07 // pop into module global arg
 	OP_ADD       uint8 = 0x10
 	OP_SUB       uint8 = 0x11
 	OP_MUL       uint8 = 0x12
@@ -44,4 +51,48 @@ const (
 	OP_ADDRESS   uint8 = 0x30
 	OP_EXIT_ADDR uint8 = 0x31
 	OP_SYSCALL   uint8 = 0x40
+
+	// Exception handling: SETUP_EXCEPT pushes a handler at arg, POP_EXCEPT
+	// removes it, RAISE raises the exception on the stack (re-raising it if
+	// it was caught), EXC_MATCH tests an exception against a class name and
+	// MAKE_EXC builds an exception from a class name and a message.
+	OP_SETUP_EXCEPT uint8 = 0x36
+	OP_POP_EXCEPT   uint8 = 0x37
+	OP_RAISE        uint8 = 0x38
+	OP_EXC_MATCH    uint8 = 0x39
+	OP_MAKE_EXC     uint8 = 0x3a
+
+	// Function values: CALL_FN calls the function below its arg arguments,
+	// CLOSURE binds the arg cells on top of the stack to the function below
+	// them, MAKE_CELL moves local arg into a new cell, and LOAD_DEREF and
+	// STORE_DEREF read and write the cell in local arg.
+	OP_CALL_FN     uint8 = 0x3b
+	OP_CLOSURE     uint8 = 0x3c
+	OP_MAKE_CELL   uint8 = 0x3d
+	OP_LOAD_DEREF  uint8 = 0x3e
+	OP_STORE_DEREF uint8 = 0x3f
+
+	// Short-circuit jumps for and/or: JMP_FALSE_OR_POP jumps to arg if the
+	// value on top of the stack is falsy, leaving it there, and pops it
+	// otherwise; JMP_TRUE_OR_POP does the same for a truthy value.
+	OP_JMP_FALSE_OR_POP uint8 = 0x41
+	OP_JMP_TRUE_OR_POP  uint8 = 0x42
+
+	// Unary operators replace the value on top of the stack: NOT with its
+	// logical negation, NEG, POS and INVERT with -x, +x and ~x. IS and IS_NOT
+	// compare the two values on top of the stack by identity.
+	OP_NOT    uint8 = 0x43
+	OP_NEG    uint8 = 0x44
+	OP_POS    uint8 = 0x45
+	OP_INVERT uint8 = 0x46
+	OP_IS     uint8 = 0x47
+	OP_IS_NOT uint8 = 0x48
+
+	// Generators: GEN starts a generator function, returning a generator
+	// that holds the first arg locals of the frame and resumes at the next
+	// instruction. YIELD suspends the generator, handing the value on top
+	// of the stack to whoever resumed it; when resumed, the generator finds
+	// None in its place.
+	OP_GEN   uint8 = 0x49
+	OP_YIELD uint8 = 0x4a
 )
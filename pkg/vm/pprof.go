@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// WritePprof writes the profile in the gzipped protocol buffer format read
+// by go tool pprof, with gas as the default sample type:
+//
+//	go tool pprof -http=: script.pprof
+func (prof *Profile) WritePprof(w io.Writer) error {
+	var b protobuf
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = len(table)
+			strs[s] = i
+			table = append(table, s)
+		}
+		return uint64(i)
+	}
+
+	types := [][2]string{{"instructions", "count"}, {"gas", "units"}, {"time", "nanoseconds"}, {"arena", "bytes"}}
+	for _, t := range types {
+		var vt protobuf
+		vt.uint(1, str(t[0]))
+		vt.uint(2, str(t[1]))
+		b.message(1, vt)
+	}
+	for _, s := range prof.Samples {
+		var sample, ids, values protobuf
+		// Locations are leaf first.
+		for i := len(s.Stack) - 1; i >= 0; i-- {
+			ids.varint(uint64(s.Stack[i]) + 1)
+		}
+		for _, v := range []int64{int64(s.Cost.Instructions), int64(s.Cost.Gas), int64(s.Cost.Time), int64(s.Cost.ArenaBytes)} {
+			values.varint(uint64(v))
+		}
+		sample.message(1, ids)
+		sample.message(2, values)
+		b.message(2, sample)
+	}
+	// One location and one function per entry, sharing its id.
+	for i, e := range prof.Entries {
+		var loc, line protobuf
+		line.uint(1, uint64(i)+1)
+		line.uint(2, uint64(e.Line))
+		loc.uint(1, uint64(i)+1)
+		loc.message(4, line)
+		b.message(4, loc)
+	}
+	for i, e := range prof.Entries {
+		var fn protobuf
+		fn.uint(1, uint64(i)+1)
+		// pprof drops <...> from names as C++ template arguments.
+		fn.uint(2, str(strings.NewReplacer("<", "(", ">", ")").Replace(e.Name)))
+		fn.uint(3, str(e.Name))
+		if !e.Host {
+			fn.uint(4, str(prof.File))
+		}
+		fn.uint(5, uint64(e.Line))
+		b.message(5, fn)
+	}
+	gas := str("gas")
+	for _, s := range table {
+		b.bytes(6, []byte(s))
+	}
+	b.uint(10, uint64(prof.Total.Time))
+	var period protobuf
+	period.uint(1, gas)
+	period.uint(2, str("units"))
+	b.message(11, period)
+	b.uint(12, 1)
+	b.uint(14, gas)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protobuf encodes the fields of a protocol buffer message.
+type protobuf []byte
+
+func (b *protobuf) varint(v uint64) {
+	*b = binary.AppendUvarint(*b, v)
+}
+
+// uint writes a varint field, omitting zero as protocol buffers do.
+func (b *protobuf) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field)<<3 | 0)
+	b.varint(v)
+}
+
+func (b *protobuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protobuf) message(field int, m protobuf) {
+	b.bytes(field, m)
+}
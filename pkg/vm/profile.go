@@ -0,0 +1,305 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Profiler is a Tracer that attributes the cost of an execution to the
+// Python functions and host functions it ran in. Set it as Machine.Tracer,
+// run the program and call Profile once Run returns:
+//
+//	p := vm.NewProfiler()
+//	m.Tracer = p
+//	err := m.Run(gas)
+//	prof := p.Profile()
+//
+// Costs are recorded per call stack, so a Profile can be rendered as a flat
+// table or written for go tool pprof.
+type Profiler struct {
+	NopTracer
+
+	entries []ProfileEntry
+	funcs   map[int]int // function entry IP -> entries index
+	hosts   map[int]int // HostRegistry index -> entries index
+	names   map[int]string
+
+	// nodes is the call tree; stack holds the path to the node currently
+	// running.
+	nodes    []profileNode
+	children map[[2]int]int // parent node, entry -> node
+	stack    []profileFrame
+
+	m     *Machine
+	last  time.Time
+	gas   int
+	arena int
+}
+
+type profileNode struct {
+	parent, entry int
+	cost          ProfileCost
+}
+
+type profileFrame struct {
+	node, depth int
+	host        bool
+}
+
+// ProfileCost is what a part of the program spent.
+type ProfileCost struct {
+	Instructions int
+	Gas          int
+	Time         time.Duration
+	// ArenaBytes counts the bytes added to the arena.
+	ArenaBytes int
+}
+
+func (c *ProfileCost) add(d ProfileCost) {
+	c.Instructions += d.Instructions
+	c.Gas += d.Gas
+	c.Time += d.Time
+	c.ArenaBytes += d.ArenaBytes
+}
+
+// ProfileEntry is the cost of one Python function, or of one host function
+// if Host is set. Self is spent in the function itself; Total also counts
+// everything it called. The gas of an OP_SYSCALL instruction is charged to
+// the host function, but the instruction is counted in its caller.
+type ProfileEntry struct {
+	Name string
+	Host bool
+	// Line is where a Python function starts, if the code has debug
+	// information.
+	Line        int
+	Calls       int
+	Self, Total ProfileCost
+}
+
+// ProfileSample is the cost spent with the entries of Stack, outermost
+// first, on the call stack.
+type ProfileSample struct {
+	Stack []int
+	Cost  ProfileCost
+}
+
+// Profile is the result of a profiled execution. Entries are sorted by
+// decreasing self gas; the module level is the entry named "<module>".
+type Profile struct {
+	File    string
+	Entries []ProfileEntry
+	Samples []ProfileSample
+	Total   ProfileCost
+}
+
+// NewProfiler returns a profiler with nothing recorded.
+func NewProfiler() *Profiler {
+	p := &Profiler{
+		funcs:    make(map[int]int),
+		hosts:    make(map[int]int),
+		children: make(map[[2]int]int),
+	}
+	p.entries = append(p.entries, ProfileEntry{Name: "<module>", Calls: 1})
+	p.nodes = append(p.nodes, profileNode{parent: -1})
+	p.stack = append(p.stack, profileFrame{})
+	return p
+}
+
+// charge attributes the cost since the last event to the running node.
+func (p *Profiler) charge(m *Machine) {
+	now := time.Now()
+	gas, arena := m.GasUsed(), len(m.Arena)
+	if p.m != m {
+		p.m, p.last, p.gas, p.arena = m, now, gas, arena
+		return
+	}
+	c := &p.nodes[p.stack[len(p.stack)-1].node].cost
+	c.Time += now.Sub(p.last)
+	// Reset zeroes the gas used and the collector shrinks the arena.
+	if gas > p.gas {
+		c.Gas += gas - p.gas
+	}
+	if arena > p.arena {
+		c.ArenaBytes += arena - p.arena
+	}
+	p.last, p.gas, p.arena = now, gas, arena
+}
+
+// push enters entry from the running node.
+func (p *Profiler) push(entry, depth int, host bool) {
+	parent := p.stack[len(p.stack)-1].node
+	key := [2]int{parent, entry}
+	n, ok := p.children[key]
+	if !ok {
+		n = len(p.nodes)
+		p.nodes = append(p.nodes, profileNode{parent: parent, entry: entry})
+		p.children[key] = n
+	}
+	p.entries[entry].Calls++
+	p.stack = append(p.stack, profileFrame{node: n, depth: depth, host: host})
+}
+
+func (p *Profiler) Instruction(m *Machine, ip int, op uint8, arg int) {
+	p.charge(m)
+	p.nodes[p.stack[len(p.stack)-1].node].cost.Instructions++
+}
+
+func (p *Profiler) SyscallEnter(m *Machine, index int, scope string) {
+	p.charge(m)
+	e, ok := p.hosts[index]
+	if !ok {
+		e = len(p.entries)
+		name := fmt.Sprintf("syscall %d", index)
+		if index < len(m.HostRegistry) && m.HostRegistry[index].Name != "" {
+			name = m.HostRegistry[index].Name
+		}
+		p.entries = append(p.entries, ProfileEntry{Name: name, Host: true})
+		p.hosts[index] = e
+	}
+	p.push(e, m.FP, true)
+}
+
+func (p *Profiler) SyscallExit(m *Machine, index int, scope string, err error) {
+	p.charge(m)
+	for len(p.stack) > 1 {
+		f := p.stack[len(p.stack)-1]
+		p.stack = p.stack[:len(p.stack)-1]
+		if f.host {
+			break
+		}
+	}
+}
+
+func (p *Profiler) Call(m *Machine, entry, depth int) {
+	p.charge(m)
+	e, ok := p.funcs[entry]
+	if !ok {
+		e = len(p.entries)
+		p.entries = append(p.entries, p.function(m, entry))
+		p.funcs[entry] = e
+	}
+	p.push(e, depth, false)
+}
+
+func (p *Profiler) Return(m *Machine, depth int) {
+	p.charge(m)
+	for len(p.stack) > 1 {
+		f := p.stack[len(p.stack)-1]
+		if f.host || f.depth < depth {
+			break
+		}
+		p.stack = p.stack[:len(p.stack)-1]
+	}
+}
+
+// function describes the Python function starting at entry, named after
+// its FunctionRegistry entry or its debug information.
+func (p *Profiler) function(m *Machine, entry int) ProfileEntry {
+	if p.names == nil {
+		p.names = make(map[int]string)
+		for name, ip := range m.FunctionRegistry {
+			p.names[ip] = name
+		}
+	}
+	e := ProfileEntry{Name: p.names[entry]}
+	if m.Debug != nil {
+		if e.Name == "" {
+			e.Name = m.Debug.FuncName(entry)
+		}
+		e.Line, _ = m.Debug.Position(entry)
+	}
+	if e.Name == "" {
+		e.Name = fmt.Sprintf("func@%d", entry)
+	}
+	return e
+}
+
+// Profile returns what has been recorded so far. Call it after Run
+// returns, before the machine is reset.
+func (p *Profiler) Profile() *Profile {
+	if p.m != nil {
+		p.charge(p.m)
+	}
+	prof := &Profile{Entries: make([]ProfileEntry, len(p.entries))}
+	copy(prof.Entries, p.entries)
+	if p.m != nil && p.m.Debug != nil {
+		prof.File = p.m.Debug.File
+	}
+
+	seen := make(map[int]bool)
+	for i, n := range p.nodes {
+		if n.cost == (ProfileCost{}) {
+			continue
+		}
+		var stack []int
+		for j := i; j >= 0; j = p.nodes[j].parent {
+			stack = append(stack, p.nodes[j].entry)
+		}
+		for l, r := 0, len(stack)-1; l < r; l, r = l+1, r-1 {
+			stack[l], stack[r] = stack[r], stack[l]
+		}
+		prof.Samples = append(prof.Samples, ProfileSample{Stack: stack, Cost: n.cost})
+		prof.Total.add(n.cost)
+		prof.Entries[n.entry].Self.add(n.cost)
+		// Recursive calls count once towards the total of a function.
+		clear(seen)
+		for _, e := range stack {
+			if !seen[e] {
+				seen[e] = true
+				prof.Entries[e].Total.add(n.cost)
+			}
+		}
+	}
+
+	// Sort the entries, renumbering the stacks to match.
+	order := make([]int, len(prof.Entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return prof.Entries[order[i]].Self.Gas > prof.Entries[order[j]].Self.Gas
+	})
+	index := make([]int, len(order))
+	entries := make([]ProfileEntry, len(order))
+	for to, from := range order {
+		index[from] = to
+		entries[to] = prof.Entries[from]
+	}
+	prof.Entries = entries
+	for _, s := range prof.Samples {
+		for i, e := range s.Stack {
+			s.Stack[i] = index[e]
+		}
+	}
+	return prof
+}
+
+// WriteTable writes the entries as a table, most expensive first.
+func (prof *Profile) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "gas\tgas%\tcum gas\tinstrs\ttime\tarena\tcalls\tfunction")
+	for _, e := range prof.Entries {
+		name := e.Name
+		if e.Host {
+			name += " [host]"
+		} else if e.Line > 0 {
+			name += fmt.Sprintf(" (line %d)", e.Line)
+		}
+		fmt.Fprintf(tw, "%d\t%.1f%%\t%d\t%d\t%v\t%d\t%d\t%s\n",
+			e.Self.Gas, percent(e.Self.Gas, prof.Total.Gas), e.Total.Gas, e.Self.Instructions,
+			e.Self.Time.Round(time.Microsecond), e.Self.ArenaBytes, e.Calls, name)
+	}
+	fmt.Fprintf(tw, "%d\t\t\t%d\t%v\t%d\t\ttotal\n",
+		prof.Total.Gas, prof.Total.Instructions, prof.Total.Time.Round(time.Microsecond), prof.Total.ArenaBytes)
+	return tw.Flush()
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
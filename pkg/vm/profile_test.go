@@ -0,0 +1,94 @@
+package vm_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestProfiler(t *testing.T) {
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_CALL) << 24) | (4 << 8),
+			(uint32(vm.OP_DROP) << 24),
+			(uint32(vm.OP_HALT) << 24),
+			(uint32(vm.OP_HALT) << 24),
+			(uint32(vm.OP_SYSCALL) << 24) | 0, // 4: f calls the host twice
+			(uint32(vm.OP_DROP) << 24),
+			(uint32(vm.OP_SYSCALL) << 24) | 0,
+			(uint32(vm.OP_RET) << 24),
+		},
+		FunctionRegistry: map[string]int{"f": 4},
+	}
+	m.HostRegistry = append(m.HostRegistry, vm.HostFunctionEntry{
+		Name: "alloc",
+		Fn: func(m *vm.Machine) error {
+			if err := m.ConsumeGas(50); err != nil {
+				return err
+			}
+			off, err := m.WriteArena([]byte("0123456789"))
+			m.Push(value.Value{Type: value.TypeString, Data: value.PackString(off, 10)})
+			return err
+		},
+	})
+	p := vm.NewProfiler()
+	m.Tracer = p
+	if err := m.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	prof := p.Profile()
+
+	entries := map[string]vm.ProfileEntry{}
+	for _, e := range prof.Entries {
+		entries[e.Name] = e
+	}
+	host, f, mod := entries["alloc"], entries["f"], entries["<module>"]
+	if !host.Host || host.Calls != 2 || host.Self.Gas != 102 || host.Self.ArenaBytes != 20 || host.Self.Instructions != 0 {
+		t.Errorf("unexpected host entry %+v", host)
+	}
+	if f.Host || f.Calls != 1 || f.Self.Instructions != 4 || f.Self.Gas != 2 || f.Total.Gas != 104 {
+		t.Errorf("unexpected f entry %+v", f)
+	}
+	if mod.Self.Instructions != 3 || mod.Total.Gas != m.GasUsed() || prof.Total.Gas != m.GasUsed() {
+		t.Errorf("unexpected module entry %+v, %d gas used", mod, m.GasUsed())
+	}
+	if prof.Entries[0].Name != "alloc" {
+		t.Errorf("expected the host function first, got %s", prof.Entries[0].Name)
+	}
+	for _, s := range prof.Samples {
+		if prof.Entries[s.Stack[0]].Name != "<module>" {
+			t.Errorf("sample %v does not start at the module", s.Stack)
+		}
+	}
+
+	var table strings.Builder
+	if err := prof.WriteTable(&table); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(table.String(), "alloc [host]") {
+		t.Errorf("missing host function in\n%s", table.String())
+	}
+
+	var buf bytes.Buffer
+	if err := prof.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"alloc", "(module)", "gas", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Errorf("pprof output lacks %q", s)
+		}
+	}
+}
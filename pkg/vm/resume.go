@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"context"
+	"errors"
+)
+
+// Status describes how a time slice ended.
+type Status int
+
+const (
+	// StatusHalted means the program ran to OP_HALT.
+	StatusHalted Status = iota
+	// StatusPreempted means the slice ran out while budget remains; call
+	// RunSlice again to continue.
+	StatusPreempted
+	// StatusFailed means the execution stopped with an error.
+	StatusFailed
+	// StatusSuspended means a host function suspended the execution; call
+	// Complete with the result, then Resume.
+	StatusSuspended
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusHalted:
+		return "halted"
+	case StatusPreempted:
+		return "preempted"
+	case StatusFailed:
+		return "failed"
+	case StatusSuspended:
+		return "suspended"
+	}
+	return "unknown"
+}
+
+// Resume continues an execution that stopped with ErrGasExhausted after adding
+// extraGas to its budget.
+//
+// Gas is checked before an instruction executes, so when Run returns
+// ErrGasExhausted the IP, stack, frames and arena are exactly as they were
+// after the last completed instruction. A host function that exhausts gas is
+// rolled back: its arguments are restored and the gas it charged is refunded,
+// and it runs again from the start on Resume. Any output it produced before
+// failing is therefore repeated, which is why host functions should charge gas
+// before doing observable work.
+//
+// Resume also continues an execution that stopped with ErrSuspended, once
+// the suspended call has been completed with Complete; before that it returns
+// ErrSuspended again without running.
+//
+// Resume returns ErrNotResumable if the last execution did not stop with
+// ErrGasExhausted or ErrSuspended.
+func (m *Machine) Resume(extraGas int) error {
+	return m.ResumeContext(context.Background(), extraGas)
+}
+
+// ResumeContext is like Resume but stops when ctx is done.
+func (m *Machine) ResumeContext(ctx context.Context, extraGas int) error {
+	if !m.resumable {
+		return ErrNotResumable
+	}
+	if m.pending != 0 {
+		return ErrSuspended
+	}
+	m.AddGas(extraGas)
+	return m.exec(ctx)
+}
+
+// RunSlice runs the loaded code from the current IP for at most slice units of
+// the remaining budget, which is set with AddGas. It returns StatusPreempted
+// when the slice is used up but budget remains, in which case RunSlice can be
+// called again to continue where it left off. Host functions and functions
+// invoked through Call are never preempted midway; they may overrun the slice
+// by drawing on the remaining budget.
+//
+// Exhausting the whole budget returns ErrGasExhausted and the execution can be
+// continued with Resume.
+func (m *Machine) RunSlice(ctx context.Context, slice int) (Status, error) {
+	if slice < m.gas {
+		m.reserve = m.gas - slice
+		m.gas = slice
+	}
+	err := m.exec(ctx)
+	preempted := errors.Is(err, ErrGasExhausted) && m.reserve > 0
+	m.gas += m.reserve
+	m.reserve = 0
+	switch {
+	case preempted:
+		return StatusPreempted, nil
+	case errors.Is(err, ErrSuspended):
+		return StatusSuspended, nil
+	case err != nil:
+		return StatusFailed, err
+	}
+	return StatusHalted, nil
+}
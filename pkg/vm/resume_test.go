@@ -0,0 +1,172 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// countTo returns a machine running `i = 0; while i < n: i += 1`.
+func countTo(n int) *vm.Machine {
+	return &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_POP_L) << 24) | 0,
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(vm.OP_LT) << 24),
+			(uint32(vm.OP_JMP_FALSE) << 24) | 11,
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 2,
+			(uint32(vm.OP_ADD) << 24),
+			(uint32(vm.OP_POP_L) << 24) | 0,
+			(uint32(vm.OP_JMP) << 24) | 2,
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{
+			{Type: value.TypeInt, Data: 0},
+			{Type: value.TypeInt, Data: uint64(n)},
+			{Type: value.TypeInt, Data: 1},
+		},
+	}
+}
+
+func TestResume(t *testing.T) {
+	ref := countTo(100)
+	if err := ref.Run(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	m := countTo(100)
+	err := m.Run(50)
+	resumes := 0
+	for errors.Is(err, vm.ErrGasExhausted) {
+		resumes++
+		err = m.Resume(7)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumes == 0 {
+		t.Fatal("expected the run to exhaust gas")
+	}
+	if got := m.Frames[0].Locals[0].Int(); got != 100 {
+		t.Errorf("expected i = 100, got %d", got)
+	}
+	if m.GasUsed() != ref.GasUsed() {
+		t.Errorf("resumed run used %d gas, uninterrupted run used %d", m.GasUsed(), ref.GasUsed())
+	}
+
+	if err := m.Resume(10); !errors.Is(err, vm.ErrNotResumable) {
+		t.Errorf("expected ErrNotResumable after halt, got %v", err)
+	}
+	if err := countTo(1).Resume(10); !errors.Is(err, vm.ErrNotResumable) {
+		t.Errorf("expected ErrNotResumable before run, got %v", err)
+	}
+}
+
+func TestResumeHostCall(t *testing.T) {
+	// The host function pops its argument and calls `def f(x): return x * 2`
+	// at IP 4, so exhausting gas inside the call must restore the argument.
+	m := &vm.Machine{}
+	m.RegisterHostFunction("", func(m *vm.Machine) error {
+		x := m.Pop()
+		r, err := m.Call(4, x)
+		if err != nil {
+			return err
+		}
+		m.Push(r)
+		return nil
+	})
+	m.Constants = []value.Value{{Type: value.TypeInt, Data: 21}, {Type: value.TypeInt, Data: 2}}
+	m.Code = []uint32{
+		(uint32(vm.OP_PUSH_C) << 24) | 0,
+		(uint32(vm.OP_SYSCALL) << 24) | 0,
+		(uint32(vm.OP_HALT) << 24),
+		(uint32(vm.OP_HALT) << 24),
+		(uint32(vm.OP_PUSH_L) << 24) | 0,
+		(uint32(vm.OP_PUSH_C) << 24) | 1,
+		(uint32(vm.OP_MUL) << 24),
+		(uint32(vm.OP_RET) << 24),
+	}
+
+	if err := m.Run(4); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatalf("expected ErrGasExhausted, got %v", err)
+	}
+	if m.IP != 1 || m.SP != 1 || m.FP != 0 || m.Peek().Int() != 21 {
+		t.Fatalf("syscall not rolled back: IP=%d SP=%d FP=%d", m.IP, m.SP, m.FP)
+	}
+	if err := m.Resume(10); err != nil {
+		t.Fatal(err)
+	}
+	if m.SP != 1 || m.Peek().Int() != 42 {
+		t.Errorf("expected 42, got %d (SP=%d)", m.Peek().Int(), m.SP)
+	}
+}
+
+func TestCallBudget(t *testing.T) {
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_RET) << 24),
+		},
+	}
+	arg := value.Value{Type: value.TypeInt, Data: 7}
+
+	if _, err := m.Call(0, arg); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatalf("expected ErrGasExhausted without budget, got %v", err)
+	}
+	if m.FP != 0 || m.SP != 0 || m.IP != 0 {
+		t.Errorf("failed call should restore state: FP=%d SP=%d IP=%d", m.FP, m.SP, m.IP)
+	}
+
+	m.AddGas(2)
+	r, err := m.Call(0, arg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Int() != 7 || m.GasRemaining() != 0 {
+		t.Errorf("expected 7 with no gas left, got %d with %d left", r.Int(), m.GasRemaining())
+	}
+}
+
+func TestRunSlice(t *testing.T) {
+	m := countTo(100)
+	m.AddGas(1 << 20)
+
+	slices := 0
+	for {
+		status, err := m.RunSlice(context.Background(), 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices++
+		if status == vm.StatusHalted {
+			break
+		}
+		if status != vm.StatusPreempted {
+			t.Fatalf("unexpected status %v", status)
+		}
+	}
+	if slices < 10 {
+		t.Errorf("expected the run to be split into slices, got %d", slices)
+	}
+	if got := m.Frames[0].Locals[0].Int(); got != 100 {
+		t.Errorf("expected i = 100, got %d", got)
+	}
+
+	m = countTo(100)
+	m.AddGas(60)
+	if status, _ := m.RunSlice(context.Background(), 50); status != vm.StatusPreempted {
+		t.Fatalf("expected StatusPreempted, got %v", status)
+	}
+	if status, err := m.RunSlice(context.Background(), 50); status != vm.StatusFailed || !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatalf("expected ErrGasExhausted, got %v %v", status, err)
+	}
+	if err := m.Resume(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+}
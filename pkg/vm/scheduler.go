@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrSchedulerClosed = errors.New("vm: scheduler closed")
+
+// Scheduler runs many machines cooperatively on a fixed pool of worker
+// goroutines. Each machine runs for one time slice at a time and is then
+// moved to the back of the queue, so a long-running script cannot hog a
+// worker while others wait.
+//
+// A machine must not be used by the caller while it is submitted.
+type Scheduler struct {
+	slice int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*task
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type task struct {
+	ctx  context.Context
+	m    *Machine
+	done chan error
+}
+
+// NewScheduler starts workers goroutines that run submitted machines in slices
+// of slice gas units.
+func NewScheduler(workers, slice int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	s := &Scheduler{slice: slice}
+	s.cond = sync.NewCond(&s.mu)
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Submit queues m to run from its current IP with a budget of gas. The
+// returned channel receives the result once the machine halts, fails or is
+// suspended by a host function; it is nil on success and ErrSuspended when
+// the machine waits for Complete. ctx is checked between slices as well as within them.
+func (s *Scheduler) Submit(ctx context.Context, m *Machine, gas int) <-chan error {
+	done := make(chan error, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		done <- ErrSchedulerClosed
+		return done
+	}
+	m.setGas(gas)
+	s.queue = append(s.queue, &task{ctx: ctx, m: m, done: done})
+	s.cond.Signal()
+	return done
+}
+
+// Close stops accepting work and waits for every queued machine to finish.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) work() {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		t := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		status, err := t.m.RunSlice(t.ctx, s.slice)
+		if status == StatusPreempted {
+			s.mu.Lock()
+			s.queue = append(s.queue, t)
+			s.mu.Unlock()
+			continue
+		}
+		if status == StatusSuspended {
+			err = ErrSuspended
+		}
+		t.done <- err
+	}
+}
@@ -0,0 +1,65 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestSchedulerInterleaves(t *testing.T) {
+	s := vm.NewScheduler(1, 100)
+	defer s.Close()
+
+	// With a single worker, a machine that never halts must not starve the
+	// short one queued behind it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	long := s.Submit(ctx, &vm.Machine{Code: infiniteLoop}, 1<<62)
+	short := s.Submit(context.Background(), countTo(1000), 1<<20)
+
+	select {
+	case err := <-short:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("short machine starved")
+	}
+
+	cancel()
+	if err := <-long; !errors.Is(err, vm.ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+}
+
+func TestSchedulerMany(t *testing.T) {
+	s := vm.NewScheduler(4, 64)
+
+	machines := make([]*vm.Machine, 200)
+	results := make([]<-chan error, len(machines))
+	for i := range machines {
+		machines[i] = countTo(100 + i)
+		results[i] = s.Submit(context.Background(), machines[i], 1<<20)
+	}
+	exhausted := s.Submit(context.Background(), countTo(1000), 100)
+
+	for i, done := range results {
+		if err := <-done; err != nil {
+			t.Fatalf("machine %d: %v", i, err)
+		}
+		if got := machines[i].Frames[0].Locals[0].Int(); got != int64(100+i) {
+			t.Errorf("machine %d: expected %d, got %d", i, 100+i, got)
+		}
+	}
+	if err := <-exhausted; !errors.Is(err, vm.ErrGasExhausted) {
+		t.Errorf("expected ErrGasExhausted, got %v", err)
+	}
+
+	s.Close()
+	if err := <-s.Submit(context.Background(), countTo(1), 100); !errors.Is(err, vm.ErrSchedulerClosed) {
+		t.Errorf("expected ErrSchedulerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package vm
+
+import (
+	"errors"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+var (
+	ErrBadSnapshot       = errors.New("vm: malformed snapshot")
+	ErrSnapshotMismatch  = errors.New("vm: snapshot was taken from different bytecode")
+	ErrSnapshotWhileBusy = errors.New("vm: cannot snapshot a running machine")
+)
+
+const (
+	snapshotMagic   = "NPYS"
+	snapshotVersion = 7
+)
+
+// Snapshot serializes the execution state of a stopped machine: its limits,
+// the stack, frames with their locals, the module globals, IP/FP, the arena,
+// the scope stack, the active exception handlers, the gas budget, the call a
+// host function suspended, if any, and every list, tuple, dict, set, range,
+// iterator, suspended generator and exception reachable from them. Objects
+// shared between several values are written once, so aliasing survives
+// Restore.
+//
+// Code, constants and the function table are not included; Restore takes them
+// from the Bytecode. Neither are host functions, the gatekeeper, the gas
+// schedule or scope tokens. Restored scopes are not re-validated, so only
+// restore snapshots from a trusted source.
+func (m *Machine) Snapshot() ([]byte, error) {
+	if m.depth != 0 {
+		return nil, ErrSnapshotWhileBusy
+	}
+	l := m.Limits()
+	w := &encoder{refs: make(map[objectRef]uint64)}
+	w.buf = append(w.buf, snapshotMagic...)
+	w.buf = append(w.buf, snapshotVersion)
+	w.uint(uint64(codeChecksum(m.Code)))
+	w.int(l.StackDepth)
+	w.int(l.MaxFrames)
+	w.int(l.MaxLocals)
+	w.int(m.IP)
+	w.int(m.SP)
+	w.int(m.FP)
+	w.int(m.gas)
+	w.int(m.GasUsed())
+	w.bool(m.resumable)
+	w.uint(m.handles)
+	w.uint(uint64(m.pending))
+	w.bytes(m.Arena)
+	for _, v := range m.Stack[:m.SP] {
+		w.value(v)
+	}
+	for i := 0; i <= m.FP; i++ {
+		f := &m.Frames[i]
+		w.int(f.ReturnIP)
+		w.int(f.BaseSP)
+		w.int(f.ArgCount)
+		w.int(f.callerIP)
+		w.int(f.entry)
+		for _, v := range f.Locals {
+			w.value(v)
+		}
+		for _, name := range f.LocalNames {
+			w.string(name)
+		}
+	}
+	w.uint(uint64(len(m.globals)))
+	for _, v := range m.globals {
+		w.value(v)
+	}
+	w.uint(uint64(len(m.ScopeStack)))
+	for _, s := range m.ScopeStack {
+		w.string(s)
+	}
+	w.uint(uint64(len(m.handlers)))
+	for _, h := range m.handlers {
+		w.int(h.ip)
+		w.int(h.fp)
+		w.int(h.sp)
+		w.int(h.scopes)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+// Restore rebuilds a machine, with the same limits, from a snapshot taken by
+// Snapshot while running bc. The caller must register host functions and set
+// the gatekeeper and gas schedule again before resuming it with Resume,
+// RunSlice or Run.
+func Restore(data []byte, bc *Bytecode) (*Machine, error) {
+	r := &decoder{buf: data}
+	if string(r.next(len(snapshotMagic))) != snapshotMagic || r.byte() != snapshotVersion {
+		return nil, ErrBadSnapshot
+	}
+	if r.uint() != uint64(codeChecksum(bc.Instructions)) {
+		return nil, ErrSnapshotMismatch
+	}
+
+	l := Limits{StackDepth: r.int(), MaxFrames: r.int(), MaxLocals: r.int()}
+	if r.err != nil || !l.valid() {
+		return nil, ErrBadSnapshot
+	}
+	m := NewMachine(l)
+	m.Code = bc.Instructions
+	m.Constants = bc.Constants
+	m.Debug = bc.Debug
+	for name, ip := range bc.Functions {
+		m.FunctionRegistry[name] = ip
+	}
+	m.IP = r.int()
+	m.SP = r.int()
+	m.FP = r.int()
+	m.maxFP = m.FP
+	m.gas = r.int()
+	m.granted = m.gas + r.int()
+	m.resumable = r.bool()
+	m.handles = r.uint()
+	m.pending = Handle(r.uint())
+	if r.err == nil && (uint64(m.pending) > m.handles || m.IP < 0 || m.IP > len(m.Code) || m.SP < 0 || m.SP > len(m.Stack) || m.FP < 0 || m.FP >= len(m.Frames)) {
+		return nil, ErrBadSnapshot
+	}
+	m.Arena = append([]byte(nil), r.bytes()...)
+	for i := 0; i < m.SP && r.err == nil; i++ {
+		m.Stack[i] = r.value()
+	}
+	for i := 0; i <= m.FP && r.err == nil; i++ {
+		f := &m.Frames[i]
+		f.ReturnIP = r.int()
+		f.BaseSP = r.int()
+		f.ArgCount = r.int()
+		f.callerIP = r.int()
+		f.entry = r.int()
+		if f.callerIP < -1 || f.callerIP > len(m.Code) || f.entry < 0 || f.entry > len(m.Code) {
+			return nil, ErrBadSnapshot
+		}
+		for j := range f.Locals {
+			f.Locals[j] = r.value()
+		}
+		for j := range f.LocalNames {
+			f.LocalNames[j] = r.string()
+		}
+	}
+	if n := r.uint(); n > MaxGlobals {
+		return nil, ErrBadSnapshot
+	} else if n > 0 {
+		m.globals = make([]value.Value, n)
+	}
+	for i := 0; i < len(m.globals) && r.err == nil; i++ {
+		m.globals[i] = r.value()
+	}
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		m.ScopeStack = append(m.ScopeStack, r.string())
+	}
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		h := handler{ip: r.int(), fp: r.int(), sp: r.int(), scopes: r.int(), depth: 1}
+		if h.ip < 0 || h.ip >= len(m.Code) || h.fp < 0 || h.fp > m.FP || h.sp < 0 || h.sp > m.SP || h.scopes < 0 {
+			return nil, ErrBadSnapshot
+		}
+		m.handlers = append(m.handlers, h)
+	}
+	if r.err != nil {
+		return nil, ErrBadSnapshot
+	}
+	if len(r.buf) != 0 {
+		return nil, ErrBadSnapshot
+	}
+	return m, nil
+}
+
+// maxSnapshotLimit bounds each limit read from a snapshot so that a corrupt
+// one cannot make Restore allocate without bound.
+const maxSnapshotLimit = 1 << 16
+
+func (l Limits) valid() bool {
+	return l.StackDepth > 0 && l.StackDepth <= maxSnapshotLimit &&
+		l.MaxFrames > 0 && l.MaxFrames <= maxSnapshotLimit &&
+		l.MaxLocals > 0 && l.MaxLocals <= maxSnapshotLimit &&
+		l.MaxFrames*l.MaxLocals <= maxSnapshotLimit*16
+}
@@ -0,0 +1,27 @@
+package vm
+
+import "testing"
+
+func TestSnapshotFrameIPs(t *testing.T) {
+	halt := uint32(OP_HALT) << 24
+	m := &Machine{Code: []uint32{halt, halt, halt, halt}}
+	m.init()
+	m.FP = 2
+	m.Frames[1] = Frame{ReturnIP: 1, callerIP: -1, entry: 2, Locals: m.Frames[1].Locals, LocalNames: m.Frames[1].LocalNames}
+	m.Frames[2] = Frame{ReturnIP: -1, callerIP: 1, entry: 3, Locals: m.Frames[2].Locals, LocalNames: m.Frames[2].LocalNames}
+
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Restore(data, &Bytecode{Instructions: m.Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= m.FP; i++ {
+		want, got := m.Frames[i], r.Frames[i]
+		if got.callerIP != want.callerIP || got.entry != want.entry {
+			t.Errorf("frame %d: callerIP %d/%d entry %d/%d", i, got.callerIP, want.callerIP, got.entry, want.entry)
+		}
+	}
+}
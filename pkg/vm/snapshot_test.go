@@ -0,0 +1,216 @@
+package vm_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func TestSnapshotResume(t *testing.T) {
+	m := countTo(100)
+	if err := m.Run(50); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatalf("expected ErrGasExhausted, got %v", err)
+	}
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := countTo(100)
+	bc := &vm.Bytecode{Instructions: ref.Code, Constants: ref.Constants}
+	r, err := vm.Restore(data, bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IP != m.IP || r.SP != m.SP || r.GasUsed() != m.GasUsed() {
+		t.Fatalf("state mismatch: IP %d/%d SP %d/%d", r.IP, m.IP, r.SP, m.SP)
+	}
+	if err := r.Resume(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Frames[0].Locals[0].Int(); got != 100 {
+		t.Errorf("expected i = 100, got %d", got)
+	}
+}
+
+func TestSnapshotObjects(t *testing.T) {
+	m := &vm.Machine{Code: []uint32{(uint32(vm.OP_HALT) << 24)}}
+	m.Arena = []byte("hello")
+	list := &[]value.Value{{Type: value.TypeInt, Data: 1}}
+	dict := map[string]any{"a": int64(1), "xs": list, "s": value.Value{Type: value.TypeString, Data: value.PackString(0, 5)}}
+	*list = append(*list, value.Value{Type: value.TypeList, Opaque: list}) // cycle
+	it := &value.Iterator{List: list, Index: 1}
+
+	m.Push(value.Value{Type: value.TypeList, Opaque: list})
+	m.Push(value.Value{Type: value.TypeList, Opaque: list})
+	m.Push(value.Value{Type: value.TypeDict, Opaque: dict})
+	m.Push(value.Value{Type: value.TypeSet, Opaque: map[any]struct{}{uint64(3): {}}})
+	m.Push(value.Value{Type: value.TypeTuple, Opaque: []value.Value{{Type: value.TypeBool, Data: 1}}})
+	m.Push(value.Value{Type: value.TypeBytes, Opaque: []byte{0, 1}})
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: it})
+	m.Frames[0].Locals[0] = value.Value{Type: value.TypeIterator, Opaque: it}
+	m.Frames[0].LocalNames[0] = "it"
+	m.Frames[0].Locals[1] = bigNum("-123456789012345678901234567890")
+	m.ScopeStack = []string{"HTTP-ENV"}
+
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := vm.Restore(data, &vm.Bytecode{Instructions: m.Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l1 := r.Stack[0].Opaque.(*[]value.Value)
+	l2 := r.Stack[1].Opaque.(*[]value.Value)
+	d := r.Stack[2].Opaque.(map[string]any)
+	if l1 != l2 || d["xs"].(*[]value.Value) != l1 || (*l1)[1].Opaque.(*[]value.Value) != l1 {
+		t.Errorf("list aliasing lost")
+	}
+	if r.Stack[6].Opaque.(*value.Iterator) != r.Frames[0].Locals[0].Opaque.(*value.Iterator) {
+		t.Errorf("iterator aliasing lost")
+	}
+	if it := r.Stack[6].Opaque.(*value.Iterator); it.List != l1 || it.Index != 1 {
+		t.Errorf("iterator state lost")
+	}
+	if d["a"].(int64) != 1 || d["s"].(value.Value).Format(r.Arena) != "hello" {
+		t.Errorf("dict contents lost: %v", d)
+	}
+	if _, ok := r.Stack[3].Opaque.(map[any]struct{})[uint64(3)]; !ok {
+		t.Errorf("set contents lost")
+	}
+	if r.Stack[4].Format(r.Arena) != "(True)" || len(r.Stack[5].Opaque.([]byte)) != 2 {
+		t.Errorf("tuple or bytes lost")
+	}
+	if r.Frames[0].LocalNames[0] != "it" || !r.HasScope("HTTP-ENV") {
+		t.Errorf("frame names or scopes lost")
+	}
+	if b := r.Frames[0].Locals[1]; !b.IsBig() || b.Format(nil) != "-123456789012345678901234567890" {
+		t.Errorf("big int lost: %v", b)
+	}
+}
+
+func TestSnapshotClosures(t *testing.T) {
+	m := &vm.Machine{Code: []uint32{(uint32(vm.OP_HALT) << 24)}}
+	// A recursive closure: its cell holds the closure itself.
+	cell := &value.Cell{}
+	fn := value.NewFunction("fact", 0, 1)
+	fn.Opaque.(*value.Function).Cells = []*value.Cell{cell}
+	cell.Value = fn
+	m.Push(fn)
+	m.Frames[0].Locals[0] = value.Value{Type: value.TypeCell, Opaque: cell}
+
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := vm.Restore(data, &vm.Bytecode{Instructions: m.Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.Stack[0].Opaque.(*value.Function)
+	c := r.Frames[0].Locals[0].Opaque.(*value.Cell)
+	if f.Name != "fact" || f.Arity != 1 || len(f.Cells) != 1 || f.Cells[0] != c || c.Value.Opaque.(*value.Function) != f {
+		t.Errorf("closure or cell aliasing lost: %+v", f)
+	}
+}
+
+func TestSnapshotIterators(t *testing.T) {
+	m := &vm.Machine{Code: []uint32{(uint32(vm.OP_HALT) << 24)}}
+	one := value.Value{Type: value.TypeInt, Data: 1}
+	rng := &value.Iterator{Kind: value.IterRange, Index: 3, Stop: 10, Step: 2, Ahead: []value.Value{one}}
+	gen := &value.Iterator{Kind: value.IterGenerator, Gen: &value.Generator{
+		Entry: 4, IP: 9, Locals: []value.Value{one}, Stack: []value.Value{one, one},
+		Calls:    []value.Call{{Entry: 12, ReturnIP: 8, BaseSP: 1, ArgCount: 1, Locals: []value.Value{one}}},
+		Scopes:   []string{"FS-ENV"},
+		Handlers: []value.Handler{{IP: 6, SP: 1}, {IP: 14, SP: 2, Frame: 1, Scopes: 1}},
+	}}
+	zip := &value.Iterator{Kind: value.IterZip, Sources: []*value.Iterator{rng, gen}}
+	mapped := &value.Iterator{Kind: value.IterMap, Fn: value.NewFunction("f", 20, 1), Sources: []*value.Iterator{zip}}
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: mapped})
+	m.Push(value.Value{Type: value.TypeIterator, Opaque: gen})
+	m.Push(value.Value{Type: value.TypeRange, Opaque: &value.Range{Start: 5, Stop: -5, Step: -3}})
+
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := vm.Restore(data, &vm.Bytecode{Instructions: m.Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.Stack[0].Opaque.(*value.Iterator)
+	if got.Kind != value.IterMap || got.Fn.Format(nil) != "<function f>" || got.Sources[0].Kind != value.IterZip {
+		t.Errorf("map changed: %+v", got)
+	}
+	if g := got.Sources[0].Sources[1]; !reflect.DeepEqual(g, gen) {
+		t.Errorf("generator changed:\n got %+v\nwant %+v", g.Gen, gen.Gen)
+	}
+	if it := got.Sources[0].Sources[0]; !reflect.DeepEqual(it, rng) {
+		t.Errorf("range iterator changed: %+v", it)
+	}
+	if got.Sources[0].Sources[1] != r.Stack[1].Opaque.(*value.Iterator) {
+		t.Errorf("generator aliasing lost")
+	}
+	if rg := r.Stack[2].Format(r.Arena); rg != "range(5, -5, -3)" {
+		t.Errorf("range changed: %s", rg)
+	}
+
+	// A handler of a frame the generator does not keep.
+	gen.Gen.Handlers[1].Frame = 2
+	if data, err = m.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Restore(data, &vm.Bytecode{Instructions: m.Code}); !errors.Is(err, vm.ErrBadSnapshot) {
+		t.Errorf("expected ErrBadSnapshot, got %v", err)
+	}
+}
+
+func TestSnapshotLimits(t *testing.T) {
+	l := vm.Limits{StackDepth: 300, MaxFrames: 4, MaxLocals: 40}
+	m := vm.NewMachine(l)
+	m.Code = []uint32{(uint32(vm.OP_HALT) << 24)}
+	m.Frames[0].Locals[39] = value.Value{Type: value.TypeInt, Data: 7}
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := vm.Restore(data, &vm.Bytecode{Instructions: m.Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Limits() != l || r.Frames[0].Locals[39].Int() != 7 {
+		t.Errorf("limits or locals lost: %+v", r.Limits())
+	}
+}
+
+func TestRestoreRejects(t *testing.T) {
+	m := countTo(100)
+	if err := m.Run(50); !errors.Is(err, vm.ErrGasExhausted) {
+		t.Fatal(err)
+	}
+	m.Push(value.Value{Type: value.TypeList, Opaque: &[]value.Value{{Type: value.TypeInt, Data: 1}}})
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := &vm.Bytecode{Instructions: m.Code, Constants: m.Constants}
+
+	if _, err := vm.Restore(data, &vm.Bytecode{Instructions: countTo(1).Code[:3]}); !errors.Is(err, vm.ErrSnapshotMismatch) {
+		t.Errorf("expected ErrSnapshotMismatch, got %v", err)
+	}
+	for i := 0; i < len(data); i++ {
+		if _, err := vm.Restore(data[:i], bc); err == nil {
+			t.Fatalf("truncated snapshot of %d bytes accepted", i)
+		}
+	}
+
+	m.Push(value.Value{Type: value.TypeDict, Opaque: map[string]any{"f": func() {}}})
+	if _, err := m.Snapshot(); err == nil {
+		t.Errorf("expected an error for an unsupported value")
+	}
+}
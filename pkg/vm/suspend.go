@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"errors"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+var (
+	// ErrSuspended is returned by Run, Resume and the other entry points
+	// when a host function has suspended the execution to wait for a result
+	// the host delivers later with Complete.
+	ErrSuspended = errors.New("vm: execution suspended")
+	// ErrUnknownHandle is returned by Complete for a handle that is not the
+	// one the machine is suspended on.
+	ErrUnknownHandle = errors.New("vm: unknown handle")
+)
+
+// Handle identifies a host function call suspended with Suspend. Handles are
+// never zero and are not reused by a machine, nor by one restored from its
+// snapshots.
+type Handle uint64
+
+// Suspend lets a host function finish its call later, e.g. once a person has
+// approved it or a queued job has run. The function pops its arguments,
+// passes the returned handle to whatever will produce the result, and
+// returns the returned error without pushing anything. The execution then
+// stops with ErrSuspended after the call, and the machine can be
+// snapshotted; Complete pushes the result and Resume continues.
+//
+// Only calls made by the program itself can be suspended. In a function
+// called back by a host function, as map() and sorted() do, or in a
+// generator, Suspend returns a RuntimeError for the host function to return
+// instead.
+func (m *Machine) Suspend() (Handle, error) {
+	if m.depth != 1 {
+		return 0, NewError("RuntimeError", "cannot suspend inside a call from a host function")
+	}
+	for i := 1; i <= m.FP; i++ {
+		if m.Frames[i].ReturnIP < 0 {
+			return 0, NewError("RuntimeError", "cannot suspend inside a call from a host function")
+		}
+	}
+	m.handles++
+	m.pending = Handle(m.handles)
+	return m.pending, ErrSuspended
+}
+
+// Pending returns the handle the machine is suspended on, and false if it
+// is not suspended or its call has been completed.
+func (m *Machine) Pending() (Handle, bool) {
+	return m.pending, m.pending != 0 && m.depth == 0
+}
+
+// Complete delivers v as the result of the suspended call h, to be found on
+// the stack when the execution resumes. Strings in v must point into the
+// machine's arena, see WriteArena. It returns ErrUnknownHandle unless the
+// machine is stopped and suspended on h.
+func (m *Machine) Complete(h Handle, v value.Value) error {
+	if h == 0 || h != m.pending || m.depth != 0 {
+		return ErrUnknownHandle
+	}
+	if m.SP >= len(m.Stack) {
+		return ErrStackOverflow
+	}
+	m.Push(v)
+	m.pending = 0
+	if rec, ok := m.Effects.(*Recorder); ok {
+		rec.complete(m, h, v)
+	}
+	return nil
+}
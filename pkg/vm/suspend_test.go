@@ -0,0 +1,171 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// approvals is a fake asynchronous tool: it queues its argument and leaves
+// the answer to the test.
+type approvals struct {
+	queue map[vm.Handle]int64
+}
+
+func (a *approvals) entry() vm.HostFunctionEntry {
+	return vm.HostFunctionEntry{
+		Name:             "approve",
+		Effect:           &vm.StackEffect{Pops: 1, Pushes: 1},
+		Nondeterministic: true,
+		Fn: func(m *vm.Machine) error {
+			x := m.Pop().Int()
+			h, err := m.Suspend()
+			if h != 0 {
+				a.queue[h] = x
+			}
+			return err
+		},
+	}
+}
+
+// approveProgram returns a machine running `g0 = approve(20) + 1`, with a
+// function `approve(5)` at IP 6.
+func approveProgram(a *approvals) *vm.Machine {
+	return &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_SYSCALL) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(vm.OP_ADD) << 24),
+			(uint32(vm.OP_POP_G) << 24) | 0,
+			(uint32(vm.OP_HALT) << 24),
+			(uint32(vm.OP_PUSH_C) << 24) | 2,
+			(uint32(vm.OP_SYSCALL) << 24) | 0,
+			(uint32(vm.OP_RET) << 24),
+		},
+		Constants: []value.Value{
+			{Type: value.TypeInt, Data: 20},
+			{Type: value.TypeInt, Data: 1},
+			{Type: value.TypeInt, Data: 5},
+		},
+		HostRegistry: []vm.HostFunctionEntry{a.entry()},
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	a := &approvals{queue: make(map[vm.Handle]int64)}
+	m := approveProgram(a)
+	if err := m.Run(100); !errors.Is(err, vm.ErrSuspended) {
+		t.Fatalf("expected ErrSuspended, got %v", err)
+	}
+	h, ok := m.Pending()
+	if !ok || a.queue[h] != 20 {
+		t.Fatalf("expected a pending call of approve(20), got handle %d (%v), queue %v", h, ok, a.queue)
+	}
+	if err := m.Resume(100); !errors.Is(err, vm.ErrSuspended) {
+		t.Errorf("expected ErrSuspended before Complete, got %v", err)
+	}
+	if err := m.Complete(h+1, value.Value{Type: value.TypeInt, Data: 1}); !errors.Is(err, vm.ErrUnknownHandle) {
+		t.Errorf("expected ErrUnknownHandle, got %v", err)
+	}
+
+	// The suspended execution survives a snapshot.
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := vm.Restore(data, &vm.Bytecode{Instructions: m.Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Constants = m.Constants
+	restored.HostRegistry = m.HostRegistry
+	if got, ok := restored.Pending(); got != h || !ok {
+		t.Fatalf("restored machine is pending on %d (%v), want %d", got, ok, h)
+	}
+	if err := restored.Complete(h, value.Value{Type: value.TypeInt, Data: uint64(a.queue[h] * 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Resume(100); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Globals()[0].Int(); got != 41 {
+		t.Errorf("expected 41, got %d", got)
+	}
+	if _, ok := restored.Pending(); ok {
+		t.Error("still pending after Complete")
+	}
+	if err := restored.Complete(h, value.Value{}); !errors.Is(err, vm.ErrUnknownHandle) {
+		t.Errorf("expected ErrUnknownHandle for a completed call, got %v", err)
+	}
+
+	// A function called from Go cannot suspend.
+	m = approveProgram(a)
+	m.AddGas(100)
+	var re *vm.RuntimeError
+	if _, err := m.Call(6); !errors.As(err, &re) || re.Kind != "RuntimeError" {
+		t.Errorf("expected a RuntimeError, got %v", err)
+	}
+	if _, ok := m.Pending(); ok {
+		t.Error("pending after a failed suspension")
+	}
+}
+
+func TestSuspendSlice(t *testing.T) {
+	a := &approvals{queue: make(map[vm.Handle]int64)}
+	m := approveProgram(a)
+	m.AddGas(100)
+	status, err := m.RunSlice(context.Background(), 50)
+	if status != vm.StatusSuspended || err != nil {
+		t.Fatalf("expected StatusSuspended, got %v, %v", status, err)
+	}
+	if status, _ := m.RunSlice(context.Background(), 50); status != vm.StatusSuspended {
+		t.Errorf("expected StatusSuspended before Complete, got %v", status)
+	}
+	h, _ := m.Pending()
+	if err := m.Complete(h, value.Value{Type: value.TypeInt, Data: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := m.RunSlice(context.Background(), 50); status != vm.StatusHalted || err != nil {
+		t.Fatalf("expected StatusHalted, got %v, %v", status, err)
+	}
+	if got := m.Globals()[0].Int(); got != 3 {
+		t.Errorf("expected 3, got %d", got)
+	}
+}
+
+func TestSuspendRecord(t *testing.T) {
+	a := &approvals{queue: make(map[vm.Handle]int64)}
+	m := approveProgram(a)
+	rec := &vm.Recorder{}
+	m.Effects = rec
+	if err := m.Run(100); !errors.Is(err, vm.ErrSuspended) {
+		t.Fatalf("expected ErrSuspended, got %v", err)
+	}
+	h, _ := m.Pending()
+	if err := m.Complete(h, value.Value{Type: value.TypeInt, Data: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Resume(100); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rec.Log.Records); n != 1 {
+		t.Fatalf("expected 1 record, got %d", n)
+	}
+	if got := rec.Log.Records[0].String(); got != "approve(20) -> 7" {
+		t.Errorf("got record %q", got)
+	}
+
+	// The replay answers from the log without suspending.
+	m = approveProgram(a)
+	m.Effects = vm.NewReplayer(&rec.Log)
+	if err := m.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Globals()[0].Int(); got != 8 {
+		t.Errorf("expected 8, got %d", got)
+	}
+}
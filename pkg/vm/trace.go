@@ -0,0 +1,108 @@
+package vm
+
+// Tracer observes an execution. Set it on Machine.Tracer before running;
+// while it is nil the dispatch loop runs without any tracing checks.
+//
+// Callbacks run on the goroutine executing the program and may inspect the
+// machine, but must not modify it. A callback that blocks pauses the
+// program, which is how a debugger stops at a breakpoint.
+type Tracer interface {
+	// Instruction is called before each instruction executes.
+	Instruction(m *Machine, ip int, op uint8, arg int)
+	// SyscallEnter is called before the host function at index runs, with
+	// the scope it requires, if any. SyscallExit is called after it
+	// returns, with its error.
+	SyscallEnter(m *Machine, index int, scope string)
+	SyscallExit(m *Machine, index int, scope string, err error)
+	// ScopeEnter is called when OP_ADDRESS opens a scope and ScopeExit
+	// when OP_EXIT_ADDR, or an exception, closes one.
+	ScopeEnter(m *Machine, scope string)
+	ScopeExit(m *Machine, scope string)
+	// Call is called when a function starting at entry has been entered
+	// in frame depth. Return is called when frame depth is left, either by
+	// OP_RET or because an exception unwound it.
+	Call(m *Machine, entry, depth int)
+	Return(m *Machine, depth int)
+}
+
+// NopTracer implements Tracer with callbacks that do nothing. Embed it to
+// implement only some of them.
+type NopTracer struct{}
+
+func (NopTracer) Instruction(m *Machine, ip int, op uint8, arg int)          {}
+func (NopTracer) SyscallEnter(m *Machine, index int, scope string)           {}
+func (NopTracer) SyscallExit(m *Machine, index int, scope string, err error) {}
+func (NopTracer) ScopeEnter(m *Machine, scope string)                        {}
+func (NopTracer) ScopeExit(m *Machine, scope string)                         {}
+func (NopTracer) Call(m *Machine, entry, depth int)                          {}
+func (NopTracer) Return(m *Machine, depth int)                               {}
+
+// dispatchTraced is the dispatch loop used while a Tracer is set. It steps
+// through the program one instruction at a time, so that the untraced loop
+// pays nothing for tracing.
+func (m *Machine) dispatchTraced() error {
+	t := m.Tracer
+	for n := 0; ; n++ {
+		if m.IP < 0 || m.IP >= len(m.Code) {
+			return m.dispatch(n, 1) // reports the bad IP
+		}
+		instr := m.Code[m.IP]
+		op, arg := uint8(instr>>24), int(instr&0x00FFFFFF)
+		fp := m.FP
+		t.Instruction(m, m.IP, op, arg)
+
+		var scope string
+		switch op {
+		case OP_SYSCALL:
+			if arg < len(m.HostRegistry) {
+				scope = m.HostRegistry[arg].RequiredScope
+			}
+			t.SyscallEnter(m, arg, scope)
+		case OP_EXIT_ADDR:
+			if len(m.ScopeStack) > 0 {
+				scope = m.ScopeStack[len(m.ScopeStack)-1]
+			}
+		}
+
+		err := m.dispatch(n, 1)
+
+		switch op {
+		case OP_HALT:
+			if err == nil {
+				return nil
+			}
+		case OP_SYSCALL:
+			t.SyscallExit(m, arg, scope, err)
+		case OP_ADDRESS:
+			if err == nil {
+				t.ScopeEnter(m, m.ScopeStack[len(m.ScopeStack)-1])
+			}
+		case OP_EXIT_ADDR:
+			if err == nil && scope != "" {
+				t.ScopeExit(m, scope)
+			}
+		case OP_CALL, OP_CALL_FN:
+			if err == nil {
+				t.Call(m, m.IP, m.FP)
+			}
+		case OP_RET, OP_GEN, OP_YIELD:
+			if err == nil || err == errStop {
+				t.Return(m, fp)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// traceUnwind reports the scopes, innermost first, and the frames from top
+// down to above bottom that an exception left.
+func (m *Machine) traceUnwind(top, bottom int, scopes []string) {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		m.Tracer.ScopeExit(m, scopes[i])
+	}
+	for d := top; d > bottom; d-- {
+		m.Tracer.Return(m, d)
+	}
+}
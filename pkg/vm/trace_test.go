@@ -0,0 +1,130 @@
+package vm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+// recorder logs the events it is told about.
+type recorder struct {
+	ips    []int
+	events []string
+}
+
+func (r *recorder) Instruction(m *vm.Machine, ip int, op uint8, arg int) {
+	r.ips = append(r.ips, ip)
+}
+
+func (r *recorder) SyscallEnter(m *vm.Machine, index int, scope string) {
+	r.events = append(r.events, fmt.Sprintf("syscall %d %s", index, scope))
+}
+
+func (r *recorder) SyscallExit(m *vm.Machine, index int, scope string, err error) {
+	r.events = append(r.events, fmt.Sprintf("exit %d %v", index, err))
+}
+
+func (r *recorder) ScopeEnter(m *vm.Machine, scope string) {
+	r.events = append(r.events, "enter "+scope)
+}
+
+func (r *recorder) ScopeExit(m *vm.Machine, scope string) {
+	r.events = append(r.events, "leave "+scope)
+}
+
+func (r *recorder) Call(m *vm.Machine, entry, depth int) {
+	r.events = append(r.events, fmt.Sprintf("call %d@%d", entry, depth))
+}
+
+func (r *recorder) Return(m *vm.Machine, depth int) {
+	r.events = append(r.events, fmt.Sprintf("return %d", depth))
+}
+
+func TestTracer(t *testing.T) {
+	m := &vm.Machine{
+		Gatekeeper: &MockGatekeeper{ValidTokens: map[string]string{"HTTP-ENV": "token"}},
+		Code: []uint32{
+			(uint32(vm.OP_SETUP_EXCEPT) << 24) | 13,
+			(uint32(vm.OP_PUSH_C) << 24) | 0,
+			(uint32(vm.OP_PUSH_C) << 24) | 1,
+			(uint32(vm.OP_ADDRESS) << 24),
+			(uint32(vm.OP_SYSCALL) << 24) | 0,
+			(uint32(vm.OP_CALL) << 24) | (8 << 8),
+			(uint32(vm.OP_POP_EXCEPT) << 24),
+			(uint32(vm.OP_HALT) << 24),
+			(uint32(vm.OP_CALL) << 24) | (11 << 8), // 8: f calls g
+			(uint32(vm.OP_DROP) << 24),
+			(uint32(vm.OP_RET) << 24),
+			(uint32(vm.OP_PUSH_C) << 24) | 2, // 11: g divides by zero
+			(uint32(vm.OP_FLOOR_DIV) << 24),
+			(uint32(vm.OP_EXIT_ADDR) << 24), // 13: handler
+			(uint32(vm.OP_HALT) << 24),
+		},
+		Constants: []value.Value{
+			{Type: value.TypeString, Data: value.PackString(0, 8)},
+			{Type: value.TypeString, Data: value.PackString(8, 5)},
+			{Type: value.TypeInt, Data: 0},
+		},
+		Arena: []byte("HTTP-ENVtoken"),
+	}
+	m.RegisterHostFunction("HTTP-ENV", func(m *vm.Machine) error {
+		m.Push(value.Value{Type: value.TypeInt, Data: 7})
+		return nil
+	})
+	r := &recorder{}
+	m.Tracer = r
+	if err := m.Run(100); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := fmt.Sprint(r.ips), "[0 1 2 3 4 5 8 11 12 13 14]"; got != want {
+		t.Errorf("instructions %s, want %s", got, want)
+	}
+	want := []string{
+		"enter HTTP-ENV",
+		"syscall 0 HTTP-ENV",
+		"exit 0 <nil>",
+		"call 8@1",
+		"call 11@2",
+		"leave HTTP-ENV",
+		"return 2",
+		"return 1",
+	}
+	if got := strings.Join(r.events, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+	if m.FP != 0 || len(m.ScopeStack) != 0 {
+		t.Errorf("FP %d, scopes %v after the handler", m.FP, m.ScopeStack)
+	}
+}
+
+func TestTracerCall(t *testing.T) {
+	m := &vm.Machine{
+		Code: []uint32{
+			(uint32(vm.OP_HALT) << 24),
+			(uint32(vm.OP_PUSH_L) << 24) | 0, // 1: return x + x
+			(uint32(vm.OP_PUSH_L) << 24) | 0,
+			(uint32(vm.OP_ADD) << 24),
+			(uint32(vm.OP_RET) << 24),
+		},
+	}
+	m.AddGas(100)
+	r := &recorder{}
+	m.Tracer = r
+	got, err := m.Call(1, value.Value{Type: value.TypeInt, Data: 21})
+	if err != nil || got.Int() != 42 {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	if s := strings.Join(r.events, ", "); s != "call 1@1, return 1" {
+		t.Errorf("events %s", s)
+	}
+
+	// NopTracer leaves the result alone.
+	m.Tracer = vm.NopTracer{}
+	if got, err := m.Call(1, value.Value{Type: value.TypeInt, Data: 2}); err != nil || got.Int() != 4 {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
@@ -0,0 +1,382 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/agenthands/npython/pkg/core/value"
+)
+
+var ErrVerification = errors.New("vm: bytecode verification failed")
+
+// StackEffect describes how a host function changes the stack. With Variadic
+// set, the top of the stack is an argument count pushed by the preceding
+// OP_PUSH_C, and that many values are popped in addition to Pops (which
+// includes the count itself).
+type StackEffect struct {
+	Pops     int
+	Pushes   int
+	Variadic bool
+}
+
+// opEffect is the fixed stack effect of an opcode. Opcodes whose effect
+// depends on the argument (OP_DUP, OP_CALL, OP_CALL_FN, OP_CLOSURE,
+// OP_SYSCALL) are handled separately.
+type opEffect struct {
+	valid        bool
+	pops, pushes int
+}
+
+var opEffects = func() (t [256]opEffect) {
+	for _, op := range []uint8{
+		OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_FLOOR_DIV, OP_MOD, OP_POW,
+		OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR, OP_LSHIFT, OP_RSHIFT,
+		OP_EQ, OP_NE, OP_GT, OP_LT, OP_LTE, OP_GTE,
+		OP_AND, OP_OR, OP_IN, OP_NOT_IN, OP_CONTAINS, OP_EXC_MATCH, OP_MAKE_EXC,
+		OP_IS, OP_IS_NOT,
+	} {
+		t[op] = opEffect{true, 2, 1}
+	}
+	for _, op := range []uint8{OP_NOT, OP_NEG, OP_POS, OP_INVERT} {
+		t[op] = opEffect{true, 1, 1}
+	}
+	t[OP_HALT] = opEffect{true, 0, 0}
+	t[OP_PUSH_C] = opEffect{true, 0, 1}
+	t[OP_PUSH_L] = opEffect{true, 0, 1}
+	t[OP_POP_L] = opEffect{true, 1, 0}
+	t[OP_PUSH_G] = opEffect{true, 0, 1}
+	t[OP_POP_G] = opEffect{true, 1, 0}
+	t[OP_DUP] = opEffect{true, 0, 1}
+	t[OP_DROP] = opEffect{true, 1, 0}
+	t[OP_PRINT] = opEffect{true, 1, 0}
+	t[OP_ERROR] = opEffect{true, 1, 0}
+	t[OP_JMP] = opEffect{true, 0, 0}
+	t[OP_JMP_FALSE] = opEffect{true, 1, 0}
+	t[OP_JMP_FALSE_OR_POP] = opEffect{true, 1, 0}
+	t[OP_JMP_TRUE_OR_POP] = opEffect{true, 1, 0}
+	t[OP_CALL] = opEffect{true, 0, 0}
+	t[OP_RET] = opEffect{true, 1, 0}
+	t[OP_ADDRESS] = opEffect{true, 2, 0}
+	t[OP_EXIT_ADDR] = opEffect{true, 0, 0}
+	t[OP_SYSCALL] = opEffect{true, 0, 0}
+	t[OP_SETUP_EXCEPT] = opEffect{true, 0, 0}
+	t[OP_POP_EXCEPT] = opEffect{true, 0, 0}
+	t[OP_RAISE] = opEffect{true, 1, 0}
+	t[OP_CALL_FN] = opEffect{true, 0, 0}
+	t[OP_CLOSURE] = opEffect{true, 0, 0}
+	t[OP_MAKE_CELL] = opEffect{true, 0, 0}
+	t[OP_LOAD_DEREF] = opEffect{true, 0, 1}
+	t[OP_STORE_DEREF] = opEffect{true, 1, 0}
+	t[OP_GEN] = opEffect{true, 0, 0}
+	t[OP_YIELD] = opEffect{true, 1, 1}
+	return t
+}()
+
+// Verify checks bc statically before it runs against registry: that every
+// opcode is implemented, that jump and call targets, constant, local and
+// host function indices are in range, that no path falls off the end of the
+// code, and that the operand stack neither underflows nor, as far as can be
+// determined, exceeds StackDepth. Stack depths are tracked per function
+// relative to the frame base; host functions without a StackEffect make the
+// depth unknown until the path merges with a known one again.
+func Verify(bc *Bytecode, registry []HostFunctionEntry) error {
+	return VerifyLimits(bc, registry, DefaultLimits)
+}
+
+// VerifyLimits is like Verify for a machine created with limits l.
+func VerifyLimits(bc *Bytecode, registry []HostFunctionEntry, l Limits) error {
+	v := &verifier{bc: bc, registry: registry, limits: l.withDefaults(), funcs: make(map[int]*funcInfo), bounds: make(map[int]int)}
+	if len(bc.Instructions) == 0 {
+		return v.errorf(0, "no code")
+	}
+	if err := v.checkOperands(); err != nil {
+		return err
+	}
+	entries := []int{0}
+	for _, ip := range bc.Functions {
+		if ip < 0 || ip >= len(bc.Instructions) {
+			return v.errorf(ip, "function entry out of range")
+		}
+		entries = append(entries, ip)
+	}
+	for _, c := range bc.Constants {
+		if f, ok := c.Opaque.(*value.Function); ok && c.Type == value.TypeFunction {
+			if f.Entry < 0 || f.Entry >= len(bc.Instructions) {
+				return v.errorf(f.Entry, "function %s entry out of range", f.Name)
+			}
+			entries = append(entries, f.Entry)
+		}
+	}
+	for ip, instr := range bc.Instructions {
+		switch uint8(instr >> 24) {
+		case OP_CALL:
+			entries = append(entries, int(instr&0x00FFFFFF)>>8)
+		case OP_GEN:
+			// The body of a generator runs when it is resumed, in a frame
+			// of its own.
+			if ip+1 >= len(bc.Instructions) {
+				return v.errorf(ip, "execution falls off the end of the code")
+			}
+			entries = append(entries, ip+1)
+		}
+	}
+	for _, ip := range entries {
+		if _, err := v.function(ip); err != nil {
+			return err
+		}
+	}
+	if bound := v.bound(0, nil); bound > v.limits.StackDepth {
+		return v.errorf(0, "stack may grow to %d values, limit is %d", bound, v.limits.StackDepth)
+	}
+	return nil
+}
+
+type verifier struct {
+	bc       *Bytecode
+	registry []HostFunctionEntry
+	limits   Limits
+	funcs    map[int]*funcInfo
+	bounds   map[int]int
+}
+
+// funcInfo is the result of analysing one function.
+type funcInfo struct {
+	maxDepth int
+	calls    []callSite
+	indirect bool // calls function values, whose targets are unknown
+}
+
+type callSite struct {
+	depth  int // stack depth below the arguments
+	target int
+}
+
+func (v *verifier) errorf(ip int, format string, args ...any) error {
+	return fmt.Errorf("%w: IP %d: %s", ErrVerification, ip, fmt.Sprintf(format, args...))
+}
+
+// checkOperands validates every instruction in isolation.
+func (v *verifier) checkOperands() error {
+	code := v.bc.Instructions
+	for ip, instr := range code {
+		op, arg := uint8(instr>>24), int(instr&0x00FFFFFF)
+		if !opEffects[op].valid {
+			return v.errorf(ip, "unknown opcode %02X", op)
+		}
+		switch op {
+		case OP_PUSH_C:
+			if arg >= len(v.bc.Constants) {
+				return v.errorf(ip, "constant %d out of range", arg)
+			}
+		case OP_PUSH_L, OP_POP_L, OP_MAKE_CELL, OP_LOAD_DEREF, OP_STORE_DEREF:
+			if arg >= v.limits.MaxLocals {
+				return v.errorf(ip, "local %d out of range", arg)
+			}
+		case OP_GEN:
+			if arg > v.limits.MaxLocals {
+				return v.errorf(ip, "generator keeps %d locals, limit is %d", arg, v.limits.MaxLocals)
+			}
+		case OP_PUSH_G, OP_POP_G:
+			if arg >= v.bc.Globals || arg >= MaxGlobals {
+				return v.errorf(ip, "global %d out of range", arg)
+			}
+		case OP_JMP, OP_JMP_FALSE, OP_JMP_FALSE_OR_POP, OP_JMP_TRUE_OR_POP, OP_SETUP_EXCEPT:
+			if arg >= len(code) {
+				return v.errorf(ip, "jump target %d out of range", arg)
+			}
+		case OP_CALL:
+			if target, argc := arg>>8, arg&0xFF; target >= len(code) {
+				return v.errorf(ip, "call target %d out of range", target)
+			} else if argc > v.limits.MaxLocals {
+				return v.errorf(ip, "%d arguments exceed %d locals", argc, v.limits.MaxLocals)
+			}
+		case OP_CALL_FN, OP_CLOSURE:
+			if arg > v.limits.MaxLocals {
+				return v.errorf(ip, "%d arguments exceed %d locals", arg, v.limits.MaxLocals)
+			}
+		case OP_SYSCALL:
+			if arg >= len(v.registry) || v.registry[arg].Fn == nil {
+				return v.errorf(ip, "host function %d is not registered", arg)
+			}
+		}
+	}
+	return nil
+}
+
+// unknownDepth marks a stack effect that cannot be determined statically.
+const unknownDepth = -1
+
+// span is the range of stack depths, relative to the frame base, that an
+// instruction can start with. Functions may read below their base (legacy
+// code passes arguments on the caller's stack), so lo can be negative.
+type span struct {
+	lo, hi int
+	known  bool
+}
+
+func (a span) merge(b span) span {
+	switch {
+	case !a.known:
+		return b
+	case !b.known:
+		return a
+	}
+	return span{min(a.lo, b.lo), max(a.hi, b.hi), true}
+}
+
+// function analyses the function starting at entry.
+func (v *verifier) function(entry int) (*funcInfo, error) {
+	if info, ok := v.funcs[entry]; ok {
+		return info, nil
+	}
+	info := &funcInfo{}
+	v.funcs[entry] = info
+
+	// Only the main program has nothing below its base.
+	floor := 0
+	if entry != 0 {
+		floor = -v.limits.StackDepth
+	}
+
+	code := v.bc.Instructions
+	spans := map[int]span{entry: {0, 0, true}}
+	work := []int{entry}
+
+	// flow merges s into ip and queues ip when that adds information.
+	flow := func(from, ip int, s span) error {
+		if ip >= len(code) {
+			return v.errorf(from, "execution falls off the end of the code")
+		}
+		old, seen := spans[ip]
+		if merged := old.merge(s); !seen || merged != old {
+			spans[ip] = merged
+			work = append(work, ip)
+		}
+		return nil
+	}
+
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		s := spans[ip]
+		instr := code[ip]
+		op, arg := uint8(instr>>24), int(instr&0x00FFFFFF)
+
+		pops, pushes := opEffects[op].pops, opEffects[op].pushes
+		switch op {
+		case OP_DUP:
+			pops, pushes = arg+1, arg+2
+		case OP_CALL:
+			target, argc := arg>>8, arg&0xFF
+			pops, pushes = argc, 1
+			if s.known {
+				info.calls = append(info.calls, callSite{depth: s.hi - argc, target: target})
+			}
+		case OP_CALL_FN:
+			pops, pushes = arg+1, 1
+			info.indirect = true
+		case OP_CLOSURE:
+			pops, pushes = arg+1, 1
+		case OP_SYSCALL:
+			pops, pushes = v.syscallEffect(ip, arg)
+		}
+
+		next := span{}
+		if s.known && pops != unknownDepth {
+			if s.lo-pops < floor {
+				return nil, v.errorf(ip, "stack underflow (depth %d, needs %d)", s.lo, pops)
+			}
+			next = span{s.lo - pops + pushes, s.hi - pops + pushes, true}
+			if next.hi > v.limits.StackDepth {
+				return nil, v.errorf(ip, "stack may grow beyond %d values", v.limits.StackDepth)
+			}
+			info.maxDepth = max(info.maxDepth, next.hi)
+		}
+
+		var err error
+		switch op {
+		case OP_HALT, OP_RET, OP_GEN, OP_ERROR, OP_RAISE:
+		case OP_JMP:
+			err = flow(ip, arg, next)
+		case OP_JMP_FALSE:
+			if err = flow(ip, arg, next); err == nil {
+				err = flow(ip, ip+1, next)
+			}
+		case OP_JMP_FALSE_OR_POP, OP_JMP_TRUE_OR_POP:
+			// The value is only popped when the jump is not taken.
+			kept := next
+			kept.lo, kept.hi = kept.lo+1, kept.hi+1
+			if err = flow(ip, arg, kept); err == nil {
+				err = flow(ip, ip+1, next)
+			}
+		case OP_SETUP_EXCEPT:
+			// The handler starts with the exception pushed.
+			exc := next
+			exc.lo, exc.hi = exc.lo+1, exc.hi+1
+			if err = flow(ip, arg, exc); err == nil {
+				err = flow(ip, ip+1, next)
+			}
+		default:
+			err = flow(ip, ip+1, next)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// syscallEffect returns the pops and pushes of the host function at idx, or
+// unknownDepth if they cannot be determined.
+func (v *verifier) syscallEffect(ip, idx int) (int, int) {
+	e := v.registry[idx].Effect
+	if e == nil {
+		return unknownDepth, 0
+	}
+	if !e.Variadic {
+		return e.Pops, e.Pushes
+	}
+	if ip == 0 || uint8(v.bc.Instructions[ip-1]>>24) != OP_PUSH_C {
+		return unknownDepth, 0
+	}
+	c := v.bc.Constants[v.bc.Instructions[ip-1]&0x00FFFFFF]
+	if c.Type != value.TypeInt || c.Int() < 0 {
+		return unknownDepth, 0
+	}
+	return e.Pops + int(c.Int()), e.Pushes
+}
+
+// bound returns the deepest absolute stack the function at entry can reach,
+// including the functions it calls, or -1 for recursive call chains and calls
+// of function values, which cannot be bounded statically; the VM still stops
+// them at run time.
+func (v *verifier) bound(entry int, active map[int]bool) int {
+	if b, ok := v.bounds[entry]; ok {
+		return b
+	}
+	if active == nil {
+		active = make(map[int]bool)
+	}
+	if active[entry] {
+		return -1
+	}
+	active[entry] = true
+	defer delete(active, entry)
+
+	info := v.funcs[entry]
+	if info.indirect {
+		return -1
+	}
+	b := info.maxDepth
+	for _, c := range info.calls {
+		cb := v.bound(c.target, active)
+		if cb < 0 {
+			return -1
+		}
+		if c.depth+cb > b {
+			b = c.depth + cb
+		}
+	}
+	v.bounds[entry] = b
+	return b
+}
@@ -0,0 +1,104 @@
+package vm_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/agenthands/npython/pkg/core/value"
+	"github.com/agenthands/npython/pkg/vm"
+)
+
+func op(o uint8, arg int) uint32 { return uint32(o)<<24 | uint32(arg) }
+
+func TestVerify(t *testing.T) {
+	nop := func(m *vm.Machine) error { return nil }
+	registry := []vm.HostFunctionEntry{
+		{Fn: nop, Effect: &vm.StackEffect{Pops: 1, Pushes: 1}},
+		{Fn: nop},
+		{Fn: nop, Effect: &vm.StackEffect{Pops: 1, Pushes: 1, Variadic: true}},
+	}
+	consts := []value.Value{{Type: value.TypeInt, Data: 1}, {Type: value.TypeInt, Data: 2}, {Type: value.TypeInt, Data: 0}}
+
+	tests := []struct {
+		name string
+		code []uint32
+		want string // empty if the code is valid
+	}{
+		{"CountTo", countTo(10).Code, ""},
+		{"HostCalls", []uint32{op(vm.OP_PUSH_C, 0), op(vm.OP_SYSCALL, 0), op(vm.OP_PUSH_C, 0), op(vm.OP_PUSH_C, 0), op(vm.OP_SYSCALL, 2), op(vm.OP_ADD, 0), op(vm.OP_HALT, 0)}, ""},
+		{"UnknownEffect", []uint32{op(vm.OP_SYSCALL, 1), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}, ""},
+		{"Function", []uint32{op(vm.OP_PUSH_C, 0), op(vm.OP_CALL, 4<<8|1), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0), op(vm.OP_POP_L, 0), op(vm.OP_PUSH_L, 0), op(vm.OP_RET, 0)}, ""},
+		{"Handler", []uint32{op(vm.OP_SETUP_EXCEPT, 3), op(vm.OP_POP_EXCEPT, 0), op(vm.OP_HALT, 0), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}, ""},
+		{"ShortCircuit", []uint32{op(vm.OP_PUSH_C, 0), op(vm.OP_JMP_FALSE_OR_POP, 3), op(vm.OP_PUSH_C, 1), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}, ""},
+		{"Generator", []uint32{op(vm.OP_CALL, 3<<8), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0), op(vm.OP_GEN, 1), op(vm.OP_PUSH_L, 0), op(vm.OP_YIELD, 0), op(vm.OP_RET, 0)}, ""},
+		{"UnknownOpcode", []uint32{op(0xEE, 0), op(vm.OP_HALT, 0)}, "unknown opcode"},
+		{"BadConstant", []uint32{op(vm.OP_PUSH_C, 3), op(vm.OP_HALT, 0)}, "constant 3"},
+		{"BadLocal", []uint32{op(vm.OP_PUSH_L, vm.MaxLocals), op(vm.OP_HALT, 0)}, "local"},
+		{"BadGlobal", []uint32{op(vm.OP_PUSH_C, 0), op(vm.OP_POP_G, vm.MaxLocals), op(vm.OP_HALT, 0)}, "global"},
+		{"BadJump", []uint32{op(vm.OP_JMP, 7), op(vm.OP_HALT, 0)}, "jump target"},
+		{"BadHandler", []uint32{op(vm.OP_SETUP_EXCEPT, 5), op(vm.OP_HALT, 0)}, "jump target"},
+		{"BadCall", []uint32{op(vm.OP_CALL, 9<<8), op(vm.OP_HALT, 0)}, "call target"},
+		{"Unregistered", []uint32{op(vm.OP_SYSCALL, 3), op(vm.OP_HALT, 0)}, "not registered"},
+		{"Underflow", []uint32{op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}, "underflow"},
+		{"SyscallUnderflow", []uint32{op(vm.OP_PUSH_C, 1), op(vm.OP_SYSCALL, 2), op(vm.OP_HALT, 0)}, "underflow"},
+		{"ShortCircuitUnderflow", []uint32{op(vm.OP_PUSH_C, 0), op(vm.OP_JMP_TRUE_OR_POP, 3), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}, "underflow"},
+		{"HandlerUnderflow", []uint32{op(vm.OP_SETUP_EXCEPT, 2), op(vm.OP_HALT, 0), op(vm.OP_DROP, 0), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}, "underflow"},
+		{"FallsOffEnd", []uint32{op(vm.OP_PUSH_C, 0), op(vm.OP_DROP, 0)}, "falls off"},
+		{"GeneratorWithoutBody", []uint32{op(vm.OP_CALL, 2<<8), op(vm.OP_HALT, 0), op(vm.OP_GEN, 0)}, "falls off"},
+		{"GeneratorLocals", []uint32{op(vm.OP_CALL, 2<<8), op(vm.OP_HALT, 0), op(vm.OP_GEN, vm.MaxLocals+1), op(vm.OP_PUSH_C, 0), op(vm.OP_RET, 0)}, "generator keeps"},
+		{"Overflow", []uint32{op(vm.OP_PUSH_C, 0), op(vm.OP_JMP, 0)}, "beyond"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := vm.Verify(&vm.Bytecode{Instructions: tt.code, Constants: consts}, registry)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, vm.ErrVerification) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestVerifyLimits(t *testing.T) {
+	bc := &vm.Bytecode{Instructions: []uint32{op(vm.OP_PUSH_L, 20), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}}
+	if err := vm.Verify(bc, nil); !errors.Is(err, vm.ErrVerification) {
+		t.Errorf("expected local 20 to be rejected with the default limits, got %v", err)
+	}
+	if err := vm.VerifyLimits(bc, nil, vm.Limits{MaxLocals: 32}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Globals are bounded by the module's global count, not by MaxLocals.
+	bc = &vm.Bytecode{Instructions: []uint32{op(vm.OP_PUSH_G, 20), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0)}, Globals: 21}
+	if err := vm.Verify(bc, nil); err != nil {
+		t.Errorf("unexpected error for global 20 of 21: %v", err)
+	}
+	bc.Globals = 20
+	if err := vm.Verify(bc, nil); !errors.Is(err, vm.ErrVerification) {
+		t.Errorf("expected global 20 of 20 to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyFunctionValues(t *testing.T) {
+	// f(1) where f is the function value of the code at 5, which is only
+	// reachable through the constant.
+	code := []uint32{
+		op(vm.OP_PUSH_C, 0), op(vm.OP_PUSH_C, 1), op(vm.OP_CALL_FN, 1), op(vm.OP_DROP, 0), op(vm.OP_HALT, 0),
+		op(vm.OP_LOAD_DEREF, 1), op(vm.OP_RET, 0),
+	}
+	consts := []value.Value{value.NewFunction("f", 5, 1), {Type: value.TypeInt, Data: 1}}
+	if err := vm.Verify(&vm.Bytecode{Instructions: code, Constants: consts}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	consts[0] = value.NewFunction("f", 7, 1)
+	if err := vm.Verify(&vm.Bytecode{Instructions: code, Constants: consts}, nil); err == nil || !strings.Contains(err.Error(), "entry out of range") {
+		t.Errorf("expected a bad entry to be rejected, got %v", err)
+	}
+}
@@ -352,3 +352,56 @@ func TestSuite_StringOperations(t *testing.T) {
 		t.Errorf("String operations failed. Output: %s", out)
 	}
 }
+
+func TestSuite_CompiledBytecode(t *testing.T) {
+	sandbox, teardown := setupSandbox(t)
+	defer teardown()
+
+	script := `
+def square(x):
+    return x * x
+
+total = 0
+for i in range(5):
+    total = total + square(i)
+print("Total:", total)
+`
+	scriptPath := filepath.Join(sandbox, "agent.py")
+	os.WriteFile(scriptPath, []byte(script), 0644)
+	compiledPath := filepath.Join(sandbox, "agent.npyc")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	absNPython, _ := filepath.Abs("../npython")
+	if out, err := exec.CommandContext(ctx, absNPython, "compile", scriptPath, "-o", compiledPath).CombinedOutput(); err != nil {
+		t.Fatalf("compile failed: %v\nOutput: %s", err, out)
+	}
+
+	out, err := runNPython(ctx, compiledPath, sandbox, nil)
+	if err != nil {
+		t.Fatalf("running bytecode failed: %v\nOutput: %s", err, out)
+	}
+	if !strings.Contains(out, "Total: 30") {
+		t.Errorf("unexpected output: %s", out)
+	}
+
+	listing, err := exec.CommandContext(ctx, absNPython, "disasm", compiledPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("disasm failed: %v\nOutput: %s", err, listing)
+	}
+	for _, want := range []string{"square:", "; square", "; range", `; "Total:"`} {
+		if !strings.Contains(string(listing), want) {
+			t.Errorf("disassembly is missing %q:\n%s", want, listing)
+		}
+	}
+
+	// A corrupted file must be rejected before it runs.
+	data, _ := os.ReadFile(compiledPath)
+	data[len(data)/2] ^= 0xFF
+	os.WriteFile(compiledPath, data, 0644)
+	out, err = runNPython(ctx, compiledPath, sandbox, nil)
+	if err == nil || !strings.Contains(out, "checksum") {
+		t.Errorf("expected checksum error, got %v\nOutput: %s", err, out)
+	}
+}
@@ -29,7 +29,7 @@ z = x + y
 		t.Fatalf("VM Execution failed: %v", err)
 	}
 
-	zVal := machine.Frames[0].Locals[2]
+	zVal := machine.Globals()[2]
 	if zVal.Int() != 30 {
 		t.Errorf("Expected z (local 2) to be 30, got %d", zVal.Int())
 	}
@@ -60,7 +60,7 @@ else:
 		t.Fatalf("VM Execution failed: %v", err)
 	}
 
-	yVal := machine.Frames[0].Locals[1]
+	yVal := machine.Globals()[1]
 	if yVal.Int() != 1 {
 		t.Errorf("Expected y to be 1, got %d", yVal.Int())
 	}
@@ -91,7 +91,7 @@ while i < 5:
 		t.Fatalf("VM Execution failed: %v", err)
 	}
 
-	countVal := machine.Frames[0].Locals[1]
+	countVal := machine.Globals()[1]
 	if countVal.Int() != 10 {
 		t.Errorf("Expected count to be 10, got %d", countVal.Int())
 	}
@@ -1,6 +1,8 @@
 package main_test
 
 import (
+	"errors"
+	"slices"
 	"testing"
 
 	"github.com/agenthands/npython/pkg/compiler/python"
@@ -26,7 +28,7 @@ while n > 0:
     n = n - 1
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				res := m.Frames[0].Locals[1].Int()
+				res := m.Globals()[1].Int()
 				if res != 120 {
 					t.Errorf("Expected factorial(5) = 120, got %d", res)
 				}
@@ -46,7 +48,7 @@ else:
     res = 0
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				res := m.Frames[0].Locals[1].Int()
+				res := m.Globals()[1].Int()
 				if res != 2 {
 					t.Errorf("Expected res = 2, got %d", res)
 				}
@@ -67,7 +69,7 @@ while i < n:
     i = i + 1
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				res := m.Frames[0].Locals[1].Int() // a is local 1
+				res := m.Globals()[1].Int() // a is local 1
 				if res != 55 {
 					t.Errorf("Expected fib(10) = 55, got %d", res)
 				}
@@ -82,7 +84,7 @@ s3 = "World"
 res = s1 + s2 + s3
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				resVal := m.Frames[0].Locals[3]
+				resVal := m.Globals()[3]
 				res := value.UnpackString(resVal.Data, m.Arena)
 				if res != "Hello World" {
 					t.Errorf("Expected 'Hello World', got '%s'", res)
@@ -103,10 +105,10 @@ if a != b:
     res2 = 1
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				if m.Frames[0].Locals[3].Int() != 1 {
+				if m.Globals()[3].Int() != 1 {
 					t.Errorf("Expected res1 = 1")
 				}
-				if m.Frames[0].Locals[4].Int() != 1 {
+				if m.Globals()[4].Int() != 1 {
 					t.Errorf("Expected res2 = 1")
 				}
 			},
@@ -122,27 +124,27 @@ m2 = min(items)
 sl = len("hello")
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				lVal := m.Frames[0].Locals[1].Int()
+				lVal := m.Globals()[1].Int()
 				if lVal != 5 {
 					t.Errorf("Expected len(range(5)) = 5, got %d", lVal)
 				}
 
-				sVal := m.Frames[0].Locals[2].Int()
+				sVal := m.Globals()[2].Int()
 				if sVal != 10 {
 					t.Errorf("Expected sum(range(5)) = 10, got %d", sVal)
 				}
 
-				m1Val := m.Frames[0].Locals[3].Int()
+				m1Val := m.Globals()[3].Int()
 				if m1Val != 4 {
 					t.Errorf("Expected max(range(5)) = 4, got %d", m1Val)
 				}
 
-				m2Val := m.Frames[0].Locals[4].Int()
+				m2Val := m.Globals()[4].Int()
 				if m2Val != 0 {
 					t.Errorf("Expected min(range(5)) = 0, got %d", m2Val)
 				}
 
-				slVal := m.Frames[0].Locals[5].Int()
+				slVal := m.Globals()[5].Int()
 				if slVal != 5 {
 					t.Errorf("Expected len('hello') = 5, got %d", slVal)
 				}
@@ -159,7 +161,7 @@ res = map(double, items)
 s = sum(res)
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				sVal := m.Frames[0].Locals[2].Int()
+				sVal := m.Globals()[3].Int()
 				if sVal != 6 {
 					t.Errorf("Expected sum(map(double, items)) = 6, got %d", sVal)
 				}
@@ -177,27 +179,27 @@ s2 = str(b1)
 i1 = int("456")
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				if m.Frames[0].Locals[1].Int() != 10 {
+				if m.Globals()[1].Int() != 10 {
 					t.Errorf("abs(-10) failed")
 				}
-				if m.Frames[0].Locals[2].Data != 1 {
+				if m.Globals()[2].Data != 1 {
 					t.Errorf("bool(1) failed")
 				}
-				if m.Frames[0].Locals[3].Data != 0 {
+				if m.Globals()[3].Data != 0 {
 					t.Errorf("bool(0) failed")
 				}
 
-				s1Val := m.Frames[0].Locals[4]
+				s1Val := m.Globals()[4]
 				if value.UnpackString(s1Val.Data, m.Arena) != "123" {
 					t.Errorf("str(123) failed")
 				}
 
-				s2Val := m.Frames[0].Locals[5]
+				s2Val := m.Globals()[5]
 				if value.UnpackString(s2Val.Data, m.Arena) != "True" {
 					t.Errorf("str(True) failed")
 				}
 
-				if m.Frames[0].Locals[6].Int() != 456 {
+				if m.Globals()[6].Int() != 456 {
 					t.Errorf("int('456') failed")
 				}
 			},
@@ -206,7 +208,7 @@ i1 = int("456")
 			name: "Filter and Pow",
 			src: `
 def is_even(x):
-    half = x / 2
+    half = x // 2
     back = half * 2
     return x == back
 
@@ -216,12 +218,12 @@ l = len(evens)
 p = pow(2, 3)
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				lVal := m.Frames[0].Locals[2].Int()
+				lVal := m.Globals()[3].Int()
 				if lVal != 3 {
 					t.Errorf("Expected 3 evens, got %d", lVal)
 				}
 
-				pVal := m.Frames[0].Locals[3].Int()
+				pVal := m.Globals()[4].Int()
 				if pVal != 8 {
 					t.Errorf("Expected pow(2, 3) = 8, got %d", pVal)
 				}
@@ -237,13 +239,13 @@ a2 = any(list1) # true
 a3 = all(list2) # true
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				if m.Frames[0].Locals[2].Data != 0 {
+				if m.Globals()[2].Data != 0 {
 					t.Errorf("all(range(3)) should be false")
 				}
-				if m.Frames[0].Locals[3].Data != 1 {
+				if m.Globals()[3].Data != 1 {
 					t.Errorf("any(range(3)) should be true")
 				}
-				if m.Frames[0].Locals[4].Data != 1 {
+				if m.Globals()[4].Data != 1 {
 					t.Errorf("all([1,2,3]) should be true")
 				}
 			},
@@ -255,7 +257,7 @@ items = [10, 20, 30]
 x = items[1]
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				xVal := m.Frames[0].Locals[1].Int()
+				xVal := m.Globals()[1].Int()
 				if xVal != 20 {
 					t.Errorf("Expected items[1] = 20, got %d", xVal)
 				}
@@ -273,22 +275,22 @@ f = float("3.14")
 c = chr(65)
 o = ord("A")
 t1 = type(10)
-is_f = callable("double")
+is_f = callable(double)
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				if m.Frames[0].Locals[1].Int() != 3 {
+				if m.Globals()[2].Int() != 3 {
 					t.Errorf("divmod q failed")
 				}
-				if m.Frames[0].Locals[2].Int() != 1 {
+				if m.Globals()[3].Int() != 1 {
 					t.Errorf("divmod r failed")
 				}
-				if value.UnpackString(m.Frames[0].Locals[3].Data, m.Arena) != "0xff" {
+				if value.UnpackString(m.Globals()[4].Data, m.Arena) != "0xff" {
 					t.Errorf("hex failed")
 				}
-				if value.UnpackString(m.Frames[0].Locals[7].Data, m.Arena) != "int" {
+				if value.UnpackString(m.Globals()[8].Data, m.Arena) != "int" {
 					t.Errorf("type failed")
 				}
-				if m.Frames[0].Locals[8].Data != 1 {
+				if m.Globals()[9].Data != 1 {
 					t.Errorf("callable failed")
 				}
 			},
@@ -301,7 +303,7 @@ items[1] = 99
 val = items[1]
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				val := m.Frames[0].Locals[1].Int() // items=0, val=1
+				val := m.Globals()[1].Int() // items=0, val=1
 				if val != 99 {
 					t.Errorf("Expected 99, got %d", val)
 				}
@@ -316,14 +318,274 @@ v1 = next(it)
 v2 = next(it)
 `,
 			verify: func(m *vm.Machine, t *testing.T) {
-				if m.Frames[0].Locals[2].Int() != 10 {
+				if m.Globals()[2].Int() != 10 {
 					t.Errorf("next 1 failed")
 				}
-				if m.Frames[0].Locals[3].Int() != 20 {
+				if m.Globals()[3].Int() != 20 {
 					t.Errorf("next 2 failed")
 				}
 			},
 		},
+		{
+			name: "Try/Except/Finally",
+			src: `
+r = 0
+try:
+    x = 1 // 0
+    r = 100
+except (KeyError, ZeroDivisionError) as e:
+    r = 1
+finally:
+    r = r + 10
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				if r := m.Globals()[0].Int(); r != 11 {
+					t.Errorf("Expected r = 11, got %d", r)
+				}
+			},
+		},
+		{
+			name: "Leaving Try Blocks",
+			src: `
+hits = 0
+for i in range(5):
+    try:
+        if i == 3:
+            break
+        continue
+    finally:
+        hits = hits + 1
+def f(n):
+    try:
+        if n > 0:
+            return n
+        raise ValueError("negative")
+    except ValueError:
+        return -1
+a = f(5)
+b = f(0)
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				if hits := m.Globals()[0].Int(); hits != 4 {
+					t.Errorf("Expected 4 finally runs, got %d", hits)
+				}
+				if global(m, "a").Int() != 5 || global(m, "b").Int() != -1 {
+					t.Errorf("return through try failed")
+				}
+				if m.SP != 0 {
+					t.Errorf("Expected an empty stack, got SP %d", m.SP)
+				}
+			},
+		},
+		{
+			name: "Module Globals",
+			src: `
+def base():
+    return BASE * 10
+def bump(n):
+    global count
+    count = count + n
+    return count
+BASE = 4
+count = 0
+a = base()
+bump(2)
+b = bump(3)
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				base, a := global(m, "BASE").Int(), global(m, "a").Int()
+				if base != 4 || a != 40 {
+					t.Errorf("Expected BASE = 4 and a = 40, got %d and %d", base, a)
+				}
+				count, b := global(m, "count").Int(), global(m, "b").Int()
+				if count != 5 || b != 5 {
+					t.Errorf("Expected count = b = 5, got %d and %d", count, b)
+				}
+			},
+		},
+		{
+			name: "Config at the Top and Forward References",
+			src: `
+def main():
+    return helper(2)
+def helper(x):
+    return x * total()
+def total():
+    return C0 + C1 + C2 + C3 + C4 + C5 + C6 + C7 + C8 + C9 + C10 + C11 + C12 + C13 + C14 + C15 + C16 + C17 + C18 + C19
+C0 = 0
+C1 = 1
+C2 = 2
+C3 = 3
+C4 = 4
+C5 = 5
+C6 = 6
+C7 = 7
+C8 = 8
+C9 = 9
+C10 = 10
+C11 = 11
+C12 = 12
+C13 = 13
+C14 = 14
+C15 = 15
+C16 = 16
+C17 = 17
+C18 = 18
+C19 = 19
+res = main()
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				if n := len(m.Debug.Globals); n <= vm.MaxLocals {
+					t.Errorf("Expected more than %d globals, got %d", vm.MaxLocals, n)
+				}
+				if res := global(m, "res").Int(); res != 380 {
+					t.Errorf("Expected main() = 2 * 190, got %d", res)
+				}
+			},
+		},
+		{
+			name: "Closures and Function Values",
+			src: `
+def make_adder(n):
+    def add(x):
+        return x + n
+    return add
+def counter():
+    count = 0
+    def bump():
+        nonlocal count
+        count += 1
+        return count
+    return bump
+add5 = make_adder(5)
+a = add5(3)
+c = counter()
+c()
+b = c()
+rows = [[3, "c"], [1, "a"], [2, "b"]]
+field = 0
+by_field = sorted(rows, key=lambda r: r[field], reverse=True)
+first = by_field[0][1]
+doubled = sum(map(lambda x: x * 2, [1, 2, 3]))
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				a, b := global(m, "a").Int(), global(m, "b").Int()
+				if a != 8 || b != 2 {
+					t.Errorf("Expected add5(3) = 8 and c() = 2, got %d and %d", a, b)
+				}
+				if s := value.UnpackString(global(m, "first").Data, m.Arena); s != "c" {
+					t.Errorf("Expected sorted by key, reversed, to start with c, got %q", s)
+				}
+				if d := global(m, "doubled").Int(); d != 12 {
+					t.Errorf("Expected sum(map(lambda ...)) = 12, got %d", d)
+				}
+			},
+		},
+		{
+			name: "Mixed Numbers",
+			src: `
+amounts = [19.99, 5, 0.01, True]
+total = sum(amounts)
+over = total > 25
+matched = total == 26
+mixed = 1.5 + 2 * 3
+floor = -7.5 // 2
+rem = -7 % 3
+largest = max(amounts)
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				g := m.Globals()
+				if s := g[1].Format(m.Arena); s != "26.0" {
+					t.Errorf("Expected sum = 26.0, got %s", s)
+				}
+				if g[2].Data != 1 || g[3].Data != 1 {
+					t.Errorf("Expected 26.0 > 25 and 26.0 == 26")
+				}
+				if s := g[4].Format(m.Arena) + " " + g[5].Format(m.Arena) + " " + g[6].Format(m.Arena); s != "7.5 -4.0 2" {
+					t.Errorf("Expected 7.5 -4.0 2, got %s", s)
+				}
+				if s := g[7].Format(m.Arena); s != "19.99" {
+					t.Errorf("Expected max = 19.99, got %s", s)
+				}
+			},
+		},
+		{
+			name: "Big Integers",
+			src: `
+def fact(n):
+    r = 1
+    for i in range(2, n + 1):
+        r = r * i
+    return r
+f = fact(30)
+h = hex(2 ** 64)
+back = f // fact(28)
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				if s := global(m, "f").Format(m.Arena); s != "265252859812191058636308480000000" {
+					t.Errorf("Expected 30!, got %s", s)
+				}
+				if s := global(m, "h").Format(m.Arena); s != "0x10000000000000000" {
+					t.Errorf("Expected hex(2**64), got %s", s)
+				}
+				if back := global(m, "back"); back.IsBig() || back.Int() != 870 {
+					t.Errorf("Expected 30! // 28! = 870, got %s", back.Format(m.Arena))
+				}
+			},
+		},
+		{
+			name: "Short-Circuit and Conditional Expressions",
+			src: `
+cfg = None
+port = cfg and cfg["port"]
+name = ""
+label = name or "default"
+first = 0 or None or "last"
+all3 = 1 and 2 and 3
+size = "big" if all3 > 2 else "small"
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				g := m.Globals()
+				if g[1].Type != value.TypeVoid {
+					t.Errorf("Expected cfg and cfg[...] to be None, got %s", g[1].Format(m.Arena))
+				}
+				if s := g[3].Format(m.Arena) + " " + g[4].Format(m.Arena); s != "default last" {
+					t.Errorf("Expected the deciding operands, got %s", s)
+				}
+				if g[5].Type != value.TypeInt || g[5].Int() != 3 {
+					t.Errorf("Expected 1 and 2 and 3 = 3, got %s", g[5].Format(m.Arena))
+				}
+				if s := g[6].Format(m.Arena); s != "big" {
+					t.Errorf("Expected big, got %s", s)
+				}
+			},
+		},
+		{
+			name: "Chained Comparisons and Unary Operators",
+			src: `
+calls = 0
+def mid(v):
+    global calls
+    calls += 1
+    return v
+x = 7
+inside = 0 <= mid(x) < 10
+outside = 10 < mid(x) < mid(20)
+result = [inside, outside, calls, -x, +x, ~x, not x, -1.5, x is None, x is not None]
+`,
+			verify: func(m *vm.Machine, t *testing.T) {
+				g := m.Globals()
+				var got string
+				for _, v := range g {
+					if v.Type == value.TypeList {
+						got = v.Format(m.Arena)
+					}
+				}
+				if want := "[True, False, 2, -7, 7, -8, False, -1.5, False, True]"; got != want {
+					t.Errorf("Expected %s, got %s", want, got)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -340,6 +602,7 @@ v2 = next(it)
 			machine.Code = bytecode.Instructions
 			machine.Constants = bytecode.Constants
 			machine.Arena = bytecode.Arena
+			machine.Debug = bytecode.Debug
 
 			for name, ip := range bytecode.Functions {
 				machine.FunctionRegistry[name] = ip
@@ -397,6 +660,7 @@ v2 = next(it)
 			machine.HostRegistry[59] = vm.HostFunctionEntry{Fn: stdlib.ByteArray}
 			machine.HostRegistry[60] = vm.HostFunctionEntry{Fn: stdlib.HasNext}
 			machine.HostRegistry[63] = vm.HostFunctionEntry{Fn: stdlib.IsInstance}
+			machine.HostRegistry[64] = vm.HostFunctionEntry{Fn: stdlib.SortedKey}
 
 			err = machine.Run(10000)
 			if err != nil {
@@ -407,3 +671,95 @@ v2 = next(it)
 		})
 	}
 }
+
+// global returns the module global called name.
+func global(m *vm.Machine, name string) value.Value {
+	return m.Globals()[slices.Index(m.Debug.Globals, name)]
+}
+
+// TestGenerators runs generator functions and lazy builtins on a budget too
+// small to finish, restoring the machine from a snapshot each time it runs
+// out, and checks that the results are those of an uninterrupted run.
+func TestGenerators(t *testing.T) {
+	src := `
+def count(n):
+    i = 0
+    while i < n:
+        yield i
+        i += 1
+
+def same(v):
+    w = v * 3
+    return w // 3
+
+def evens(xs):
+    for x in xs:
+        try:
+            if x % 2 == 1:
+                raise ValueError("odd")
+            yield same(x)
+        except ValueError:
+            x = -1
+
+def chain(a, b):
+    yield from a
+    yield from b
+
+out = []
+for i, x in enumerate(chain(evens(range(10)), map(lambda y: y * 10, count(3)))):
+    out.append(i * 100 + x)
+big = 0
+for i in range(10**8):
+    if i == 1000:
+        break
+    big += i
+g = count(2)
+first = next(g)
+rest = list(g)
+res = str(out) + " " + str(big) + " " + str(first) + " " + str(rest)
+`
+	bc, err := python.NewCompiler().CompileFile("gen.py", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := stdlib.NewRegistry(nil, nil)
+	result := func(m *vm.Machine) string {
+		i := slices.Index(bc.Debug.Globals, "res")
+		return m.Globals()[i].Format(m.Arena)
+	}
+	const want = "[0, 102, 204, 306, 408, 500, 610, 720] 499500 0 [1]"
+
+	m := vm.NewMachine(vm.DefaultLimits)
+	m.Code, m.Constants, m.Arena, m.HostRegistry = bc.Instructions, bc.Constants, bc.Arena, registry
+	if err := m.Run(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if got := result(m); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	m = vm.NewMachine(vm.DefaultLimits)
+	m.Code, m.Constants, m.Arena, m.HostRegistry = bc.Instructions, bc.Constants, bc.Arena, registry
+	err = m.Run(7)
+	stops := 0
+	for ; errors.Is(err, vm.ErrGasExhausted); stops++ {
+		data, serr := m.Snapshot()
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		if m, serr = vm.Restore(data, bc); serr != nil {
+			t.Fatal(serr)
+		}
+		m.HostRegistry = registry
+		err = m.Resume(7)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stops < 10 {
+		t.Errorf("expected the run to stop often, it stopped %d times", stops)
+	}
+	if got := result(m); got != want {
+		t.Errorf("after %d restores: got %q, want %q", stops, got, want)
+	}
+}
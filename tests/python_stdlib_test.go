@@ -113,13 +113,13 @@ else:
 	}
 
 	// Verify results in locals
-	if machine.Frames[0].Locals[1].Int() != 1 {
+	if machine.Globals()[1].Int() != 1 {
 		t.Errorf("ok1 failed")
 	}
-	if machine.Frames[0].Locals[2].Int() != 1 {
+	if machine.Globals()[2].Int() != 1 {
 		t.Errorf("ok2 failed")
 	}
-	if machine.Frames[0].Locals[3].Int() != 1 {
+	if machine.Globals()[3].Int() != 1 {
 		t.Errorf("ok3 failed")
 	}
 }
@@ -171,7 +171,7 @@ with scope("HTTP-ENV", "valid-token"):
 		t.Fatalf("VM Execution failed: %v", err)
 	}
 
-	statusVal := machine.Frames[0].Locals[1]
+	statusVal := machine.Globals()[1]
 	if statusVal.Int() != 201 {
 		t.Errorf("Expected status 201, got %d", statusVal.Int())
 	}
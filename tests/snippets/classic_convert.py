@@ -0,0 +1,19 @@
+for s in ["42", " -7 ", "abc", "1.5", "99999999999999999999999"]:
+    try:
+        print(int(s))
+    except ValueError as e:
+        print("ValueError", e)
+for s in ["1.5", " 2 ", "x"]:
+    try:
+        print(float(s))
+    except ValueError as e:
+        print("ValueError", e)
+try:
+    int(None)
+except TypeError as e:
+    print("TypeError", e)
+try:
+    float([1])
+except TypeError as e:
+    print("TypeError", e)
+print(int(True), float(False), int(-2.7))
@@ -0,0 +1,37 @@
+def f():
+    return 1
+
+def call_f():
+    return f()
+
+f = lambda: 2
+print(f())
+print(call_f())
+
+def handler():
+    return "first"
+
+def handler2():
+    return "second"
+
+def use(h):
+    return h()
+
+handler = handler2
+print(use(handler))
+
+def k():
+    return 1
+
+def set_k():
+    global k
+    k = lambda: 5
+
+print(k())
+set_k()
+print(k())
+
+def fixed(a, b):
+    return a - b
+
+print(fixed(b=1, a=5))
@@ -0,0 +1,16 @@
+print(sorted([2.5, 1, -3, 0, -0.5, True]))
+print(sorted([-1, -10, 5, 3]))
+print(" ".join(sorted(["pear", "apple", "fig", "Banana", "app"])))
+print(sorted([10**20, -10**30, 7, 2**64, -1]))
+print(sorted((3, 1, 2)))
+print(sorted([1.5, 2**70, -2.5, -2**65]))
+print(" ".join([t[1] for t in sorted([(1, "b"), (1, "a"), (0, "z")])]))
+print(sorted([(None, 2), (None, 1)], key=lambda t: t[1]))
+try:
+    sorted(["b", 1])
+except TypeError as e:
+    print("TypeError", e)
+try:
+    sorted([3, "a"], key=lambda x: x, reverse=True)
+except TypeError as e:
+    print("TypeError", e)